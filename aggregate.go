@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Folds the merged values into a single number. Reducers without an identity (min, max) are
+// seeded with the first value and yield null for an empty merge. Arithmetic wraps on overflow.
+type reducer struct {
+	identity    int
+	hasIdentity bool
+	fn          func(acc, v int) int
+}
+
+var (
+	reducersMu sync.RWMutex
+	reducers   = make(map[string]reducer)
+)
+
+// Makes a reducer available as /aggregate?op=name
+func registerReducer(name string, r reducer) {
+	reducersMu.Lock()
+	defer reducersMu.Unlock()
+	reducers[name] = r
+}
+
+func lookupReducer(name string) (reducer, bool) {
+	reducersMu.RLock()
+	defer reducersMu.RUnlock()
+	r, ok := reducers[name]
+	return r, ok
+}
+
+func reducerNames() []string {
+	reducersMu.RLock()
+	defer reducersMu.RUnlock()
+	names := make([]string, 0, len(reducers))
+	for name := range reducers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerReducer("sum", reducer{identity: 0, hasIdentity: true, fn: func(acc, v int) int { return acc + v }})
+	registerReducer("product", reducer{identity: 1, hasIdentity: true, fn: func(acc, v int) int { return acc * v }})
+	registerReducer("xor", reducer{identity: 0, hasIdentity: true, fn: func(acc, v int) int { return acc ^ v }})
+	registerReducer("min", reducer{fn: func(acc, v int) int {
+		if v < acc {
+			return v
+		}
+		return acc
+	}})
+	registerReducer("max", reducer{fn: func(acc, v int) int {
+		if v > acc {
+			return v
+		}
+		return acc
+	}})
+}
+
+func (r reducer) reduce(values []int) *int {
+	if len(values) == 0 && !r.hasIdentity {
+		return nil
+	}
+	acc := r.identity
+	if !r.hasIdentity {
+		acc, values = values[0], values[1:]
+	}
+	for _, v := range values {
+		acc = r.fn(acc, v)
+	}
+	return &acc
+}
+
+type aggregateResult struct {
+	Op    string `json:"op"`
+	Value *int   `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Same fan-out and merge as /numbers, but the response is a single reduced value
+func aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	q := r.URL.Query()
+	op := q.Get("op")
+	red, ok := lookupReducer(op)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400 - invalid op %q, expected one of %s", op, strings.Join(reducerNames(), "|"))))
+		return
+	}
+	opts, err := parseOptions(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
+		return
+	}
+	if opts.histogram != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - histogram is not supported by /aggregate"))
+		return
+	}
+	if opts.attribute != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - attribute is not supported by /aggregate"))
+		return
+	}
+	ctx, cancel := requestContext(r, opts.deadline)
+	defer cancel()
+	urls, err := resolveURLs(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
+		return
+	}
+	if perr := checkTenantRequest(ctx, q, urls, opts); perr != nil {
+		perr.write(w)
+		return
+	}
+	sum := cachedRun(ctx, w, urls, opts)
+	observeCompleteness(sum.ok, len(urls))
+	defer func() { slos.record(tenantFrom(ctx), time.Since(start), sum.ok, len(urls)) }()
+	json.NewEncoder(w).Encode(aggregateResult{Op: op, Value: red.reduce(sum.numbers), Count: len(sum.numbers)})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAggregateHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 1, 2, 3, 5, 8, 13, 21})))
+	defer ts.Close()
+	tt := []struct {
+		op       string
+		query    string
+		expected *int
+		status   int
+	}{
+		{op: "sum", query: "&u=" + ts.URL, expected: intp(53)},
+		{op: "product", query: "&u=" + ts.URL, expected: intp(65520)},
+		{op: "xor", query: "&u=" + ts.URL, expected: intp(1 ^ 2 ^ 3 ^ 5 ^ 8 ^ 13 ^ 21)},
+		{op: "min", query: "&u=" + ts.URL, expected: intp(1)},
+		{op: "max", query: "&u=" + ts.URL, expected: intp(21)},
+		{op: "sum", query: "&dedup=false&u=" + ts.URL, expected: intp(54)},
+		{op: "sum", expected: intp(0)},
+		{op: "max", expected: nil},
+		{op: "median", status: http.StatusBadRequest},
+	}
+	for _, tc := range tt {
+		t.Run(tc.op+tc.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			aggregateHandler(rec, httptest.NewRequest(http.MethodGet, "/aggregate?op="+tc.op+tc.query, nil))
+			if tc.status != 0 {
+				if rec.Code != tc.status {
+					t.Fatalf("expected status %v; got %v", tc.status, rec.Code)
+				}
+				return
+			}
+			var res aggregateResult
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if (res.Value == nil) != (tc.expected == nil) || res.Value != nil && *res.Value != *tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, res.Value)
+			}
+		})
+	}
+}
+
+func TestRegisterReducer(t *testing.T) {
+	registerReducer("count_odd", reducer{hasIdentity: true, fn: func(acc, v int) int { return acc + v&1 }})
+	if got := *reducers["count_odd"].reduce([]int{1, 2, 3}); got != 2 {
+		t.Errorf("expected 2 odd values; got %d", got)
+	}
+}
+
+func intp(v int) *int {
+	return &v
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+// Values of the attribute query parameter
+const (
+	attributeSources = "true"
+	attributeCount   = "count"
+)
+
+// Most sources a request with attribute may fan out to. Every distinct value takes a bit per
+// source, 128 bytes at this limit.
+const maxAttributedSources = 1024
+
+// Which sources reported every value: a bitmap per value over the URLs of the request, in
+// rows of words appended to a single slice
+type attribution struct {
+	// attributeSources or attributeCount
+	mode string
+	// Redacted, in the order of the request
+	urls  []string
+	words int
+	rows  map[int]int
+	bits  []uint64
+}
+
+func newAttribution(urls []string, mode string) *attribution {
+	a := &attribution{mode: mode, urls: make([]string, len(urls)), words: (len(urls) + 63) / 64, rows: make(map[int]int)}
+	for i, u := range urls {
+		a.urls[i] = redact(u)
+	}
+	return a
+}
+
+func parseAttribute(v string) (string, error) {
+	switch v {
+	case "", "false":
+		return "", nil
+	case attributeSources, attributeCount:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid attribute %q, expected true, count or false", v)
+}
+
+// Refuses fan-outs too large to attribute
+func checkAttribute(o options, urls []string) error {
+	if o.attribute != "" && len(urls) > maxAttributedSources {
+		return fmt.Errorf("attribute supports at most %d urls, got %d", maxAttributedSources, len(urls))
+	}
+	return nil
+}
+
+// Records that the source at index reported values. A nil attribution records nothing.
+func (a *attribution) add(index int, values []int) {
+	if a == nil {
+		return
+	}
+	word, mask := index/64, uint64(1)<<(index%64)
+	for _, v := range values {
+		row, ok := a.rows[v]
+		if !ok {
+			row = len(a.bits)
+			a.rows[v] = row
+			for i := 0; i < a.words; i++ {
+				a.bits = append(a.bits, 0)
+			}
+		}
+		a.bits[row+word] |= mask
+	}
+}
+
+// URLs of the sources that reported v
+func (a *attribution) sources(v int) []string {
+	out := []string{}
+	row, ok := a.rows[v]
+	if !ok {
+		return out
+	}
+	for w, word := range a.bits[row : row+a.words] {
+		for word != 0 {
+			i := bits.TrailingZeros64(word)
+			out = append(out, a.urls[w*64+i])
+			word &= word - 1
+		}
+	}
+	return out
+}
+
+func (a *attribution) count(v int) int {
+	row, ok := a.rows[v]
+	if !ok {
+		return 0
+	}
+	n := 0
+	for _, word := range a.bits[row : row+a.words] {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// Sources or number of sources of each of values, keyed by the value
+func (a *attribution) render(values []int) interface{} {
+	if a.mode == attributeCount {
+		out := make(map[string]int, len(values))
+		for _, v := range values {
+			out[strconv.Itoa(v)] = a.count(v)
+		}
+		return out
+	}
+	out := make(map[string][]string, len(values))
+	for _, v := range values {
+		out[strconv.Itoa(v)] = a.sources(v)
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAttributionBitmap(t *testing.T) {
+	urls := make([]string, 130)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://s%d.test/", i)
+	}
+	a := newAttribution(urls, attributeSources)
+	a.add(0, []int{1, 2})
+	a.add(64, []int{2, 3})
+	a.add(129, []int{2})
+	a.add(129, []int{2})
+	tests := []struct {
+		value   int
+		sources []string
+	}{
+		{1, []string{urls[0]}},
+		{2, []string{urls[0], urls[64], urls[129]}},
+		{3, []string{urls[64]}},
+		{4, []string{}},
+	}
+	for _, tt := range tests {
+		if got := a.sources(tt.value); !reflect.DeepEqual(got, tt.sources) || a.count(tt.value) != len(tt.sources) {
+			t.Errorf("%d: expected %v; got %v (count %d)", tt.value, tt.sources, got, a.count(tt.value))
+		}
+	}
+	var nothing *attribution
+	nothing.add(0, []int{1})
+}
+
+func TestAttributeResponse(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[1,2,3]}`)))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[3,4]}`)))
+	defer b.Close()
+	down := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer down.Close()
+	urls := "?u=" + a.URL + "&u=" + b.URL + "&u=" + down.URL
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{query: "&attribute=true", status: http.StatusOK, want: fmt.Sprintf(`{"1":[%[1]q],"2":[%[1]q],"3":[%[1]q,%[2]q],"4":[%[2]q]}`, a.URL, b.URL)},
+		{query: "&attribute=count&filter=even", status: http.StatusOK, want: `{"2":1,"4":1}`},
+		{query: "&attribute=count&page_size=2", status: http.StatusOK, want: `{"1":1,"2":1}`},
+		{query: "&attribute=false", status: http.StatusOK},
+		{query: "&attribute=yes", status: http.StatusBadRequest},
+		{query: "&attribute=true&histogram=auto", status: http.StatusBadRequest},
+		{query: "&attribute=true&shape=array", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+urls+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d; got %d %s", tt.query, tt.status, rec.Code, rec.Body)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Attribution json.RawMessage `json:"attribution"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if string(body.Attribution) != tt.want {
+			t.Errorf("%s: expected attribution %s; got %s", tt.query, tt.want, body.Attribution)
+		}
+	}
+}
+
+func TestAttributeTooManySources(t *testing.T) {
+	o, err := parseOptions(map[string][]string{"attribute": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAttribute(o, make([]string, maxAttributedSources+1)); err == nil {
+		t.Errorf("expected an error for more than %d sources", maxAttributedSources)
+	}
+	if err := checkAttribute(o, make([]string, maxAttributedSources)); err != nil {
+		t.Errorf("expected no error for %d sources; got %v", maxAttributedSources, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most queries a batch may carry
+const maxBatchQueries = 50
+
+// Body of POST /batch
+type batchRequest struct {
+	Queries []batchQuery `json:"queries"`
+	// Deadline of the whole batch, 0 or more than the server's timeout is the server's timeout
+	DeadlineMS int `json:"deadline_ms,omitempty"`
+}
+
+// A query of a batch: the query string /numbers would get, plus op to reduce it like /aggregate
+type batchQuery struct {
+	ID    string `json:"id"`
+	Query string `json:"query"`
+	// Time the query may take before it has to share what other queries left, 0 is the batch deadline
+	DeadlineMS int `json:"deadline_ms,omitempty"`
+	// Queries of a higher priority get a larger share of the time left
+	Priority int `json:"priority,omitempty"`
+}
+
+// Outcome of a query, with the status /numbers or /aggregate would have answered
+type batchResult struct {
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Cache  string      `json:"cache,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	// Time the query was given in the end, including what it got from other queries
+	BudgetMS int64 `json:"budget_ms"`
+}
+
+// Validates the body of a batch
+func (b batchRequest) validate() error {
+	if len(b.Queries) == 0 {
+		return errors.New("no queries")
+	}
+	if len(b.Queries) > maxBatchQueries {
+		return fmt.Errorf("%d queries exceed the limit of %d", len(b.Queries), maxBatchQueries)
+	}
+	if b.DeadlineMS < 0 {
+		return errors.New("deadline_ms must not be negative")
+	}
+	seen := make(map[string]bool, len(b.Queries))
+	for _, q := range b.Queries {
+		if q.ID == "" {
+			return errors.New("every query needs an id")
+		}
+		if seen[q.ID] {
+			return fmt.Errorf("duplicate id %q", q.ID)
+		}
+		if q.DeadlineMS < 0 {
+			return fmt.Errorf("deadline_ms of %q must not be negative", q.ID)
+		}
+		seen[q.ID] = true
+	}
+	return nil
+}
+
+// Runs several independent queries in one request, all at once and under the deadline of the
+// batch, and answers their results keyed by the client's ids. Time a query leaves of its own
+// deadline goes to the queries still running.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	var b batchRequest
+	err := json.NewDecoder(r.Body).Decode(&b)
+	if bodyTooLarge(err) {
+		writeProblem(w, http.StatusRequestEntityTooLarge, limits.maxBodyBytes, "batch exceeds the body limit")
+		return
+	}
+	if err == nil {
+		err = b.validate()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
+		return
+	}
+	ctx, cancel := requestContext(r, 0)
+	defer cancel()
+	if b.DeadlineMS > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(b.DeadlineMS)*time.Millisecond)
+		defer cancel()
+	}
+	// Always set by requestContext
+	limit, _ := ctx.Deadline()
+	sched := newBatchScheduler(limit)
+	id := requestID(r)
+	results := make(map[string]batchResult, len(b.Queries))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, q := range b.Queries {
+		wg.Add(1)
+		go func(q batchQuery) {
+			defer wg.Done()
+			budget := sched.start(time.Duration(q.DeadlineMS)*time.Millisecond, q.Priority)
+			res := runBatchQuery(withQueryBudget(ctx, budget), q.Query, start, id)
+			budget.finish()
+			res.BudgetMS = budget.allotted().Milliseconds()
+			mu.Lock()
+			results[q.ID] = res
+			mu.Unlock()
+		}(q)
+	}
+	wg.Wait()
+	httpMetrics.Add("batch_queries", int64(len(b.Queries)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// Answers one query of a batch like /numbers, or like /aggregate when it has an op
+func runBatchQuery(ctx context.Context, raw string, start time.Time, id string) batchResult {
+	q, err := url.ParseQuery(raw)
+	if err != nil {
+		return batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	opts, err := parseOptions(q)
+	if err == nil {
+		err = resolveShape(ctx, &opts)
+	}
+	if err != nil {
+		return batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	if opts.cursor != "" || opts.pageSize > 0 || opts.trace {
+		return batchResult{Status: http.StatusBadRequest, Error: "cursor, page_size and trace are not supported in a batch"}
+	}
+	if opts.deadline > 0 {
+		return batchResult{Status: http.StatusBadRequest, Error: "timeout is not supported in a batch, queries have deadline_ms"}
+	}
+	op := q.Get("op")
+	red, reduce := lookupReducer(op)
+	if op != "" && !reduce {
+		return batchResult{Status: http.StatusBadRequest, Error: fmt.Sprintf("invalid op %q, expected one of %s", op, strings.Join(reducerNames(), "|"))}
+	}
+	if reduce && (opts.histogram != "" || opts.attribute != "") {
+		return batchResult{Status: http.StatusBadRequest, Error: "histogram and attribute are not supported with op"}
+	}
+	urls, err := resolveURLs(q)
+	if err == nil {
+		err = checkAttribute(opts, urls)
+	}
+	if err != nil {
+		return batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	if perr := checkTenantRequest(ctx, q, urls, opts); perr != nil {
+		return batchResult{Status: perr.status, Error: perr.msg}
+	}
+	route := endpoint
+	if reduce {
+		route = "/aggregate"
+	}
+	// Only the batch route itself is checked by the middleware
+	if win, ok := maintenance.lookup(route, q["g"]); ok {
+		httpMetrics.Add("maintenance_rejected", 1)
+		return batchResult{Status: http.StatusServiceUnavailable, Error: win.Message}
+	}
+	// The queries run at once, so each gets its own headers
+	rec := &queryWriter{header: make(http.Header)}
+	sum := cachedRun(ctx, rec, urls, opts)
+	observeCompleteness(sum.ok, len(urls))
+	res := batchResult{Status: http.StatusOK, Cache: rec.header.Get("X-Cache")}
+	if opts.excludeSeen {
+		sum.numbers = seenValues.filter(seenScope(tenantFrom(ctx), q["g"]), sum.numbers)
+	}
+	if reduce {
+		res.Result = aggregateResult{Op: op, Value: red.reduce(sum.numbers), Count: len(sum.numbers)}
+		return res
+	}
+	if perr := checkTenantResult(ctx, opts, len(sum.numbers)); perr != nil {
+		return batchResult{Status: perr.status, Error: perr.msg}
+	}
+	res.Result = newEnvelope(opts, sum, len(urls), time.Since(start), id)
+	return res
+}
+
+// Collects what a query of a batch would have set on the response
+type queryWriter struct {
+	header http.Header
+}
+
+func (w *queryWriter) Header() http.Header         { return w.header }
+func (w *queryWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *queryWriter) WriteHeader(int)             {}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBatchHandler(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{3, 1})))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{2})))
+	defer b.Close()
+	ua, ub := url.QueryEscape(a.URL), url.QueryEscape(b.URL)
+	body := `{"queries":[
+		{"id":"both","query":"u=` + ua + `&u=` + ub + `&verbose=count"},
+		{"id":"sum","query":"u=` + ua + `&op=sum"},
+		{"id":"bad","query":"u=` + ua + `&op=median"},
+		{"id":"paged","query":"u=` + ua + `&page_size=1"}
+	]}`
+	rec := httptest.NewRecorder()
+	batchHandler(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Results map[string]struct {
+			Status int             `json:"status"`
+			Error  string          `json:"error"`
+			Result json.RawMessage `json:"result"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		status int
+		result string
+	}{
+		"both":  {status: 200, result: `{"numbers":[1,2,3],"count":3}`},
+		"sum":   {status: 200, result: `{"op":"sum","value":4,"count":2}`},
+		"bad":   {status: 400},
+		"paged": {status: 400},
+	}
+	for id, w := range want {
+		r, ok := got.Results[id]
+		if !ok || r.Status != w.status || w.result != "" && string(r.Result) != w.result {
+			t.Errorf("%s: expected %d %s; got %d %s %s", id, w.status, w.result, r.Status, r.Result, r.Error)
+		}
+		if w.status != 200 && r.Error == "" {
+			t.Errorf("%s: expected an error message", id)
+		}
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	many := make([]string, maxBatchQueries+1)
+	for i := range many {
+		many[i] = `{"id":"` + strings.Repeat("x", i+1) + `","query":""}`
+	}
+	for _, body := range []string{
+		`{"queries":[]}`,
+		`{"queries":[{"query":"u=http://a"}]}`,
+		`{"queries":[{"id":"a"},{"id":"a"}]}`,
+		`{"queries":[` + strings.Join(many, ",") + `]}`,
+		`{"queries":[{"id":"a"}],"deadline_ms":-1}`,
+		`{"queries":[{"id":"a","deadline_ms":-5}]}`,
+		`not json`,
+	} {
+		rec := httptest.NewRecorder()
+		batchHandler(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: expected 400; got %d", body, rec.Code)
+		}
+	}
+}
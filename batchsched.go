@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Shares the time of a batch between its queries. A query that finishes before its deadline
+// leaves the rest in a pool, and a query that reaches its deadline takes more time from the
+// pool, leaving a share for every running query of a higher priority. No query runs past the
+// deadline of the batch.
+type batchScheduler struct {
+	mu      sync.Mutex
+	limit   time.Time
+	pool    time.Duration
+	running map[*queryBudget]struct{}
+	now     func() time.Time
+}
+
+// Deadline of a query of a batch, which the scheduler may extend while it runs
+type queryBudget struct {
+	sched    *batchScheduler
+	priority int
+	start    time.Time
+	// Guarded by sched.mu
+	deadline time.Time
+}
+
+func newBatchScheduler(limit time.Time) *batchScheduler {
+	return &batchScheduler{limit: limit, running: make(map[*queryBudget]struct{}), now: time.Now}
+}
+
+// Budget of a query starting now, which may run for d or, when d is 0, until the batch deadline
+func (s *batchScheduler) start(d time.Duration, priority int) *queryBudget {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	deadline := s.limit
+	if d > 0 && now.Add(d).Before(deadline) {
+		deadline = now.Add(d)
+	}
+	b := &queryBudget{sched: s, priority: priority, start: now, deadline: deadline}
+	s.running[b] = struct{}{}
+	return b
+}
+
+func (b *queryBudget) current() time.Time {
+	b.sched.mu.Lock()
+	defer b.sched.mu.Unlock()
+	return b.deadline
+}
+
+// Time the query was given so far
+func (b *queryBudget) allotted() time.Duration {
+	return b.current().Sub(b.start)
+}
+
+// Gives the query more time from the pool once it used up its own, reports the new deadline
+// and whether it moved
+func (b *queryBudget) extend() (time.Time, bool) {
+	s := b.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pool <= 0 || !b.deadline.Before(s.limit) {
+		return b.deadline, false
+	}
+	higher := 0
+	for q := range s.running {
+		if q.priority > b.priority {
+			higher++
+		}
+	}
+	deadline := b.deadline.Add(s.pool / time.Duration(higher+1))
+	if deadline.After(s.limit) {
+		deadline = s.limit
+	}
+	s.pool -= deadline.Sub(b.deadline)
+	b.deadline = deadline
+	httpMetrics.Add("batch_extensions", 1)
+	return deadline, true
+}
+
+// Returns the time the query didn't use to the pool
+func (b *queryBudget) finish() {
+	s := b.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, b)
+	if left := b.deadline.Sub(s.now()); left > 0 {
+		s.pool += left
+	}
+}
+
+type queryBudgetKeyType struct{}
+
+func withQueryBudget(ctx context.Context, b *queryBudget) context.Context {
+	return context.WithValue(ctx, queryBudgetKeyType{}, b)
+}
+
+func queryBudgetFrom(ctx context.Context) *queryBudget {
+	b, _ := ctx.Value(queryBudgetKeyType{}).(*queryBudget)
+	return b
+}
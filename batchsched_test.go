@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBatchScheduler(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newBatchScheduler(now.Add(time.Second))
+	s.now = func() time.Time { return now }
+	fast := s.start(400*time.Millisecond, 0)
+	low := s.start(100*time.Millisecond, 0)
+	high := s.start(100*time.Millisecond, 1)
+	whole := s.start(0, 0)
+	if got := whole.current(); !got.Equal(now.Add(time.Second)) {
+		t.Errorf("expected a query without deadline to get the batch's; got %v", got.Sub(now))
+	}
+	if _, ok := low.extend(); ok {
+		t.Error("expected no extension before any query left time")
+	}
+	now = now.Add(100 * time.Millisecond)
+	fast.finish()
+	// 300ms left, shared with the query of a higher priority
+	if got, ok := low.extend(); !ok || got.Sub(low.start) != 250*time.Millisecond {
+		t.Errorf("expected low to get half of the pool; got %v %v", got.Sub(low.start), ok)
+	}
+	if got, ok := high.extend(); !ok || got.Sub(high.start) != 250*time.Millisecond {
+		t.Errorf("expected high to get the rest of the pool; got %v %v", got.Sub(high.start), ok)
+	}
+	if _, ok := low.extend(); ok {
+		t.Error("expected the pool to be used up")
+	}
+	// Returns 100ms, which can't take high past the batch deadline
+	high.finish()
+	s.pool += time.Second
+	if got, ok := low.extend(); !ok || !got.Equal(s.limit) {
+		t.Errorf("expected the extension to end at the batch deadline; got %v", got.Sub(now))
+	}
+	if _, ok := low.extend(); ok {
+		t.Error("expected no extension past the batch deadline")
+	}
+	if whole.allotted() != time.Second {
+		t.Errorf("expected 1s allotted; got %v", whole.allotted())
+	}
+}
+
+func TestBatchBudgetCutoff(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte(`{"numbers":[1]}`))
+	}))
+	defer slow.Close()
+	o, _ := parseOptions(nil)
+	for _, left := range []time.Duration{0, 500 * time.Millisecond} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		limit, _ := ctx.Deadline()
+		s := newBatchScheduler(limit)
+		if left > 0 {
+			// A query that finished right away
+			s.start(left, 0).finish()
+		}
+		b := s.start(50*time.Millisecond, 0)
+		sum := run(withQueryBudget(ctx, b), []string{slow.URL}, o)
+		b.finish()
+		cancel()
+		want := 0
+		if left > 0 {
+			want = 1
+		}
+		if len(sum.numbers) != want {
+			t.Errorf("%v left: expected %d values; got %v", left, want, sum.numbers)
+		}
+		if left == 0 && sum.deadlineStage != requestStageFetch {
+			t.Errorf("expected the query's deadline to stop the fetch; got stage %q", sum.deadlineStage)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Splits the request deadline into a fetch budget and a render budget. Instead of fetching until
+// the deadline and sorting and encoding past it, a request stops taking answers once the time
+// left is what sorting and encoding the values merged so far is expected to cost. Small results
+// keep fetching almost until the deadline, large ones stop early enough to be sent in time.
+type renderConfig struct {
+	// Bounds of the render reserve, a max of 0 fetches until the deadline
+	minReserve, maxReserve time.Duration
+	// Factor the estimated cost is multiplied with
+	margin float64
+}
+
+var (
+	renderMu   sync.RWMutex
+	renderConf = renderConfig{minReserve: time.Millisecond, maxReserve: timeout * time.Millisecond / 10, margin: 2}
+)
+
+func registerRenderFlags(fs *flag.FlagSet, c *renderConfig) {
+	fs.DurationVar(&c.minReserve, "render.min-reserve", c.minReserve, "time always kept at the end of the request deadline for sorting and encoding the result")
+	fs.DurationVar(&c.maxReserve, "render.max-reserve", c.maxReserve, "most time kept for sorting and encoding however large the result, 0 fetches until the deadline")
+	fs.Float64Var(&c.margin, "render.margin", c.margin, "factor the measured sort and encode cost is multiplied with to size the reserve")
+}
+
+func setRenderConfig(c renderConfig) error {
+	if c.minReserve < 0 || c.maxReserve < 0 || c.margin < 1 {
+		return fmt.Errorf("-render.min-reserve and -render.max-reserve must not be negative, -render.margin at least 1")
+	}
+	if c.maxReserve > 0 && c.minReserve > c.maxReserve {
+		return fmt.Errorf("-render.min-reserve must not exceed -render.max-reserve")
+	}
+	renderMu.Lock()
+	defer renderMu.Unlock()
+	renderConf = c
+	return nil
+}
+
+func currentRenderConfig() renderConfig {
+	renderMu.RLock()
+	defer renderMu.RUnlock()
+	return renderConf
+}
+
+// Results smaller than this are dominated by fixed overhead and don't tell the cost per value
+const renderSampleMin = 100
+
+// Moving averages of the measured sort and encode cost
+type renderCost struct {
+	mu sync.Mutex
+	// Nanoseconds per comparison (n·log2 n) of the sort and per encoded value
+	sortNs, encodeNs float64
+	samples          int64
+}
+
+// Seeded with conservative costs until the first large results were measured
+var renderCosts = &renderCost{sortNs: 5, encodeNs: 100}
+
+func sortOps(n int) float64 {
+	if n < 2 {
+		return float64(n)
+	}
+	return float64(n) * math.Log2(float64(n))
+}
+
+func ewma(avg, sample float64) float64 {
+	return avg + 0.2*(sample-avg)
+}
+
+func (c *renderCost) observeSort(n int, took time.Duration) {
+	if n < renderSampleMin {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sortNs = ewma(c.sortNs, float64(took)/sortOps(n))
+	c.samples++
+}
+
+func (c *renderCost) observeEncode(n int, took time.Duration) {
+	if n < renderSampleMin {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encodeNs = ewma(c.encodeNs, float64(took)/float64(n))
+	c.samples++
+}
+
+// Expected time to sort and encode n values
+func (c *renderCost) estimate(n int) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.sortNs*sortOps(n) + c.encodeNs*float64(n))
+}
+
+// Expected time to sort n values
+func (c *renderCost) estimateSort(n int) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.sortNs * sortOps(n))
+}
+
+// Time kept at the end of the deadline to render n values, 0 when the reserve is disabled
+func renderReserve(c renderConfig, costs *renderCost, n int) time.Duration {
+	if c.maxReserve <= 0 {
+		return 0
+	}
+	r := time.Duration(float64(costs.estimate(n)) * c.margin)
+	if r < c.minReserve {
+		return c.minReserve
+	}
+	if r > c.maxReserve {
+		return c.maxReserve
+	}
+	return r
+}
+
+// Fires when the fetch budget of a request is used up: at its deadline minus the render reserve
+// for the values merged so far. The reserve only grows, so the cutoff only moves earlier, unless
+// the query of a batch is given more time.
+type fetchCutoff struct {
+	conf     renderConfig
+	deadline time.Time
+	at       time.Time
+	timer    *time.Timer
+	// Budget of a query of a batch, whose deadline comes before the request's
+	budget *queryBudget
+	// Values merged so far
+	n int
+}
+
+// nil without a deadline, or with the reserve disabled outside of a batch
+func newFetchCutoff(ctx context.Context) *fetchCutoff {
+	deadline, ok := ctx.Deadline()
+	c := currentRenderConfig()
+	b := queryBudgetFrom(ctx)
+	if b != nil {
+		if d := b.current(); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	if !ok || (c.maxReserve <= 0 && b == nil) {
+		return nil
+	}
+	at := deadline.Add(-renderReserve(c, renderCosts, 0))
+	return &fetchCutoff{conf: c, deadline: deadline, at: at, timer: time.NewTimer(time.Until(at)), budget: b}
+}
+
+func (c *fetchCutoff) C() <-chan time.Time {
+	if c == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// Moves the cutoff earlier once n values need a larger reserve
+func (c *fetchCutoff) update(n int) {
+	if c == nil {
+		return
+	}
+	c.n = n
+	at := c.deadline.Add(-renderReserve(c.conf, renderCosts, n))
+	if !at.Before(c.at) {
+		return
+	}
+	c.reset(at)
+}
+
+// Moves the cutoff later once it fired, if the batch had time left for the query
+func (c *fetchCutoff) extend() bool {
+	if c == nil || c.budget == nil {
+		return false
+	}
+	deadline, ok := c.budget.extend()
+	if !ok {
+		return false
+	}
+	c.deadline = deadline
+	c.reset(deadline.Add(-renderReserve(c.conf, renderCosts, c.n)))
+	return true
+}
+
+func (c *fetchCutoff) reset(at time.Time) {
+	c.at = at
+	if !c.timer.Stop() {
+		select {
+		case <-c.timer.C:
+		default:
+		}
+	}
+	c.timer.Reset(time.Until(at))
+}
+
+func (c *fetchCutoff) stop() {
+	if c != nil {
+		c.timer.Stop()
+	}
+}
+
+func init() {
+	httpMetrics.Set("render_cost", expvar.Func(func() interface{} {
+		renderCosts.mu.Lock()
+		defer renderCosts.mu.Unlock()
+		return map[string]interface{}{
+			"sort_ns_per_op":      renderCosts.sortNs,
+			"encode_ns_per_value": renderCosts.encodeNs,
+			"samples":             renderCosts.samples,
+		}
+	}))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenderReserve(t *testing.T) {
+	costs := &renderCost{sortNs: 0, encodeNs: 1000}
+	c := renderConfig{minReserve: time.Millisecond, maxReserve: 10 * time.Millisecond, margin: 2}
+	tests := []struct {
+		conf renderConfig
+		n    int
+		want time.Duration
+	}{
+		{conf: c, n: 0, want: time.Millisecond},
+		{conf: c, n: 1000, want: 2 * time.Millisecond},
+		{conf: c, n: 100000, want: 10 * time.Millisecond},
+		{conf: renderConfig{margin: 2}, n: 100000, want: 0},
+	}
+	for _, tt := range tests {
+		if got := renderReserve(tt.conf, costs, tt.n); got != tt.want {
+			t.Errorf("%+v, %d values: expected %v; got %v", tt.conf, tt.n, tt.want, got)
+		}
+	}
+}
+
+func TestRenderCostObserve(t *testing.T) {
+	c := &renderCost{sortNs: 5, encodeNs: 100}
+	// Too small to tell the cost per value
+	c.observeEncode(10, time.Second)
+	if c.samples != 0 || c.encodeNs != 100 {
+		t.Errorf("expected small results to be ignored; got %+v", c)
+	}
+	for i := 0; i < 50; i++ {
+		c.observeEncode(1000, time.Millisecond)
+	}
+	if c.encodeNs < 990 || c.encodeNs > 1000 {
+		t.Errorf("expected the encode cost to converge to 1000ns per value; got %v", c.encodeNs)
+	}
+	if got := c.estimate(1000); got < 900*time.Microsecond {
+		t.Errorf("expected about 1ms for 1000 values; got %v", got)
+	}
+}
+
+func TestSetRenderConfig(t *testing.T) {
+	defer setRenderConfig(currentRenderConfig())
+	for _, c := range []renderConfig{
+		{minReserve: -1, margin: 2},
+		{maxReserve: time.Second, margin: 0.5},
+		{minReserve: time.Second, maxReserve: time.Millisecond, margin: 2},
+	} {
+		if err := setRenderConfig(c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+	if err := setRenderConfig(renderConfig{minReserve: time.Second, margin: 1}); err != nil {
+		t.Errorf("expected a disabled reserve to ignore the minimum; got %v", err)
+	}
+}
+
+func TestFetchCutoff(t *testing.T) {
+	defer setRenderConfig(currentRenderConfig())
+	defer func(c *renderCost) { renderCosts = c }(renderCosts)
+	// 1ms per value, so 50 values need most of the deadline
+	renderCosts = &renderCost{encodeNs: float64(time.Millisecond)}
+	big := make([]int, 50)
+	for i := range big {
+		big[i] = i
+	}
+	early := httptest.NewServer(http.HandlerFunc(simpleHandler(big)))
+	defer early.Close()
+	late := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(250 * time.Millisecond)
+		w.Write([]byte(`{"numbers":[100]}`))
+	}))
+	defer late.Close()
+	o, _ := parseOptions(nil)
+	tests := []struct {
+		conf   renderConfig
+		want   int
+		failed int
+		stage  string
+	}{
+		// Fetching until the deadline
+		{conf: renderConfig{margin: 1}, want: 51},
+		// The 50 values reserve 100ms, so the fetch budget ends at 200ms
+		{conf: renderConfig{minReserve: time.Millisecond, maxReserve: time.Second, margin: 2}, want: 50, failed: 1, stage: requestStageFetch},
+	}
+	for _, tt := range tests {
+		if err := setRenderConfig(tt.conf); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		start := time.Now()
+		sum := run(ctx, []string{early.URL, late.URL}, o)
+		took := time.Since(start)
+		cancel()
+		if len(sum.numbers) != tt.want || sum.failed != tt.failed || sum.deadlineStage != tt.stage {
+			t.Errorf("%+v: expected %d values, %d failed and stage %q; got %d values, %d failed, %q", tt.conf, tt.want, tt.failed, tt.stage, len(sum.numbers), sum.failed, sum.deadlineStage)
+		}
+		if tt.stage != "" && took > 250*time.Millisecond {
+			t.Errorf("%+v: expected the fetches to stop at the render reserve; took %v", tt.conf, took)
+		}
+	}
+}
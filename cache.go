@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caches merged results of whole requests. A TTL of 0 disables the cache.
+type resultCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*cacheEntry
+	now        func() time.Time
+	// Background refresh of entries with at least refreshMinHits hits, at most
+	// refreshConcurrency at a time. 0 disables it.
+	refreshConcurrency int
+	refreshMinHits     int
+	// Finish fan-outs whose client went away and cache their result for the retry
+	finishOnDisconnect bool
+}
+
+type cacheEntry struct {
+	sum     summary
+	created time.Time
+	expires time.Time
+	// What produced the entry, so it can be refreshed in the background
+	urls []string
+	opts options
+	// Hits since the entry was last (re)filled
+	hits       int
+	refreshing bool
+}
+
+var requestCache = newResultCache(0, 1000)
+
+func newResultCache(ttl time.Duration, maxEntries int) *resultCache {
+	return &resultCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*cacheEntry), now: time.Now, refreshMinHits: 2}
+}
+
+func registerCacheFlags(fs *flag.FlagSet, ttl *time.Duration, max *int, finish *bool) {
+	fs.DurationVar(ttl, "cache.ttl", 0, "how long merged results of identical requests are served from cache, 0 disables caching")
+	fs.IntVar(max, "cache.max-entries", 1000, "maximum number of cached results")
+	fs.BoolVar(finish, "cache.finish-on-disconnect", false, "when a client disconnects, finish the fan-out up to the request deadline anyway and cache the result for its retry")
+}
+
+func registerRefreshFlags(fs *flag.FlagSet, concurrency, minHits *int) {
+	fs.IntVar(concurrency, "cache.refresh-concurrency", 0, "hot cache entries refreshed in parallel before they expire, 0 disables background refresh")
+	fs.IntVar(minHits, "cache.refresh-min-hits", 2, "hits an entry needs since its last refresh to be considered hot")
+}
+
+// Canonical form of a request: the sorted URL list and the options that change the merged
+// result. Options that only affect rendering, like verbose or stringify, are left out.
+func cacheKey(urls []string, o options) string {
+	sorted := append([]string(nil), urls...)
+	sort.Strings(sorted)
+	var b strings.Builder
+	b.WriteString(strconv.FormatInt(int64(o.upstreamTimeout/time.Millisecond), 10))
+	b.WriteString("|" + strconv.FormatBool(o.lenient))
+	b.WriteString("|" + o.dedup)
+	b.WriteString("|" + o.histogram)
+	b.WriteString("|" + strings.Join(o.filter, ","))
+	b.WriteString("|" + strconv.Itoa(o.bucket))
+	b.WriteString("|" + o.attribute)
+	for _, u := range sorted {
+		b.WriteString("|" + u)
+	}
+	return b.String()
+}
+
+func (c *resultCache) enabled() bool {
+	return c.ttl > 0
+}
+
+func (c *resultCache) get(key string) (summary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return summary{}, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return summary{}, false
+	}
+	e.hits++
+	return e.sum, true
+}
+
+func (c *resultCache) put(key string, urls []string, o options, sum summary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{sum: sum, created: now, expires: now.Add(c.ttl), urls: urls, opts: o}
+}
+
+// Keys of the hottest entries in the last quarter of their TTL, most hits first
+func (c *resultCache) hot() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	window := c.ttl / 4
+	var keys []string
+	for key, e := range c.entries {
+		if e.refreshing || e.hits < c.refreshMinHits || now.Before(e.expires.Add(-window)) || !now.Before(e.expires) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].hits > c.entries[keys[j]].hits })
+	return keys
+}
+
+// Marks an entry as being refreshed and returns what it needs to be recomputed
+func (c *resultCache) claim(key string) ([]string, options, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.refreshing {
+		return nil, options{}, false
+	}
+	e.refreshing = true
+	return e.urls, e.opts, true
+}
+
+// Periodically refreshes hot entries until ctx is done. Refreshes only run while fewer than
+// maxConnections fan-outs are in flight, so they use spare capacity rather than compete with clients.
+func (c *resultCache) refresher(ctx context.Context) {
+	if !c.enabled() || c.refreshConcurrency <= 0 {
+		return
+	}
+	interval := c.ttl / 8
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	sem := make(chan struct{}, c.refreshConcurrency)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, key := range c.hot() {
+				if inflightRuns() >= maxConnections {
+					break
+				}
+				select {
+				case sem <- struct{}{}:
+				default:
+					// Every refresh slot is busy, try again on the next tick
+					continue
+				}
+				urls, o, ok := c.claim(key)
+				if !ok {
+					<-sem
+					continue
+				}
+				go func(key string) {
+					defer func() { <-sem }()
+					c.refresh(ctx, key, urls, o)
+				}(key)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *resultCache) refresh(ctx context.Context, key string, urls []string, o options) {
+	ctx, cancel := context.WithTimeout(ctx, timeout*time.Millisecond)
+	defer cancel()
+	sum := run(ctx, urls, o)
+	upstreamMetrics.Add("cache_refreshes", 1)
+	if !cacheable(sum) {
+		// The entry stands until it expires
+		upstreamMetrics.Add("cache_incomplete", 1)
+		return
+	}
+	// put resets the hit count, so an entry has to stay popular to keep being refreshed
+	c.put(key, urls, o, sum)
+}
+
+// Whether sum is the result any caller of the key would get. A result some sources failed to
+// contribute to, e.g. because of a tenant's deadline or timeout, or that the deadline left
+// unsorted isn't worth serving to anyone else.
+func cacheable(sum summary) bool {
+	return sum.failed == 0 && sum.order == ""
+}
+
+// Drops expired entries, or the oldest one if none has expired
+func (c *resultCache) evict(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || e.created.Before(oldestAt) {
+			oldest, oldestAt = key, e.created
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// Like run but serves identical requests from the cache while the entry is fresh.
+// Sets X-Cache to HIT or MISS when the cache is enabled.
+func cachedRun(ctx context.Context, w http.ResponseWriter, urls []string, o options) summary {
+	if !requestCache.enabled() || len(urls) == 0 {
+		return run(ctx, urls, o)
+	}
+	key := cacheKey(urls, o)
+	if sum, ok := requestCache.get(key); ok {
+		w.Header().Set("X-Cache", "HIT")
+		upstreamMetrics.Add("cache_hits", 1)
+		return sum
+	}
+	w.Header().Set("X-Cache", "MISS")
+	upstreamMetrics.Add("cache_misses", 1)
+	if sum, denied := egressDenied(ctx, urls); denied {
+		// Not worth caching, the budget resets
+		return sum
+	}
+	runCtx := ctx
+	if requestCache.finishOnDisconnect {
+		// The fan-out outlives the client but not the request deadline
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(timeout * time.Millisecond)
+		}
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		defer cancel()
+	}
+	sum := run(runCtx, urls, o)
+	if cacheable(sum) {
+		requestCache.put(key, urls, o, sum)
+	} else {
+		upstreamMetrics.Add("cache_incomplete", 1)
+	}
+	if errors.Is(ctx.Err(), context.Canceled) && runCtx != ctx {
+		upstreamMetrics.Add("cache_disconnect_saves", 1)
+	}
+	return sum
+}
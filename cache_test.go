@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyCanonical(t *testing.T) {
+	o, _ := parseOptions(url.Values{"verbose": {"true"}})
+	plain, _ := parseOptions(nil)
+	if cacheKey([]string{"b", "a"}, o) != cacheKey([]string{"a", "b"}, plain) {
+		t.Error("URL order and rendering options must not change the key")
+	}
+	lenient, _ := parseOptions(url.Values{"lenient": {"true"}})
+	if cacheKey([]string{"a"}, lenient) == cacheKey([]string{"a"}, plain) {
+		t.Error("options changing the result must change the key")
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := newResultCache(time.Second, 2)
+	c.now = func() time.Time { return now }
+	c.put("a", nil, options{}, summary{numbers: []int{1}})
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a hit")
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected the entry to expire")
+	}
+	c.put("a", nil, options{}, summary{})
+	now = now.Add(time.Millisecond)
+	c.put("b", nil, options{}, summary{})
+	c.put("c", nil, options{}, summary{})
+	if _, ok := c.get("a"); ok || len(c.entries) != 2 {
+		t.Errorf("expected the oldest entry to be evicted; got %v", c.entries)
+	}
+}
+
+func TestCachedRun(t *testing.T) {
+	defer func(c *resultCache) { requestCache = c }(requestCache)
+	requestCache = newResultCache(time.Minute, 10)
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`{"numbers":[2,1]}`))
+	}))
+	defer ts.Close()
+	for i, expected := range []string{"MISS", "HIT"} {
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL, nil))
+		if rec.Header().Get("X-Cache") != expected || rec.Body.String() != `{"numbers":[1,2]}`+"\n" {
+			t.Errorf("request %d: expected %s; got %s %s", i, expected, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected a single upstream fetch; got %d", n)
+	}
+}
+
+func TestCachedRunSkipsIncomplete(t *testing.T) {
+	defer func(c *resultCache) { requestCache = c }(requestCache)
+	requestCache = newResultCache(time.Minute, 10)
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer ts.Close()
+	slow := httptest.NewServer(http.HandlerFunc(timeOutHandler([]int{2})))
+	defer slow.Close()
+	// A short timeout cuts off the slow source, callers with more time must not get the rest
+	for _, query := range []string{"&timeout=100ms", ""} {
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+"&u="+slow.URL+query, nil))
+		if rec.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("%q: expected an incomplete result not to be cached; got %s", query, rec.Header().Get("X-Cache"))
+		}
+	}
+	c := newResultCache(time.Minute, 10)
+	o, _ := parseOptions(nil)
+	down := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer down.Close()
+	urls := []string{ts.URL, down.URL}
+	key := cacheKey(urls, o)
+	c.put(key, urls, o, summary{numbers: []int{1, 3}})
+	c.refresh(context.Background(), key, urls, o)
+	if sum, _ := c.get(key); len(sum.numbers) != 2 {
+		t.Errorf("expected a refresh with a failed source to keep the entry; got %v", sum.numbers)
+	}
+}
+
+func TestHotEntries(t *testing.T) {
+	now := time.Now()
+	c := newResultCache(time.Minute, 10)
+	c.now = func() time.Time { return now }
+	for key, hits := range map[string]int{"cold": 1, "warm": 2, "hot": 5} {
+		c.put(key, nil, options{}, summary{})
+		for i := 0; i < hits; i++ {
+			c.get(key)
+		}
+	}
+	if keys := c.hot(); len(keys) != 0 {
+		t.Errorf("nothing is close to expiry yet; got %v", keys)
+	}
+	now = now.Add(50 * time.Second)
+	keys := c.hot()
+	if len(keys) != 2 || keys[0] != "hot" || keys[1] != "warm" {
+		t.Errorf("expected hot and warm, hottest first; got %v", keys)
+	}
+}
+
+func TestRefresherKeepsHotEntryFresh(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`{"numbers":[1]}`))
+	}))
+	defer ts.Close()
+	c := newResultCache(200*time.Millisecond, 10)
+	c.refreshConcurrency = 1
+	o, _ := parseOptions(nil)
+	urls := []string{ts.URL}
+	key := cacheKey(urls, o)
+	c.put(key, urls, o, summary{numbers: []int{1}})
+	c.get(key)
+	c.get(key)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.refresher(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&hits) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&hits) == 0 {
+		t.Fatal("hot entry was never refreshed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get(key); !ok {
+		t.Error("expected the refreshed entry to still be cached")
+	}
+}
+
+func TestFinishOnDisconnect(t *testing.T) {
+	defer func(c *resultCache) { requestCache = c }(requestCache)
+	requestCache = newResultCache(time.Minute, 10)
+	requestCache.finishOnDisconnect = true
+	arrived, release := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte(`{"numbers":[2,1]}`))
+	}))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		numbersHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL, nil).WithContext(ctx))
+	}()
+	<-arrived
+	// The client gives up while the upstream is still working on it
+	cancel()
+	close(release)
+	<-done
+
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL, nil))
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != `{"numbers":[1,2]}`+"\n" {
+		t.Errorf("expected the retry to be served the finished result; got %s %s", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
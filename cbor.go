@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR (RFC 8949) for upstreams and clients preferring a compact binary format
+func init() {
+	registerCodec(&codec{
+		name:       "cbor",
+		mediaTypes: []string{"application/cbor"},
+		parse: func(data []byte) (interface{}, error) {
+			r := &cborReader{byteReader{data: data}}
+			return r.end(r.value())
+		},
+		writer: func(buf *bytes.Buffer) valueWriter { return cborWriter{buf} },
+		binary: true,
+	})
+}
+
+// Major types
+const (
+	cborUint = iota
+	cborNegint
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// Additional info of an indefinite length and the break ending it
+const (
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+var errCBORBreak = errors.New("cbor: unexpected break")
+
+type cborReader struct {
+	byteReader
+}
+
+// Reads the initial byte of an item and its argument
+func (r *cborReader) head() (major, info byte, arg uint64, err error) {
+	c, err := r.byte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = c>>5, c&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		arg, err = r.uint(1 << (info - 24))
+		return major, info, arg, err
+	case info == cborIndefinite && major >= cborBytes && major <= cborMap || c == cborBreak:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("cbor: invalid initial byte 0x%02x", c)
+}
+
+func (r *cborReader) value() (interface{}, error) {
+	major, info, arg, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+		return int64(arg), nil
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			return oversized{}, nil
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		b, err := r.chunks(major, info, arg)
+		if major == cborText {
+			return string(b), err
+		}
+		return b, err
+	case cborArray:
+		if err := r.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { r.depth-- }()
+		var a []interface{}
+		if info != cborIndefinite {
+			a = make([]interface{}, 0, r.capacity(arg))
+		}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && r.breaks() {
+				break
+			}
+			v, err := r.value()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case cborMap:
+		if err := r.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { r.depth-- }()
+		m := make(map[string]interface{})
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && r.breaks() {
+				break
+			}
+			k, err := r.value()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cbor: map key of type %s, expected text", valueKind(k))
+			}
+			if m[key], err = r.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		v, err := r.value()
+		// Unsigned and negative bignums, other tags don't change what the value is
+		if err == nil && (arg == 2 || arg == 3) {
+			return oversized{}, nil
+		}
+		return v, err
+	}
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		// null and undefined
+		return nil, nil
+	case 25:
+		return halfFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	case cborIndefinite:
+		return nil, errCBORBreak
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+}
+
+// Consumes the break ending an indefinite container
+func (r *cborReader) breaks() bool {
+	if r.pos < len(r.data) && r.data[r.pos] == cborBreak {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+// Bytes of a string, joining the chunks of an indefinite one
+func (r *cborReader) chunks(major, info byte, arg uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		return r.take(arg)
+	}
+	var b []byte
+	for !r.breaks() {
+		m, i, n, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || i == cborIndefinite {
+			return nil, errors.New("cbor: invalid chunk of an indefinite string")
+		}
+		chunk, err := r.take(n)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+	return b, nil
+}
+
+// IEEE 754 half precision
+func halfFloat(h uint16) float64 {
+	exp, frac := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if frac != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+type cborWriter struct {
+	buf *bytes.Buffer
+}
+
+func (w cborWriter) head(major byte, arg uint64) {
+	var b [9]byte
+	switch {
+	case arg < 24:
+		w.buf.WriteByte(major<<5 | byte(arg))
+		return
+	case arg <= math.MaxUint8:
+		b[0], b[1] = major<<5|24, byte(arg)
+		w.buf.Write(b[:2])
+	case arg <= math.MaxUint16:
+		b[0] = major<<5 | 25
+		binary.BigEndian.PutUint16(b[1:], uint16(arg))
+		w.buf.Write(b[:3])
+	case arg <= math.MaxUint32:
+		b[0] = major<<5 | 26
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		w.buf.Write(b[:5])
+	default:
+		b[0] = major<<5 | 27
+		binary.BigEndian.PutUint64(b[1:], arg)
+		w.buf.Write(b[:9])
+	}
+}
+
+func (w cborWriter) null() { w.buf.WriteByte(cborSimple<<5 | 22) }
+
+func (w cborWriter) boolean(v bool) {
+	if v {
+		w.buf.WriteByte(cborSimple<<5 | 21)
+		return
+	}
+	w.buf.WriteByte(cborSimple<<5 | 20)
+}
+
+func (w cborWriter) integer(v int64) {
+	if v < 0 {
+		w.head(cborNegint, uint64(-1-v))
+		return
+	}
+	w.head(cborUint, uint64(v))
+}
+
+// Always double precision, head would pick the width by the value of the bits
+func (w cborWriter) float(v float64) {
+	var b [9]byte
+	b[0] = cborSimple<<5 | 27
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+	w.buf.Write(b[:])
+}
+
+func (w cborWriter) str(v string) {
+	w.head(cborText, uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w cborWriter) array(n int)  { w.head(cborArray, uint64(n)) }
+func (w cborWriter) object(n int) { w.head(cborMap, uint64(n)) }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// How the text of a body was read: the encoding it was transcoded from and what said so
+type bodyCharset struct {
+	// "" for UTF-8, which is read as it is
+	name string
+	// "bom", "source", "header" or "sniffed"
+	from string
+	// First bytes as received, for diagnostics
+	head []byte
+}
+
+func (c bodyCharset) String() string {
+	return fmt.Sprintf("read as %s by its %s", c.name, c.from)
+}
+
+// Bytes of a body kept for diagnostics
+const charsetHead = 8
+
+// Reads the text of a body as UTF-8. A byte order mark decides the encoding, then the source's
+// charset, the charset of contentType and for bodies starting with a NUL byte next to an ASCII
+// one UTF-16. A UTF-8 byte order mark is dropped, as JSON decoders choke on it.
+func newCharsetReader(r io.Reader, contentType, hint string) (io.Reader, bodyCharset, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(charsetHead)
+	c := bodyCharset{head: append([]byte(nil), head...)}
+	label := ""
+	switch {
+	case len(head) >= 3 && head[0] == 0xef && head[1] == 0xbb && head[2] == 0xbf:
+		br.Discard(3)
+		return br, c, nil
+	case len(head) >= 2 && head[0] == 0xff && head[1] == 0xfe:
+		br.Discard(2)
+		label, c.from = "utf-16le", "bom"
+	case len(head) >= 2 && head[0] == 0xfe && head[1] == 0xff:
+		br.Discard(2)
+		label, c.from = "utf-16be", "bom"
+	case hint != "":
+		label, c.from = hint, "source"
+	default:
+		if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+			label, c.from = params["charset"], "header"
+		} else if len(head) >= 2 && head[0] != 0 && head[0] < utf8.RuneSelf && head[1] == 0 {
+			label, c.from = "utf-16le", "sniffed"
+		} else if len(head) >= 2 && head[0] == 0 && head[1] != 0 && head[1] < utf8.RuneSelf {
+			label, c.from = "utf-16be", "sniffed"
+		}
+	}
+	next, name, err := charsetDecoder(label)
+	if err != nil {
+		return nil, c, err
+	}
+	if next == nil {
+		return br, c, nil
+	}
+	c.name = name
+	upstreamMetrics.Add("transcoded "+name, 1)
+	return &transcoder{src: br, next: next}, c, nil
+}
+
+// Reads one character of an encoding
+type runeDecoder func(*bufio.Reader) (rune, error)
+
+// Decoder and canonical name of a charset label, a nil decoder for UTF-8 and ASCII
+func charsetDecoder(label string) (runeDecoder, string, error) {
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return nil, "", nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return func(r *bufio.Reader) (rune, error) {
+			b, err := r.ReadByte()
+			return rune(b), err
+		}, "iso-8859-1", nil
+	case "windows-1252", "cp1252", "x-cp1252":
+		return func(r *bufio.Reader) (rune, error) {
+			b, err := r.ReadByte()
+			if err == nil && b >= 0x80 && b < 0xa0 {
+				return cp1252[b-0x80], nil
+			}
+			return rune(b), err
+		}, "windows-1252", nil
+	case "utf-16le":
+		return utf16Decoder(false), "utf-16le", nil
+	case "utf-16", "utf-16be":
+		// Big-endian without a byte order mark, as RFC 2781 has it
+		return utf16Decoder(true), "utf-16be", nil
+	}
+	return nil, "", fmt.Errorf("unsupported charset %q", label)
+}
+
+// Characters of windows-1252 where latin1 has control characters
+var cp1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+func utf16Decoder(bigEndian bool) runeDecoder {
+	var b [2]byte
+	// A unit read after a high surrogate which didn't complete it
+	var pending rune = -1
+	unit := func(r *bufio.Reader) (rune, error) {
+		if u := pending; u >= 0 {
+			pending = -1
+			return u, nil
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("utf-16 body has an odd number of bytes")
+			}
+			return 0, err
+		}
+		if bigEndian {
+			return rune(b[0])<<8 | rune(b[1]), nil
+		}
+		return rune(b[1])<<8 | rune(b[0]), nil
+	}
+	return func(r *bufio.Reader) (rune, error) {
+		u, err := unit(r)
+		if err != nil || !utf16.IsSurrogate(u) {
+			return u, err
+		}
+		low, err := unit(r)
+		if err == io.EOF {
+			return utf8.RuneError, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if d := utf16.DecodeRune(u, low); d != utf8.RuneError {
+			return d, nil
+		}
+		pending = low
+		return utf8.RuneError, nil
+	}
+}
+
+// Reader of the UTF-8 text of a body in another encoding
+type transcoder struct {
+	src  *bufio.Reader
+	next runeDecoder
+	buf  []byte
+	err  error
+}
+
+func (t *transcoder) Read(p []byte) (int, error) {
+	var enc [utf8.UTFMax]byte
+	for len(t.buf) < len(p) && t.err == nil {
+		r, err := t.next(t.src)
+		if err != nil {
+			t.err = err
+			break
+		}
+		n := utf8.EncodeRune(enc[:], r)
+		t.buf = append(t.buf, enc[:n]...)
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[:copy(t.buf, t.buf[n:])]
+	if len(t.buf) == 0 && t.err != nil {
+		return n, t.err
+	}
+	return n, nil
+}
+
+// What was seen of the bodies of a source which needed transcoding or failed to decode, so that
+// a source sending an unexpected encoding can be told apart from one sending garbage
+type decodeDiagnostic struct {
+	Charset     string     `json:"charset,omitempty"`
+	DetectedBy  string     `json:"detected_by,omitempty"`
+	Transcoded  int64      `json:"transcoded"`
+	Failures    int64      `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	// Hex of the first bytes of the last body that failed
+	Head string `json:"head,omitempty"`
+}
+
+// Sources tracked at most, later ones are only counted
+const maxDiagnostics = 1024
+
+var decodeDiagnostics = struct {
+	sync.Mutex
+	sources map[string]*decodeDiagnostic
+}{sources: make(map[string]*decodeDiagnostic)}
+
+// Records how a body of url was read, err is its decoding error
+func noteDecode(url string, c bodyCharset, err error) {
+	if c.name == "" && err == nil {
+		return
+	}
+	url = redact(url)
+	decodeDiagnostics.Lock()
+	defer decodeDiagnostics.Unlock()
+	d := decodeDiagnostics.sources[url]
+	if d == nil {
+		if len(decodeDiagnostics.sources) >= maxDiagnostics {
+			upstreamMetrics.Add("decode_diagnostics_dropped", 1)
+			return
+		}
+		d = &decodeDiagnostic{}
+		decodeDiagnostics.sources[url] = d
+	}
+	if c.name != "" {
+		d.Charset, d.DetectedBy = c.name, c.from
+		d.Transcoded++
+	}
+	if err != nil {
+		d.Failures++
+		now := time.Now().UTC()
+		d.LastError, d.LastFailure, d.Head = err.Error(), &now, hex.EncodeToString(c.head)
+	}
+}
+
+func upstreamDecodingHandler(w http.ResponseWriter, r *http.Request) {
+	decodeDiagnostics.Lock()
+	sources := make(map[string]decodeDiagnostic, len(decodeDiagnostics.sources))
+	for url, d := range decodeDiagnostics.sources {
+		sources[url] = *d
+	}
+	decodeDiagnostics.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sources": sources})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// UTF-16 of s, little or big endian, after a byte order mark when bom
+func encodeUTF16(s string, bigEndian, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xfeff}, units...)
+	}
+	out := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		if bigEndian {
+			out = append(out, byte(u>>8), byte(u))
+		} else {
+			out = append(out, byte(u), byte(u>>8))
+		}
+	}
+	return out
+}
+
+func TestCharsetReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		hint        string
+		want        string
+		charset     string
+		from        string
+		err         bool
+	}{
+		{name: "utf-8", body: []byte(`{"numbers":[1]}`), contentType: "application/json", want: `{"numbers":[1]}`},
+		{name: "utf-8 bom", body: []byte("\xef\xbb\xbf{\"numbers\":[1]}"), want: `{"numbers":[1]}`},
+		{name: "utf-16le bom", body: encodeUTF16(`{"n":"é𝄞"}`, false, true), contentType: "application/json; charset=utf-8", want: `{"n":"é𝄞"}`, charset: "utf-16le", from: "bom"},
+		{name: "utf-16be bom", body: encodeUTF16(`[1]`, true, true), want: `[1]`, charset: "utf-16be", from: "bom"},
+		{name: "utf-16le sniffed", body: encodeUTF16(`{"numbers":[2]}`, false, false), want: `{"numbers":[2]}`, charset: "utf-16le", from: "sniffed"},
+		{name: "declared utf-16", body: encodeUTF16(`[3]`, true, false), contentType: "application/json; charset=UTF-16", want: `[3]`, charset: "utf-16be", from: "header"},
+		{name: "latin1", body: []byte("\"caf\xe9\""), contentType: "text/plain; charset=ISO-8859-1", want: `"café"`, charset: "iso-8859-1", from: "header"},
+		{name: "windows-1252 by source", body: []byte("\"\x80 \x93x\x94\""), contentType: "text/plain; charset=utf-8", hint: "windows-1252", want: "\"€ “x”\"", charset: "windows-1252", from: "source"},
+		{name: "lone surrogate", body: []byte{0xff, 0xfe, 0x00, 0xd8, 0x41, 0x00}, want: "�A", charset: "utf-16le", from: "bom"},
+		{name: "odd utf-16", body: []byte{0xff, 0xfe, 0x41, 0x00, 0x42}, err: true},
+		{name: "unsupported", body: []byte("[]"), contentType: "application/json; charset=koi8-r", err: true},
+	}
+	for _, tt := range tests {
+		r, c, err := newCharsetReader(strings.NewReader(string(tt.body)), tt.contentType, tt.hint)
+		var got []byte
+		if err == nil {
+			got, err = ioutil.ReadAll(r)
+		}
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error; got %q", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want || c.name != tt.charset || c.from != tt.from {
+			t.Errorf("%s: expected %q as %q by %q; got %q as %q by %q, %v", tt.name, tt.want, tt.charset, tt.from, got, c.name, c.from, err)
+		}
+	}
+}
+
+func TestCharsetSources(t *testing.T) {
+	windows := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(encodeUTF16(`{"numbers": [2, 1]}`, false, true))
+	}))
+	defer windows.Close()
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte("<?xml version=\"1.0\" encoding=\"windows-1252\"?><r><n>3</n><s>\x80</s></r>"))
+	}))
+	defer legacy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(encodeUTF16(`{"numbers": "4"}`, true, true))
+	}))
+	defer broken.Close()
+	all := map[string]group{"legacy": {URLs: []string{windows.URL, legacy.URL, broken.URL}, Sources: map[string]sourceConfig{
+		legacy.URL: {XML: &xmlConfig{Path: "//n"}},
+		broken.URL: {Charset: "utf-8"},
+	}}}
+	if err := validateGroups(all); err != nil {
+		t.Fatal(err)
+	}
+	defer groups.set(groups.all())
+	groups.set(all)
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?g=legacy&verbose=errors", nil))
+	var res struct {
+		Numbers []int         `json:"numbers"`
+		Errors  []errorDetail `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Numbers) != 3 || len(res.Errors) != 1 || !strings.HasSuffix(res.Errors[0].Message, "(read as utf-16be by its bom)") {
+		t.Errorf("expected the values of two sources and the charset of the failing one; got %+v", res)
+	}
+	rec = httptest.NewRecorder()
+	upstreamDecodingHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/upstreams/decoding", nil))
+	var diag struct {
+		Sources map[string]decodeDiagnostic `json:"sources"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&diag); err != nil {
+		t.Fatal(err)
+	}
+	if d := diag.Sources[windows.URL]; d.Charset != "utf-16le" || d.DetectedBy != "bom" || d.Transcoded == 0 || d.Failures != 0 {
+		t.Errorf("unexpected diagnostics of the UTF-16 source %+v", d)
+	}
+	if d := diag.Sources[broken.URL]; d.Failures == 0 || d.Head != "feff007b0022006e" || d.LastFailure == nil {
+		t.Errorf("unexpected diagnostics of the failing source %+v", d)
+	}
+	if _, err := compileSource(sourceConfig{Charset: "ebcdic"}); err == nil {
+		t.Error("expected an unsupported charset to be rejected")
+	}
+}
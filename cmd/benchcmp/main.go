@@ -0,0 +1,190 @@
+// Command benchcmp runs the replay benchmarks on a base commit and on the working tree and
+// reports the change of time, bytes and allocations per operation. It exits 1 when any of them
+// regressed by more than -threshold percent.
+//
+//	benchcmp -base=main -count=5
+//	benchcmp old.txt new.txt
+//
+// With two files it compares saved `go test -bench` outputs instead of running anything.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Units compared, in the order they are reported
+var units = []string{"ns/op", "B/op", "allocs/op"}
+
+// Samples of a benchmark by unit
+type samples map[string][]float64
+
+// Parses `go test -bench` output into the samples of every benchmark. Runs with -count=n
+// repeat a benchmark line n times.
+func parse(r io.Reader) (map[string]samples, error) {
+	out := make(map[string]samples)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 4 || !strings.HasPrefix(f[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(f[1]); err != nil {
+			continue
+		}
+		s := out[f[0]]
+		if s == nil {
+			s = make(samples)
+			out[f[0]] = s
+		}
+		for i := 2; i+1 < len(f); i += 2 {
+			v, err := strconv.ParseFloat(f[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q in %q", f[i], sc.Text())
+			}
+			s[f[i+1]] = append(s[f[i+1]], v)
+		}
+	}
+	return out, sc.Err()
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Change of a benchmark in one unit, medians of the samples
+type delta struct {
+	Name     string
+	Unit     string
+	Old, New float64
+	// Relative change in percent
+	Change float64
+}
+
+// Compares the benchmarks present in both runs
+func compare(old, new map[string]samples) []delta {
+	var names []string
+	for name := range new {
+		if _, ok := old[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var out []delta
+	for _, name := range names {
+		for _, unit := range units {
+			o, n := old[name][unit], new[name][unit]
+			if len(o) == 0 || len(n) == 0 {
+				continue
+			}
+			d := delta{Name: name, Unit: unit, Old: median(o), New: median(n)}
+			if d.Old != 0 {
+				d.Change = (d.New - d.Old) / d.Old * 100
+			}
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Writes the deltas and reports whether any regressed by more than threshold percent
+func report(w io.Writer, deltas []delta, threshold float64) bool {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "benchmark\tunit\told\tnew\tchange\t")
+	regressed := false
+	for _, d := range deltas {
+		mark := ""
+		if d.Change > threshold {
+			mark, regressed = "regression", true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.0f\t%.0f\t%+.1f%%\t%s\n", d.Name, d.Unit, d.Old, d.New, d.Change, mark)
+	}
+	tw.Flush()
+	return regressed
+}
+
+// Runs the benchmarks in dir
+func bench(dir, pattern string, count int) (map[string]samples, error) {
+	cmd := exec.Command("go", "test", "-run", "^$", "-bench", pattern, "-benchmem", "-count", strconv.Itoa(count), ".")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("benchmarks in %s: %v\n%s", dir, err, b)
+	}
+	return parse(strings.NewReader(string(b)))
+}
+
+// Checks base out into a temporary worktree and runs the benchmarks there
+func benchBase(base, pattern string, count int) (map[string]samples, error) {
+	dir, err := ioutil.TempDir("", "benchcmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tree := filepath.Join(dir, "base")
+	if b, err := exec.Command("git", "worktree", "add", "--detach", tree, base).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("git worktree add %s: %v\n%s", base, err, b)
+	}
+	defer exec.Command("git", "worktree", "remove", "--force", tree).Run()
+	return bench(tree, pattern, count)
+}
+
+func parseFile(path string) (map[string]samples, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+func main() {
+	base := flag.String("base", "main", "commit to compare the working tree with")
+	pattern := flag.String("bench", "Replay", "benchmarks to run")
+	count := flag.Int("count", 5, "runs of every benchmark, the median is compared")
+	threshold := flag.Float64("threshold", 10, "percent by which a benchmark may get worse before benchcmp fails")
+	flag.Parse()
+
+	var old, new map[string]samples
+	var err error
+	switch flag.NArg() {
+	case 2:
+		if old, err = parseFile(flag.Arg(0)); err == nil {
+			new, err = parseFile(flag.Arg(1))
+		}
+	case 0:
+		if old, err = benchBase(*base, *pattern, *count); err == nil {
+			new, err = bench(".", *pattern, *count)
+		}
+	default:
+		err = fmt.Errorf("usage: benchcmp [flags] [old.txt new.txt]")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	deltas := compare(old, new)
+	if len(deltas) == 0 {
+		log.Fatal("no benchmarks in common")
+	}
+	if report(os.Stdout, deltas, *threshold) {
+		os.Exit(1)
+	}
+}
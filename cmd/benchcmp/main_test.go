@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const oldRun = `goos: linux
+BenchmarkReplay/small-8   	    1000	    100000 ns/op	   50000 B/op	     300 allocs/op
+BenchmarkReplay/small-8   	    1000	    120000 ns/op	   50000 B/op	     300 allocs/op
+BenchmarkReplay/small-8   	    1000	    110000 ns/op	   50000 B/op	     300 allocs/op
+BenchmarkReplay/gone-8    	    1000	      1000 ns/op
+PASS
+`
+
+const newRun = `BenchmarkReplay/small-8   	    1000	    130000 ns/op	   50000 B/op	     270 allocs/op
+BenchmarkReplay/added-8   	    1000	      1000 ns/op
+ok  	github.com/karthikraobr/ta-go	1.2s
+`
+
+func TestParse(t *testing.T) {
+	got, err := parse(strings.NewReader(oldRun))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]samples{
+		"BenchmarkReplay/small-8": {"ns/op": {100000, 120000, 110000}, "B/op": {50000, 50000, 50000}, "allocs/op": {300, 300, 300}},
+		"BenchmarkReplay/gone-8":  {"ns/op": {1000}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+	if _, err := parse(strings.NewReader("BenchmarkX 10 abc ns/op\n")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	old, _ := parse(strings.NewReader(oldRun))
+	new, _ := parse(strings.NewReader(newRun))
+	deltas := compare(old, new)
+	want := []delta{
+		{Name: "BenchmarkReplay/small-8", Unit: "ns/op", Old: 110000, New: 130000, Change: 200.0 / 11},
+		{Name: "BenchmarkReplay/small-8", Unit: "B/op", Old: 50000, New: 50000},
+		{Name: "BenchmarkReplay/small-8", Unit: "allocs/op", Old: 300, New: 270, Change: -10},
+	}
+	if !reflect.DeepEqual(deltas, want) {
+		t.Fatalf("expected %+v; got %+v", want, deltas)
+	}
+	var buf bytes.Buffer
+	if !report(&buf, deltas, 10) {
+		t.Error("expected a regression at 10%")
+	}
+	if !strings.Contains(buf.String(), "+18.2%") {
+		t.Errorf("unexpected report\n%s", buf.String())
+	}
+	if report(&bytes.Buffer{}, deltas, 20) {
+		t.Error("expected no regression at 20%")
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{values: []float64{3}, want: 3},
+		{values: []float64{3, 1, 2}, want: 2},
+		{values: []float64{4, 1, 3, 2}, want: 2.5},
+	}
+	for _, tt := range tests {
+		if got := median(tt.values); got != tt.want {
+			t.Errorf("%v: expected %v; got %v", tt.values, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Command demo starts a playground: mock upstreams with different behaviours, each on a port of
+// its own, and an aggregator with a group per upstream plus one of all of them. It prints example
+// requests and tears everything down on Ctrl-C. Flags after -- go to the aggregator, to try
+// features against the same upstreams.
+//
+//	go run ./cmd/demo -addr=127.0.0.1:8000 -- -upstream.coalesce -response.fields=all
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/karthikraobr/ta-go/mock"
+)
+
+// A mock upstream of the playground
+type upstream struct {
+	name   string
+	about  string
+	source mock.Source
+}
+
+func profile(s string) mock.Profile {
+	p, err := mock.ParseProfile(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func sizes(s string) mock.Sizes {
+	d, err := mock.ParseSizes(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+var topology = []upstream{
+	{name: "fast", about: "answers 100 values within 5ms", source: mock.Source{Numbers: 100, Delay: 5 * time.Millisecond}},
+	{name: "bimodal", about: "takes 800ms for one request in five, where hedging pays off", source: mock.Source{Numbers: 100, Latency: profile("bimodal:30ms,800ms@0.2")}},
+	{name: "spiky", about: "stalls for 2s during the first 5s of every 30s", source: mock.Source{Numbers: 100, Latency: profile("spike:20ms,2s/30s+5s")}},
+	{name: "ramping", about: "slows down from 10ms to 1.5s over every 2 minutes", source: mock.Source{Numbers: 100, Latency: profile("ramp:10ms-1500ms/2m")}},
+	{name: "flaky", about: "fails a third of the requests", source: mock.Source{Numbers: 100, Delay: 10 * time.Millisecond, ErrorRate: 0.33}},
+	{name: "large", about: "answers heavy-tailed bodies of 1000 values and more, where streaming pays off", source: mock.Source{Latency: profile("bimodal:20ms,200ms@0.1"), Sizes: sizes("pareto:1000,1.2")}},
+}
+
+// An upstream serving on its own listener
+type running struct {
+	upstream
+	url    string
+	server *http.Server
+}
+
+// Starts every upstream of topology on a free port of host. The nth request of an upstream
+// behaves the same in every run with the same seed.
+func startUpstreams(host string, ups []upstream, seed int64) ([]running, error) {
+	var out []running
+	for i, u := range ups {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			stopUpstreams(out)
+			return nil, err
+		}
+		srv := &http.Server{Handler: mock.Handler()}
+		go srv.Serve(l)
+		s := u.source
+		s.Endpoint, s.Seed = u.name, int64(i+1)
+		if seed != 0 {
+			s.SimSeed = seed + int64(i)*1000003
+		}
+		out = append(out, running{upstream: u, url: s.URL("http://" + l.Addr().String()), server: srv})
+	}
+	return out, nil
+}
+
+func stopUpstreams(ups []running) {
+	for _, u := range ups {
+		u.server.Close()
+	}
+}
+
+// Writes the groups file of the aggregator: a group named after every upstream and "demo" of all
+func writeGroups(path string, ups []running) error {
+	type group struct {
+		URLs []string `json:"urls"`
+	}
+	all := map[string]group{"demo": {}}
+	for _, u := range ups {
+		all[u.name] = group{URLs: []string{u.url}}
+		all["demo"] = group{URLs: append(all["demo"].URLs, u.url)}
+	}
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0o600)
+}
+
+// Builds the aggregator from the module in src into dir
+func build(src, dir string) (string, error) {
+	bin := filepath.Join(dir, "ta-go")
+	cmd := exec.Command("go", "build", "-o", bin, ".")
+	cmd.Dir, cmd.Stdout, cmd.Stderr = src, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("building the aggregator in %s - %v", src, err)
+	}
+	return bin, nil
+}
+
+// Polls /healthz until the aggregator answers, fails once exited is closed or timeout passed
+func waitHealthy(base string, exited <-chan struct{}, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if res, err := http.Get(base + "/healthz"); err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-tick.C:
+		case <-exited:
+			return errors.New("the aggregator exited before it became healthy")
+		case <-deadline:
+			return fmt.Errorf("the aggregator wasn't healthy within %v", timeout)
+		}
+	}
+}
+
+// Prints what the playground runs and requests to try
+func examples(w io.Writer, base string, ups []running, logPath string) {
+	fmt.Fprintf(w, "aggregator on %s, logging to %s\n\nupstreams:\n", base, logPath)
+	for _, u := range ups {
+		fmt.Fprintf(w, "  %-8s %s\n", u.name, u.about)
+	}
+	fmt.Fprintf(w, "\ntry:\n")
+	fmt.Fprintf(w, "  curl '%s/numbers?g=demo&verbose=errors,sources_total,sources_failed'\n", base)
+	for _, u := range ups {
+		fmt.Fprintf(w, "  curl '%s/numbers?g=%s&verbose=errors'\n", base, u.name)
+	}
+	fmt.Fprintf(w, "  curl '%s/numbers?g=bimodal&g=large&upstream_timeout_ms=300&verbose=errors'\n", base)
+	fmt.Fprintf(w, "  curl '%s/admin/upstreams/stats'\n", base)
+	fmt.Fprintf(w, "  curl '%s/admin/upstreams/offenders?min_requests=1'\n", base)
+	fmt.Fprintf(w, "  curl '%s/debug/vars'\n", base)
+	fmt.Fprintf(w, "  go run ./cmd/loadgen -target=%s -mix=5x100 -latency=bimodal:20ms,500ms@0.1 -duration=30s\n", base)
+	fmt.Fprintf(w, "\nCtrl-C stops everything\n")
+}
+
+func main() {
+	server := flag.String("server", "", "aggregator binary, empty builds the module in -src")
+	src := flag.String("src", ".", "directory of the aggregator's module, used without -server")
+	addr := flag.String("addr", "127.0.0.1:8000", "listen address of the aggregator")
+	host := flag.String("mock.host", "127.0.0.1", "host the mock upstreams listen on, each on a free port")
+	seed := flag.Int64("seed", 1, "seed of the upstreams' latencies, sizes and failures, so that runs repeat them, 0 is random")
+	flag.Parse()
+	dir, err := ioutil.TempDir("", "ta-go-demo")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := run(*server, *src, *addr, *host, *seed, dir, flag.Args()); err != nil {
+		// Exits without removing dir, which holds the aggregator's log
+		log.Fatal(err)
+	}
+}
+
+func run(server, src, addr, host string, seed int64, dir string, extra []string) error {
+	ups, err := startUpstreams(host, topology, seed)
+	if err != nil {
+		return err
+	}
+	defer stopUpstreams(ups)
+	groupsPath := filepath.Join(dir, "groups.json")
+	if err := writeGroups(groupsPath, ups); err != nil {
+		return err
+	}
+	if server == "" {
+		if server, err = build(src, dir); err != nil {
+			return err
+		}
+	}
+	logPath := filepath.Join(dir, "aggregator.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(server, append([]string{"-http.addr=" + addr, "-groups.file=" + groupsPath}, extra...)...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	stop := func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+	base := "http://" + addr
+	if err := waitHealthy(base, exited, 30*time.Second); err != nil {
+		stop()
+		return fmt.Errorf("%v, see %s", err, logPath)
+	}
+	examples(os.Stdout, base, ups, logPath)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case <-sig:
+		stop()
+		fmt.Println("stopped")
+		return nil
+	case <-exited:
+		return fmt.Errorf("the aggregator exited: %v, see %s", cmd.ProcessState, logPath)
+	}
+}
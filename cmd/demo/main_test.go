@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreams(t *testing.T) {
+	ups, err := startUpstreams("127.0.0.1", topology, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopUpstreams(ups)
+	hosts := map[string]bool{}
+	for _, u := range ups {
+		if u.name == "spiky" || u.name == "ramping" {
+			// Their first request is the slow one
+			continue
+		}
+		res, err := http.Get(u.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK && !(u.name == "flaky" && res.StatusCode == http.StatusInternalServerError) {
+			t.Errorf("%s: unexpected status %d", u.name, res.StatusCode)
+		}
+		hosts[res.Request.URL.Host] = true
+	}
+	if len(hosts) != len(ups)-2 {
+		t.Errorf("expected every upstream on a port of its own; got %v", hosts)
+	}
+	path := filepath.Join(t.TempDir(), "groups.json")
+	if err := writeGroups(path, ups); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	var groups map[string]struct {
+		URLs []string `json:"urls"`
+	}
+	if err := json.Unmarshal(b, &groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != len(ups)+1 || len(groups["demo"].URLs) != len(ups) || groups["fast"].URLs[0] != ups[0].url {
+		t.Errorf("unexpected groups %s", b)
+	}
+	var out bytes.Buffer
+	examples(&out, "http://127.0.0.1:8000", ups, "aggregator.log")
+	for _, want := range []string{"curl 'http://127.0.0.1:8000/numbers?g=demo", "g=bimodal&verbose=errors", "go run ./cmd/loadgen -target=http://127.0.0.1:8000", "Ctrl-C"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	exited := make(chan struct{})
+	close(exited)
+	if err := waitHealthy("http://127.0.0.1:1", exited, time.Second); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("expected the exit to be reported; got %v", err)
+	}
+}
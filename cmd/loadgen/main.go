@@ -0,0 +1,365 @@
+// Command loadgen sends a configurable mix of /numbers requests to a running aggregator and
+// reports latency percentiles, a latency histogram and error rates. The upstreams are played
+// by the mock server, embedded unless -mock.url points at one.
+//
+//	loadgen -target=http://localhost:8000 -mix=10x1000@3,100x100 -error-rate=0.05 -duration=1m
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karthikraobr/ta-go/mock"
+)
+
+// A kind of request in the mix: URLs sources of Numbers values each, picked Weight times as
+// often as a weight of 1
+type mixEntry struct {
+	Name    string
+	URLs    int
+	Numbers int
+	Weight  int
+}
+
+// Parses entries like "10x1000@3", meaning 10 sources of 1000 numbers with weight 3
+func parseMix(s string) ([]mixEntry, error) {
+	var mix []mixEntry
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		e := mixEntry{Name: part, Weight: 1}
+		spec := part
+		if i := strings.IndexByte(part, '@'); i >= 0 {
+			w, err := strconv.Atoi(part[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", part)
+			}
+			e.Weight, spec = w, part[:i]
+		}
+		f := strings.Split(spec, "x")
+		if len(f) != 2 {
+			return nil, fmt.Errorf("invalid mix entry %q, expected URLSxNUMBERS[@WEIGHT]", part)
+		}
+		var err1, err2 error
+		e.URLs, err1 = strconv.Atoi(f[0])
+		e.Numbers, err2 = strconv.Atoi(f[1])
+		if err1 != nil || err2 != nil || e.URLs < 1 || e.Numbers < 0 {
+			return nil, fmt.Errorf("invalid mix entry %q, expected URLSxNUMBERS[@WEIGHT]", part)
+		}
+		mix = append(mix, e)
+	}
+	return mix, nil
+}
+
+func pick(mix []mixEntry, rnd *rand.Rand) int {
+	total := 0
+	for _, e := range mix {
+		total += e.Weight
+	}
+	n := rnd.Intn(total)
+	for i, e := range mix {
+		if n < e.Weight {
+			return i
+		}
+		n -= e.Weight
+	}
+	return len(mix) - 1
+}
+
+type config struct {
+	target      string
+	mockURL     string
+	mix         []mixEntry
+	source      mock.Source
+	query       string
+	concurrency int
+	duration    time.Duration
+	requests    int
+}
+
+// Builds the /numbers URL for one request of e. Every source gets its own seed, so neither
+// the aggregator's cache nor its dedup make the run cheaper than intended.
+func (c *config) requestURL(e mixEntry, rnd *rand.Rand) string {
+	q := url.Values{}
+	for i := 0; i < e.URLs; i++ {
+		s := c.source
+		s.Numbers = e.Numbers
+		s.Seed = rnd.Int63() + 1
+		q.Add("u", s.URL(c.mockURL))
+	}
+	q.Set("verbose", "sources_total,sources_failed")
+	u := c.target + "/numbers?" + q.Encode()
+	if c.query != "" {
+		u += "&" + c.query
+	}
+	return u
+}
+
+// Outcome of a single request
+type sample struct {
+	entry         int
+	latency       time.Duration
+	status        int
+	err           error
+	sources       int
+	sourcesFailed int
+}
+
+func (c *config) do(client *http.Client, e int, rnd *rand.Rand) sample {
+	s := sample{entry: e}
+	start := time.Now()
+	res, err := client.Get(c.requestURL(c.mix[e], rnd))
+	if err != nil {
+		s.err, s.latency = err, time.Since(start)
+		return s
+	}
+	defer res.Body.Close()
+	s.status = res.StatusCode
+	var body struct {
+		SourcesTotal  int `json:"sources_total"`
+		SourcesFailed int `json:"sources_failed"`
+	}
+	if res.StatusCode == http.StatusOK {
+		err = json.NewDecoder(res.Body).Decode(&body)
+	} else {
+		_, err = io.Copy(ioutil.Discard, res.Body)
+	}
+	s.latency = time.Since(start)
+	if err != nil {
+		s.err = err
+	}
+	s.sources, s.sourcesFailed = body.SourcesTotal, body.SourcesFailed
+	return s
+}
+
+// Runs the configured load and returns every sample
+func (c *config) run() []sample {
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: c.concurrency}}
+	var (
+		mu      sync.Mutex
+		samples []sample
+		wg      sync.WaitGroup
+	)
+	deadline := time.Now().Add(c.duration)
+	next := make(chan struct{})
+	go func() {
+		defer close(next)
+		for i := 0; c.requests == 0 || i < c.requests; i++ {
+			if c.duration > 0 && time.Now().After(deadline) {
+				return
+			}
+			next <- struct{}{}
+		}
+	}()
+	wg.Add(c.concurrency)
+	for i := 0; i < c.concurrency; i++ {
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for range next {
+				s := c.do(client, pick(c.mix, rnd), rnd)
+				mu.Lock()
+				samples = append(samples, s)
+				mu.Unlock()
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	return samples
+}
+
+// Nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+type stats struct {
+	requests, failed           int
+	sources, sourcesFailed     int
+	latencies                  []time.Duration
+	statuses                   map[int]int
+	transportErrors, badBodies int
+}
+
+func summarize(samples []sample, entry int) stats {
+	st := stats{statuses: make(map[int]int)}
+	for _, s := range samples {
+		if entry >= 0 && s.entry != entry {
+			continue
+		}
+		st.requests++
+		st.latencies = append(st.latencies, s.latency)
+		st.sources += s.sources
+		st.sourcesFailed += s.sourcesFailed
+		switch {
+		case s.status == 0:
+			st.transportErrors++
+			st.failed++
+		case s.status != http.StatusOK:
+			st.statuses[s.status]++
+			st.failed++
+		case s.err != nil:
+			st.badBodies++
+			st.failed++
+		default:
+			st.statuses[s.status]++
+		}
+	}
+	sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+	return st
+}
+
+func (st stats) errorRate() float64 {
+	if st.requests == 0 {
+		return 0
+	}
+	return float64(st.failed) / float64(st.requests)
+}
+
+func (st stats) sourceErrorRate() float64 {
+	if st.sources == 0 {
+		return 0
+	}
+	return float64(st.sourcesFailed) / float64(st.sources)
+}
+
+func (st stats) latencyLine() string {
+	return fmt.Sprintf("p50 %v  p95 %v  p99 %v  max %v",
+		round(percentile(st.latencies, 0.50)), round(percentile(st.latencies, 0.95)),
+		round(percentile(st.latencies, 0.99)), round(percentile(st.latencies, 1)))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// Prints the latencies in power of two millisecond buckets
+func histogram(w io.Writer, sorted []time.Duration) {
+	if len(sorted) == 0 {
+		return
+	}
+	const width = 50
+	var bounds []time.Duration
+	var counts []int
+	bound := time.Millisecond
+	i := 0
+	for i < len(sorted) {
+		n := 0
+		for ; i < len(sorted) && sorted[i] <= bound; i++ {
+			n++
+		}
+		bounds, counts = append(bounds, bound), append(counts, n)
+		bound *= 2
+	}
+	max := 0
+	for _, n := range counts {
+		if n > max {
+			max = n
+		}
+	}
+	for j, n := range counts {
+		fmt.Fprintf(w, "  <= %-8v %7d %s\n", bounds[j], n, strings.Repeat("#", n*width/max))
+	}
+}
+
+func report(w io.Writer, c *config, samples []sample, elapsed time.Duration) {
+	all := summarize(samples, -1)
+	fmt.Fprintf(w, "%d requests in %v (%.1f/s), concurrency %d\n", all.requests, elapsed.Round(time.Millisecond),
+		float64(all.requests)/elapsed.Seconds(), c.concurrency)
+	codes := make([]int, 0, len(all.statuses))
+	for code := range all.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprint(w, "status")
+	for _, code := range codes {
+		fmt.Fprintf(w, " %d: %d", code, all.statuses[code])
+	}
+	fmt.Fprintf(w, ", transport errors: %d, bad bodies: %d\n", all.transportErrors, all.badBodies)
+	fmt.Fprintf(w, "error rate %.2f%%, failed sources %.2f%%\n", all.errorRate()*100, all.sourceErrorRate()*100)
+	fmt.Fprintf(w, "latency %s\n", all.latencyLine())
+	if len(c.mix) > 1 {
+		for i, e := range c.mix {
+			st := summarize(samples, i)
+			fmt.Fprintf(w, "  %-12s %6d requests  errors %.2f%%  %s\n", e.Name, st.requests, st.errorRate()*100, st.latencyLine())
+		}
+	}
+	fmt.Fprintln(w, "histogram")
+	histogram(w, all.latencies)
+}
+
+// Starts the embedded mock server, which the aggregator must be able to reach on addr
+func startMock(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(l, mock.Handler())
+	return "http://" + l.Addr().String(), nil
+}
+
+func main() {
+	c := &config{}
+	flag.StringVar(&c.target, "target", "http://localhost:8000", "base URL of the aggregator under test")
+	mix := flag.String("mix", "10x1000", "comma separated request kinds URLSxNUMBERS[@WEIGHT]")
+	flag.Float64Var(&c.source.ErrorRate, "error-rate", 0, "share of mock sources answering with a 500")
+	flag.DurationVar(&c.source.Delay, "delay", 0, "latency of every mock source")
+	flag.DurationVar(&c.source.Jitter, "jitter", 0, "random extra latency of mock sources")
+	latency := flag.String("latency", "", "latency profile of mock sources on top of -delay: ramp:LOW-HIGH/PERIOD, spike:LOW,HIGH/PERIOD+BURST or bimodal:LOW,HIGH@P")
+	sizes := flag.String("sizes", "", "distribution of the values per mock source replacing the mix's: uniform:MIN-MAX, exp:MEAN or pareto:MIN,ALPHA")
+	flag.Int64Var(&c.source.SimSeed, "sim-seed", 0, "seed of the latency, size and failure of mock requests, so that runs repeat them, 0 is random")
+	flag.StringVar(&c.query, "query", "", "extra query parameters for every request, e.g. dedup=false")
+	flag.IntVar(&c.concurrency, "concurrency", 8, "requests in flight")
+	flag.DurationVar(&c.duration, "duration", 30*time.Second, "how long to send requests, 0 relies on -requests")
+	flag.IntVar(&c.requests, "requests", 0, "stop after this many requests, 0 relies on -duration")
+	mockAddr := flag.String("mock.addr", "127.0.0.1:0", "listen address of the embedded mock server")
+	flag.StringVar(&c.mockURL, "mock.url", "", "base URL of an external mock server, disables the embedded one")
+	flag.Parse()
+	var err error
+	if c.mix, err = parseMix(*mix); err != nil {
+		log.Fatal(err)
+	}
+	if c.source.Latency, err = mock.ParseProfile(*latency); err != nil {
+		log.Fatal(err)
+	}
+	if c.source.Sizes, err = mock.ParseSizes(*sizes); err != nil {
+		log.Fatal(err)
+	}
+	if c.concurrency < 1 {
+		log.Fatal("-concurrency must be at least 1")
+	}
+	if c.duration <= 0 && c.requests <= 0 {
+		log.Fatal("one of -duration and -requests is needed")
+	}
+	if c.mockURL == "" {
+		if c.mockURL, err = startMock(*mockAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	start := time.Now()
+	samples := c.run()
+	report(os.Stdout, c, samples, time.Since(start))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("10x1000@3, 1x5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mixEntry{{Name: "10x1000@3", URLs: 10, Numbers: 1000, Weight: 3}, {Name: "1x5", URLs: 1, Numbers: 5, Weight: 1}}
+	if !reflect.DeepEqual(mix, want) {
+		t.Errorf("expected %+v; got %+v", want, mix)
+	}
+	for _, bad := range []string{"", "10", "0x10", "axb", "1x1@0", "1x1@x"} {
+		if _, err := parseMix(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRunAndReport(t *testing.T) {
+	calls := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls%4 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"numbers":[1],"sources_total":` + strconv.Itoa(len(r.URL.Query()["u"])) + `,"sources_failed":1}`))
+	}))
+	defer target.Close()
+	c := &config{target: target.URL, mockURL: "http://mock", concurrency: 1, requests: 8}
+	c.mix, _ = parseMix("2x10")
+	samples := c.run()
+	if len(samples) != 8 {
+		t.Fatalf("expected 8 samples; got %d", len(samples))
+	}
+	st := summarize(samples, -1)
+	if st.errorRate() != 0.25 || st.sourceErrorRate() != 0.5 {
+		t.Errorf("expected 25%% failed requests and 50%% failed sources; got %v and %v", st.errorRate(), st.sourceErrorRate())
+	}
+	var out bytes.Buffer
+	report(&out, c, samples, time.Second)
+	for _, want := range []string{"8 requests", "status 200: 6 503: 2", "error rate 25.00%", "latency p50", "histogram"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the report:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var d []time.Duration
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	if p := percentile(d, 0.95); p != 95*time.Millisecond {
+		t.Errorf("expected p95 of 95ms; got %v", p)
+	}
+	if p := percentile(nil, 0.5); p != 0 {
+		t.Errorf("expected 0 for no samples; got %v", p)
+	}
+}
@@ -0,0 +1,107 @@
+// Command ta-cli bundles tools for operating the aggregator and its upstreams.
+//
+//	ta-cli check-source [-budget=450ms] [-json] <url>...
+//	ta-cli tune -groups=groups.json [-group=name] [-workers=8,32,128] [-timeouts=200ms,450ms] [-hedge=off,p90] [-write] [-json]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/karthikraobr/ta-go/sourcecheck"
+)
+
+// A subcommand gets its arguments without the command name and returns the exit code
+type command struct {
+	usage string
+	run   func(args []string, stdout, stderr io.Writer) int
+}
+
+var commands = map[string]command{
+	"check-source": {usage: "verify that upstream URLs answer in the format and time the aggregator expects", run: checkSource},
+	"tune":         {usage: "benchmark worker counts, timeouts and hedging against groups and recommend settings", run: tune},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	return cmd.run(args[1:], stdout, stderr)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: ta-cli <command> [flags] [args]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-14s %s\n", name, commands[name].usage)
+	}
+}
+
+func checkSource(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check-source", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	budget := fs.Duration("budget", sourcecheck.DefaultBudget, "time the source has to answer with its whole body")
+	asJSON := fs.Bool("json", false, "print the reports as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: ta-cli check-source [-budget=450ms] [-json] <url>...")
+		return 2
+	}
+	code := 0
+	var reports []sourcecheck.Report
+	for _, u := range fs.Args() {
+		r := sourcecheck.Run(context.Background(), u, sourcecheck.Options{Budget: *budget})
+		if !r.OK() {
+			code = 1
+		}
+		if *asJSON {
+			reports = append(reports, r)
+			continue
+		}
+		verdict := "PASS"
+		if !r.OK() {
+			verdict = "FAIL"
+		}
+		fmt.Fprintf(stdout, "%s %s (%d numbers in %v)\n", verdict, u, r.Numbers, r.Latency.Round(time.Millisecond))
+		for _, c := range r.Checks {
+			mark := "ok"
+			if !c.OK {
+				mark = "FAILED"
+			}
+			fmt.Fprintf(stdout, "  %-12s %s", c.Name, mark)
+			if c.Detail != "" {
+				fmt.Fprintf(stdout, " - %s", c.Detail)
+			}
+			fmt.Fprintln(stdout)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	}
+	return code
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckSource(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"numbers":[1,2]}`))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer bad.Close()
+
+	var out, errs bytes.Buffer
+	if code := run([]string{"check-source", good.URL}, &out, &errs); code != 0 {
+		t.Fatalf("expected exit code 0; got %d\n%s%s", code, out.String(), errs.String())
+	}
+	if !strings.HasPrefix(out.String(), "PASS "+good.URL+" (2 numbers") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	out.Reset()
+	if code := run([]string{"check-source", "-json", good.URL, bad.URL}, &out, &errs); code != 1 {
+		t.Fatalf("expected exit code 1; got %d", code)
+	}
+	var reports []struct {
+		URL    string `json:"url"`
+		Checks []struct {
+			Name string `json:"name"`
+			OK   bool   `json:"ok"`
+		} `json:"checks"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil || len(reports) != 2 {
+		t.Fatalf("expected two JSON reports; got %v\n%s", err, out.String())
+	}
+	if last := reports[1].Checks[len(reports[1].Checks)-1]; last.Name != "status" || last.OK {
+		t.Errorf("expected the status check to fail for %s; got %+v", bad.URL, reports[1].Checks)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var out, errs bytes.Buffer
+	for _, args := range [][]string{nil, {"nope"}, {"check-source"}} {
+		errs.Reset()
+		if code := run(args, &out, &errs); code != 2 {
+			t.Errorf("%v: expected exit code 2; got %d", args, code)
+		}
+		if errs.Len() == 0 {
+			t.Errorf("%v: expected usage on stderr", args)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings tried by tune: every combination of the worker counts, per-source timeouts and hedges
+type tuneConfig struct {
+	workers  []int
+	timeouts []time.Duration
+	hedges   []string
+	// Deadline of a fan-out, sources answering later count as missing
+	budget time.Duration
+	// Calibration fetches per URL and fan-outs per combination
+	samples, rounds int
+	client          *http.Client
+}
+
+// Outcome of the fan-outs of one combination
+type trial struct {
+	Workers    int           `json:"workers"`
+	Timeout    time.Duration `json:"timeout_ns"`
+	Hedge      string        `json:"hedge"`
+	HedgeAfter time.Duration `json:"hedge_after_ns,omitempty"`
+	// Share of the sources answering within the budget, fan-out latency percentiles and
+	// requests sent per fan-out, hedges included
+	Completeness float64       `json:"completeness"`
+	P50          time.Duration `json:"p50_ns"`
+	P99          time.Duration `json:"p99_ns"`
+	Requests     float64       `json:"requests"`
+}
+
+// Benchmarks of a group and the combination recommended
+type groupReport struct {
+	Group string `json:"group"`
+	URLs  int    `json:"urls"`
+	// Latency percentiles of single fetches measured before the fan-outs
+	FetchP50 time.Duration `json:"fetch_p50_ns"`
+	FetchP90 time.Duration `json:"fetch_p90_ns"`
+	FetchP99 time.Duration `json:"fetch_p99_ns"`
+	Trials   []trial       `json:"trials"`
+	Best     trial         `json:"recommended"`
+}
+
+func tune(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("tune", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	groupsFile := fs.String("groups", "", "groups file of the aggregator, see -groups.file")
+	var names []string
+	fs.Var(listValue{&names}, "group", "comma separated groups to benchmark, all by default")
+	workers := fs.String("workers", "8,32,128", "comma separated worker counts to try")
+	timeouts := fs.String("timeouts", "200ms,450ms", "comma separated per-source timeouts to try")
+	hedges := fs.String("hedge", "off,p90", "comma separated hedges to try: off, a percentile of the calibrated fetch latency like p90, or a duration")
+	c := tuneConfig{client: &http.Client{}}
+	fs.DurationVar(&c.budget, "budget", 450*time.Millisecond, "deadline of a fan-out, the aggregator's default leaves 50ms of its 500ms to merging")
+	fs.IntVar(&c.samples, "samples", 10, "calibration fetches per URL")
+	fs.IntVar(&c.rounds, "rounds", 5, "fan-outs per combination")
+	write := fs.Bool("write", false, "store the recommended settings as the tuning of each group in the groups file")
+	asJSON := fs.Bool("json", false, "print the reports as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *groupsFile == "" || fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: ta-cli tune -groups=groups.json [-group=name] [-workers=8,32,128] [-timeouts=200ms,450ms] [-hedge=off,p90] [-write] [-json]")
+		return 2
+	}
+	var err error
+	if c.workers, err = parseInts(*workers); err == nil {
+		if c.timeouts, err = parseDurations(*timeouts); err == nil {
+			c.hedges, err = parseHedges(*hedges)
+		}
+	}
+	if err == nil && (c.budget <= 0 || c.samples < 1 || c.rounds < 1) {
+		err = errors.New("-budget, -samples and -rounds must be positive")
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	all, err := readGroupURLs(*groupsFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if len(names) == 0 {
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var reports []groupReport
+	for _, name := range names {
+		urls, ok := all[name]
+		if !ok {
+			fmt.Fprintf(stderr, "unknown group %q\n", name)
+			return 1
+		}
+		reports = append(reports, c.run(context.Background(), name, urls))
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	} else {
+		printTuning(stdout, reports)
+	}
+	if *write {
+		if err := writeTuning(*groupsFile, reports, time.Now()); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintf(stderr, "stored the recommended settings in %s\n", *groupsFile)
+	}
+	return 0
+}
+
+// Comma separated list flag
+type listValue struct {
+	values *[]string
+}
+
+func (l listValue) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l listValue) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l.values = append(*l.values, s)
+		}
+	}
+	return nil
+}
+
+func parseInts(s string) ([]int, error) {
+	var out []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid worker count %q", part)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func parseDurations(s string) ([]time.Duration, error) {
+	var out []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", part)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func parseHedges(s string) ([]string, error) {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if _, err := hedgeDelay(part, nil); err != nil {
+			return nil, err
+		}
+		out = append(out, part)
+	}
+	return out, nil
+}
+
+// Delay after which a second request is sent for hedge, 0 for off. Percentiles are taken from
+// the sorted calibration latencies.
+func hedgeDelay(hedge string, sorted []time.Duration) (time.Duration, error) {
+	switch {
+	case hedge == "off":
+		return 0, nil
+	case strings.HasPrefix(hedge, "p"):
+		p, err := strconv.ParseFloat(hedge[1:], 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return 0, fmt.Errorf("invalid hedge %q, expected off, a percentile like p90 or a duration", hedge)
+		}
+		return percentile(sorted, p), nil
+	}
+	d, err := time.ParseDuration(hedge)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid hedge %q, expected off, a percentile like p90 or a duration", hedge)
+	}
+	return d, nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)) * p / 100)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// URLs of every group in the groups file at path
+func readGroupURLs(path string) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]struct {
+		URLs []string `json:"urls"`
+	}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, fmt.Errorf("%s decoding error - %v", path, err)
+	}
+	out := make(map[string][]string, len(all))
+	for name, g := range all {
+		if len(g.URLs) == 0 {
+			return nil, fmt.Errorf("group %q has no urls", name)
+		}
+		out[name] = g.URLs
+	}
+	return out, nil
+}
+
+// Calibrates the fetch latency of the URLs, then runs the fan-outs of every combination
+func (c *tuneConfig) run(ctx context.Context, name string, urls []string) groupReport {
+	r := groupReport{Group: name, URLs: len(urls)}
+	var fetches []time.Duration
+	for i := 0; i < c.samples; i++ {
+		for _, u := range urls {
+			start := time.Now()
+			// Twice the budget, so that slow sources are measured rather than cut off
+			fctx, cancel := context.WithTimeout(ctx, 2*c.budget)
+			c.get(fctx, u)
+			cancel()
+			fetches = append(fetches, time.Since(start))
+		}
+	}
+	sort.Slice(fetches, func(i, j int) bool { return fetches[i] < fetches[j] })
+	r.FetchP50, r.FetchP90, r.FetchP99 = percentile(fetches, 50), percentile(fetches, 90), percentile(fetches, 99)
+	for _, w := range c.workers {
+		for _, timeout := range c.timeouts {
+			for _, hedge := range c.hedges {
+				after, _ := hedgeDelay(hedge, fetches)
+				r.Trials = append(r.Trials, c.trial(ctx, urls, w, timeout, hedge, after))
+			}
+		}
+	}
+	r.Best = recommend(r.Trials)
+	return r
+}
+
+func (c *tuneConfig) trial(ctx context.Context, urls []string, workers int, timeout time.Duration, hedge string, after time.Duration) trial {
+	t := trial{Workers: workers, Timeout: timeout, Hedge: hedge, HedgeAfter: after}
+	var took []time.Duration
+	answered, requests := 0, 0
+	for i := 0; i < c.rounds; i++ {
+		n, sent, d := c.fanOut(ctx, urls, workers, timeout, after)
+		answered += n
+		requests += sent
+		took = append(took, d)
+	}
+	sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+	t.Completeness = float64(answered) / float64(len(urls)*c.rounds)
+	t.P50, t.P99 = percentile(took, 50), percentile(took, 99)
+	t.Requests = float64(requests) / float64(c.rounds)
+	return t
+}
+
+// Fetches urls with a pool of workers until the budget passes, like a request of the aggregator.
+// Reports the sources that answered in time, the requests sent and how long the fan-out took.
+func (c *tuneConfig) fanOut(ctx context.Context, urls []string, workers int, timeout, hedgeAfter time.Duration) (int, int, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, c.budget)
+	defer cancel()
+	start := time.Now()
+	queue := make(chan string, len(urls))
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	var mu sync.Mutex
+	answered, requests := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(urls); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				ok, sent := c.hedged(ctx, u, timeout, hedgeAfter)
+				mu.Lock()
+				requests += sent
+				if ok && ctx.Err() == nil {
+					answered++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	took := time.Since(start)
+	if took > c.budget {
+		took = c.budget
+	}
+	return answered, requests, took
+}
+
+// Fetches u within timeout, sending a second request when the first took longer than after.
+// The first successful answer wins.
+func (c *tuneConfig) hedged(ctx context.Context, u string, timeout, after time.Duration) (bool, int) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := make(chan bool, 2)
+	send := func() { results <- c.get(ctx, u) }
+	go send()
+	sent, pending := 1, 1
+	var hedge <-chan time.Time
+	if after > 0 {
+		timer := time.NewTimer(after)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	for {
+		select {
+		case ok := <-results:
+			pending--
+			if ok {
+				return true, sent
+			}
+			if pending == 0 && hedge == nil {
+				return false, sent
+			}
+		case <-hedge:
+			hedge = nil
+			sent++
+			pending++
+			go send()
+		case <-ctx.Done():
+			return false, sent
+		}
+	}
+}
+
+// Reads the whole answer of u, reporting whether it was a 200
+func (c *tuneConfig) get(ctx context.Context, u string) bool {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(ioutil.Discard, res.Body)
+	return err == nil && res.StatusCode == http.StatusOK
+}
+
+// Best of the trials: the most complete, within half a percent, then the lowest p99, then the
+// one sending the fewest requests and the one with the fewest workers
+func recommend(trials []trial) trial {
+	if len(trials) == 0 {
+		return trial{}
+	}
+	sorted := append([]trial(nil), trials...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if d := a.Completeness - b.Completeness; d > 0.005 || d < -0.005 {
+			return d > 0
+		}
+		if a.P99 != b.P99 {
+			return a.P99 < b.P99
+		}
+		if a.Requests != b.Requests {
+			return a.Requests < b.Requests
+		}
+		return a.Workers < b.Workers
+	})
+	return sorted[0]
+}
+
+func printTuning(w io.Writer, reports []groupReport) {
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s: %d urls, fetch p50 %v p90 %v p99 %v\n", r.Group, r.URLs, ms(r.FetchP50), ms(r.FetchP90), ms(r.FetchP99))
+		fmt.Fprintf(w, "  %7s %8s %12s %9s %8s %8s %8s\n", "workers", "timeout", "hedge", "complete", "p50", "p99", "requests")
+		for _, t := range r.Trials {
+			fmt.Fprintf(w, "  %7d %8v %12s %8.1f%% %8v %8v %8.1f\n", t.Workers, ms(t.Timeout), hedgeLabel(t), t.Completeness*100, ms(t.P50), ms(t.P99), t.Requests)
+		}
+		b := r.Best
+		fmt.Fprintf(w, "  recommended: -pool.max=%d, upstream timeout %v, hedge %s (%.1f%% complete, p99 %v)\n", b.Workers, ms(b.Timeout), hedgeLabel(b), b.Completeness*100, ms(b.P99))
+	}
+}
+
+func hedgeLabel(t trial) string {
+	if t.HedgeAfter == 0 || t.Hedge == ms(t.HedgeAfter).String() {
+		return t.Hedge
+	}
+	return fmt.Sprintf("%s=%v", t.Hedge, ms(t.HedgeAfter))
+}
+
+func ms(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
+
+// Stores the recommendation of every report as the tuning of its group, keeping everything
+// else of the file. The file is replaced atomically.
+func writeTuning(path string, reports []groupReport, now time.Time) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var all map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return fmt.Errorf("%s decoding error - %v", path, err)
+	}
+	for _, r := range reports {
+		t := map[string]interface{}{
+			"upstream_timeout": ms(r.Best.Timeout).String(),
+			"workers":          r.Best.Workers,
+			"completeness":     r.Best.Completeness,
+			"p99":              ms(r.Best.P99).String(),
+			"tuned_at":         now.UTC().Format(time.RFC3339),
+		}
+		if r.Best.HedgeAfter > 0 {
+			t["hedge_after"] = ms(r.Best.HedgeAfter).String()
+		}
+		raw, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		all[r.Group]["tuning"] = raw
+	}
+	out, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(out, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
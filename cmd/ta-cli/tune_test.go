@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgeDelay(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "off"},
+		{in: "p50", want: 6 * time.Millisecond},
+		{in: "p90", want: 10 * time.Millisecond},
+		{in: "p99.9", want: 10 * time.Millisecond},
+		{in: "25ms", want: 25 * time.Millisecond},
+		{in: "p100", err: true},
+		{in: "px", err: true},
+		{in: "-1s", err: true},
+		{in: "soon", err: true},
+	}
+	for _, tt := range tests {
+		got, err := hedgeDelay(tt.in, sorted)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error; got %v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %v; got %v, %v", tt.in, tt.want, got, err)
+		}
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	trials := []trial{
+		{Workers: 8, Completeness: 0.8, P99: 100 * time.Millisecond, Requests: 10},
+		{Workers: 32, Completeness: 1, P99: 300 * time.Millisecond, Requests: 10},
+		{Workers: 128, Completeness: 0.998, P99: 200 * time.Millisecond, Requests: 12},
+		{Workers: 32, Completeness: 0.998, P99: 200 * time.Millisecond, Requests: 11},
+		{Workers: 8, Completeness: 0.998, P99: 200 * time.Millisecond, Requests: 11},
+	}
+	if got := recommend(trials); got != trials[4] {
+		t.Errorf("expected the complete, fast and cheap trial with the fewest workers; got %+v", got)
+	}
+	if got := recommend(nil); got != (trial{}) {
+		t.Errorf("expected no recommendation without trials; got %+v", got)
+	}
+}
+
+func TestTune(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"numbers":[1]}`))
+	}))
+	defer fast.Close()
+	// Every other request stalls beyond the budget, a hedge gets the source through
+	var n int64
+	bimodal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&n, 1)%2 == 0 {
+			select {
+			case <-time.After(300 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte(`{"numbers":[2]}`))
+	}))
+	defer bimodal.Close()
+	path := filepath.Join(t.TempDir(), "groups.json")
+	groups := `{"mixed": {"urls": ["` + fast.URL + `", "` + bimodal.URL + `"], "sources": {"` + fast.URL + `": {"charset": "utf-8"}}}}`
+	if err := ioutil.WriteFile(path, []byte(groups), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out, errs bytes.Buffer
+	args := []string{"tune", "-groups=" + path, "-workers=2", "-timeouts=150ms", "-hedge=off,20ms", "-budget=200ms", "-samples=2", "-rounds=4", "-json", "-write"}
+	if code := run(args, &out, &errs); code != 0 {
+		t.Fatalf("expected exit code 0; got %d\n%s", code, errs.String())
+	}
+	var reports []groupReport
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil || len(reports) != 1 || len(reports[0].Trials) != 2 {
+		t.Fatalf("expected a report of two trials; got %v\n%s", err, out.String())
+	}
+	best := reports[0].Best
+	if best.Hedge != "20ms" || best.Completeness != 1 || best.Requests <= 2 {
+		t.Errorf("expected hedging to be recommended for the bimodal source; got %+v", reports[0].Trials)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored map[string]struct {
+		URLs    []string                   `json:"urls"`
+		Sources map[string]json.RawMessage `json:"sources"`
+		Tuning  map[string]interface{}     `json:"tuning"`
+	}
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	g := stored["mixed"]
+	if len(g.URLs) != 2 || len(g.Sources) != 1 {
+		t.Errorf("expected the rest of the group to be kept; got %s", b)
+	}
+	if g.Tuning["upstream_timeout"] != "150ms" || g.Tuning["hedge_after"] != "20ms" || g.Tuning["workers"] != 2.0 || g.Tuning["tuned_at"] == nil {
+		t.Errorf("unexpected tuning %v", g.Tuning)
+	}
+	if code := run([]string{"tune", "-groups=" + path, "-group=nope"}, &out, &errs); code != 1 {
+		t.Errorf("expected exit code 1 for an unknown group; got %d", code)
+	}
+	if code := run([]string{"tune", "-groups=" + path, "-hedge=maybe"}, &out, &errs); code != 2 {
+		t.Errorf("expected exit code 2 for an invalid hedge; got %d", code)
+	}
+}
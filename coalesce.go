@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Fetches of the same URL that concurrent requests share: the first request to need a URL
+// fetches it and the others wait for its decoded result instead of fetching it again
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+}
+
+// A fetch other requests may be waiting for
+type fetchCall struct {
+	done      chan struct{}
+	followers int
+	// Set before done is closed. numbers is a copy the followers copy again, as every request
+	// filters its values in place.
+	numbers []int
+	skipped int
+	coerced int
+	err     error
+}
+
+var fetches = &fetchGroup{calls: make(map[string]*fetchCall)}
+
+// Fetches of u with o can be shared unless the request sent depends on the client
+func coalesceKey(o options, u string) string {
+	if !upstream.coalesce || upstream.forwardClient {
+		return ""
+	}
+	if src := groups.source(u); src != nil && src.body != nil {
+		// The body template may render the request id or tenant
+		return ""
+	}
+	key := u
+	if o.lenient {
+		key += "\x00lenient"
+	}
+	return key
+}
+
+// Joins the running fetch for key or starts a new one. leader is true when the caller has to
+// fetch and finish the call. An empty key isn't coalesced.
+func (g *fetchGroup) join(key string) (c *fetchCall, leader bool) {
+	if key == "" {
+		return nil, true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		c.followers++
+		return c, false
+	}
+	c = &fetchCall{done: make(chan struct{})}
+	g.calls[key] = c
+	return c, true
+}
+
+// Publishes the leader's outcome to the followers. Must be called before the leader hands res
+// to its own fan-out.
+func (g *fetchGroup) finish(key string, c *fetchCall, res result, err error) {
+	if c == nil {
+		return
+	}
+	g.mu.Lock()
+	delete(g.calls, key)
+	followers := c.followers
+	g.mu.Unlock()
+	if followers > 0 {
+		c.numbers = append([]int(nil), res.Numbers...)
+		c.skipped, c.coerced, c.err = res.skipped, res.coerced, err
+	}
+	close(c.done)
+}
+
+// Waits for the leader's outcome on behalf of the fetch of u in ctx. shared is false when the
+// leader failed for reasons of its own request, e.g. its deadline, and the caller should fetch.
+func (c *fetchCall) follow(ctx context.Context, u string, timeout time.Duration) (res result, shared bool, err error) {
+	stage := fetchStageFrom(ctx)
+	setStage(stage, stageHeaders)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return res, true, newFetchError(transportCode(ctx.Err()), u, "waiting for a shared fetch - %v", ctx.Err()).at(stageHeaders)
+	case <-timer.C:
+		return res, true, newFetchError(codeUpstreamTimeout, u, "waiting for a shared fetch - %v", context.DeadlineExceeded).at(stageHeaders)
+	}
+	if c.err != nil {
+		switch errorCodeOf(c.err) {
+		case codeBudgetExceeded, codeShed, codeUpstreamTimeout:
+			upstreamMetrics.Add("coalesced_fallbacks", 1)
+			return res, false, nil
+		}
+		upstreamMetrics.Add("coalesced_fetches", 1)
+		return res, true, c.err
+	}
+	setStage(stage, stageMergeWait)
+	if err := mergeGateFrom(ctx).acquire(ctx); err != nil {
+		return res, true, newFetchError(codeBudgetExceeded, u, "merge stage did not catch up - %v", err).at(stageMergeWait)
+	}
+	setStage(stage, stageDone)
+	upstreamMetrics.Add("coalesced_fetches", 1)
+	return result{Numbers: append([]int(nil), c.numbers...), skipped: c.skipped, coerced: c.coerced}, true, nil
+}
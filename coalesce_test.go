@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescedFetches(t *testing.T) {
+	defer func(c bool) { upstream.coalesce = c }(upstream.coalesce)
+	upstream.coalesce = true
+	var hits int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{"numbers":[3,1,2]}`))
+	}))
+	defer ts.Close()
+	o, _ := parseOptions(nil)
+	before := counter(upstreamMetrics.Get("coalesced_fetches"))
+	var wg sync.WaitGroup
+	sums := make([]summary, 3)
+	for i := range sums {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sums[i] = run(context.Background(), []string{ts.URL}, o)
+		}(i)
+		// Let the first request start its fetch
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Errorf("expected a single fetch; got %d", n)
+	}
+	for i, sum := range sums {
+		if !reflect.DeepEqual(sum.numbers, []int{1, 2, 3}) {
+			t.Errorf("request %d: expected [1 2 3]; got %v", i, sum.numbers)
+		}
+	}
+	if got := counter(upstreamMetrics.Get("coalesced_fetches")) - before; got != 2 {
+		t.Errorf("expected 2 coalesced fetches; got %d", got)
+	}
+}
+
+func TestFollowFallsBack(t *testing.T) {
+	tests := []struct {
+		err    error
+		shared bool
+	}{
+		{err: newFetchError(codeShed, "u", "shed"), shared: false},
+		{err: newFetchError(codeBudgetExceeded, "u", "late"), shared: false},
+		{err: newFetchError(codeDecode, "u", "bad body"), shared: true},
+	}
+	for _, tt := range tests {
+		c := &fetchCall{done: make(chan struct{}), err: tt.err}
+		close(c.done)
+		_, shared, err := c.follow(context.Background(), "u", time.Second)
+		if shared != tt.shared || shared && err != tt.err {
+			t.Errorf("%v: expected shared %v; got %v, %v", tt.err, tt.shared, shared, err)
+		}
+	}
+	// The follower's own timeout still applies
+	c := &fetchCall{done: make(chan struct{})}
+	if _, shared, err := c.follow(context.Background(), "u", time.Millisecond); !shared || errorCodeOf(err) != codeUpstreamTimeout {
+		t.Errorf("expected an upstream timeout; got %v", err)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	defer func(c, f bool) { upstream.coalesce, upstream.forwardClient = c, f }(upstream.coalesce, upstream.forwardClient)
+	o, _ := parseOptions(nil)
+	lenient := o
+	lenient.lenient = true
+	tests := []struct {
+		coalesce, forward bool
+		o                 options
+		want              string
+	}{
+		{coalesce: false, o: o, want: ""},
+		{coalesce: true, o: o, want: "http://a"},
+		{coalesce: true, o: lenient, want: "http://a\x00lenient"},
+		// Every request carries its own client address
+		{coalesce: true, forward: true, o: o, want: ""},
+	}
+	for _, tt := range tests {
+		upstream.coalesce, upstream.forwardClient = tt.coalesce, tt.forward
+		if got := coalesceKey(tt.o, "http://a"); got != tt.want {
+			t.Errorf("%+v: expected %q; got %q", tt, tt.want, got)
+		}
+	}
+}
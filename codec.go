@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A format upstreams may answer in and clients may ask for instead of JSON. JSON itself keeps its
+// dedicated decoders and encoders.
+type codec struct {
+	name string
+	// Media types of the format, the first is the one responses are sent as
+	mediaTypes []string
+	// Parses a whole document into maps with string keys, []interface{}, int64, uint64,
+	// float64, string, []byte, bool, nil and oversized for integers beyond 64 bits
+	parse func(data []byte) (interface{}, error)
+	// Writer encoding values into buf, nil for formats responses can't be sent in
+	writer func(buf *bytes.Buffer) valueWriter
+	// Bodies aren't text, so no charset applies
+	binary bool
+}
+
+// Writes values of a format one at a time, containers as a header followed by their elements
+type valueWriter interface {
+	null()
+	boolean(bool)
+	integer(int64)
+	float(float64)
+	str(string)
+	array(n int)
+	object(n int)
+}
+
+// An integer too large for 64 bits, e.g. a CBOR bignum
+type oversized struct{}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]*codec)
+)
+
+// Makes a format available for upstream bodies and responses under its media types
+func registerCodec(c *codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	for _, mt := range c.mediaTypes {
+		codecs[mt] = c
+	}
+}
+
+// Codec of the media type in a Content-Type header, nil for JSON and anything unknown
+func codecFor(contentType string) *codec {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[mt]
+}
+
+// Codec registered under name, nil when there is none
+func codecNamed(name string) *codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Codec a client prefers by its Accept header, nil when JSON does as well
+func responseCodec(accept string) *codec {
+	if accept == "" {
+		return nil
+	}
+	type choice struct {
+		mt string
+		q  float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{mt, q})
+		}
+	}
+	// Equally preferred types keep the client's order
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if matchMediaType(c.mt, "application/json") {
+			return nil
+		}
+		codecsMu.RLock()
+		found := codecs[c.mt]
+		codecsMu.RUnlock()
+		if found != nil && found.writer != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Decodes the numbers of a body in the format of c, those under "numbers" or the ones at path.
+// Values are converted like decodeNumbers does and, with lenient, like decodeLenient.
+func (c *codec) decode(r io.Reader, lenient bool, path *docPath) (result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return result{}, err
+	}
+	upstreamMetrics.Add("codec_bodies "+c.name, 1)
+	doc, err := c.parse(data)
+	if err != nil {
+		return result{}, err
+	}
+	res := result{Numbers: []int{}}
+	var values []interface{}
+	if path != nil {
+		values = path.selectValues(doc)
+	} else {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return result{}, fmt.Errorf("%s: cannot unmarshal %s into result", c.name, valueKind(doc))
+		}
+		if m["numbers"] == nil {
+			return res, nil
+		}
+		if values, ok = m["numbers"].([]interface{}); !ok {
+			return result{}, fmt.Errorf("%s: cannot unmarshal %s into result.numbers", c.name, valueKind(m["numbers"]))
+		}
+	}
+	res.Numbers = make([]int, 0, len(values))
+	for i, v := range values {
+		var n int
+		switch t := v.(type) {
+		case int64:
+			n = int(t)
+		case uint64:
+			if t > math.MaxInt64 {
+				res.skip(skipOverflow)
+				continue
+			}
+			n = int(t)
+		case oversized:
+			res.skip(skipOverflow)
+			continue
+		case float64:
+			switch {
+			case math.IsNaN(t) || t >= -math.MinInt64 || t < math.MinInt64:
+				res.skip(skipOverflow)
+				continue
+			case t != math.Trunc(t):
+				res.skip(skipFraction)
+				continue
+			}
+			n = int(t)
+			res.coerce()
+		case nil:
+			res.skip("null")
+			continue
+		case string:
+			if !lenient {
+				return result{}, fmt.Errorf("%s: cannot unmarshal string into result.numbers.%d of type int", c.name, i)
+			}
+			var reason string
+			if n, _, reason = numberInt(strings.TrimSpace(t)); reason != "" {
+				res.skip(reason)
+				continue
+			}
+			res.coerce()
+		default:
+			if !lenient {
+				return result{}, fmt.Errorf("%s: cannot unmarshal %s into result.numbers.%d of type int", c.name, valueKind(v), i)
+			}
+			res.skip(valueKind(v))
+			continue
+		}
+		res.Numbers = append(res.Numbers, n)
+	}
+	return res, nil
+}
+
+// JSON parsed like the binary formats, for JSON sources with a path
+var jsonDocument = &codec{name: "json", parse: parseJSONDocument}
+
+func parseJSONDocument(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("json: data after the document")
+	}
+	return jsonNumbers(doc), nil
+}
+
+// Replaces the json.Numbers in v by the number types codecs parse into
+func jsonNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(t.String(), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			return u
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return oversized{}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = jsonNumbers(e)
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = jsonNumbers(e)
+		}
+	}
+	return v
+}
+
+// Name of the type of a parsed value
+func valueKind(v interface{}) string {
+	switch v.(type) {
+	case []byte:
+		return "bytes"
+	case msgpackExt:
+		return "extension"
+	case nil:
+		return "null"
+	case int64, uint64, float64, oversized:
+		return "number"
+	}
+	return jsonKind(v)
+}
+
+// Encodes a response in the format of c. The envelope fields go through their JSON encoding,
+// the values are written directly.
+func (c *codec) encodeEnvelope(e envelope) ([]byte, error) {
+	var buf bytes.Buffer
+	w := c.writer(&buf)
+	values := e.Numbers
+	if e.shape.bare {
+		if values == nil {
+			values = []int{}
+		}
+		err := writeValue(w, values)
+		return buf.Bytes(), err
+	}
+	key := "numbers"
+	if e.shape.key != "" {
+		key = e.shape.key
+	}
+	e.Numbers, e.shape = nil, responseShape{}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if values != nil {
+		fields[key] = values
+	}
+	if err := writeValue(w, fields); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes v, which holds what encoding/json decodes into plus the values of a response
+func writeValue(w valueWriter, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		w.null()
+	case bool:
+		w.boolean(t)
+	case string:
+		w.str(t)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			w.integer(i)
+			break
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return err
+		}
+		w.float(f)
+	case []int:
+		w.array(len(t))
+		for _, n := range t {
+			w.integer(int64(n))
+		}
+	case stringNumbers:
+		w.array(len(t))
+		for _, n := range t {
+			w.str(strconv.Itoa(n))
+		}
+	case []interface{}:
+		w.array(len(t))
+		for _, e := range t {
+			if err := writeValue(w, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.object(len(keys))
+		for _, k := range keys {
+			w.str(k)
+			if err := writeValue(w, t[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T", v)
+	}
+	return nil
+}
+
+// Sends e in the format of c
+func writeCodec(w http.ResponseWriter, c *codec, e envelope) {
+	b, err := c.encodeEnvelope(e)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - " + err.Error()))
+		return
+	}
+	httpMetrics.Add("encoded "+c.name, 1)
+	w.Header().Set("Content-Type", c.mediaTypes[0])
+	w.Write(b)
+}
+
+// Reads the parts of binary documents, failing on truncated input
+type byteReader struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// Containers nested deeper than this are rejected instead of exhausting the stack
+const maxCodecDepth = 64
+
+func (r *byteReader) take(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *byteReader) byte() (byte, error) {
+	b, err := r.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Big-endian unsigned integer of n bytes
+func (r *byteReader) uint(n int) (uint64, error) {
+	b, err := r.take(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// Capacity for a container of n elements, which a hostile length must not inflate beyond the
+// bytes left
+func (r *byteReader) capacity(n uint64) int {
+	if left := uint64(len(r.data) - r.pos); n > left {
+		return int(left)
+	}
+	return int(n)
+}
+
+func (r *byteReader) enter() error {
+	if r.depth++; r.depth > maxCodecDepth {
+		return fmt.Errorf("nested deeper than %d", maxCodecDepth)
+	}
+	return nil
+}
+
+// Fails when a document is followed by more data
+func (r *byteReader) end(v interface{}, err error) (interface{}, error) {
+	if err == nil && r.pos != len(r.data) {
+		return nil, fmt.Errorf("%d bytes after the document", len(r.data)-r.pos)
+	}
+	return v, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResponseCodec(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: ""},
+		{accept: "*/*", want: ""},
+		{accept: "application/cbor", want: "cbor"},
+		{accept: "application/json, application/cbor", want: ""},
+		{accept: "application/json;q=0.5, application/x-msgpack", want: "msgpack"},
+		{accept: "application/cbor;q=0, application/json", want: ""},
+		{accept: "text/html, application/msgpack;q=0.9, */*;q=0.1", want: "msgpack"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if c := responseCodec(tt.accept); c != nil {
+			got = c.name
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %q; got %q", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCodecDecode(t *testing.T) {
+	cbor, msgpack := codecFor("application/cbor"), codecFor("application/msgpack; charset=binary")
+	tests := []struct {
+		name    string
+		codec   *codec
+		body    string
+		lenient bool
+		want    []int
+		skipped int
+		coerced int
+		err     bool
+	}{
+		// {"numbers": [1, -1, 1000000, 2.0 (half), null]}
+		{name: "cbor", codec: cbor, body: "a1 67 6e756d62657273 85 01 20 1a000f4240 f94000 f6", want: []int{1, -1, 1000000, 2}, skipped: 1, coerced: 1},
+		// Indefinite map and array, a bignum and 1.5
+		{name: "cbor indefinite", codec: cbor, body: "bf 67 6e756d62657273 9f 03 c2 49 010000000000000000 f93e00 ff ff", want: []int{3}, skipped: 2},
+		// 2^64-1 and -2^64
+		{name: "cbor overflow", codec: cbor, body: "a1 67 6e756d62657273 82 1bffffffffffffffff 3bffffffffffffffff", want: []int{}, skipped: 2},
+		{name: "cbor string", codec: cbor, body: "a1 67 6e756d62657273 81 61 37", err: true},
+		{name: "cbor lenient string", codec: cbor, body: "a1 67 6e756d62657273 82 61 37 f5", lenient: true, want: []int{7}, skipped: 1, coerced: 1},
+		{name: "cbor truncated", codec: cbor, body: "a1 67 6e756d62657273 82 01", err: true},
+		{name: "cbor trailing", codec: cbor, body: "a0 00", err: true},
+		{name: "cbor not a map", codec: cbor, body: "80", err: true},
+		{name: "cbor without numbers", codec: cbor, body: "a1 61 61 01", want: []int{}},
+		// {"numbers": [5, -3, 300, -200, 2^40, 3.0 (float32)], "count": 6}
+		{name: "msgpack", codec: msgpack, body: "82 a7 6e756d62657273 96 05 fd cd012c d1ff38 cf0000010000000000 ca40400000 a5 636f756e74 06", want: []int{5, -3, 300, -200, 1 << 40, 3}, coerced: 1},
+		{name: "msgpack uint64", codec: msgpack, body: "81 a7 6e756d62657273 92 cfffffffffffffffff d3ffffffffffffffff", want: []int{-1}, skipped: 1},
+		{name: "msgpack ext", codec: msgpack, body: "81 a7 6e756d62657273 91 d6ff00000001", err: true},
+		{name: "msgpack lenient ext", codec: msgpack, body: "81 a7 6e756d62657273 92 d6ff00000001 01", lenient: true, want: []int{1}, skipped: 1},
+		{name: "msgpack invalid", codec: msgpack, body: "c1", err: true},
+		{name: "msgpack huge length", codec: msgpack, body: "81 a7 6e756d62657273 dd ffffffff 01", err: true},
+	}
+	for _, tt := range tests {
+		res, err := tt.codec.decode(bytes.NewReader(mustHex(t, tt.body)), tt.lenient, nil)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error; got %v", tt.name, res.Numbers)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(res.Numbers, tt.want) || res.skipped != tt.skipped || res.coerced != tt.coerced {
+			t.Errorf("%s: expected %v, %d skipped, %d coerced; got %v, %d, %d, %v", tt.name, tt.want, tt.skipped, tt.coerced, res.Numbers, res.skipped, res.coerced, err)
+		}
+	}
+	deep := strings.Repeat("81", maxCodecDepth+1) + "80"
+	if _, err := cbor.parse(mustHex(t, deep)); err == nil {
+		t.Error("expected deeply nested containers to be rejected")
+	}
+}
+
+func TestCodecEncode(t *testing.T) {
+	values := []int{0, 23, 24, 255, 256, 65536, 1 << 32, math.MaxInt64, -1, -25, -129, -40000, math.MinInt64}
+	count := len(values)
+	for _, name := range []string{"application/cbor", "application/msgpack"} {
+		c := codecFor(name)
+		for _, e := range []envelope{
+			{Numbers: values, Count: &count},
+			{Numbers: stringNumbers{1, -2}},
+			{Numbers: []int{3}, shape: responseShape{key: "values"}},
+			{Numbers: values, shape: responseShape{bare: true}},
+		} {
+			b, err := c.encodeEnvelope(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := c.parse(b)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			var want interface{}
+			switch {
+			case e.shape.bare:
+				want = ints(values)
+			case e.shape.key != "":
+				want = map[string]interface{}{"values": ints([]int{3})}
+			case e.Count != nil:
+				want = map[string]interface{}{"numbers": ints(values), "count": int64(count)}
+			default:
+				want = map[string]interface{}{"numbers": []interface{}{"1", "-2"}}
+			}
+			if !reflect.DeepEqual(doc, want) {
+				t.Errorf("%s: expected %v; got %v", c.name, want, doc)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	cborWriter{&buf}.float(1.5)
+	if hex.EncodeToString(buf.Bytes()) != "fb3ff8000000000000" {
+		t.Errorf("unexpected float encoding %x", buf.Bytes())
+	}
+}
+
+func ints(values []int) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = int64(v)
+	}
+	return out
+}
+
+func TestBinarySources(t *testing.T) {
+	cbor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/cbor")
+		w.Write(mustHex(t, "a1 67 6e756d62657273 82 03 01"))
+	}))
+	defer cbor.Close()
+	msgpack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/msgpack")
+		w.Write(mustHex(t, "81 a7 6e756d62657273 92 02 03"))
+	}))
+	defer msgpack.Close()
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?u="+cbor.URL+"&u="+msgpack.URL, nil)
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, req)
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"numbers":[1,2,3]}` {
+		t.Errorf("expected the values of both sources; got %s", got)
+	}
+	req.Header.Set("Accept", "application/msgpack")
+	rec = httptest.NewRecorder()
+	numbersHandler(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Fatalf("expected a msgpack response; got %q %s", ct, rec.Body)
+	}
+	if got := hex.EncodeToString(rec.Body.Bytes()); got != "81a76e756d6265727393010203" {
+		t.Errorf("unexpected msgpack response %s", got)
+	}
+}
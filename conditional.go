@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Validators and decoded values of upstream responses, so that fetches can be made conditional
+// and a 304 reuses the values instead of transferring and decoding the body again
+type validatorStore struct {
+	mu sync.Mutex
+	// Values kept over all entries, 0 disables conditional fetches
+	maxValues int
+	values    int
+	entries   map[string]*validated
+	now       func() time.Time
+}
+
+// A response an upstream may confirm as unchanged. numbers is never modified once stored.
+type validated struct {
+	etag, lastModified string
+	numbers            []int
+	skipped, coerced   int
+	used               time.Time
+}
+
+var validators = newValidatorStore(0)
+
+func newValidatorStore(maxValues int) *validatorStore {
+	return &validatorStore{maxValues: maxValues, entries: make(map[string]*validated), now: time.Now}
+}
+
+func registerConditionalFlags(fs *flag.FlagSet, maxValues *int) {
+	fs.IntVar(maxValues, "upstream.conditional-values", 0, "decoded values kept for upstream responses with an ETag or Last-Modified, so that later fetches are conditional and a 304 reuses them, 0 disables conditional fetches")
+}
+
+func (s *validatorStore) setMaxValues(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxValues = n
+	for s.values > n && len(s.entries) > 0 {
+		s.evict()
+	}
+}
+
+// Key the response to req is stored under, empty when it can't be made conditional: only
+// plain GETs that don't depend on the client are
+func (s *validatorStore) key(req *http.Request, lenient bool) string {
+	s.mu.Lock()
+	enabled := s.maxValues > 0
+	s.mu.Unlock()
+	if !enabled || req.Method != http.MethodGet || upstream.forwardClient {
+		return ""
+	}
+	key := req.URL.String()
+	if lenient {
+		key += "\x00lenient"
+	}
+	return key
+}
+
+// Adds the validators stored for key to req and returns the entry a 304 refers to
+func (s *validatorStore) prepare(key string, req *http.Request) *validated {
+	if key == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	v.used = s.now()
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+	return v
+}
+
+// Validators of a response, nil when it has none
+func validatorsOf(h http.Header) *validated {
+	etag, lastModified := h.Get("ETag"), h.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	return &validated{etag: etag, lastModified: lastModified}
+}
+
+// Stores the decoded values of a response with validators v. Responses larger than the whole
+// store are not kept.
+func (s *validatorStore) put(key string, v *validated, res result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(res.Numbers) > s.maxValues {
+		s.remove(key)
+		return
+	}
+	s.remove(key)
+	for s.values+len(res.Numbers) > s.maxValues && len(s.entries) > 0 {
+		s.evict()
+	}
+	v.numbers = append(make([]int, 0, len(res.Numbers)), res.Numbers...)
+	v.skipped, v.coerced, v.used = res.skipped, res.coerced, s.now()
+	s.entries[key] = v
+	s.values += len(v.numbers)
+}
+
+func (s *validatorStore) remove(key string) {
+	if v, ok := s.entries[key]; ok {
+		s.values -= len(v.numbers)
+		delete(s.entries, key)
+	}
+}
+
+// Drops the least recently used entry
+func (s *validatorStore) evict() {
+	var oldest string
+	var oldestAt time.Time
+	for key, v := range s.entries {
+		if oldest == "" || v.used.Before(oldestAt) {
+			oldest, oldestAt = key, v.used
+		}
+	}
+	s.remove(oldest)
+}
+
+// Copy of the values a 304 confirmed
+func (v *validated) result() result {
+	return result{Numbers: append([]int(nil), v.numbers...), skipped: v.skipped, coerced: v.coerced}
+}
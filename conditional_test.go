@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConditionalFetch(t *testing.T) {
+	defer func(s *validatorStore) { validators = s }(validators)
+	var bodies int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt64(&bodies, 1)
+		w.Write([]byte(`{"numbers":[3,1,2]}`))
+	}))
+	defer ts.Close()
+	o, _ := parseOptions(nil)
+	tests := []struct {
+		name      string
+		maxValues int
+		bodies    int64
+		hits      int64
+	}{
+		{name: "disabled", bodies: 2},
+		{name: "not modified", maxValues: 10, bodies: 1, hits: 1},
+		{name: "too large to keep", maxValues: 2, bodies: 2},
+	}
+	for _, tt := range tests {
+		validators = newValidatorStore(tt.maxValues)
+		atomic.StoreInt64(&bodies, 0)
+		before := counter(upstreamMetrics.Get("conditional_hits"))
+		for i := 0; i < 2; i++ {
+			sum := run(context.Background(), []string{ts.URL}, o)
+			if sum.ok != 1 || len(sum.numbers) != 3 || sum.numbers[0] != 1 {
+				t.Errorf("%s: expected the sorted values; got %+v", tt.name, sum)
+			}
+		}
+		if got := atomic.LoadInt64(&bodies); got != tt.bodies {
+			t.Errorf("%s: expected %d bodies; got %d", tt.name, tt.bodies, got)
+		}
+		if got := counter(upstreamMetrics.Get("conditional_hits")) - before; got != tt.hits {
+			t.Errorf("%s: expected %d hits; got %d", tt.name, tt.hits, got)
+		}
+	}
+}
+
+func TestValidatorStoreEviction(t *testing.T) {
+	s := newValidatorStore(5)
+	now := time.Unix(0, 0)
+	s.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	s.put("a", &validated{etag: "a"}, result{Numbers: []int{1, 2}})
+	s.put("b", &validated{etag: "b"}, result{Numbers: []int{1, 2}})
+	// a was used last, so b goes
+	s.prepare("a", httptest.NewRequest(http.MethodGet, "/", nil))
+	s.put("c", &validated{etag: "c"}, result{Numbers: []int{1, 2}})
+	if _, ok := s.entries["b"]; ok || len(s.entries) != 2 || s.values != 4 {
+		t.Errorf("expected b to be evicted; got %v with %d values", s.entries, s.values)
+	}
+	s.setMaxValues(2)
+	if len(s.entries) != 1 || s.values != 2 {
+		t.Errorf("expected one entry left; got %v with %d values", s.entries, s.values)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+)
+
+// Values of decoded bodies a request keeps for sources returning the same bytes, about 8MB
+const contentKeepValues = 1 << 20
+
+// Bodies decoded by a request by the hash of their bytes, so that mirrored sources returning
+// byte-identical content are decoded once and the values attributed to each of them
+type contentSet struct {
+	mu     sync.Mutex
+	bodies map[[sha256.Size]byte]*decodedBody
+	// Values kept for later duplicates
+	kept int
+}
+
+type decodedBody struct {
+	done chan struct{}
+	// Set before done is closed, numbers is nil when the decode failed or wasn't kept
+	numbers          []int
+	skipped, coerced int
+}
+
+type contentSetKeyType struct{}
+
+func withContentSet(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contentSetKeyType{}, &contentSet{bodies: make(map[[sha256.Size]byte]*decodedBody)})
+}
+
+func contentSetFrom(ctx context.Context) *contentSet {
+	s, _ := ctx.Value(contentSetKeyType{}).(*contentSet)
+	return s
+}
+
+// Decodes data with decode, unless the request decoded the same bytes before. Then the values
+// are copied and shared is true.
+func (s *contentSet) decode(data []byte, lenient bool, decode func() (result, error)) (res result, shared bool, err error) {
+	key := sha256.Sum256(data)
+	if lenient {
+		// The same bytes decode differently, although all sources of a request share the mode
+		key[0] ^= 1
+	}
+	s.mu.Lock()
+	d, ok := s.bodies[key]
+	if !ok {
+		d = &decodedBody{done: make(chan struct{})}
+		s.bodies[key] = d
+	}
+	s.mu.Unlock()
+	if ok {
+		<-d.done
+		if d.numbers != nil {
+			upstreamMetrics.Add("content_duplicates", 1)
+			return result{Numbers: append([]int(nil), d.numbers...), skipped: d.skipped, coerced: d.coerced}, true, nil
+		}
+		// The first decode failed or its values weren't kept
+		res, err = decode()
+		return res, false, err
+	}
+	defer close(d.done)
+	res, err = decode()
+	if err != nil {
+		return res, false, err
+	}
+	s.mu.Lock()
+	keep := s.kept+len(res.Numbers) <= contentKeepValues
+	if keep {
+		s.kept += len(res.Numbers)
+	}
+	s.mu.Unlock()
+	if keep {
+		// The caller filters its values in place
+		d.numbers = append(make([]int, 0, len(res.Numbers)), res.Numbers...)
+		d.skipped, d.coerced = res.skipped, res.coerced
+	}
+	return res, false, nil
+}
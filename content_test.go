@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContentSetDecode(t *testing.T) {
+	s := withContentSet(context.Background())
+	set := contentSetFrom(s)
+	decodes := 0
+	ok := func() (result, error) {
+		decodes++
+		return result{Numbers: []int{1, 2}, coerced: 1}, nil
+	}
+	bad := func() (result, error) {
+		decodes++
+		return result{}, errors.New("bad body")
+	}
+	steps := []struct {
+		body    string
+		lenient bool
+		decode  func() (result, error)
+		shared  bool
+		decodes int
+	}{
+		{body: "a", decode: ok, decodes: 1},
+		{body: "a", decode: ok, shared: true, decodes: 1},
+		{body: "a", lenient: true, decode: ok, decodes: 2},
+		{body: "b", decode: bad, decodes: 3},
+		// The failed decode isn't shared
+		{body: "b", decode: bad, decodes: 4},
+	}
+	for i, st := range steps {
+		res, shared, err := set.decode([]byte(st.body), st.lenient, st.decode)
+		if shared != st.shared || decodes != st.decodes {
+			t.Errorf("step %d: expected shared %v after %d decodes; got %v after %d", i, st.shared, st.decodes, shared, decodes)
+		}
+		if err == nil && (len(res.Numbers) != 2 || res.coerced != 1) {
+			t.Errorf("step %d: expected the values and counts; got %+v", i, res)
+		}
+	}
+}
+
+func TestContentDuplicates(t *testing.T) {
+	mirror := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+	}
+	a, b, c := mirror(`{"numbers":[3,1,2]}`), mirror(`{"numbers":[3,1,2]}`), mirror(`{"numbers":[4]}`)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	before := counter(upstreamMetrics.Get("content_duplicates"))
+	o, _ := parseOptions(nil)
+	o.dedup = dedupNone
+	tr := newTracer(time.Now())
+	sum := run(withTracer(context.Background(), tr), []string{a.URL, b.URL, c.URL}, o)
+	if sum.ok != 3 || len(sum.numbers) != 7 {
+		t.Fatalf("expected the mirrored values attributed to both sources; got %+v", sum)
+	}
+	if got := counter(upstreamMetrics.Get("content_duplicates")) - before; got != 1 {
+		t.Errorf("expected 1 duplicate; got %d", got)
+	}
+	shared := 0
+	for _, e := range tr.timeline() {
+		if e.Event == "decode_shared" {
+			shared++
+		}
+	}
+	if shared != 1 {
+		t.Errorf("expected one decode_shared event; got %v", tr.timeline())
+	}
+}
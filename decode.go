@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bodies buffered for the fast path are recycled, except unusually large ones
+const maxPooledBody = 16 << 20
+
+var bodyPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Decodes an upstream body in the usual {"numbers":[...]} shape by scanning the integers
+// straight out of the buffered bytes. Anything the scanner doesn't expect - other keys, nulls,
+// fractions, overflowing values - is handed to decodeNumbers.
+func decodeStrict(r io.Reader) (result, error) {
+	buf := bodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBody {
+			bodyPool.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return result{}, err
+	}
+	if nums, ok := scanNumbers(buf.Bytes()); ok {
+		return result{Numbers: nums}, nil
+	}
+	upstreamMetrics.Add("decode_fallbacks", 1)
+	return decodeNumbers(bytes.NewReader(buf.Bytes()))
+}
+
+// Decodes the numbers with encoding/json, keeping them as json.Number so that nothing is
+// truncated: integral values like 3.0 or 1e3 are coerced, nulls, fractions and values beyond
+// int64 are skipped, both counted. Other elements like strings still fail the source.
+func decodeNumbers(r io.Reader) (result, error) {
+	var raw struct {
+		Numbers []interface{} `json:"numbers"`
+		bodyChecks
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return result{}, err
+	}
+	if err := raw.verify(raw.Numbers); err != nil {
+		return result{}, err
+	}
+	if raw.Numbers == nil {
+		return result{}, nil
+	}
+	res := result{Numbers: make([]int, 0, len(raw.Numbers))}
+	for i, v := range raw.Numbers {
+		if v == nil {
+			res.skip("null")
+			continue
+		}
+		num, ok := v.(json.Number)
+		if !ok {
+			// Worded like encoding/json, which used to decode these bodies
+			return result{}, fmt.Errorf("json: cannot unmarshal %s into result.numbers.%d of type int", jsonKind(v), i)
+		}
+		n, coerced, reason := numberInt(num.String())
+		if reason != "" {
+			res.skip(reason)
+			continue
+		}
+		if coerced {
+			res.coerce()
+		}
+		res.Numbers = append(res.Numbers, n)
+	}
+	return res, nil
+}
+
+// Integrity fields a source behind an unreliable proxy may send next to its numbers: how many
+// there are, and the CRC-32 (IEEE) of the list written without whitespace, e.g. of [1,2,3], as
+// a number or in hex
+type bodyChecks struct {
+	Count *int64      `json:"count"`
+	CRC32 interface{} `json:"crc32"`
+}
+
+// A body whose numbers don't add up to its count or checksum, truncated or corrupted on the way
+type checksumError struct {
+	msg string
+}
+
+func (e *checksumError) Error() string {
+	return e.msg
+}
+
+// Checks the numbers of a body, as decoded before any conversion, against its integrity fields
+func (c bodyChecks) verify(values []interface{}) error {
+	if c.Count == nil && c.CRC32 == nil {
+		return nil
+	}
+	upstreamMetrics.Add("checksums_verified", 1)
+	if c.Count != nil && *c.Count != int64(len(values)) {
+		return &checksumError{fmt.Sprintf("count is %d but the body has %d numbers", *c.Count, len(values))}
+	}
+	if c.CRC32 == nil {
+		return nil
+	}
+	want, err := parseCRC32(c.CRC32)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		values = []interface{}{}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(values); err != nil {
+		return err
+	}
+	if got := crc32.ChecksumIEEE(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); got != want {
+		return &checksumError{fmt.Sprintf("crc32 is %08x but the numbers hash to %08x", want, got)}
+	}
+	return nil
+}
+
+func parseCRC32(v interface{}) (uint32, error) {
+	var n uint64
+	var err error
+	switch t := v.(type) {
+	case json.Number:
+		n, err = strconv.ParseUint(t.String(), 10, 32)
+	case string:
+		n, err = strconv.ParseUint(strings.TrimPrefix(t, "0x"), 16, 32)
+	default:
+		err = fmt.Errorf("not a number or hex string")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid crc32 %v - %v", v, err)
+	}
+	return uint32(n), nil
+}
+
+// Why values are skipped
+const (
+	skipOverflow = "overflow"
+	skipFraction = "fraction"
+)
+
+// Parses a JSON number into an int. coerced is set for integral values that weren't written
+// as integers, reason says why a value doesn't fit.
+func numberInt(s string) (n int, coerced bool, reason string) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return int(i), false, ""
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, false, skipOverflow
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	switch {
+	case err != nil && !errors.Is(err, strconv.ErrRange):
+		return 0, false, "invalid"
+	case err != nil || f >= -math.MinInt64 || f < math.MinInt64:
+		// -MinInt64 is 2^63, MaxInt64 itself isn't representable as a float
+		return 0, false, skipOverflow
+	case f != math.Trunc(f):
+		return 0, false, skipFraction
+	}
+	return int(f), true, ""
+}
+
+func (r *result) skip(reason string) {
+	r.skipped++
+	upstreamMetrics.Add("values_skipped "+reason, 1)
+}
+
+func (r *result) coerce() {
+	r.coerced++
+	upstreamMetrics.Add("values_coerced", 1)
+}
+
+// Name of the JSON type of a decoded value
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "number"
+}
+
+// Parses {"numbers":[int,...]} and reports false for anything else
+func scanNumbers(data []byte) ([]int, bool) {
+	s := scanner{data: data}
+	if !s.expect('{') || !s.literal(`"numbers"`) || !s.expect(':') || !s.expect('[') {
+		return nil, false
+	}
+	nums := make([]int, 0, bytes.Count(data, []byte{','})+1)
+	if s.expect(']') {
+		return nums, s.expect('}')
+	}
+	for {
+		s.space()
+		n, ok := s.integer()
+		if !ok {
+			return nil, false
+		}
+		nums = append(nums, n)
+		if s.expect(']') {
+			break
+		}
+		if !s.expect(',') {
+			return nil, false
+		}
+	}
+	// Like json.Decoder, whatever follows the object is left alone
+	return nums, s.expect('}')
+}
+
+type scanner struct {
+	data []byte
+	i    int
+}
+
+func (s *scanner) space() {
+	for s.i < len(s.data) {
+		switch s.data[s.i] {
+		case ' ', '\t', '\n', '\r':
+			s.i++
+		default:
+			return
+		}
+	}
+}
+
+// Skips whitespace and consumes c if it comes next
+func (s *scanner) expect(c byte) bool {
+	s.space()
+	if s.i < len(s.data) && s.data[s.i] == c {
+		s.i++
+		return true
+	}
+	return false
+}
+
+func (s *scanner) literal(lit string) bool {
+	s.space()
+	if !bytes.HasPrefix(s.data[s.i:], []byte(lit)) {
+		return false
+	}
+	s.i += len(lit)
+	return true
+}
+
+// Parses a JSON integer that fits an int
+func (s *scanner) integer() (int, bool) {
+	neg := false
+	if s.i < len(s.data) && s.data[s.i] == '-' {
+		neg = true
+		s.i++
+	}
+	start := s.i
+	var u uint64
+	for ; s.i < len(s.data) && s.data[s.i] >= '0' && s.data[s.i] <= '9'; s.i++ {
+		d := uint64(s.data[s.i] - '0')
+		if u > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		u = u*10 + d
+	}
+	digits := s.i - start
+	if digits == 0 || (digits > 1 && s.data[start] == '0') {
+		return 0, false
+	}
+	// Fractions and exponents are left to encoding/json, which rejects them for ints
+	if s.i < len(s.data) && (s.data[s.i] == '.' || s.data[s.i] == 'e' || s.data[s.i] == 'E') {
+		return 0, false
+	}
+	limit := uint64(math.MaxInt)
+	if neg {
+		limit++
+	}
+	if u > limit {
+		return 0, false
+	}
+	n := int(u)
+	if neg {
+		n = -n
+	}
+	return n, true
+}
+
+// Decodes an upstream body without failing on the first bad element. Numeric strings and
+// integral floats are coerced, everything else (null, fractions, objects...) is skipped, both counted.
+func decodeLenient(r io.Reader) (result, error) {
+	var raw struct {
+		Numbers []interface{} `json:"numbers"`
+		bodyChecks
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return result{}, err
+	}
+	if err := raw.verify(raw.Numbers); err != nil {
+		return result{}, err
+	}
+	res := result{Numbers: make([]int, 0, len(raw.Numbers))}
+	for _, v := range raw.Numbers {
+		var s string
+		switch t := v.(type) {
+		case json.Number:
+			s = t.String()
+		case string:
+			s = strings.TrimSpace(t)
+		case nil:
+			res.skip("null")
+			continue
+		default:
+			res.skip(jsonKind(v))
+			continue
+		}
+		n, coerced, reason := numberInt(s)
+		if reason != "" {
+			res.skip(reason)
+			continue
+		}
+		if _, ok := v.(string); ok || coerced {
+			res.coerce()
+		}
+		res.Numbers = append(res.Numbers, n)
+	}
+	return res, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDecodeLenient(t *testing.T) {
+	tt := []struct {
+		name     string
+		body     string
+		expected []int
+		skipped  int
+		coerced  int
+	}{
+		{name: "Clean", body: `{"numbers":[1,2,3]}`, expected: []int{1, 2, 3}},
+		{name: "Mixed", body: `{"numbers":[1,"2",null,3.0]}`, expected: []int{1, 2, 3}, skipped: 1, coerced: 2},
+		{name: "Garbage", body: `{"numbers":[1.5,"x",{},[],true,4]}`, expected: []int{4}, skipped: 5},
+		{name: "Empty", body: `{}`, expected: []int{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := decodeLenient(strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !res.equals(result{Numbers: tc.expected}) || res.skipped != tc.skipped || res.coerced != tc.coerced {
+				t.Errorf("expected %v (%d skipped, %d coerced) but got %v (%d skipped, %d coerced)", tc.expected, tc.skipped, tc.coerced, res.Numbers, res.skipped, res.coerced)
+			}
+		})
+	}
+}
+
+func TestBodyChecks(t *testing.T) {
+	crc := crc32.ChecksumIEEE([]byte(`[1,2,3]`))
+	tt := []struct {
+		name     string
+		body     string
+		lenient  bool
+		checksum bool
+		err      bool
+	}{
+		{name: "None", body: `{"numbers":[1,2,3]}`},
+		{name: "Count", body: `{"numbers":[1,2,3],"count":3}`},
+		{name: "Short", body: `{"numbers":[1,2],"count":3}`, checksum: true},
+		{name: "CRC", body: fmt.Sprintf(`{"crc32":%d,"numbers":[1, 2, 3]}`, crc)},
+		{name: "HexCRC", body: fmt.Sprintf(`{"numbers":[1,2,3],"count":3,"crc32":"%08x"}`, crc)},
+		{name: "Corrupted", body: fmt.Sprintf(`{"numbers":[1,2,4],"count":3,"crc32":%d}`, crc), checksum: true},
+		{name: "EmptyList", body: fmt.Sprintf(`{"numbers":[],"count":0,"crc32":%d}`, crc32.ChecksumIEEE([]byte(`[]`)))},
+		{name: "AsSent", body: fmt.Sprintf(`{"numbers":[1,"2",null],"crc32":%d}`, crc32.ChecksumIEEE([]byte(`[1,"2",null]`))), lenient: true},
+		{name: "InvalidCRC", body: `{"numbers":[1],"crc32":"xyz"}`, err: true},
+		{name: "InvalidCount", body: `{"numbers":[1],"count":"1"}`, err: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			decode := decodeStrict
+			if tc.lenient {
+				decode = decodeLenient
+			}
+			_, err := decode(strings.NewReader(tc.body))
+			var ce *checksumError
+			if (err != nil) != (tc.err || tc.checksum) || errors.As(err, &ce) != tc.checksum {
+				t.Errorf("expected error %v, checksum error %v; got %v", tc.err || tc.checksum, tc.checksum, err)
+			}
+		})
+	}
+}
+
+func TestDecodeStrictMatchesJSON(t *testing.T) {
+	tt := []struct {
+		name string
+		body string
+		fast bool
+	}{
+		{name: "Clean", body: `{"numbers":[1,2,3]}`, fast: true},
+		{name: "Spaces", body: " {\n \"numbers\" : [ 1 ,\t-2 , 0 ]\r\n} ", fast: true},
+		{name: "EmptyList", body: `{"numbers":[]}`, fast: true},
+		{name: "Extremes", body: `{"numbers":[9223372036854775807,-9223372036854775808]}`, fast: true},
+		{name: "TrailingData", body: `{"numbers":[1]} garbage`, fast: true},
+		{name: "LeadingZero", body: `{"numbers":[01]}`},
+		{name: "Null", body: `{"numbers":null}`},
+		{name: "OtherKey", body: `{"count":2,"numbers":[1,2]}`},
+		{name: "CaseInsensitiveKey", body: `{"Numbers":[1,2]}`},
+		{name: "NoNumbers", body: `{}`},
+		{name: "TrailingComma", body: `{"numbers":[1,]}`},
+		{name: "Truncated", body: `{"numbers":[1,2`},
+		{name: "NotAnObject", body: `[1,2]`},
+		{name: "Empty", body: ``},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, fast := scanNumbers([]byte(tc.body))
+			if fast != tc.fast {
+				t.Errorf("expected fast path %v; got %v", tc.fast, fast)
+			}
+			var want result
+			wantErr := json.NewDecoder(strings.NewReader(tc.body)).Decode(&want)
+			got, err := decodeStrict(strings.NewReader(tc.body))
+			if (err != nil) != (wantErr != nil) {
+				t.Fatalf("expected error %v; got %v", wantErr, err)
+			}
+			if !reflect.DeepEqual(got.Numbers, want.Numbers) {
+				t.Errorf("expected %#v; got %#v", want.Numbers, got.Numbers)
+			}
+		})
+	}
+}
+
+func numbersBody(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"numbers":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Itoa(i * 7919))
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+func BenchmarkDecode(b *testing.B) {
+	body := numbersBody(100000)
+	b.Run("json", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			var res result
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&res); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeStrict(bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDecodeStrictNumbers(t *testing.T) {
+	tt := []struct {
+		name             string
+		body             string
+		expected         []int
+		skipped, coerced int
+		fails            bool
+	}{
+		{name: "Overflow", body: `{"numbers":[9223372036854775808,-9223372036854775809,1]}`, expected: []int{1}, skipped: 2},
+		{name: "FloatOverflow", body: `{"numbers":[9.3e18,1e400]}`, expected: []int{}, skipped: 2},
+		{name: "Fraction", body: `{"numbers":[1.5,2]}`, expected: []int{2}, skipped: 1},
+		{name: "Integral", body: `{"numbers":[1e3,3.0,-2E1]}`, expected: []int{1000, 3, -20}, coerced: 3},
+		{name: "NullElement", body: `{"numbers":[1,null]}`, expected: []int{1}, skipped: 1},
+		{name: "StringElement", body: `{"numbers":[1,"2"]}`, fails: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := decodeStrict(strings.NewReader(tc.body))
+			if (err != nil) != tc.fails {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.fails && !res.equals(result{Numbers: tc.expected}) || res.skipped != tc.skipped || res.coerced != tc.coerced {
+				t.Errorf("expected %v (%d skipped, %d coerced) but got %v (%d skipped, %d coerced)", tc.expected, tc.skipped, tc.coerced, res.Numbers, res.skipped, res.coerced)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Body of a successful upstream response, waiting to be decoded. It holds a merge gate credit
+// and the fetch's timeout, both given back by decode.
+type pendingBody struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	url     string
+	lenient bool
+	// Values are taken from the elements of an XML body instead
+	xml *docPath
+	// Format of a body that isn't JSON, see registerCodec, and the path of its values
+	codec *codec
+	path  *docPath
+	// Content-Type of the response and the charset the source is configured with, see newCharsetReader
+	contentType string
+	charset     string
+	body        *countingReader
+	closer      io.Closer
+	gate        mergeGate
+	stage       *int32
+	// Records the fetch in the host stats
+	finish func(ok, blame bool, end time.Time)
+	// Values an upstream confirmed with a 304, or the validators to store the values under
+	cached     *validated
+	condKey    string
+	validators *validated
+
+	// Set by readAll: the whole body, or the error reading it, and when it was read
+	buf    *bytes.Buffer
+	err    error
+	readAt time.Time
+}
+
+// Reads the whole body, so that the network worker can start the next fetch while a decoder
+// parses it. decode streams the body when it wasn't read before.
+func (b *pendingBody) readAll() {
+	buf := bodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	_, err := buf.ReadFrom(b.body)
+	b.closer.Close()
+	b.buf, b.readAt = buf, time.Now()
+	if err != nil {
+		b.err = b.failed(err)
+	}
+}
+
+// A body that couldn't be read or decoded. A body cut short by the deadline isn't the source's fault.
+func (b *pendingBody) failed(err error) error {
+	if b.ctx.Err() != nil {
+		return newFetchError(codeUpstreamTimeout, b.url, "decoding error - %v", err).at(stageBody)
+	}
+	return bodyError(b.url, err)
+}
+
+// A body the source sent in full that isn't a result, or whose numbers fail its checksum
+func bodyError(url string, err error) *fetchError {
+	var ce *checksumError
+	if errors.As(err, &ce) {
+		return newFetchError(codeChecksum, url, "checksum error - %v", err).at(stageBody)
+	}
+	return newFetchError(codeDecode, url, "decoding error - %v", err).at(stageBody)
+}
+
+func (b *pendingBody) decode() (result, error) {
+	defer b.cancel()
+	defer b.closer.Close()
+	set := contentSetFrom(b.ctx)
+	if b.cached != nil || b.xml != nil || b.codec != nil || b.charset != "" {
+		// The same XML decodes differently under another path or charset, binary formats are rare enough
+		set = nil
+	}
+	if set != nil && b.buf == nil && b.err == nil {
+		// The whole body is needed to hash it
+		b.readAll()
+	}
+	var r io.Reader = b.body
+	if b.buf != nil {
+		r = bytes.NewReader(b.buf.Bytes())
+		defer func() {
+			if b.buf.Cap() <= maxPooledBody {
+				bodyPool.Put(b.buf)
+			}
+		}()
+	}
+	end := b.readAt
+	var number result
+	var charset bodyCharset
+	err := b.err
+	if err == nil && b.cached == nil && (b.codec == nil || !b.codec.binary) {
+		if r, charset, err = newCharsetReader(r, b.contentType, b.charset); err != nil {
+			err = newFetchError(codeDecode, b.url, "decoding error - %v", err).at(stageBody)
+			noteDecode(b.url, charset, err)
+		}
+	}
+	if err == nil {
+		decode := func() (result, error) {
+			if b.xml != nil {
+				return decodeXML(r, b.xml, b.lenient, charset.name != "")
+			}
+			if b.codec != nil {
+				return b.codec.decode(r, b.lenient, b.path)
+			}
+			if b.lenient {
+				return decodeLenient(r)
+			}
+			return decodeStrict(r)
+		}
+		var shared bool
+		if b.cached != nil {
+			number = b.cached.result()
+		} else if set != nil {
+			number, shared, err = set.decode(b.buf.Bytes(), b.lenient, decode)
+		} else {
+			number, err = decode()
+		}
+		if shared {
+			tracerFrom(b.ctx).mark("decode_shared", b.url)
+		}
+		if err == nil {
+			noteDecode(b.url, charset, nil)
+		}
+		if err != nil {
+			noteDecode(b.url, charset, err)
+			if charset.name != "" {
+				err = fmt.Errorf("%w (%s)", err, charset)
+			}
+			if b.buf != nil {
+				// Read in full, so the source sent something that isn't a result
+				err = bodyError(b.url, err)
+			} else {
+				err = b.failed(err)
+			}
+		}
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if err != nil {
+		b.gate.release()
+		b.finish(false, true, end)
+		return number, err
+	}
+	tracerFrom(b.ctx).mark("decode_done", b.url)
+	if b.validators != nil {
+		validators.put(b.condKey, b.validators, number)
+	}
+	number.Numbers = groups.transform(b.url).apply(number.Numbers)
+	if number.skipped > 0 {
+		log.Printf("%s%s skipped %d malformed elements", logPrefix(b.ctx), redact(b.url), number.skipped)
+	}
+	if number.coerced > 0 {
+		log.Printf("%s%s coerced %d values to integers", logPrefix(b.ctx), redact(b.url), number.coerced)
+	}
+	setStage(b.stage, stageDone)
+	b.finish(true, true, end)
+	return number, nil
+}
+
+// Decoders that parse the bodies the network workers read, so that decoding million-number
+// bodies is bounded by the CPUs and doesn't keep the workers from starting new fetches.
+type decoderPool struct {
+	mu sync.RWMutex
+	// A token per decoder, nil decodes on the network workers
+	slots chan struct{}
+	// Bodies being decoded and the time bodies waited for a decoder
+	busy int64
+	wait *latencyHistogram
+}
+
+var decoders = newDecoderPool(runtime.GOMAXPROCS(0))
+
+func newDecoderPool(n int) *decoderPool {
+	d := &decoderPool{wait: newLatencyHistogram()}
+	d.resize(n)
+	return d
+}
+
+func registerDecoderFlags(fs *flag.FlagSet, n *int) {
+	fs.IntVar(n, "decode.workers", -1, "bodies decoded at once, apart from the fetch workers, -1 is one per CPU and 0 decodes on the fetch workers")
+}
+
+// Sets the number of decoders, n < 0 uses one per CPU
+func (d *decoderPool) resize(n int) {
+	if n < 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	var slots chan struct{}
+	if n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.slots = slots
+}
+
+func (d *decoderPool) size() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return cap(d.slots)
+}
+
+func (d *decoderPool) current() chan struct{} {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.slots
+}
+
+// Reads b and decodes it once a decoder is free, then calls deliver with the outcome. Reports
+// false without touching b when decoding happens on the network workers.
+func (d *decoderPool) submit(b *pendingBody, deliver func(result, error)) bool {
+	slots := d.current()
+	if slots == nil {
+		return false
+	}
+	b.readAll()
+	queued := time.Now()
+	go func() {
+		slots <- struct{}{}
+		d.wait.observe(time.Since(queued))
+		atomic.AddInt64(&d.busy, 1)
+		res, err := b.decode()
+		atomic.AddInt64(&d.busy, -1)
+		<-slots
+		deliver(res, err)
+	}()
+	return true
+}
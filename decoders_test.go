@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecoderPool(t *testing.T) {
+	defer decoders.resize(decoders.size())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.Write([]byte(`{"numbers":[1,`))
+			return
+		}
+		w.Write([]byte(`{"numbers":[3,1,2]}`))
+	}))
+	defer ts.Close()
+	o, _ := parseOptions(nil)
+	tests := []struct {
+		path string
+		want []int
+		code errorCode
+	}{
+		{path: "/", want: []int{3, 1, 2}},
+		{path: "/bad", code: codeDecode},
+	}
+	for _, tt := range tests {
+		decoders.resize(1)
+		// Hold the only decoder
+		slots := decoders.current()
+		slots <- struct{}{}
+		b, err := fetchBody(context.Background(), currentTransport(), o, ts.URL+tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type outcome struct {
+			res result
+			err error
+		}
+		delivered := make(chan outcome, 1)
+		// The network worker hands the body over without waiting for a decoder
+		if !decoders.submit(b, func(res result, err error) { delivered <- outcome{res, err} }) {
+			t.Fatal("expected the body to be handed to the decoders")
+		}
+		select {
+		case <-delivered:
+			t.Fatalf("%s: expected decoding to wait for a free decoder", tt.path)
+		case <-time.After(20 * time.Millisecond):
+		}
+		<-slots
+		got := <-delivered
+		code := errorCode("")
+		if got.err != nil {
+			code = errorCodeOf(got.err)
+		}
+		if !reflect.DeepEqual(got.res.Numbers, tt.want) || code != tt.code {
+			t.Errorf("%s: expected %v and code %q; got %v, %v", tt.path, tt.want, tt.code, got.res.Numbers, got.err)
+		}
+	}
+	decoders.resize(0)
+	b, err := fetchBody(context.Background(), currentTransport(), o, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoders.submit(b, func(result, error) {}) {
+		t.Error("expected no decoders")
+	}
+	if res, err := b.decode(); err != nil || len(res.Numbers) != 3 {
+		t.Errorf("expected the body to be decoded in place; got %v, %v", res.Numbers, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Address families upstream dials may use, in -transport.ip-family
+const (
+	// Whatever the resolver returns first, with Happy Eyeballs falling back to the other family
+	familyAny = "any"
+	// Only this family, hosts without such an address fail to dial
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	// This family first, the other one once it failed or after the fallback delay
+	familyPreferIPv4 = "prefer-ipv4"
+	familyPreferIPv6 = "prefer-ipv6"
+)
+
+// Flag taking one of the address families
+type ipFamilyFlag struct{ v *string }
+
+func (f ipFamilyFlag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	return *f.v
+}
+
+func (f ipFamilyFlag) Set(s string) error {
+	switch s {
+	case familyAny, familyIPv4, familyIPv6, familyPreferIPv4, familyPreferIPv6:
+		*f.v = s
+		return nil
+	}
+	return fmt.Errorf("invalid IP family %q, expected any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6", s)
+}
+
+// Network restricted to the IPv4 or IPv6 variant, v is "4" or "6"
+func familyNetwork(network, v string) string {
+	if network == "tcp" || network == "udp" {
+		return network + v
+	}
+	return network
+}
+
+// Whether ip belongs to the family preferred or required by family
+func inFamily(ip net.IP, family string) bool {
+	switch family {
+	case familyIPv4, familyPreferIPv4:
+		return ip.To4() != nil
+	case familyIPv6, familyPreferIPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// Dials upstreams in the address families of family. In the prefer modes the other family gets
+// dialed once the preferred one failed or, unless delay is negative, after delay, and the first
+// connection wins.
+func familyDialer(dial dialFunc, family string, delay time.Duration) dialFunc {
+	switch family {
+	case familyIPv4, familyIPv6:
+		v := family[len(family)-1:]
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, familyNetwork(network, v), addr)
+		}
+	case familyPreferIPv4:
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialPreferred(ctx, dial, network, addr, "4", "6", delay)
+		}
+	case familyPreferIPv6:
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialPreferred(ctx, dial, network, addr, "6", "4", delay)
+		}
+	}
+	return dial
+}
+
+func dialPreferred(ctx context.Context, dial dialFunc, network, addr, primary, fallback string, delay time.Duration) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(addr); err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, network, addr)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type attempt struct {
+		conn     net.Conn
+		err      error
+		fallback bool
+	}
+	results := make(chan attempt, 2)
+	start := func(v string, fallback bool) {
+		go func() {
+			c, err := dial(ctx, familyNetwork(network, v), addr)
+			results <- attempt{c, err, fallback}
+		}()
+	}
+	start(primary, false)
+	var timer <-chan time.Time
+	if delay >= 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+	pending, fellBack := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			if !fellBack {
+				fellBack, pending = true, pending+1
+				start(fallback, true)
+			}
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				if a.fallback {
+					upstreamMetrics.Add("dial_fallbacks", 1)
+				}
+				if pending > 0 {
+					// The loser is cancelled, close it in case it connected anyway
+					go func() {
+						if a := <-results; a.conn != nil {
+							a.conn.Close()
+						}
+					}()
+				}
+				return a.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			if !fellBack {
+				timer, fellBack, pending = nil, true, pending+1
+				start(fallback, true)
+				continue
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFamilyDialer(t *testing.T) {
+	// Dials tcp4 right away, tcp6 either fails, hangs until cancelled like a broken route, or
+	// connects
+	fake := func(v6 string) (dialFunc, *[]string) {
+		var mu sync.Mutex
+		var networks []string
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			networks = append(networks, network)
+			mu.Unlock()
+			if network == "tcp6" {
+				switch v6 {
+				case "fail":
+					return nil, errors.New("no route")
+				case "hang":
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		}, &networks
+	}
+	tests := []struct {
+		name, family, v6 string
+		delay            time.Duration
+		want             []string
+		fallbacks        int64
+	}{
+		{name: "any", family: familyAny, v6: "ok", want: []string{"tcp"}},
+		{name: "only ipv4", family: familyIPv4, v6: "ok", want: []string{"tcp4"}},
+		{name: "only ipv6 failing", family: familyIPv6, v6: "fail", want: []string{"tcp6"}},
+		{name: "prefer ipv6", family: familyPreferIPv6, v6: "ok", delay: time.Hour, want: []string{"tcp6"}},
+		{name: "prefer ipv6 failing", family: familyPreferIPv6, v6: "fail", delay: time.Hour, want: []string{"tcp6", "tcp4"}, fallbacks: 1},
+		{name: "prefer ipv6 hanging", family: familyPreferIPv6, v6: "hang", delay: 10 * time.Millisecond, want: []string{"tcp6", "tcp4"}, fallbacks: 1},
+		{name: "prefer ipv4", family: familyPreferIPv4, v6: "hang", delay: -1, want: []string{"tcp4"}},
+	}
+	for _, tt := range tests {
+		before := counter(upstreamMetrics.Get("dial_fallbacks"))
+		dial, networks := fake(tt.v6)
+		c, err := familyDialer(dial, tt.family, tt.delay)(context.Background(), "tcp", "example.com:443")
+		if (err != nil) != (tt.v6 == "fail" && tt.family == familyIPv6) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if c != nil {
+			c.Close()
+		}
+		if got := counter(upstreamMetrics.Get("dial_fallbacks")) - before; got != tt.fallbacks {
+			t.Errorf("%s: expected %d fallbacks; got %d", tt.name, tt.fallbacks, got)
+		}
+		if len(*networks) != len(tt.want) {
+			t.Errorf("%s: expected dials on %v; got %v", tt.name, tt.want, *networks)
+			continue
+		}
+		for i := range tt.want {
+			if (*networks)[i] != tt.want[i] {
+				t.Errorf("%s: expected dials on %v; got %v", tt.name, tt.want, *networks)
+			}
+		}
+	}
+}
+
+func TestIPFamilyFlag(t *testing.T) {
+	var v string
+	f := ipFamilyFlag{&v}
+	if err := f.Set(familyPreferIPv4); err != nil || v != familyPreferIPv4 {
+		t.Errorf("expected prefer-ipv4; got %q, %v", v, err)
+	}
+	if err := f.Set("ipv5"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content coding of responses compressed with a group's dictionary, Dictionary-Compressed
+// Zstandard of Compression Dictionary Transport (RFC 9842)
+const dictEncoding = "dcz"
+
+// Header of dcz responses, followed by the SHA-256 of the dictionary and the zstd frame
+var dczMagic = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+// Size of a dictionary, and of the start of a sample kept for training. Responses of a group
+// mostly share their start, and a small dictionary is fetched and trained quickly.
+const dictMaxBytes = 32 << 10
+
+// Training splits samples into segments and keeps those whose 8-byte substrings occur in the
+// most samples
+const (
+	dictSegment = 256
+	dictKmer    = 8
+)
+
+func registerDictFlags(fs *flag.FlagSet, samples *int, interval *time.Duration) {
+	fs.IntVar(samples, "dict.samples", 16, "recent responses per group that compression dictionaries are trained on, 0 disables dictionaries")
+	fs.DurationVar(interval, "dict.interval", 10*time.Minute, "how long a group's dictionary is served before it is trained again on newer responses")
+}
+
+// Dictionary trained on responses of a group
+type dictionary struct {
+	// SHA-256 of data as a structured field byte sequence, as clients send it in
+	// Available-Dictionary
+	id      string
+	hash    [sha256.Size]byte
+	data    []byte
+	trained time.Time
+}
+
+type groupDictionaries struct {
+	// Oldest first
+	samples [][]byte
+	// Samples taken since current was trained
+	fresh int
+	// The previous dictionary is still used for clients that haven't fetched the current one
+	current, previous *dictionary
+	training          bool
+}
+
+// Responses and dictionaries of the groups requested with a single ?g=name
+type dictionaryStore struct {
+	mu       sync.Mutex
+	samples  int
+	interval time.Duration
+	groups   map[string]*groupDictionaries
+	now      func() time.Time
+}
+
+var dictionaries = newDictionaryStore(16, 10*time.Minute)
+
+func newDictionaryStore(samples int, interval time.Duration) *dictionaryStore {
+	return &dictionaryStore{samples: samples, interval: interval, groups: make(map[string]*groupDictionaries), now: time.Now}
+}
+
+func (s *dictionaryStore) enabled() bool {
+	return s.samples > 0
+}
+
+// Keeps the start of body as a sample of group, replacing the oldest one
+func (s *dictionaryStore) observe(group string, body []byte) {
+	if !s.enabled() {
+		return
+	}
+	if len(body) > dictMaxBytes {
+		body = body[:dictMaxBytes]
+	}
+	sample := append([]byte(nil), body...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[group]
+	if !ok {
+		g = &groupDictionaries{}
+		s.groups[group] = g
+	}
+	g.samples = append(g.samples, sample)
+	if len(g.samples) > s.samples {
+		g.samples = g.samples[len(g.samples)-s.samples:]
+	}
+	g.fresh++
+}
+
+// Current dictionary of group, trained first when there is none yet or it is older than the
+// interval and newer samples were taken. False when no response of group was sampled.
+func (s *dictionaryStore) dictionary(group string) (*dictionary, bool) {
+	s.mu.Lock()
+	g, ok := s.groups[group]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	now := s.now()
+	stale := g.current == nil || (g.fresh > 0 && now.Sub(g.current.trained) >= s.interval)
+	if !stale || g.training {
+		d := g.current
+		s.mu.Unlock()
+		return d, d != nil
+	}
+	// Samples are never modified, the training works on a copy of the list
+	samples := append([][]byte(nil), g.samples...)
+	g.training = true
+	g.fresh = 0
+	s.mu.Unlock()
+
+	data := trainDictionary(samples)
+	sum := sha256.Sum256(data)
+	d := &dictionary{id: ":" + base64.StdEncoding.EncodeToString(sum[:]) + ":", hash: sum, data: data, trained: now}
+	httpMetrics.Add("dictionaries_trained", 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g.training = false
+	if g.current == nil || g.current.id != d.id {
+		g.previous, g.current = g.current, d
+	} else {
+		g.current.trained = now
+	}
+	return g.current, true
+}
+
+// Dictionary of group with the given id, the current or the previous one
+func (s *dictionaryStore) lookup(group, id string) *dictionary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[group]
+	if !ok {
+		return nil
+	}
+	for _, d := range []*dictionary{g.current, g.previous} {
+		if d != nil && d.id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// Picks the segments of samples sharing the most substrings with the other samples, greedily
+// and without counting a substring twice. The most useful segments go last, where matches
+// reach them at the shortest offsets, which take the fewest bits.
+func trainDictionary(samples [][]byte) []byte {
+	// Number of samples each substring occurs in
+	freq := make(map[uint64]int)
+	for _, s := range samples {
+		seen := make(map[uint64]struct{})
+		for i := 0; i+dictKmer <= len(s); i++ {
+			k := binary.LittleEndian.Uint64(s[i:])
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				freq[k]++
+			}
+		}
+	}
+	var segs segmentHeap
+	for _, s := range samples {
+		for i := 0; i < len(s); i += dictSegment {
+			end := i + dictSegment
+			if end > len(s) {
+				end = len(s)
+			}
+			seg := &dictSegmentScore{data: s[i:end]}
+			seg.rescore(freq)
+			segs = append(segs, seg)
+		}
+	}
+	heap.Init(&segs)
+	var picked [][]byte
+	size := 0
+	for segs.Len() > 0 && size < dictMaxBytes {
+		top := segs[0]
+		// Scores only drop as substrings are covered, a segment still scoring at least as
+		// much as the next best is the best
+		top.rescore(freq)
+		if segs.Len() > 1 && top.score < segs.next() {
+			heap.Fix(&segs, 0)
+			continue
+		}
+		heap.Pop(&segs)
+		if top.score == 0 {
+			break
+		}
+		picked = append(picked, top.data)
+		size += len(top.data)
+		for i := 0; i+dictKmer <= len(top.data); i++ {
+			delete(freq, binary.LittleEndian.Uint64(top.data[i:]))
+		}
+	}
+	var b bytes.Buffer
+	for i := len(picked) - 1; i >= 0; i-- {
+		b.Write(picked[i])
+	}
+	data := b.Bytes()
+	if len(data) > dictMaxBytes {
+		data = data[len(data)-dictMaxBytes:]
+	}
+	return data
+}
+
+type dictSegmentScore struct {
+	data  []byte
+	score int
+}
+
+// Sums the sample counts of the distinct substrings of the segment not covered yet
+func (s *dictSegmentScore) rescore(freq map[uint64]int) {
+	s.score = 0
+	seen := make(map[uint64]struct{})
+	for i := 0; i+dictKmer <= len(s.data); i++ {
+		k := binary.LittleEndian.Uint64(s.data[i:])
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			s.score += freq[k]
+		}
+	}
+}
+
+// Max-heap of segments by score
+type segmentHeap []*dictSegmentScore
+
+func (h segmentHeap) Len() int            { return len(h) }
+func (h segmentHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(*dictSegmentScore)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Best score below the top
+func (h segmentHeap) next() int {
+	best := h[1].score
+	if len(h) > 2 && h[2].score > best {
+		best = h[2].score
+	}
+	return best
+}
+
+// Group whose dictionary applies to a request: the only group of a request without u
+func dictGroup(q url.Values) string {
+	if len(q["g"]) != 1 || len(q["u"]) > 0 {
+		return ""
+	}
+	return q["g"][0]
+}
+
+// Whether accept, an Accept-Encoding header, allows coding
+func acceptsEncoding(accept, coding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), coding) {
+			continue
+		}
+		for _, p := range fields[1:] {
+			if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+				if q, err := strconv.ParseFloat(v[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Samples the JSON response e of group and, when the client holds one of the group's
+// dictionaries and accepts dictEncoding, serves it compressed unless that isn't shorter. Returns
+// false when the response is left to the caller.
+func serveWithDictionary(w http.ResponseWriter, r *http.Request, group string, e envelope) bool {
+	if !dictionaries.enabled() {
+		return false
+	}
+	w.Header().Add("Vary", "Accept-Encoding, Available-Dictionary")
+	body, err := jsonBody(e)
+	if err != nil {
+		return false
+	}
+	dictionaries.observe(group, body)
+	id := r.Header.Get("Available-Dictionary")
+	if id == "" || r.Header.Get("Range") != "" || !acceptsEncoding(r.Header.Get("Accept-Encoding"), dictEncoding) {
+		return false
+	}
+	d := dictionaries.lookup(group, id)
+	if d == nil {
+		httpMetrics.Add("dictionary_misses", 1)
+		return false
+	}
+	compressed := append(append(append([]byte(nil), dczMagic...), d.hash[:]...), zstdCompress(body, d.data)...)
+	// The header alone is 40 bytes, more than the shortest responses
+	if len(compressed) >= len(body) {
+		return false
+	}
+	httpMetrics.Add("dictionary_compressed", 1)
+	httpMetrics.Add("dictionary_bytes_saved", int64(len(body)-len(compressed)))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", dictEncoding)
+	w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+	w.Write(compressed)
+	return true
+}
+
+// The body writeTraced writes for v without a trace
+func jsonBody(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := writeTraced(&b, v, nil)
+	return b.Bytes(), err
+}
+
+// Serves the current dictionary of ?g=name, for clients to send its id back as
+// Available-Dictionary. Browsers keep one dictionary per match pattern, so the one of the
+// group fetched last is used for all groups and the others get plain responses.
+func dictHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("g")
+	if _, ok := groups.get(name); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - unknown group " + strconv.Quote(name)))
+		return
+	}
+	if !dictionaries.enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - dictionaries are disabled"))
+		return
+	}
+	d, ok := dictionaries.dictionary(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - no response of group " + name + " to train a dictionary on yet"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Dictionary-Id", d.id)
+	w.Header().Set("Use-As-Dictionary", "match="+strconv.Quote(endpoint+"*"))
+	w.Write(d.data)
+}
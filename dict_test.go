@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrainDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 8; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"numbers":[1000001,1000002,1000003,1000004,%d]}`, i)))
+	}
+	dict := trainDictionary(samples)
+	if len(dict) == 0 || len(dict) > dictMaxBytes {
+		t.Fatalf("expected a dictionary of at most %d bytes; got %d", dictMaxBytes, len(dict))
+	}
+	if !bytes.Contains(dict, []byte(`{"numbers":[1000001,1000002`)) {
+		t.Errorf("expected the shared content in the dictionary; got %q", dict)
+	}
+	body := []byte(`{"numbers":[1000001,1000002,1000003,1000004,9]}`)
+	if with, without := len(zstdCompress(body, dict)), len(zstdCompress(body, nil)); with >= without {
+		t.Errorf("expected the dictionary to compress better; got %d bytes with it and %d without", with, without)
+	}
+	if d := trainDictionary(nil); len(d) != 0 {
+		t.Errorf("expected an empty dictionary without samples; got %q", d)
+	}
+}
+
+func TestDictionaryRotation(t *testing.T) {
+	s := newDictionaryStore(2, time.Minute)
+	now := time.Unix(0, 0)
+	s.now = func() time.Time { return now }
+	if _, ok := s.dictionary("g"); ok {
+		t.Fatal("expected no dictionary without samples")
+	}
+	s.observe("g", []byte(`{"numbers":[1,2,3]}`))
+	first, ok := s.dictionary("g")
+	if !ok {
+		t.Fatal("expected a dictionary")
+	}
+	s.observe("g", []byte(`{"numbers":[4,5,6]}`))
+	s.observe("g", []byte(`{"numbers":[7,8,9]}`))
+	if d, _ := s.dictionary("g"); d != first {
+		t.Error("expected the dictionary to be kept within the interval")
+	}
+	now = now.Add(time.Minute)
+	second, _ := s.dictionary("g")
+	if second == first || bytes.Contains(second.data, []byte("1,2,3")) {
+		t.Errorf("expected a dictionary of the last 2 samples; got %q", second.data)
+	}
+	if s.lookup("g", first.id) != first || s.lookup("g", second.id) != second || s.lookup("h", first.id) != nil {
+		t.Error("expected the current and the previous dictionary to be found")
+	}
+	now = now.Add(time.Minute)
+	if d, _ := s.dictionary("g"); d != second {
+		t.Error("expected no training without new samples")
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", false},
+		{"gzip, br, zstd, dcb, dcz", true},
+		{"DCZ;q=0.5", true},
+		{"dcz;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.accept, dictEncoding); got != tt.want {
+			t.Errorf("%q: expected %v; got %v", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	defer func(d *dictionaryStore) { dictionaries = d }(dictionaries)
+	dictionaries = newDictionaryStore(4, time.Minute)
+	var numbers []int
+	for n := 1000001; n <= 1000020; n++ {
+		numbers = append(numbers, n)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler(numbers)))
+	defer ts.Close()
+	tiny := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer tiny.Close()
+	defer groups.set(groups.all())
+	groups.set(map[string]group{"g1": {URLs: []string{ts.URL}}, "tiny": {URLs: []string{tiny.URL}}})
+
+	rec := httptest.NewRecorder()
+	dictHandler(rec, httptest.NewRequest(http.MethodGet, "/dict?g=g1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected no dictionary before a response was sampled; got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	dictHandler(rec, httptest.NewRequest(http.MethodGet, "/dict?g=unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown group to be refused; got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?g=g1", nil))
+	plain := rec.Body.Bytes()
+	rec = httptest.NewRecorder()
+	dictHandler(rec, httptest.NewRequest(http.MethodGet, "/dict?g=g1", nil))
+	id := rec.Header().Get("X-Dictionary-Id")
+	if rec.Code != http.StatusOK || id == "" {
+		t.Fatalf("expected a dictionary; got %d", rec.Code)
+	}
+	if use := rec.Header().Get("Use-As-Dictionary"); use != `match="/numbers*"` {
+		t.Errorf("expected the dictionary to be offered for /numbers; got %q", use)
+	}
+	dict := rec.Body.Bytes()
+
+	tests := []struct {
+		name       string
+		dictionary string
+		accept     string
+		compressed bool
+	}{
+		{name: "held", dictionary: id, accept: "gzip, dcz", compressed: true},
+		{name: "not accepted", dictionary: id, accept: "gzip, dcb"},
+		{name: "unknown", dictionary: ":AAAA:", accept: "dcz"},
+		{name: "none", accept: "dcz"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, endpoint+"?g=g1", nil)
+		req.Header.Set("Available-Dictionary", tt.dictionary)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, req)
+		body := rec.Body.Bytes()
+		if compressed := rec.Header().Get("Content-Encoding") == dictEncoding; compressed != tt.compressed {
+			t.Errorf("%s: expected compressed %v; got %v", tt.name, tt.compressed, compressed)
+			continue
+		}
+		if tt.compressed {
+			if len(body) >= len(plain) {
+				t.Errorf("%s: expected fewer than %d bytes; got %d", tt.name, len(plain), len(body))
+			}
+			sum := sha256.Sum256(dict)
+			if header := append(append([]byte(nil), dczMagic...), sum[:]...); !bytes.HasPrefix(body, header) {
+				t.Fatalf("%s: expected the dcz header with the dictionary hash; got %x", tt.name, body)
+			}
+			var err error
+			if body, err = zstdDecompress(body[len(dczMagic)+sha256.Size:], dict); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		var res result
+		if err := json.Unmarshal(body, &res); err != nil || len(res.Numbers) != len(numbers) {
+			t.Errorf("%s: expected the numbers; got %q (%v)", tt.name, body, err)
+		}
+	}
+
+	// The response is shorter than the dcz header
+	numbersHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, endpoint+"?g=tiny", nil))
+	rec = httptest.NewRecorder()
+	dictHandler(rec, httptest.NewRequest(http.MethodGet, "/dict?g=tiny", nil))
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?g=tiny", nil)
+	req.Header.Set("Available-Dictionary", rec.Header().Get("X-Dictionary-Id"))
+	req.Header.Set("Accept-Encoding", "dcz")
+	rec = httptest.NewRecorder()
+	numbersHandler(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected a short response to be sent plain; got %q", rec.Body)
+	}
+}
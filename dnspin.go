@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"net"
+	"net/http/httptrace"
+	"sync"
+)
+
+// Whether every upstream host is resolved once per request and all its URLs on that host
+// connect to the same address
+var (
+	dnsPinMu   sync.RWMutex
+	dnsPinning bool
+)
+
+func registerDNSFlags(fs *flag.FlagSet, pin *bool) {
+	fs.BoolVar(pin, "dns.pin", false, "resolve every upstream host once per request and connect to the same address for all of its URLs on that host")
+}
+
+func setDNSPinning(on bool) {
+	dnsPinMu.Lock()
+	defer dnsPinMu.Unlock()
+	dnsPinning = on
+}
+
+func currentDNSPinning() bool {
+	dnsPinMu.RLock()
+	defer dnsPinMu.RUnlock()
+	return dnsPinning
+}
+
+// Address every host of a request was pinned to, the first one resolved or connected to wins
+type dnsPins struct {
+	mu    sync.Mutex
+	addrs map[string]string
+}
+
+type dnsPinsKeyType struct{}
+
+func withDNSPins(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dnsPinsKeyType{}, &dnsPins{addrs: make(map[string]string)})
+}
+
+func dnsPinsFrom(ctx context.Context) *dnsPins {
+	p, _ := ctx.Value(dnsPinsKeyType{}).(*dnsPins)
+	return p
+}
+
+func (p *dnsPins) get(host string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ip, ok := p.addrs[host]
+	return ip, ok
+}
+
+// Pins host to ip unless it is pinned already, returns the pinned address
+func (p *dnsPins) pin(host, ip string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pinned, ok := p.addrs[host]; ok {
+		return pinned
+	}
+	p.addrs[host] = ip
+	return ip
+}
+
+// Dials the address the host is pinned to in the request, resolving and pinning it first to
+// an address of the preferred family. Without pins, and for IP addresses, it dials addr as it is.
+func pinnedDialer(dial dialFunc, family string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		pins := dnsPinsFrom(ctx)
+		host, port, err := net.SplitHostPort(addr)
+		if pins == nil || err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ip, ok := pins.get(host)
+		if !ok {
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			pick := ips[0].IP
+			for _, a := range ips {
+				if inFamily(a.IP, family) {
+					pick = a.IP
+					break
+				}
+			}
+			ip = pins.pin(host, pick.String())
+			upstreamMetrics.Add("dns_pinned", 1)
+		}
+		return dial(ctx, network, net.JoinHostPort(ip, port))
+	}
+}
+
+// With pinning on, records the address that served the fetch of u in the trace and pins the
+// host to it when the connection was taken from the pool before the request dialed one
+func traceConnAddr(ctx context.Context, u, host string) context.Context {
+	t, pins := tracerFrom(ctx), dnsPinsFrom(ctx)
+	if pins == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			addr := info.Conn.RemoteAddr().String()
+			if tc, ok := info.Conn.(*tls.Conn); ok {
+				addr = tc.NetConn().RemoteAddr().String()
+			}
+			t.markAddr("connected", u, addr)
+			if ip, _, err := net.SplitHostPort(addr); err == nil {
+				name, _, err := net.SplitHostPort(host)
+				if err != nil {
+					name = host
+				}
+				pins.pin(name, ip)
+			}
+		},
+	})
+}
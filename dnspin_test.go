@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPinnedDialer(t *testing.T) {
+	var dialed []string
+	dial := pinnedDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, nil
+	}, familyAny)
+	ctx := withDNSPins(context.Background())
+	dnsPinsFrom(ctx).pin("pinned.example", "192.0.2.7")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		addr string
+		want string
+	}{
+		{name: "pinned", ctx: ctx, addr: "pinned.example:443", want: "192.0.2.7:443"},
+		{name: "other port of a pinned host", ctx: ctx, addr: "pinned.example:8443", want: "192.0.2.7:8443"},
+		{name: "ip", ctx: ctx, addr: "198.51.100.1:80", want: "198.51.100.1:80"},
+		{name: "without pins", ctx: context.Background(), addr: "pinned.example:443", want: "pinned.example:443"},
+	}
+	for _, tt := range tests {
+		dialed = nil
+		dial(tt.ctx, "tcp", tt.addr)
+		if len(dialed) != 1 || dialed[0] != tt.want {
+			t.Errorf("%s: expected a dial to %s; got %v", tt.name, tt.want, dialed)
+		}
+	}
+	// The first resolved address is kept for the rest of the request
+	dial(ctx, "tcp", "localhost:80")
+	ip, ok := dnsPinsFrom(ctx).get("localhost")
+	if !ok || net.ParseIP(ip) == nil || !net.ParseIP(ip).IsLoopback() {
+		t.Fatalf("expected localhost to be pinned to a loopback address; got %q", ip)
+	}
+	if got := dnsPinsFrom(ctx).pin("localhost", "192.0.2.8"); got != ip {
+		t.Errorf("expected the pin to stay %s; got %s", ip, got)
+	}
+}
+
+func TestDNSPinTrace(t *testing.T) {
+	defer setDNSPinning(currentDNSPinning())
+	setDNSPinning(true)
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	u := "http://localhost:" + port
+	o, _ := parseOptions(nil)
+	tr := newTracer(time.Now())
+	sum := run(withTracer(context.Background(), tr), []string{u + "/a", u + "/b"}, o)
+	if sum.ok != 2 {
+		t.Fatalf("expected both sources to succeed; got %+v", sum)
+	}
+	var addrs []string
+	for _, e := range tr.timeline() {
+		if e.Event == "connected" {
+			addrs = append(addrs, e.Addr)
+		}
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("expected a connected event per fetch; got %v", tr.timeline())
+	}
+	for _, a := range addrs {
+		if !strings.HasSuffix(a, ":"+port) || a != addrs[0] {
+			t.Errorf("expected every fetch served by the same address; got %v", addrs)
+		}
+	}
+}
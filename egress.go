@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What happens to requests once an egress budget is used up
+const (
+	// Every request of the tenant, or of everyone for the global budget, gets a 429
+	egressReject = "reject"
+	// Cached results are still served, anything that would fetch fails its sources with policy
+	egressCacheOnly = "cache-only"
+)
+
+// Upstream bytes fetched per window, for everyone and per tenant. Fan-outs already running
+// when a budget runs out finish, so a budget can be overshot by the requests in flight.
+type egressBudget struct {
+	mu sync.Mutex
+	// Bytes per window, 0 is unlimited
+	global, tenant int64
+	window         time.Duration
+	mode           string
+	total          egressWindow
+	tenants        map[string]*egressWindow
+	now            func() time.Time
+}
+
+type egressWindow struct {
+	start time.Time
+	bytes int64
+}
+
+var egress = newEgressBudget(0, 0, time.Hour, egressReject)
+
+func newEgressBudget(global, tenant int64, window time.Duration, mode string) *egressBudget {
+	return &egressBudget{global: global, tenant: tenant, window: window, mode: mode, tenants: make(map[string]*egressWindow), now: time.Now}
+}
+
+// Flag taking sizes like 10GiB, empty or 0 is unlimited
+type byteSizeFlag struct{ n *int64 }
+
+func (f byteSizeFlag) String() string {
+	if f.n == nil || *f.n == 0 {
+		return ""
+	}
+	return formatBytes(*f.n)
+}
+
+func (f byteSizeFlag) Set(s string) error {
+	if s == "" || s == "0" {
+		*f.n = 0
+		return nil
+	}
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*f.n = n
+	return nil
+}
+
+func registerEgressFlags(fs *flag.FlagSet, global, tenant *int64, window *time.Duration, mode *string) {
+	fs.Var(byteSizeFlag{global}, "egress.global", "upstream bytes all requests may fetch per window, e.g. 50GiB, empty is unlimited")
+	fs.Var(byteSizeFlag{tenant}, "egress.tenant", "upstream bytes every tenant may fetch per window, empty is unlimited")
+	fs.DurationVar(window, "egress.window", time.Hour, "window of the egress budgets")
+	fs.StringVar(mode, "egress.mode", egressReject, "once a budget is used up: reject requests with a 429, or cache-only to still serve cached results")
+}
+
+func (b *egressBudget) configure(global, tenant int64, window time.Duration, mode string) error {
+	if mode != egressReject && mode != egressCacheOnly {
+		return fmt.Errorf("invalid -egress.mode %q, expected reject or cache-only", mode)
+	}
+	if window <= 0 {
+		return fmt.Errorf("-egress.window must be positive")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.global, b.tenant, b.window, b.mode = global, tenant, window, mode
+	return nil
+}
+
+// Window w as of now, restarted when it passed
+func (b *egressBudget) current(w *egressWindow, now time.Time) *egressWindow {
+	if now.Sub(w.start) >= b.window {
+		w.start, w.bytes = now, 0
+	}
+	return w
+}
+
+// Counts n bytes fetched for tenant
+func (b *egressBudget) charge(tenant string, n int64) {
+	if n <= 0 {
+		return
+	}
+	upstreamMetrics.Add("egress_bytes", n)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.global <= 0 && b.tenant <= 0 {
+		return
+	}
+	now := b.now()
+	b.current(&b.total, now).bytes += n
+	if b.tenant > 0 {
+		w, ok := b.tenants[tenant]
+		if !ok {
+			if len(b.tenants) >= rateLimitSweep {
+				b.sweep(now)
+			}
+			w = &egressWindow{start: now}
+			b.tenants[tenant] = w
+		}
+		b.current(w, now).bytes += n
+	}
+}
+
+func (b *egressBudget) sweep(now time.Time) {
+	for name, w := range b.tenants {
+		if now.Sub(w.start) >= b.window {
+			delete(b.tenants, name)
+		}
+	}
+}
+
+// A used up budget
+type egressExhausted struct {
+	scope         string
+	limit         int64
+	window, reset time.Duration
+	mode          string
+}
+
+func (e egressExhausted) Error() string {
+	return fmt.Sprintf("egress budget of %s per %v used up for %s, resets in %v", formatBytes(e.limit), e.window, e.scope, e.reset.Round(time.Second))
+}
+
+// The budget tenant has used up, the global one first
+func (b *egressBudget) exhausted(tenant string) (egressExhausted, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.global > 0 {
+		if w := b.current(&b.total, now); w.bytes >= b.global {
+			return egressExhausted{scope: "all tenants", limit: b.global, window: b.window, reset: w.start.Add(b.window).Sub(now), mode: b.mode}, true
+		}
+	}
+	if w, ok := b.tenants[tenant]; ok && b.tenant > 0 {
+		if w := b.current(w, now); w.bytes >= b.tenant {
+			return egressExhausted{scope: fmt.Sprintf("tenant %q", tenant), limit: b.tenant, window: b.window, reset: w.start.Add(b.window).Sub(now), mode: b.mode}, true
+		}
+	}
+	return egressExhausted{}, false
+}
+
+// Summary failing every URL without fetching when the budget of the request in ctx is used up
+func egressDenied(ctx context.Context, urls []string) (summary, bool) {
+	e, ok := egress.exhausted(tenantFrom(ctx))
+	if !ok {
+		return summary{}, false
+	}
+	upstreamMetrics.Add("egress_denied", 1)
+	sum := summary{numbers: []int{}}
+	for _, u := range urls {
+		sum.addError(newFetchError(codePolicy, u, "not fetched, %v", e))
+	}
+	return sum, true
+}
+
+// Rejects requests with a 429 once their egress budget is used up, unless cached results are
+// still served in cache-only mode
+func egressLimited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := egress.exhausted(tenantFrom(r.Context()))
+		if !ok || e.mode == egressCacheOnly {
+			next.ServeHTTP(w, r)
+			return
+		}
+		httpMetrics.Add("egress_rejected", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int((e.reset+time.Second-1)/time.Second)))
+		writeProblem(w, http.StatusTooManyRequests, e.limit, "%v", e)
+	})
+}
+
+// Usage of a budget in its current window
+type egressUsage struct {
+	Tenant string `json:"tenant,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	Limit  int64  `json:"limit"`
+	Reset  string `json:"reset"`
+}
+
+func (b *egressBudget) usage() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	total := b.current(&b.total, now)
+	tenants := make([]egressUsage, 0, len(b.tenants))
+	for name, w := range b.tenants {
+		if w = b.current(w, now); w.bytes == 0 {
+			// Forget tenants without traffic in the window
+			delete(b.tenants, name)
+			continue
+		}
+		tenants = append(tenants, egressUsage{Tenant: name, Bytes: w.bytes, Limit: b.tenant, Reset: w.start.Add(b.window).Sub(now).Round(time.Second).String()})
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Bytes > tenants[j].Bytes })
+	return map[string]interface{}{
+		"window":  b.window.String(),
+		"mode":    b.mode,
+		"global":  egressUsage{Bytes: total.bytes, Limit: b.global, Reset: total.start.Add(b.window).Sub(now).Round(time.Second).String()},
+		"tenants": tenants,
+	}
+}
+
+// Bytes fetched in the current window, globally and by tenant
+func egressHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(egress.usage())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEgressBudget(t *testing.T) {
+	b := newEgressBudget(100, 50, time.Hour, egressReject)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	steps := []struct {
+		tenant string
+		bytes  int64
+		// Tenant whose budget is checked afterwards and the scope expected to be used up
+		check, scope string
+	}{
+		{tenant: "a", bytes: 30, check: "a"},
+		{tenant: "a", bytes: 30, check: "a", scope: `tenant "a"`},
+		{tenant: "b", bytes: 30, check: "b"},
+		{tenant: "c", bytes: 10, check: "c", scope: "all tenants"},
+	}
+	for i, s := range steps {
+		b.charge(s.tenant, s.bytes)
+		e, ok := b.exhausted(s.check)
+		if ok != (s.scope != "") || e.scope != s.scope {
+			t.Errorf("step %d: expected scope %q; got %q (%v)", i, s.scope, e.scope, ok)
+		}
+	}
+	now = now.Add(time.Hour)
+	if e, ok := b.exhausted("a"); ok {
+		t.Errorf("expected the budgets to reset with the window; got %v", e)
+	}
+}
+
+func TestEgressLimited(t *testing.T) {
+	defer func(b *egressBudget) { egress = b }(egress)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	for _, tt := range []struct {
+		mode string
+		want int
+	}{
+		{mode: egressReject, want: http.StatusTooManyRequests},
+		{mode: egressCacheOnly, want: http.StatusNoContent},
+	} {
+		egress = newEgressBudget(10, 0, time.Minute, tt.mode)
+		egress.charge("", 10)
+		rec := httptest.NewRecorder()
+		egressLimited(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d; got %d", tt.mode, tt.want, rec.Code)
+		}
+		if tt.mode == egressReject && rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("expected Retry-After 60; got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestEgressDenied(t *testing.T) {
+	defer func(b *egressBudget) { egress = b }(egress)
+	egress = newEgressBudget(0, 100, time.Minute, egressCacheOnly)
+	var hits int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Write([]byte(`{"numbers":[1,2,3]}`))
+	}))
+	defer ts.Close()
+	o, _ := parseOptions(nil)
+	ctx := withTenant(context.Background(), "a")
+	if sum := run(ctx, []string{ts.URL}, o); sum.ok != 1 {
+		t.Fatalf("expected the source to be fetched; got %+v", sum)
+	}
+	egress.charge("a", 100)
+	sum := run(ctx, []string{ts.URL}, o)
+	if sum.failed != 1 || errorCodeOf(sum.errs[0]) != codePolicy || atomic.LoadInt64(&hits) != 1 {
+		t.Errorf("expected the source to fail with policy without a fetch; got %+v after %d fetches", sum, hits)
+	}
+	// Other tenants still have their budget
+	if sum := run(withTenant(context.Background(), "b"), []string{ts.URL}, o); sum.ok != 1 {
+		t.Errorf("expected tenant b to fetch; got %+v", sum)
+	}
+}
+
+func TestByteSizeFlag(t *testing.T) {
+	var n int64
+	f := byteSizeFlag{&n}
+	for _, tt := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{in: "10GiB", want: 10 << 30, ok: true},
+		{in: "", want: 0, ok: true},
+		{in: "lots"},
+	} {
+		err := f.Set(tt.in)
+		if (err == nil) != tt.ok || tt.ok && n != tt.want {
+			t.Errorf("%q: expected %d; got %d, %v", tt.in, tt.want, n, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Leads every encrypted document, followed by the key id, the nonce and the AES-GCM sealed data
+const sealedMagic = "TAGOENC1"
+
+// Length of the key id, the start of the SHA-256 of the key. It tells a document encrypted
+// with another key apart from a corrupted one.
+const keyIDLength = 4
+
+// Encrypts documents written to disk with AES-GCM
+type sealer struct {
+	aead cipher.AEAD
+	id   []byte
+}
+
+// Encrypts snapshots when a key is configured, nil leaves them in plaintext
+var snapshotSealer *sealer
+
+func registerEncryptionFlags(fs *flag.FlagSet, keyEnv, keyFile *string) {
+	fs.StringVar(keyEnv, "snapshot.key-env", "", "environment variable holding the AES key snapshots are encrypted with, base64 or hex encoded")
+	fs.StringVar(keyFile, "snapshot.key-file", "", "file holding the AES key snapshots are encrypted with, e.g. written by a KMS agent")
+}
+
+// Reads the key from the environment variable keyEnv or the file keyFile. Neither set
+// returns a nil sealer.
+func loadSealer(keyEnv, keyFile string) (*sealer, error) {
+	var raw string
+	switch {
+	case keyEnv != "" && keyFile != "":
+		return nil, errors.New("-snapshot.key-env and -snapshot.key-file are mutually exclusive")
+	case keyEnv != "":
+		if raw = os.Getenv(keyEnv); raw == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", keyEnv)
+		}
+	case keyFile != "":
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(b)
+	default:
+		return nil, nil
+	}
+	key, err := parseKey(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	return newSealer(key)
+}
+
+// Keys are 16, 24 or 32 bytes for AES-128, AES-192 or AES-256, hex or base64 encoded
+func parseKey(s string) ([]byte, error) {
+	for _, decode := range []func(string) ([]byte, error){hex.DecodeString, base64.StdEncoding.DecodeString, base64.RawStdEncoding.DecodeString} {
+		key, err := decode(s)
+		if err != nil {
+			continue
+		}
+		switch len(key) {
+		case 16, 24, 32:
+			return key, nil
+		}
+	}
+	return nil, errors.New("invalid encryption key, expected 16, 24 or 32 bytes, hex or base64 encoded")
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &sealer{aead: aead, id: sum[:keyIDLength]}, nil
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedMagic))
+}
+
+func (s *sealer) header() []byte {
+	return append([]byte(sealedMagic), s.id...)
+}
+
+func (s *sealer) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(s.header(), nonce...)
+	// The header is authenticated too, so the key id can't be swapped
+	return s.aead.Seal(out, nonce, plain, s.header()), nil
+}
+
+func (s *sealer) open(data []byte) ([]byte, error) {
+	h := s.header()
+	if len(data) < len(h)+s.aead.NonceSize() {
+		return nil, errors.New("truncated encrypted document")
+	}
+	if !bytes.Equal(data[:len(h)], h) {
+		return nil, errors.New("document was encrypted with a different key")
+	}
+	nonce := data[len(h) : len(h)+s.aead.NonceSize()]
+	plain, err := s.aead.Open(nil, nonce, data[len(h)+len(nonce):], h)
+	if err != nil {
+		return nil, errors.New("encrypted document is corrupted")
+	}
+	return plain, nil
+}
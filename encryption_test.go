@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, s := range []string{hex.EncodeToString(key), base64.StdEncoding.EncodeToString(key), base64.RawStdEncoding.EncodeToString(key), hex.EncodeToString(key[:16])} {
+		if _, err := parseKey(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "secret", hex.EncodeToString(key[:20]), base64.StdEncoding.EncodeToString(key[:31])} {
+		if _, err := parseKey(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestSealer(t *testing.T) {
+	s, _ := newSealer(bytes.Repeat([]byte{1}, 32))
+	other, _ := newSealer(bytes.Repeat([]byte{2}, 32))
+	plain := []byte(`{"numbers":[1,2,3]}`)
+	sealed, err := s.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || bytes.Contains(sealed, plain) {
+		t.Fatalf("expected an encrypted document; got %q", sealed)
+	}
+	if again, _ := s.seal(plain); bytes.Equal(again, sealed) {
+		t.Error("expected a fresh nonce for every document")
+	}
+	if got, err := s.open(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("expected %q; got %q %v", plain, got, err)
+	}
+	if _, err := other.open(sealed); err == nil {
+		t.Error("expected an error for another key")
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	for _, data := range [][]byte{tampered, sealed[:len(sealedMagic)+keyIDLength+3]} {
+		if _, err := s.open(data); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestLoadSealer(t *testing.T) {
+	key := hex.EncodeToString(bytes.Repeat([]byte{3}, 32))
+	os.Setenv("TA_GO_TEST_SNAPSHOT_KEY", key)
+	defer os.Unsetenv("TA_GO_TEST_SNAPSHOT_KEY")
+	file := filepath.Join(t.TempDir(), "key")
+	ioutil.WriteFile(file, []byte(key+"\n"), 0600)
+	if s, err := loadSealer("", ""); s != nil || err != nil {
+		t.Errorf("expected no sealer; got %v %v", s, err)
+	}
+	fromEnv, err := loadSealer("TA_GO_TEST_SNAPSHOT_KEY", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := loadSealer("", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromEnv.id, fromFile.id) {
+		t.Error("expected the same key from the environment and the file")
+	}
+	for _, args := range [][2]string{{"TA_GO_TEST_UNSET", ""}, {"", file + ".missing"}, {"TA_GO_TEST_SNAPSHOT_KEY", file}} {
+		if _, err := loadSealer(args[0], args[1]); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	defer func(s *sealer) { snapshotSealer = s }(snapshotSealer)
+	defer groups.set(groups.all())
+	defer history.load(history.dump())
+	history.load(nil)
+	history.record("secret", []int{424242})
+	snapshotSealer, _ = newSealer(bytes.Repeat([]byte{4}, 32))
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	exported := rec.Body.Bytes()
+	if rec.Code != http.StatusOK || !isSealed(exported) || bytes.Contains(exported, []byte("424242")) {
+		t.Fatalf("expected an encrypted snapshot; got %d %q", rec.Code, exported)
+	}
+	history.load(nil)
+	rec = httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/snapshot", bytes.NewReader(exported)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status no content; got %v: %s", rec.Code, rec.Body)
+	}
+	if s, ok := history.latest("secret"); !ok || s.Numbers[0] != 424242 {
+		t.Errorf("history was not restored: %+v", s)
+	}
+
+	snapshotSealer = nil
+	rec = httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/snapshot", bytes.NewReader(exported)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an encrypted snapshot to be rejected without a key; got %v", rec.Code)
+	}
+}
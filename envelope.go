@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional top-level fields a response can carry besides "numbers"
+var envelopeFields = []string{"count", "duration_ms", "sources_total", "sources_ok", "sources_failed", "completeness", "request_id", "errors", "suggested_deadline_ms", "deadline_stage"}
+
+// Envelope fields added to every response unless the request says otherwise. Set by -response.fields.
+var (
+	fieldsMu      sync.RWMutex
+	defaultFields = ""
+)
+
+func currentDefaultFields() string {
+	fieldsMu.RLock()
+	defer fieldsMu.RUnlock()
+	return defaultFields
+}
+
+func setDefaultFields(v string) error {
+	if v != "" && v != "true" && v != "all" && v != "false" {
+		for _, f := range strings.Split(v, ",") {
+			if !isEnvelopeField(strings.TrimSpace(f)) {
+				return fmt.Errorf("invalid response field %q", f)
+			}
+		}
+	}
+	fieldsMu.Lock()
+	defer fieldsMu.Unlock()
+	defaultFields = v
+	return nil
+}
+
+// Our response. Only "numbers" is always present so existing clients keep working, unless the
+// client explicitly asked for a histogram instead.
+type envelope struct {
+	Numbers      interface{} `json:"numbers,omitempty"`
+	Histogram    []bucket    `json:"histogram,omitempty"`
+	Count        *int        `json:"count,omitempty"`
+	DurationMS   *float64    `json:"duration_ms,omitempty"`
+	SourcesTotal *int        `json:"sources_total,omitempty"`
+	SourcesOK    *int        `json:"sources_ok,omitempty"`
+	SourcesFail  *int        `json:"sources_failed,omitempty"`
+	// Share of the requested sources that contributed before the deadline
+	Completeness *float64       `json:"completeness,omitempty"`
+	RequestID    string         `json:"request_id,omitempty"`
+	Skipped      map[string]int `json:"skipped,omitempty"`
+	Coerced      map[string]int `json:"coerced,omitempty"`
+	// Sources, or number of sources, that reported each value, keyed by the value
+	Attribution interface{} `json:"attribution,omitempty"`
+	// Always set when the client's Bloom filter dropped values, some of which it may not have
+	Bloom  *bloomDisclosure `json:"bloom,omitempty"`
+	Errors *[]errorDetail   `json:"errors,omitempty"`
+	// Deadline a retry would likely need to be complete, only set when the response was incomplete
+	// because of sources that timed out, see suggestDeadline
+	SuggestedDeadlineMS *int64 `json:"suggested_deadline_ms,omitempty"`
+	// Stage the request was in when its deadline passed, only set when it did
+	DeadlineStage string `json:"deadline_stage,omitempty"`
+	// Set whenever the numbers aren't fully sorted because the sort ran out of time
+	Order string `json:"order,omitempty"`
+	// Set on every page of a paginated response but the last
+	NextCursor string `json:"next_cursor,omitempty"`
+	shape      responseShape
+}
+
+// Parses the verbose query parameter. "true" or "all" selects every field, "false" none,
+// anything else is a comma separated list of field names. An empty value falls back to the server default.
+func parseFields(v string) (map[string]bool, error) {
+	if v == "" {
+		v = currentDefaultFields()
+	}
+	fields := make(map[string]bool)
+	switch v {
+	case "", "false":
+		return fields, nil
+	case "true", "all":
+		for _, f := range envelopeFields {
+			fields[f] = true
+		}
+		return fields, nil
+	}
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if !isEnvelopeField(f) {
+			return nil, fmt.Errorf("invalid verbose field %q", f)
+		}
+		fields[f] = true
+	}
+	return fields, nil
+}
+
+func isEnvelopeField(f string) bool {
+	for _, e := range envelopeFields {
+		if e == f {
+			return true
+		}
+	}
+	return false
+}
+
+func newEnvelope(o options, sum summary, total int, elapsed time.Duration, id string) envelope {
+	fields := o.fields
+	e := envelope{Numbers: sum.numbers, Order: sum.order}
+	if o.shape != nil {
+		e.shape = *o.shape
+	}
+	if o.stringify {
+		e.Numbers = stringNumbers(sum.numbers)
+	}
+	n := len(sum.numbers)
+	if sum.histogram != nil {
+		e.Numbers = nil
+		e.Histogram = sum.histogram.buckets()
+		n = sum.histogram.total
+	}
+	if fields["count"] {
+		e.Count = &n
+	}
+	if fields["duration_ms"] {
+		d := float64(elapsed) / float64(time.Millisecond)
+		e.DurationMS = &d
+	}
+	if fields["sources_total"] {
+		e.SourcesTotal = &total
+	}
+	if fields["sources_ok"] {
+		ok := sum.ok
+		e.SourcesOK = &ok
+	}
+	if fields["sources_failed"] {
+		failed := sum.failed
+		e.SourcesFail = &failed
+	}
+	if fields["completeness"] {
+		c := completeness(sum.ok, total)
+		e.Completeness = &c
+	}
+	if fields["request_id"] {
+		e.RequestID = id
+	}
+	if fields["errors"] {
+		details := make([]errorDetail, 0, len(sum.errs))
+		for _, err := range sum.errs {
+			details = append(details, detailOf(err))
+		}
+		e.Errors = &details
+	}
+	if fields["deadline_stage"] {
+		e.DeadlineStage = sum.deadlineStage
+	}
+	if len(fields) > 0 {
+		e.Skipped, e.Coerced = sum.skipped, sum.coerced
+	}
+	if sum.attribution != nil {
+		e.Attribution = sum.attribution.render(sum.numbers)
+	}
+	e.Bloom = sum.bloom
+	return e
+}
+
+// Share of total sources that contributed, rounded to 4 places. A request without sources is complete.
+func completeness(ok, total int) float64 {
+	if total == 0 {
+		return 1
+	}
+	return math.Round(float64(ok)/float64(total)*1e4) / 1e4
+}
+
+// Counts a response by its completeness in tenths, "completeness 0.8" covering 0.8 up to 0.9
+// and "completeness 1" only complete ones
+func observeCompleteness(ok, total int) {
+	c := completeness(ok, total)
+	httpMetrics.Add("completeness "+strconv.FormatFloat(math.Floor(c*10)/10, 'f', -1, 64), 1)
+}
+
+// Values encoded as JSON strings so JavaScript clients don't lose precision above 2^53
+type stringNumbers []int
+
+func (s stringNumbers) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 2+len(s)*8)
+	b = append(b, '[')
+	for i, v := range s {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '"')
+		b = strconv.AppendInt(b, int64(v), 10)
+		b = append(b, '"')
+	}
+	return append(b, ']'), nil
+}
+
+// Returns the id assigned by the request id middleware, the caller supplied X-Request-ID or a random one
+func requestID(r *http.Request) string {
+	if id := requestIDFrom(r.Context()); id != "" {
+		return id
+	}
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
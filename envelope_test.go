@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerboseEnvelope(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[3,"x",1]}`)))
+	defer ts.Close()
+	tt := []struct {
+		name    string
+		verbose string
+		present []string
+		absent  []string
+	}{
+		{name: "Minimal", present: []string{"numbers"}, absent: envelopeFields},
+		// suggested_deadline_ms is only set when sources timed out, deadline_stage when the deadline passed
+		{name: "All", verbose: "true", present: append([]string{"numbers", "skipped"}, envelopeFields[:len(envelopeFields)-2]...)},
+		{name: "Subset", verbose: "count,request_id", present: []string{"numbers", "count", "request_id"}, absent: []string{"duration_ms", "sources_ok"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, endpoint+"?lenient=true&u="+ts.URL+"&u="+ts.URL+"/other&verbose="+tc.verbose, nil)
+			req.Header.Set("X-Request-ID", "abc")
+			rec := httptest.NewRecorder()
+			numbersHandler(rec, req)
+			var body map[string]interface{}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			for _, f := range tc.present {
+				if _, ok := body[f]; !ok {
+					t.Errorf("expected field %q in %v", f, body)
+				}
+			}
+			for _, f := range tc.absent {
+				if _, ok := body[f]; ok {
+					t.Errorf("unexpected field %q in %v", f, body)
+				}
+			}
+			if tc.verbose == "true" {
+				if body["count"] != 2.0 || body["sources_total"] != 2.0 || body["sources_ok"] != 2.0 || body["request_id"] != "abc" {
+					t.Errorf("unexpected envelope %v", body)
+				}
+			}
+		})
+	}
+}
+
+func TestCompleteness(t *testing.T) {
+	tests := []struct {
+		ok, total int
+		want      float64
+		metric    string
+	}{
+		{ok: 4, total: 5, want: 0.8, metric: "completeness 0.8"},
+		{ok: 2, total: 3, want: 0.6667, metric: "completeness 0.6"},
+		{ok: 0, total: 7, want: 0, metric: "completeness 0"},
+		{ok: 0, total: 0, want: 1, metric: "completeness 1"},
+	}
+	for _, tt := range tests {
+		before := counter(httpMetrics.Get(tt.metric))
+		observeCompleteness(tt.ok, tt.total)
+		if got := completeness(tt.ok, tt.total); got != tt.want {
+			t.Errorf("%d of %d: expected %v; got %v", tt.ok, tt.total, tt.want, got)
+		}
+		if counter(httpMetrics.Get(tt.metric)) != before+1 {
+			t.Errorf("%d of %d: expected %q to be counted", tt.ok, tt.total, tt.metric)
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[1]}`)))
+	defer ts.Close()
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+"&u=http://127.0.0.1:1/gone&verbose=completeness", nil))
+	if got := rec.Body.String(); got != `{"numbers":[1],"completeness":0.5}`+"\n" {
+		t.Errorf("unexpected response %q", got)
+	}
+}
+
+func TestParseFieldsRejectsUnknown(t *testing.T) {
+	if _, err := parseFields("count,bogus"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestStringify(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[9007199254740993,-1]}`)))
+	defer ts.Close()
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?stringify=true&u="+ts.URL, nil))
+	expected := `{"numbers":["-1","9007199254740993"]}` + "\n"
+	if rec.Body.String() != expected {
+		t.Errorf("expected %s but got %s", expected, rec.Body.String())
+	}
+}
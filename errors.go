@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Classifies why a source didn't contribute to a response. Codes are part of the verbose
+// response and of the metric names, so they must not change once released.
+type errorCode string
+
+const (
+	codeValidation      errorCode = "validation"
+	codePolicy          errorCode = "policy"
+	codeUpstreamTimeout errorCode = "upstream_timeout"
+	codeUpstream5xx     errorCode = "upstream_5xx"
+	codeUpstreamStatus  errorCode = "upstream_status"
+	codeUpstreamError   errorCode = "upstream_error"
+	codeDecode          errorCode = "decode_error"
+	codeChecksum        errorCode = "checksum_mismatch"
+	codeContentType     errorCode = "content_type"
+	codeBudgetExceeded  errorCode = "budget_exceeded"
+	codeShed            errorCode = "shed"
+	codeInternal        errorCode = "internal"
+)
+
+// Error of a single source
+type fetchError struct {
+	code errorCode
+	url  string
+	msg  string
+	// Stage a timeout hit, see fetchStage
+	stage string
+}
+
+func (e *fetchError) Error() string {
+	if e.url == "" {
+		return e.msg
+	}
+	return e.url + " " + e.msg
+}
+
+// Credentials in url, and in URLs quoted by the message, are redacted
+func newFetchError(code errorCode, url, format string, args ...interface{}) *fetchError {
+	return &fetchError{code: code, url: redact(url), msg: redact(fmt.Sprintf(format, args...))}
+}
+
+// Stage a timeout of err hit, empty for other errors
+func stageOf(err error) string {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe.stage
+	}
+	return ""
+}
+
+// Code of err, codeInternal for anything that isn't a fetchError
+func errorCodeOf(err error) errorCode {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe.code
+	}
+	return codeInternal
+}
+
+// Distinguishes timeouts from other transport failures
+func transportCode(err error) errorCode {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codeUpstreamTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return codeUpstreamTimeout
+	}
+	return codeUpstreamError
+}
+
+func statusCode(status int) errorCode {
+	if status >= 500 {
+		return codeUpstream5xx
+	}
+	return codeUpstreamStatus
+}
+
+// Rendering of an error in the verbose response
+type errorDetail struct {
+	URL     string    `json:"url,omitempty"`
+	Code    errorCode `json:"code"`
+	Message string    `json:"message"`
+	Stage   string    `json:"stage,omitempty"`
+}
+
+func detailOf(err error) errorDetail {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return errorDetail{URL: fe.url, Code: fe.code, Message: fe.msg, Stage: fe.stage}
+	}
+	return errorDetail{Code: codeInternal, Message: err.Error()}
+}
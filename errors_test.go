@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrorCodes(t *testing.T) {
+	tt := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request)
+		query   string
+		code    errorCode
+	}{
+		{name: "5xx", handler: errHandler(), code: codeUpstream5xx},
+		{name: "4xx", handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) }, code: codeUpstreamStatus},
+		{name: "Decode", handler: rawHandler(`{"numbers":[1,}`), code: codeDecode},
+		{name: "Truncated", handler: rawHandler(`{"numbers":[1,2],"count":3}`), code: codeChecksum},
+		{name: "Corrupted", handler: rawHandler(`{"numbers":[1,2,4],"crc32":"fd6db3e9"}`), code: codeChecksum},
+		{name: "Timeout", handler: timeOutHandler([]int{1}), query: "&upstream_timeout_ms=50", code: codeUpstreamTimeout},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(tc.handler))
+			defer ts.Close()
+			errs := verboseErrors(t, endpoint+"?verbose=errors&u="+ts.URL+tc.query)
+			if len(errs) != 1 || errs[0].Code != tc.code || errs[0].URL != ts.URL {
+				t.Errorf("expected a single %s error for %s; got %+v", tc.code, ts.URL, errs)
+			}
+		})
+	}
+}
+
+func TestValidationErrorCode(t *testing.T) {
+	errs := verboseErrors(t, endpoint+"?verbose=errors&u=http://\\bad")
+	if len(errs) != 1 || errs[0].Code != codeValidation {
+		t.Errorf("expected a validation error; got %+v", errs)
+	}
+}
+
+func TestNoErrorsIsEmptyList(t *testing.T) {
+	if errs := verboseErrors(t, endpoint+"?verbose=errors"); errs == nil || len(errs) != 0 {
+		t.Errorf("expected an empty error list; got %+v", errs)
+	}
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	if c := errorCodeOf(newFetchError(codeShed, "u", "x")); c != codeShed {
+		t.Errorf("expected %s; got %s", codeShed, c)
+	}
+	if c := transportCode(timeoutErr{}); c != codeUpstreamTimeout {
+		t.Errorf("expected %s; got %s", codeUpstreamTimeout, c)
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func verboseErrors(t *testing.T, target string) []errorDetail {
+	t.Helper()
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	var body struct {
+		Errors []errorDetail `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("request took %v", time.Since(start))
+	}
+	return body.Errors
+}
+
+func TestSummaryAttributesEveryURL(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 2})))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(timeOutHandler([]int{3})))
+	defer slow.Close()
+	failing := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer failing.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	o, _ := parseOptions(nil)
+	sum := run(ctx, []string{fast.URL, slow.URL, failing.URL}, o)
+	if sum.ok != 1 || sum.failed != 2 {
+		t.Fatalf("expected 1 ok and 2 failed sources; got %d and %d", sum.ok, sum.failed)
+	}
+	codes := make(map[string]errorCode)
+	for _, err := range sum.errs {
+		d := detailOf(err)
+		codes[d.URL] = d.Code
+	}
+	if codes[slow.URL] != codeBudgetExceeded || codes[failing.URL] != codeUpstream5xx {
+		t.Errorf("unexpected attribution %v", codes)
+	}
+}
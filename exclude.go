@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+)
+
+// Body of POST /numbers, the query string still carries everything else
+type numbersRequest struct {
+	// Values the client already has, dropped from the merged result
+	Exclude []int `json:"exclude,omitempty"`
+	// Source whose values are dropped as well, fetched along with the others
+	ExcludeURL string `json:"exclude_url,omitempty"`
+	// Values the client probably has, for sets too large to list
+	ExcludeBloom *clientBloom `json:"exclude_bloom,omitempty"`
+}
+
+// Decodes the body of a POST, an empty one excludes nothing
+func decodeNumbersBody(r *http.Request) (numbersRequest, error) {
+	var b numbersRequest
+	if r.Method != http.MethodPost || r.Body == nil {
+		return b, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil && !errors.Is(err, io.EOF) {
+		return b, err
+	}
+	return b, nil
+}
+
+func (b numbersRequest) excludes() bool {
+	return len(b.Exclude) > 0 || b.ExcludeURL != "" || b.ExcludeBloom != nil
+}
+
+func (b numbersRequest) validate(o options) error {
+	if !b.excludes() {
+		return nil
+	}
+	if o.cursor != "" {
+		return errors.New("exclude applies to the first page, a cursor pages through the result it was cut from")
+	}
+	if o.histogram != "" {
+		return errors.New("exclude can't be combined with histogram")
+	}
+	if b.ExcludeBloom != nil && o.shape != nil && o.shape.bare {
+		return errors.New("exclude_bloom can't be combined with shape array, which has no room to disclose false positives")
+	}
+	if b.ExcludeURL != "" {
+		target, err := normalizeURL(b.ExcludeURL)
+		if err == nil {
+			var u *url.URL
+			if u, err = url.Parse(target); err == nil {
+				err = upstream.checkScheme(u)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid exclude_url - %v", err)
+		}
+	}
+	return nil
+}
+
+// Starts fetching exclude_url next to the fan-out. The returned func waits for it and returns
+// the values to drop; it fails when exclude_url didn't answer.
+func (b numbersRequest) exclusions(ctx context.Context, o options) func() (map[int]struct{}, error) {
+	var fetched chan summary
+	if b.ExcludeURL != "" {
+		// Filtered and bucketed like the merged values they are compared to
+		o.attribute = ""
+		fetched = make(chan summary, 1)
+		go func() { fetched <- run(ctx, []string{b.ExcludeURL}, o) }()
+	}
+	return func() (map[int]struct{}, error) {
+		set := make(map[int]struct{}, len(b.Exclude))
+		for _, v := range b.Exclude {
+			set[v] = struct{}{}
+		}
+		if fetched == nil {
+			return set, nil
+		}
+		sum := <-fetched
+		if sum.ok == 0 {
+			if len(sum.errs) > 0 {
+				return nil, fmt.Errorf("exclude_url failed - %v", sum.errs[0])
+			}
+			return nil, errors.New("exclude_url failed")
+		}
+		for _, v := range sum.numbers {
+			set[v] = struct{}{}
+		}
+		return set, nil
+	}
+}
+
+// Most hash functions a client's Bloom filter may use
+const maxClientBloomHashes = 64
+
+// Bloom filter of the values a client already has, uploaded as {"m": bits, "k": hashes, "bits":
+// base64}. Bit i of the filter is bit i%8 of byte i/8 and value v sets the bits
+// (mix64(v) + i*(mix64(v^0x9e3779b97f4a7c15)|1)) % m for i < k, like the seen window's filters.
+type clientBloom struct {
+	filter *bloom
+	// Chance that a value the client doesn't have tests positive, from the share of bits set
+	falsePositiveRate float64
+}
+
+func (c *clientBloom) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		M    uint64 `json:"m"`
+		K    uint64 `json:"k"`
+		Bits string `json:"bits"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw.M == 0 || raw.K == 0 || raw.K > maxClientBloomHashes {
+		return fmt.Errorf("exclude_bloom needs m > 0 and k between 1 and %d", maxClientBloomHashes)
+	}
+	data, err := base64.StdEncoding.DecodeString(raw.Bits)
+	if err != nil {
+		return fmt.Errorf("exclude_bloom bits - %v", err)
+	}
+	if uint64(len(data)) != (raw.M+7)/8 {
+		return fmt.Errorf("exclude_bloom has %d bytes of bits, %d bits take %d", len(data), raw.M, (raw.M+7)/8)
+	}
+	if raw.M%8 != 0 {
+		// Bits past m are never tested and must not count as set
+		data[len(data)-1] &= byte(1)<<(raw.M%8) - 1
+	}
+	f := &bloom{bits: make([]uint64, (raw.M+63)/64), m: raw.M, k: raw.K}
+	set := 0
+	for i, by := range data {
+		f.bits[i/8] |= uint64(by) << (8 * (i % 8))
+		set += bits.OnesCount8(by)
+	}
+	c.filter = f
+	c.falsePositiveRate = math.Pow(float64(set)/float64(raw.M), float64(raw.K))
+	return nil
+}
+
+// What a client's Bloom filter dropped from a response. Values the client doesn't have are
+// dropped as well, at the false positive rate.
+type bloomDisclosure struct {
+	Excluded          int     `json:"excluded"`
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+}
+
+// Values that don't test positive in the filter, in a new slice since values may be shared
+// with the cache
+func (c *clientBloom) drop(values []int) ([]int, *bloomDisclosure) {
+	out := make([]int, 0, len(values))
+	for _, v := range values {
+		if !c.filter.test(v) {
+			out = append(out, v)
+		}
+	}
+	d := &bloomDisclosure{Excluded: len(values) - len(out), FalsePositiveRate: c.falsePositiveRate}
+	httpMetrics.Add("bloom_excluded", int64(d.Excluded))
+	return out, d
+}
+
+// Values not in set, in a new slice since values may be shared with the cache
+func dropExcluded(values []int, set map[int]struct{}) []int {
+	out := make([]int, 0, len(values))
+	for _, v := range values {
+		if _, ok := set[v]; !ok {
+			out = append(out, v)
+		}
+	}
+	if n := len(values) - len(out); n > 0 {
+		httpMetrics.Add("values_excluded", int64(n))
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExclude(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[1,2,3,4,5,6]}`)))
+	defer ts.Close()
+	known := httptest.NewServer(http.HandlerFunc(rawHandler(`{"numbers":[5,6,7]}`)))
+	defer known.Close()
+	down := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer down.Close()
+	tests := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+		want   []int
+	}{
+		{name: "no body", status: http.StatusOK, want: []int{1, 2, 3, 4, 5, 6}},
+		{name: "empty", body: `{}`, status: http.StatusOK, want: []int{1, 2, 3, 4, 5, 6}},
+		{name: "values", body: `{"exclude":[2,4,9]}`, status: http.StatusOK, want: []int{1, 3, 5, 6}},
+		{name: "url", body: `{"exclude_url":"` + known.URL + `"}`, status: http.StatusOK, want: []int{1, 2, 3, 4}},
+		{name: "both", body: `{"exclude":[1],"exclude_url":"` + known.URL + `"}`, status: http.StatusOK, want: []int{2, 3, 4}},
+		{name: "filtered", query: "&filter=odd", body: `{"exclude":[3]}`, status: http.StatusOK, want: []int{1, 5}},
+		{name: "paged", query: "&page_size=2", body: `{"exclude":[1,2]}`, status: http.StatusOK, want: []int{3, 4}},
+		{name: "url down", body: `{"exclude_url":"` + down.URL + `"}`, status: http.StatusBadGateway},
+		{name: "invalid url", body: `{"exclude_url":"ftp://x"}`, status: http.StatusBadRequest},
+		{name: "invalid body", body: `{"exclude":["a"]}`, status: http.StatusBadRequest},
+		{name: "histogram", query: "&histogram=auto", body: `{"exclude":[1]}`, status: http.StatusBadRequest},
+		{name: "cursor", query: "&cursor=abc", body: `{"exclude":[1]}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, endpoint+"?u="+ts.URL+tt.query, strings.NewReader(tt.body))
+		numbersHandler(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d; got %d %s", tt.name, tt.status, rec.Code, rec.Body)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var res result
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Numbers, tt.want) {
+			t.Errorf("%s: expected %v; got %v", tt.name, tt.want, res.Numbers)
+		}
+	}
+}
+
+func TestExcludeCountsAgainstTenant(t *testing.T) {
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"acme": {MaxURLs: 1}})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, endpoint+"?u=http://a.test/", strings.NewReader(`{"exclude_url":"http://b.test/"}`))
+	numbersHandler(rec, req.WithContext(withTenant(req.Context(), "acme")))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected exclude_url to count against max_urls; got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Uploadable form of f, as a client would send it
+func bloomJSON(f *bloom) string {
+	data := make([]byte, (f.m+7)/8)
+	for i := range data {
+		data[i] = byte(f.bits[i/8] >> (8 * (i % 8)))
+	}
+	return fmt.Sprintf(`{"m":%d,"k":%d,"bits":%q}`, f.m, f.k, base64.StdEncoding.EncodeToString(data))
+}
+
+func TestExcludeBloom(t *testing.T) {
+	values := make([]int, 1000)
+	for i := range values {
+		values[i] = i
+	}
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler(values)))
+	defer ts.Close()
+	known := newBloom(900, 0.001)
+	for v := 100; v < 1000; v++ {
+		known.add(v)
+	}
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodPost, endpoint+"?u="+ts.URL, strings.NewReader(`{"exclude_bloom":`+bloomJSON(known)+`}`)))
+	var res struct {
+		Numbers []int            `json:"numbers"`
+		Bloom   *bloomDisclosure `json:"bloom"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("%v: %d", err, rec.Code)
+	}
+	// A value the client doesn't have is only dropped as a false positive
+	if len(res.Numbers) > 100 || len(res.Numbers) < 90 {
+		t.Errorf("expected about the 100 unknown values; got %d values", len(res.Numbers))
+	}
+	for _, v := range res.Numbers {
+		if v >= 100 {
+			t.Errorf("expected every known value to be dropped; got %d", v)
+		}
+	}
+	if res.Bloom == nil || res.Bloom.Excluded != 1000-len(res.Numbers) || res.Bloom.FalsePositiveRate <= 0 || res.Bloom.FalsePositiveRate > 0.01 {
+		t.Errorf("expected the false positives to be disclosed; got %+v", res.Bloom)
+	}
+}
+
+func TestClientBloomValidation(t *testing.T) {
+	tests := []struct {
+		body string
+		rate float64
+		err  bool
+	}{
+		{body: `{"m":8,"k":1,"bits":"AA=="}`, rate: 0},
+		{body: `{"m":4,"k":1,"bits":"/w=="}`, rate: 1},
+		{body: `{"m":16,"k":2,"bits":"/wA="}`, rate: 0.25},
+		{body: `{"m":0,"k":1,"bits":""}`, err: true},
+		{body: `{"m":8,"k":0,"bits":"AA=="}`, err: true},
+		{body: `{"m":8,"k":65,"bits":"AA=="}`, err: true},
+		{body: `{"m":16,"k":1,"bits":"AA=="}`, err: true},
+		{body: `{"m":8,"k":1,"bits":"!"}`, err: true},
+	}
+	for _, tt := range tests {
+		var c clientBloom
+		err := json.Unmarshal([]byte(tt.body), &c)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v; got %v", tt.body, tt.err, err)
+			continue
+		}
+		if err == nil && c.falsePositiveRate != tt.rate {
+			t.Errorf("%s: expected a false positive rate of %v; got %v", tt.body, tt.rate, c.falsePositiveRate)
+		}
+	}
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodPost, endpoint+"?shape=array", strings.NewReader(`{"exclude_bloom":{"m":8,"k":1,"bits":"AA=="}}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a bare array to be refused; got %d", rec.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// Feature flag sampling requests into the merge experiment. Sampled requests are served as
+// usual, afterwards the values of their sources are merged again off the request path, once
+// the way consume does it and once with a k-way merge of sorted sources, and the k-way result
+// is compared with the response.
+const mergeExperimentFeature = "merge_experiment"
+
+// Values of the sources of a sampled request, copied as they arrive since the originals are
+// handed back to the pipeline once merged
+type mergeShadow struct {
+	dedup   string
+	sources [][]int
+}
+
+// nil unless the request is sampled. Histograms don't keep the values, so they are left out.
+func newMergeShadow(ctx context.Context, o options) *mergeShadow {
+	if o.histogram != "" || !featureEnabled(ctx, mergeExperimentFeature) {
+		return nil
+	}
+	return &mergeShadow{dedup: o.dedup}
+}
+
+func (s *mergeShadow) add(values []int) {
+	if s == nil {
+		return
+	}
+	s.sources = append(s.sources, append([]int(nil), values...))
+}
+
+// Compares the served values with the shadow merges in the background
+func (s *mergeShadow) compare(ctx context.Context, served []int) {
+	if s == nil {
+		return
+	}
+	go s.run(logPrefix(ctx), append([]int(nil), served...))
+}
+
+func (s *mergeShadow) run(prefix string, served []int) {
+	start := time.Now()
+	mapMerge(s.sources, s.dedup)
+	mapTook := time.Since(start)
+	start = time.Now()
+	got := kwayMerge(s.sources, s.dedup)
+	kwayTook := time.Since(start)
+	experimentMetrics.Add("merge runs", 1)
+	experimentMetrics.Add("merge map_ns", int64(mapTook))
+	experimentMetrics.Add("merge kway_ns", int64(kwayTook))
+	if i := firstDifference(got, served); i >= 0 {
+		experimentMetrics.Add("merge divergences", 1)
+		log.Printf("%smerge experiment: k-way merge of %d sources returned %d values, %d were served, first difference at index %d", prefix, len(s.sources), len(got), len(served), i)
+	}
+}
+
+// The merge of consume: values deduplicated through a map, then sorted
+func mapMerge(sources [][]int, dedup string) []int {
+	var out []int
+	visited := make(map[int]struct{})
+	for _, values := range sources {
+		switch dedup {
+		case dedupNone:
+			out = append(out, values...)
+		case dedupPerSource:
+			out = appendUnique(out, values, make(map[int]struct{}, len(values)))
+		default:
+			out = appendUnique(out, values, visited)
+		}
+	}
+	sort.Ints(out)
+	return out
+}
+
+// Sorts every source, then merges them through a heap. Duplicates are adjacent once sorted,
+// so deduplication needs no set. Sorts the sources in place.
+func kwayMerge(sources [][]int, dedup string) []int {
+	h := make(mergeHeap, 0, len(sources))
+	total := 0
+	for _, values := range sources {
+		sort.Ints(values)
+		if dedup != dedupNone {
+			values = compactSorted(values)
+		}
+		if len(values) > 0 {
+			h = append(h, values)
+			total += len(values)
+		}
+	}
+	heap.Init(&h)
+	out := make([]int, 0, total)
+	for len(h) > 0 {
+		v := h[0][0]
+		if dedup != dedupAll || len(out) == 0 || out[len(out)-1] != v {
+			out = append(out, v)
+		}
+		if h[0] = h[0][1:]; len(h[0]) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return out
+}
+
+// Drops repeated values of a sorted slice in place
+func compactSorted(values []int) []int {
+	if len(values) == 0 {
+		return values
+	}
+	n := 1
+	for _, v := range values[1:] {
+		if v != values[n-1] {
+			values[n] = v
+			n++
+		}
+	}
+	return values[:n]
+}
+
+// Remaining values of the sorted sources, ordered by their first value
+type mergeHeap [][]int
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i][0] < h[j][0] }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.([]int)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Index of the first value that differs, -1 when a and b are equal
+func firstDifference(a, b []int) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	if len(b) > len(a) {
+		return len(a)
+	}
+	return -1
+}
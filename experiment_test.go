@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestKwayMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []int {
+		values := make([]int, n)
+		for i := range values {
+			values[i] = r.Intn(50) - 10
+		}
+		return values
+	}
+	inputs := [][][]int{
+		nil,
+		{{}},
+		{{3, 1, 2}, {2, 2, 5}, {}, {1}},
+		{random(100), random(7), random(300), random(1)},
+	}
+	for _, dedup := range []string{dedupAll, dedupNone, dedupPerSource} {
+		for i, sources := range inputs {
+			copied := make([][]int, len(sources))
+			for j, values := range sources {
+				copied[j] = append([]int(nil), values...)
+			}
+			want := mapMerge(sources, dedup)
+			if got := kwayMerge(copied, dedup); firstDifference(got, want) >= 0 {
+				t.Errorf("dedup=%s input %d: expected %v; got %v", dedup, i, want, got)
+			}
+		}
+	}
+}
+
+func TestMergeShadow(t *testing.T) {
+	defer setFeatures(currentFeatures())
+	setFeatures(nil)
+	if s := newMergeShadow(context.Background(), options{dedup: dedupAll}); s != nil {
+		t.Error("expected no shadow without the feature flag")
+	}
+	setFeatures(map[string]featureRule{mergeExperimentFeature: {Percent: 100}})
+	if s := newMergeShadow(context.Background(), options{dedup: dedupAll, histogram: "0,10"}); s != nil {
+		t.Error("expected no shadow for a histogram")
+	}
+	s := newMergeShadow(context.Background(), options{dedup: dedupAll})
+	if s == nil {
+		t.Fatal("expected a shadow")
+	}
+	values := []int{4, 1, 4}
+	s.add(values)
+	values[0] = 99
+	s.add([]int{2, 1})
+	if !reflect.DeepEqual(s.sources, [][]int{{4, 1, 4}, {2, 1}}) {
+		t.Fatalf("expected copies of the sources; got %v", s.sources)
+	}
+
+	divergences := func() int64 {
+		if v, ok := experimentMetrics.Get("merge divergences").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := divergences()
+	s.run("", []int{1, 2, 4})
+	if divergences() != before {
+		t.Error("expected no divergence")
+	}
+	s.run("", []int{1, 2, 3})
+	if divergences() != before+1 {
+		t.Error("expected a divergence")
+	}
+}
+
+func TestFirstDifference(t *testing.T) {
+	tests := []struct {
+		a, b []int
+		want int
+	}{
+		{want: -1},
+		{a: []int{1, 2}, b: []int{1, 2}, want: -1},
+		{a: []int{1, 2}, b: []int{1, 3}, want: 1},
+		{a: []int{1, 2}, b: []int{1}, want: 1},
+		{a: []int{1}, b: []int{1, 2}, want: 1},
+	}
+	for _, tt := range tests {
+		if got := firstDifference(tt.a, tt.b); got != tt.want {
+			t.Errorf("%v %v: expected %d; got %d", tt.a, tt.b, tt.want, got)
+		}
+	}
+}
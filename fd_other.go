@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// Descriptor headroom isn't tracked on this platform
+func fdHeadroom() (int, bool) {
+	return 0, false
+}
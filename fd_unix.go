@@ -0,0 +1,49 @@
+//go:build unix
+
+package main
+
+import (
+	"math"
+	"os"
+	"syscall"
+)
+
+// Number of file descriptors the process can still open before hitting its soft limit.
+// Open descriptors are counted through /proc or /dev/fd, so it's unknown where neither exists.
+func fdHeadroom() (int, bool) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, false
+	}
+	open, ok := openFiles()
+	if !ok {
+		return 0, false
+	}
+	// An unlimited soft limit is reported as a huge value
+	cur := lim.Cur
+	if cur > math.MaxInt32 {
+		cur = math.MaxInt32
+	}
+	free := int64(cur) - int64(open)
+	if free < 0 {
+		free = 0
+	}
+	return int(free), true
+}
+
+func openFiles() (int, bool) {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		// The directory handle itself shows up in the listing
+		return len(names) - 1, true
+	}
+	return 0, false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Rollout of a new behavior, e.g. streaming, hedging or the v2 envelope. Code paths check
+// featureEnabled before taking the new path, so a flag can be ramped up or rolled back without
+// a deploy. Names aren't declared up front, a flag nobody checks yet is simply inert.
+type featureRule struct {
+	// Share of requests, 0 to 100, that get the behavior
+	Percent int `json:"percent"`
+	// Per-tenant overrides of Percent, true forces the behavior on and false off
+	Tenants map[string]bool `json:"tenants,omitempty"`
+}
+
+var (
+	featuresMu sync.RWMutex
+	features   = map[string]featureRule{}
+)
+
+func registerFeatureFlags(fs *flag.FlagSet, file *string) {
+	fs.StringVar(file, "features.file", "", "JSON file with feature flags of the form {\"name\": {\"percent\": 10, \"tenants\": {\"acme\": true}}}")
+}
+
+func loadFeatures(path string) (map[string]featureRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var all map[string]featureRule
+	if err := json.NewDecoder(f).Decode(&all); err != nil {
+		return nil, fmt.Errorf("%s decoding error - %v", path, err)
+	}
+	return all, validateFeatures(all)
+}
+
+func validateFeatures(all map[string]featureRule) error {
+	for name, rule := range all {
+		if name == "" {
+			return fmt.Errorf("feature without a name")
+		}
+		if rule.Percent < 0 || rule.Percent > 100 {
+			return fmt.Errorf("feature %q has percent %d, expected 0 to 100", name, rule.Percent)
+		}
+	}
+	return nil
+}
+
+func setFeatures(all map[string]featureRule) {
+	copied := make(map[string]featureRule, len(all))
+	for name, rule := range all {
+		copied[name] = rule
+	}
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	features = copied
+}
+
+func currentFeatures() map[string]featureRule {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+	out := make(map[string]featureRule, len(features))
+	for name, rule := range features {
+		out[name] = rule
+	}
+	return out
+}
+
+// Whether the request of ctx gets feature name. The tenant override wins, otherwise the request
+// id picks a stable bucket, so retries with the same X-Request-ID take the same path.
+func featureEnabled(ctx context.Context, name string) bool {
+	featuresMu.RLock()
+	rule, ok := features[name]
+	featuresMu.RUnlock()
+	if !ok {
+		return false
+	}
+	on, overridden := rule.Tenants[tenantFrom(ctx)]
+	if !overridden {
+		on = featureBucket(name, requestIDFrom(ctx)) < rule.Percent
+	}
+	if on {
+		httpMetrics.Add("feature "+name+" on", 1)
+	} else {
+		httpMetrics.Add("feature "+name+" off", 1)
+	}
+	return on
+}
+
+// 0 to 99. Salted with the name so the same requests don't get every feature at a low percent.
+func featureBucket(name, key string) int {
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	io.WriteString(h, key)
+	return int(h.Sum32() % 100)
+}
+
+// GET lists the feature flags, POST sets the flags of a JSON document like -features.file,
+// leaving the others alone, and DELETE removes the flag named by the name query parameter,
+// which turns it off everywhere
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var set map[string]featureRule
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&set)
+		if err == nil {
+			err = validateFeatures(set)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - " + err.Error()))
+			return
+		}
+		featuresMu.Lock()
+		for name, rule := range set {
+			features[name] = rule
+		}
+		featuresMu.Unlock()
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		featuresMu.Lock()
+		_, ok := features[name]
+		delete(features, name)
+		featuresMu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - unknown feature"))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentFeatures())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFeatureEnabled(t *testing.T) {
+	defer setFeatures(currentFeatures())
+	setFeatures(map[string]featureRule{
+		"all":     {Percent: 100},
+		"none":    {Percent: 0, Tenants: map[string]bool{"beta": true}},
+		"half":    {Percent: 50, Tenants: map[string]bool{"legacy": false}},
+		"tenants": {Percent: 100, Tenants: map[string]bool{"legacy": false}},
+	})
+	ctx := func(tenant, id string) context.Context {
+		return withTenant(withRequestID(context.Background(), id), tenant)
+	}
+	tests := []struct {
+		name   string
+		tenant string
+		want   bool
+	}{
+		{name: "all", want: true},
+		{name: "none"},
+		{name: "none", tenant: "beta", want: true},
+		{name: "tenants", tenant: "acme", want: true},
+		{name: "tenants", tenant: "legacy"},
+		{name: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := featureEnabled(ctx(tt.tenant, "id"), tt.name); got != tt.want {
+			t.Errorf("%s for %q: expected %v; got %v", tt.name, tt.tenant, tt.want, got)
+		}
+	}
+
+	on := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprint(i)
+		got := featureEnabled(ctx("", id), "half")
+		if got != featureEnabled(ctx("", id), "half") {
+			t.Fatalf("request %s: expected a stable decision", id)
+		}
+		if got {
+			on++
+		}
+		if featureEnabled(ctx("legacy", id), "half") {
+			t.Fatalf("request %s: expected the tenant override to win", id)
+		}
+	}
+	if on < 400 || on > 600 {
+		t.Errorf("expected about half of the requests; got %d of 1000", on)
+	}
+}
+
+func TestFeaturesHandler(t *testing.T) {
+	defer setFeatures(currentFeatures())
+	setFeatures(map[string]featureRule{"streaming": {Percent: 10}})
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		featuresHandler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	for _, body := range []string{`{"x": {"percent": 101}}`, `{"x": {"percent": -1}}`, `{"": {}}`, `[`} {
+		if rec := do(http.MethodPost, "/admin/features", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400; got %d", body, rec.Code)
+		}
+	}
+	if rec := do(http.MethodPost, "/admin/features", `{"hedging": {"percent": 5}}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d: %s", rec.Code, rec.Body)
+	}
+	if all := currentFeatures(); len(all) != 2 || all["hedging"].Percent != 5 || all["streaming"].Percent != 10 {
+		t.Errorf("unexpected flags %v", all)
+	}
+	if rec := do(http.MethodDelete, "/admin/features?name=streaming", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected 200; got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/features?name=streaming", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404; got %d", rec.Code)
+	}
+	if _, ok := currentFeatures()["streaming"]; ok {
+		t.Error("expected streaming to be rolled back")
+	}
+}
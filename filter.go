@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keeps or drops a single merged value
+type predicate func(v int) bool
+
+// Builds a predicate from the colon separated arguments of a filter, e.g. ["7", "0"] for mod:7:0
+type predicateFactory func(args []string) (predicate, error)
+
+var (
+	filtersMu sync.RWMutex
+	filters   = make(map[string]predicateFactory)
+)
+
+// Makes a predicate available as ?filter=name[:arg...]
+func registerFilter(name string, f predicateFactory) {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	filters[name] = f
+}
+
+func filterNames() []string {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compiles filter specs such as "even" or "mod:7:0". A value is kept when every filter holds.
+func parseFilters(specs []string) ([]predicate, error) {
+	var preds []predicate
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		filtersMu.RLock()
+		f, ok := filters[parts[0]]
+		filtersMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q, expected one of %s", spec, strings.Join(filterNames(), "|"))
+		}
+		p, err := f(parts[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q - %v", spec, err)
+		}
+		preds = append(preds, p)
+	}
+	return preds, nil
+}
+
+// Drops the values some predicate doesn't hold for, in place
+func applyFilters(preds []predicate, values []int) []int {
+	if len(preds) == 0 {
+		return values
+	}
+	out := values[:0]
+next:
+	for _, v := range values {
+		for _, p := range preds {
+			if !p(v) {
+				continue next
+			}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// Floors values in place to the nearest multiple of size at or below them, so that
+// near-duplicates such as timestamps a few milliseconds apart dedup as one value
+func bucketValues(size int, values []int) {
+	if size <= 1 {
+		return
+	}
+	for i, v := range values {
+		r := v % size
+		if r < 0 {
+			r += size
+		}
+		// The bucket below the smallest values isn't representable, they stay in the lowest one
+		if b := v - r; b <= v {
+			values[i] = b
+		} else {
+			values[i] = b + size
+		}
+	}
+}
+
+// Factory for predicates without arguments
+func noArgs(p predicate) predicateFactory {
+	return func(args []string) (predicate, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("takes no arguments")
+		}
+		return p, nil
+	}
+}
+
+func init() {
+	registerFilter("even", noArgs(func(v int) bool { return v%2 == 0 }))
+	registerFilter("odd", noArgs(func(v int) bool { return v%2 != 0 }))
+	registerFilter("prime", noArgs(isPrime))
+	registerFilter("mod", func(args []string) (predicate, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected mod:divisor:remainder")
+		}
+		m, err := strconv.Atoi(args[0])
+		if err != nil || m <= 0 {
+			return nil, fmt.Errorf("divisor must be a positive integer")
+		}
+		r, err := strconv.Atoi(args[1])
+		if err != nil || r < 0 || r >= m {
+			return nil, fmt.Errorf("remainder must be between 0 and %d", m-1)
+		}
+		// Negative values have non-negative remainders too, -1 is 6 mod 7
+		return func(v int) bool { return ((v%m)+m)%m == r }, nil
+	})
+}
+
+// Deterministic Miller-Rabin, these bases are sufficient for every 64 bit number
+var primeBases = []uint64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37}
+
+func isPrime(v int) bool {
+	if v < 2 {
+		return false
+	}
+	n := uint64(v)
+	for _, p := range primeBases {
+		if n%p == 0 {
+			return n == p
+		}
+	}
+	d, s := n-1, 0
+	for d%2 == 0 {
+		d /= 2
+		s++
+	}
+next:
+	for _, a := range primeBases {
+		x := powMod(a, d, n)
+		if x == 1 || x == n-1 {
+			continue
+		}
+		for i := 1; i < s; i++ {
+			if x = mulMod(x, x, n); x == n-1 {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, rem := bits.Div64(hi%m, lo, m)
+	return rem
+}
+
+func powMod(b, e, m uint64) uint64 {
+	r := uint64(1)
+	b %= m
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			r = mulMod(r, b, m)
+		}
+		b = mulMod(b, b, m)
+	}
+	return r
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilters(t *testing.T) {
+	values := []int{-7, -1, 0, 1, 2, 3, 4, 7, 9, 13, 14, 21}
+	tests := []struct {
+		specs []string
+		want  []int
+	}{
+		{specs: nil, want: values},
+		{specs: []string{"even"}, want: []int{0, 2, 4, 14}},
+		{specs: []string{"odd"}, want: []int{-7, -1, 1, 3, 7, 9, 13, 21}},
+		{specs: []string{"prime"}, want: []int{2, 3, 7, 13}},
+		{specs: []string{"mod:7:0"}, want: []int{-7, 0, 7, 14, 21}},
+		{specs: []string{"mod:7:6"}, want: []int{-1, 13}},
+		{specs: []string{"odd", "mod:7:0"}, want: []int{-7, 7, 21}},
+	}
+	for _, tt := range tests {
+		preds, err := parseFilters(tt.specs)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.specs, err)
+		}
+		if got := applyFilters(preds, append([]int(nil), values...)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %v; got %v", tt.specs, tt.want, got)
+		}
+	}
+	for _, spec := range []string{"square", "even:2", "mod", "mod:0:0", "mod:7:7", "mod:7:-1", "mod:x:1"} {
+		if _, err := parseFilters([]string{spec}); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestIsPrime(t *testing.T) {
+	tests := map[int]bool{
+		1: false, 2: true, 37: true, 41: true, 561: false, 7919: true,
+		// Strong pseudoprime to bases 2, 3, 5 and 7
+		3215031751: false,
+		2147483647: true,
+		// Largest prime below 2^63
+		9223372036854775783: true,
+		9223372036854775807: false,
+	}
+	for v, want := range tests {
+		if got := isPrime(v); got != want {
+			t.Errorf("isPrime(%d): expected %v", v, want)
+		}
+	}
+}
+
+func TestBucketValues(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	tests := []struct {
+		size   int
+		values []int
+		want   []int
+	}{
+		{size: 0, values: []int{7, -3}, want: []int{7, -3}},
+		{size: 1, values: []int{7, -3}, want: []int{7, -3}},
+		{size: 10, values: []int{0, 9, 10, 17, -1, -10, -11}, want: []int{0, 0, 10, 10, -10, -10, -20}},
+		{size: 1000, values: []int{1571234567891, 1571234567999}, want: []int{1571234567000, 1571234567000}},
+		{size: 10, values: []int{-maxInt - 1, maxInt}, want: []int{-maxInt + 7, maxInt - 7}},
+	}
+	for _, tt := range tests {
+		bucketValues(tt.size, tt.values)
+		if !reflect.DeepEqual(tt.values, tt.want) {
+			t.Errorf("bucket %d: expected %v; got %v", tt.size, tt.want, tt.values)
+		}
+	}
+}
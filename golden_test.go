@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// Parts of a response that change from run to run
+var durationField = regexp.MustCompile(`"duration_ms":[0-9.e+-]+`)
+
+func TestGoldenResponses(t *testing.T) {
+	sources := map[string]*httptest.Server{
+		"{a}":    httptest.NewServer(http.HandlerFunc(simpleHandler([]int{5, 1, 3, 3}))),
+		"{b}":    httptest.NewServer(http.HandlerFunc(simpleHandler([]int{3, 8, 13}))),
+		"{fail}": httptest.NewServer(http.HandlerFunc(errHandler())),
+	}
+	for _, ts := range sources {
+		defer ts.Close()
+	}
+	pipeline, err := buildPipeline(defaultPipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := routes(pipeline...)
+	tt := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{name: "plain", target: "/numbers?u={a}&u={b}"},
+		{name: "dedup_false", target: "/numbers?u={a}&u={b}&dedup=false"},
+		{name: "dedup_per_source", target: "/numbers?u={a}&u={b}&dedup=per_source"},
+		{name: "stringify", target: "/numbers?u={a}&u={b}&stringify=true"},
+		{name: "verbose_all", target: "/numbers?u={a}&u={fail}&verbose=all"},
+		{name: "histogram", target: "/numbers?u={a}&u={b}&histogram=0,5,10"},
+		{name: "filter", target: "/numbers?u={a}&u={b}&filter=odd&filter=mod:5:3"},
+		{name: "aggregate_sum", target: "/aggregate?op=sum&u={a}&u={b}"},
+		{name: "bad_timeout", target: "/numbers?u={a}&upstream_timeout_ms=abc"},
+		{name: "method", method: http.MethodPut, target: "/numbers?u={a}"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.target
+			for name, ts := range sources {
+				target = strings.Replace(target, name, ts.URL, -1)
+			}
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, target, nil)
+			req.Header.Set("X-Request-ID", "golden")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			got := render(method, tc.target, rec)
+			for name, ts := range sources {
+				got = strings.Replace(got, ts.URL, name, -1)
+			}
+			path := filepath.Join("testdata", "golden", tc.name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v, run go test -run TestGoldenResponses -update to create it", err)
+			}
+			if got != string(want) {
+				t.Errorf("response differs from %s, run with -update if the change is intended\n--- want\n%s\n--- got\n%s", path, want, got)
+			}
+		})
+	}
+}
+
+// Serializes the parts of a response clients depend on
+func render(method, target string, rec *httptest.ResponseRecorder) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n%d\n", method, target, rec.Code)
+	for _, name := range []string{"Content-Type", "X-Cache", "X-Request-ID"} {
+		if v := rec.Header().Get(name); v != "" {
+			fmt.Fprintf(&buf, "%s: %s\n", name, v)
+		}
+	}
+	buf.WriteString("\n")
+	buf.Write(durationField.ReplaceAll(rec.Body.Bytes(), []byte(`"duration_ms":0`)))
+	return buf.String()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+)
+
+// How long after the request deadline answers are still merged. Fetches keep running for that
+// long past the deadline, so a source answering a few milliseconds late still makes it into
+// the response instead of being reported as budget_exceeded. 0 keeps the deadline a hard cliff.
+var (
+	graceMu   sync.RWMutex
+	lateGrace time.Duration
+)
+
+func registerGraceFlags(fs *flag.FlagSet, grace *time.Duration) {
+	fs.DurationVar(grace, "late.grace", 0, "answers arriving within this long after the request deadline are still merged, 0 disables the grace period")
+}
+
+func setLateGrace(d time.Duration) {
+	graceMu.Lock()
+	defer graceMu.Unlock()
+	lateGrace = d
+}
+
+func currentLateGrace() time.Duration {
+	graceMu.RLock()
+	defer graceMu.RUnlock()
+	return lateGrace
+}
+
+// Context for the fetches of a fan-out: like ctx, but with the deadline extended by the grace
+// period. Cancellation of ctx for any other reason, e.g. a client going away, still applies.
+func graceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	grace := currentLateGrace()
+	deadline, ok := ctx.Deadline()
+	if grace <= 0 || !ok {
+		return ctx, func() {}
+	}
+	fetchCtx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline.Add(grace))
+	stop := context.AfterFunc(ctx, func() {
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			cancel()
+		}
+	})
+	return fetchCtx, func() {
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLateGrace(t *testing.T) {
+	defer setLateGrace(currentLateGrace())
+	late := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+		w.Write([]byte(`{"numbers":[2]}`))
+	}))
+	defer late.Close()
+	onTime := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer onTime.Close()
+	o, _ := parseOptions(nil)
+	tests := []struct {
+		grace  time.Duration
+		want   int
+		failed int
+	}{
+		{grace: 0, want: 1, failed: 1},
+		{grace: time.Second, want: 2},
+	}
+	for _, tt := range tests {
+		setLateGrace(tt.grace)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		sum := run(ctx, []string{onTime.URL, late.URL}, o)
+		cancel()
+		if len(sum.numbers) != tt.want || sum.failed != tt.failed || sum.deadlineStage != requestStageFetch {
+			t.Errorf("grace %v: expected %d values and %d failed sources; got %v, %d failed, %q", tt.grace, tt.want, tt.failed, sum.numbers, sum.failed, sum.deadlineStage)
+		}
+		// The grace period ends as soon as every source answered
+		if took := time.Since(start); took > 500*time.Millisecond {
+			t.Errorf("grace %v: expected the request to end with the last answer; took %v", tt.grace, took)
+		}
+	}
+}
+
+func TestGraceContext(t *testing.T) {
+	defer setLateGrace(currentLateGrace())
+	setLateGrace(time.Minute)
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Hour)
+	ctx, cancel := graceContext(parent)
+	defer cancel()
+	if d, _ := ctx.Deadline(); d.Sub(time.Now()) < time.Hour {
+		t.Errorf("expected the deadline to be extended; got %v", d)
+	}
+	// A client going away isn't a deadline, the fetches stop right away
+	cancelParent()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("expected the cancellation to propagate")
+	}
+	setLateGrace(0)
+	if ctx, _ := graceContext(parent); ctx != parent {
+		t.Error("expected the context itself without a grace period")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A named set of upstream URLs which can be requested with ?g=name and, when Refresh is set,
+// is aggregated on a schedule with every result kept in the history store.
+type group struct {
+	URLs    []string `json:"urls"`
+	Refresh duration `json:"refresh,omitempty"`
+	// Request settings of URLs that aren't fetched with a plain GET. They apply wherever the
+	// URL is requested, also as a u parameter.
+	Sources map[string]sourceConfig `json:"sources,omitempty"`
+	// Applied to the numbers of every URL of the group before they are merged, see transform
+	Transform string `json:"transform,omitempty"`
+	// Notified whenever a scheduled aggregation changed the result
+	Webhook *webhookConfig `json:"webhook,omitempty"`
+	// Settings `ta-cli tune -write` measured for the group
+	Tuning *groupTuning `json:"tuning,omitempty"`
+}
+
+// Outcome of benchmarking a group. Its URLs are fetched with UpstreamTimeout unless a request
+// asks for less, the rest is kept for reference: Workers for -pool.max and HedgeAfter, the delay
+// after which a second request to a slow source paid off.
+type groupTuning struct {
+	UpstreamTimeout duration `json:"upstream_timeout,omitempty"`
+	Workers         int      `json:"workers,omitempty"`
+	HedgeAfter      duration `json:"hedge_after,omitempty"`
+	// Share of the sources answering within the budget and the p99 of the fan-outs
+	Completeness float64  `json:"completeness,omitempty"`
+	P99          duration `json:"p99,omitempty"`
+	TunedAt      string   `json:"tuned_at,omitempty"`
+}
+
+// time.Duration which reads and writes as "30s" in JSON
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type groupRegistry struct {
+	mu         sync.RWMutex
+	groups     map[string]group
+	sources    map[string]*sourceRequest
+	transforms map[string]*transform
+	// Tuned timeouts of the URLs, the longest when a URL is in several groups
+	timeouts map[string]time.Duration
+}
+
+var groups = &groupRegistry{groups: make(map[string]group)}
+
+func (g *groupRegistry) get(name string) (group, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	gr, ok := g.groups[name]
+	return gr, ok
+}
+
+func (g *groupRegistry) all() map[string]group {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	out := make(map[string]group, len(g.groups))
+	for name, gr := range g.groups {
+		out[name] = gr
+	}
+	return out
+}
+
+// Request settings of url, nil for a plain GET
+func (g *groupRegistry) source(url string) *sourceRequest {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.sources[url]
+}
+
+// Tuned timeout of url, 0 when none of its groups was tuned
+func (g *groupRegistry) timeout(url string) time.Duration {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.timeouts[url]
+}
+
+// Transform of the numbers of url, nil when they are merged as they are
+func (g *groupRegistry) transform(url string) *transform {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.transforms[url]
+}
+
+func (g *groupRegistry) set(all map[string]group) {
+	sources := make(map[string]*sourceRequest)
+	transforms := make(map[string]*transform)
+	timeouts := make(map[string]time.Duration)
+	for _, gr := range all {
+		if gr.Tuning != nil && gr.Tuning.UpstreamTimeout > 0 {
+			for _, url := range gr.URLs {
+				if d := time.Duration(gr.Tuning.UpstreamTimeout); d > timeouts[url] {
+					timeouts[url] = d
+				}
+			}
+		}
+		// Invalid configs were rejected by validateGroups
+		for url, c := range gr.Sources {
+			if s, err := compileSource(c); err == nil {
+				sources[url] = s
+			}
+		}
+		if gr.Transform == "" {
+			continue
+		}
+		if t, err := parseTransform(gr.Transform); err == nil {
+			for _, url := range gr.URLs {
+				transforms[url] = t
+			}
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.groups, g.sources, g.transforms, g.timeouts = all, sources, transforms, timeouts
+}
+
+// Reads groups from a JSON file of the form {"name": {"urls": [...], "refresh": "1m"}}. Sources
+// which need a POST are configured as "sources": {"url": {"method", "body", "content_type"}}.
+func loadGroups(path string) (map[string]group, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var all map[string]group
+	if err := json.NewDecoder(f).Decode(&all); err != nil {
+		return nil, fmt.Errorf("%s decoding error - %v", path, err)
+	}
+	return all, validateGroups(all)
+}
+
+func validateGroups(all map[string]group) error {
+	for name, gr := range all {
+		if len(gr.URLs) == 0 {
+			return fmt.Errorf("group %q has no urls", name)
+		}
+		if gr.Refresh < 0 {
+			return fmt.Errorf("group %q has a negative refresh", name)
+		}
+		if gr.Tuning != nil && (gr.Tuning.UpstreamTimeout < 0 || gr.Tuning.Workers < 0 || gr.Tuning.HedgeAfter < 0) {
+			return fmt.Errorf("group %q has a negative tuning", name)
+		}
+		if gr.Webhook != nil {
+			if gr.Refresh <= 0 {
+				return fmt.Errorf("group %q has a webhook but no refresh", name)
+			}
+			if err := gr.Webhook.validate(); err != nil {
+				return fmt.Errorf("group %q webhook: %v", name, err)
+			}
+		}
+	}
+	// A URL shared by several groups must be requested and transformed the same way by all of them
+	configs := make(map[string]sourceConfig)
+	transforms := make(map[string]string)
+	for name, gr := range all {
+		if gr.Transform != "" {
+			if _, err := parseTransform(gr.Transform); err != nil {
+				return fmt.Errorf("group %q transform: %v", name, err)
+			}
+		}
+		for _, url := range gr.URLs {
+			if prev, ok := transforms[url]; ok && prev != gr.Transform {
+				return fmt.Errorf("source %s is transformed differently in several groups", redact(url))
+			}
+			transforms[url] = gr.Transform
+		}
+		for url, c := range gr.Sources {
+			if _, err := compileSource(c); err != nil {
+				return fmt.Errorf("group %q source %s: %v", name, redact(url), err)
+			}
+			if prev, ok := configs[url]; ok && !reflect.DeepEqual(prev, c) {
+				return fmt.Errorf("source %s is configured differently in several groups", redact(url))
+			}
+			configs[url] = c
+			if !containsString(gr.URLs, url) {
+				return fmt.Errorf("group %q configures source %s which isn't one of its urls", name, redact(url))
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Collects the u parameters plus the URLs of every g parameter
+func resolveURLs(q url.Values) ([]string, error) {
+	urls := q["u"]
+	for _, name := range q["g"] {
+		gr, ok := groups.get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown group %q", name)
+		}
+		urls = append(urls, gr.URLs...)
+	}
+	return urls, nil
+}
+
+// Aggregates a group once, records the result in the history store and publishes it. Groups in
+// maintenance are skipped.
+func refreshGroup(ctx context.Context, name string, gr group) {
+	if maintenance.inGroup(name) {
+		// Its upstreams are being migrated, the last recorded result stands until it's done
+		return
+	}
+	o, _ := historyOptions(nil)
+	ctx, cancel := context.WithTimeout(ctx, timeout*time.Millisecond)
+	defer cancel()
+	sum := run(ctx, gr.URLs, o)
+	if sum.failed > 0 {
+		// Values of the failed sources would show up as removed, and as added again next time
+		httpMetrics.Add("refreshes_incomplete", 1)
+		log.Printf("group %s: %d of %d sources failed, the last recorded result stands", name, sum.failed, len(gr.URLs))
+		return
+	}
+	var prev *snapshot
+	if last, ok := history.latest(name); ok {
+		prev = &last
+	}
+	history.record(name, sum.numbers)
+	cur, _ := history.latest(name)
+	// Only complete results are announced, see above
+	resultPublisher.publishGroup(name, prev, cur)
+	notifyWebhook(name, gr.Webhook, prev, cur)
+}
+
+// Runs every group with a refresh interval on its own ticker until ctx is done.
+// Groups are re-read on every tick so that replaced configurations take effect.
+func schedule(ctx context.Context) {
+	all := groups.all()
+	names := make([]string, 0)
+	for name, gr := range all {
+		if gr.Refresh > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		go scheduleGroup(ctx, name, all[name])
+	}
+}
+
+// Runs gr as listed by schedule, the group may have been replaced or removed since
+func scheduleGroup(ctx context.Context, name string, gr group) {
+	log.Printf("scheduling group %s every %v", name, time.Duration(gr.Refresh))
+	refreshGroup(ctx, name, gr)
+	ticker := time.NewTicker(time.Duration(gr.Refresh))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gr, ok := groups.get(name)
+			if !ok || gr.Refresh <= 0 {
+				return
+			}
+			refreshGroup(ctx, name, gr)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
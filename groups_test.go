@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tt := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{name: "Valid", content: `{"primes": {"urls": ["http://a/primes"], "refresh": "30s"}}`, valid: true},
+		{name: "NoURLs", content: `{"empty": {"urls": []}}`},
+		{name: "BadRefresh", content: `{"primes": {"urls": ["http://a"], "refresh": "soon"}}`},
+		{name: "Source", content: `{"primes": {"urls": ["http://a"], "refresh": "30s", "sources": {"http://a": {"body": "{\"q\": \"primes\"}"}}}}`, valid: true},
+		{name: "SourceMethod", content: `{"primes": {"urls": ["http://a"], "sources": {"http://a": {"method": "DELETE"}}}}`},
+		{name: "SourceTemplate", content: `{"primes": {"urls": ["http://a"], "sources": {"http://a": {"body": "{{.Nope"}}}}`},
+		{name: "SourceNotInGroup", content: `{"primes": {"urls": ["http://a"], "sources": {"http://b": {"method": "POST"}}}}`},
+		{name: "Tuning", content: `{"primes": {"urls": ["http://a"], "refresh": "30s", "tuning": {"upstream_timeout": "300ms", "workers": 32, "hedge_after": "120ms", "completeness": 0.99, "p99": "280ms", "tuned_at": "2026-10-01T10:00:00Z"}}}`, valid: true},
+		{name: "NegativeTuning", content: `{"primes": {"urls": ["http://a"], "tuning": {"upstream_timeout": "-1s"}}}`},
+		{name: "SourceConflict", content: `{"a": {"urls": ["http://a"], "sources": {"http://a": {"method": "POST"}}}, "b": {"urls": ["http://a"], "sources": {"http://a": {"method": "PUT"}}}}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			all, err := loadGroups(path)
+			if !tc.valid {
+				if err == nil {
+					t.Errorf("expected an error for %s", tc.content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if time.Duration(all["primes"].Refresh) != 30*time.Second {
+				t.Errorf("unexpected refresh %v", all["primes"].Refresh)
+			}
+		})
+	}
+}
+
+func TestResolveURLs(t *testing.T) {
+	defer groups.set(groups.all())
+	groups.set(map[string]group{"g1": {URLs: []string{"http://a", "http://b"}}})
+	urls, err := resolveURLs(url.Values{"u": {"http://c"}, "g": {"g1"}})
+	if err != nil || len(urls) != 3 {
+		t.Errorf("expected 3 urls; got %v (%v)", urls, err)
+	}
+	if _, err := resolveURLs(url.Values{"g": {"nope"}}); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+}
+
+func TestScheduleRecordsHistory(t *testing.T) {
+	ts := newNumbersServer([]int{3, 2, 1})
+	defer ts.Close()
+	defer groups.set(groups.all())
+	groups.set(map[string]group{"sched": {URLs: []string{ts.URL}, Refresh: duration(time.Hour)}})
+	// Only a new aggregation may satisfy the test
+	defer history.load(history.dump())
+	history.load(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	schedule(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if s, ok := history.latest("sched"); ok {
+			if len(s.Numbers) != 3 || s.Numbers[0] != 1 {
+				t.Errorf("unexpected snapshot %v", s.Numbers)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("scheduled group was never aggregated")
+}
+
+func TestRefreshSkipsIncomplete(t *testing.T) {
+	ts := newNumbersServer([]int{1, 2})
+	defer ts.Close()
+	down := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer down.Close()
+	defer func(h *historyStore) { history = h }(history)
+	history = newHistoryStore()
+	refreshGroup(context.Background(), "g", group{URLs: []string{ts.URL, down.URL}})
+	if s, ok := history.latest("g"); ok {
+		t.Errorf("expected an incomplete result not to be recorded; got %v", s.Numbers)
+	}
+	refreshGroup(context.Background(), "g", group{URLs: []string{ts.URL}})
+	if _, ok := history.latest("g"); !ok {
+		t.Error("expected a complete result to be recorded")
+	}
+}
+
+func TestTunedTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"numbers": [1]}`))
+	}))
+	defer slow.Close()
+	defer groups.set(groups.all())
+	groups.set(map[string]group{
+		"tight": {URLs: []string{slow.URL}, Tuning: &groupTuning{UpstreamTimeout: duration(20 * time.Millisecond)}},
+		"loose": {URLs: []string{slow.URL, "http://b"}, Tuning: &groupTuning{UpstreamTimeout: duration(50 * time.Millisecond)}},
+	})
+	if d := groups.timeout(slow.URL); d != 50*time.Millisecond {
+		t.Errorf("expected the longest tuned timeout of a URL's groups; got %v", d)
+	}
+	o := options{upstreamTimeout: time.Second}
+	start := time.Now()
+	if _, err := fetch(context.Background(), currentTransport(), o, slow.URL); err == nil || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("expected the tuned timeout to cut the fetch short; got %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Upper bound on the number of explicit bucket boundaries a request may ask for
+const maxHistogramBounds = 1000
+
+// Counts values into buckets as they are merged so the raw values never need to be kept.
+// With explicit bounds b0 < b1 < ... < bn the buckets are (-inf,b0), [b0,b1) ... [bn,+inf).
+// Without bounds ("auto") values are grouped by magnitude into power of two buckets.
+type histogram struct {
+	bounds []int
+	counts map[int]int
+	total  int
+}
+
+// One bucket of the response. A nil bound means the bucket is unbounded on that side.
+type bucket struct {
+	Lower *int64 `json:"lower"`
+	Upper *int64 `json:"upper"`
+	Count int    `json:"count"`
+}
+
+func parseHistogram(v string) (*histogram, error) {
+	h := &histogram{counts: make(map[int]int)}
+	if v == "auto" {
+		return h, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) > maxHistogramBounds {
+		return nil, fmt.Errorf("histogram has more than %d bounds", maxHistogramBounds)
+	}
+	for i, part := range parts {
+		b, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram bound %q", part)
+		}
+		if i > 0 && b <= h.bounds[i-1] {
+			return nil, fmt.Errorf("histogram bounds must be strictly increasing")
+		}
+		h.bounds = append(h.bounds, b)
+	}
+	return h, nil
+}
+
+func (h *histogram) add(v int) {
+	h.total++
+	if h.bounds != nil {
+		h.counts[sort.Search(len(h.bounds), func(i int) bool { return h.bounds[i] > v })]++
+		return
+	}
+	h.counts[magnitude(v)]++
+}
+
+// Signed bit length of v. 0 for zero, k for values in [2^(k-1), 2^k) and -k for their negatives.
+func magnitude(v int) int {
+	if v >= 0 {
+		return bits.Len64(uint64(v))
+	}
+	// -(v+1) doesn't overflow for the minimum int
+	return -bits.Len64(uint64(-(v + 1)) + 1)
+}
+
+// Bounds of an auto bucket
+func magnitudeBounds(k int) (*int64, *int64) {
+	switch {
+	case k == 0:
+		return int64p(0), int64p(1)
+	case k > 0:
+		lower := int64(uint64(1) << uint(k-1))
+		if k == 63 {
+			return int64p(lower), nil
+		}
+		return int64p(lower), int64p(int64(uint64(1) << uint(k)))
+	}
+	// Negative buckets mirror the positive ones: [1-2^k, 1-2^(k-1)). The subtractions wrap
+	// around correctly for k == 63 and k == 64.
+	k = -k
+	upper := 1 - int64(uint64(1)<<uint(k-1))
+	if k == 64 {
+		return nil, int64p(upper)
+	}
+	return int64p(1 - int64(uint64(1)<<uint(k))), int64p(upper)
+}
+
+func (h *histogram) buckets() []bucket {
+	keys := make([]int, 0, len(h.counts))
+	for k := range h.counts {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	out := make([]bucket, 0, len(keys))
+	for _, k := range keys {
+		b := bucket{Count: h.counts[k]}
+		if h.bounds != nil {
+			if k > 0 {
+				b.Lower = int64p(int64(h.bounds[k-1]))
+			}
+			if k < len(h.bounds) {
+				b.Upper = int64p(int64(h.bounds[k]))
+			}
+		} else {
+			b.Lower, b.Upper = magnitudeBounds(k)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func int64p(v int64) *int64 {
+	return &v
+}
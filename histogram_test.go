@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHistogramExplicit(t *testing.T) {
+	h, err := parseHistogram("0,10,100")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, v := range []int{-5, 0, 9, 10, 99, 100, 1000, 5} {
+		h.add(v)
+	}
+	expected := []struct {
+		lower, upper *int64
+		count        int
+	}{
+		{nil, int64p(0), 1},
+		{int64p(0), int64p(10), 3},
+		{int64p(10), int64p(100), 2},
+		{int64p(100), nil, 2},
+	}
+	got := h.buckets()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d buckets; got %v", len(expected), got)
+	}
+	for i, e := range expected {
+		if !sameBound(got[i].Lower, e.lower) || !sameBound(got[i].Upper, e.upper) || got[i].Count != e.count {
+			t.Errorf("bucket %d: expected %v..%v=%d got %v..%v=%d", i, e.lower, e.upper, e.count, got[i].Lower, got[i].Upper, got[i].Count)
+		}
+	}
+}
+
+func TestHistogramAutoBoundsContainValues(t *testing.T) {
+	for _, v := range []int{0, 1, 2, 3, 4, 1023, 1024, -1, -2, -3, math.MaxInt64, math.MinInt64, math.MinInt64 + 1} {
+		lower, upper := magnitudeBounds(magnitude(v))
+		if lower != nil && int64(v) < *lower || upper != nil && int64(v) >= *upper {
+			t.Errorf("%d is outside of its bucket %v..%v", v, lower, upper)
+		}
+	}
+}
+
+func TestHistogramRejectsBadBounds(t *testing.T) {
+	for _, v := range []string{"1,1", "5,2", "a", ""} {
+		if _, err := parseHistogram(v); err == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+}
+
+func TestHistogramHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 1, 2, 3, 5, 8, 13, 21})))
+	defer ts.Close()
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?histogram=auto&verbose=count&u="+ts.URL, nil))
+	var body struct {
+		Numbers   []int    `json:"numbers"`
+		Histogram []bucket `json:"histogram"`
+		Count     int      `json:"count"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if body.Numbers != nil || body.Count != 7 || len(body.Histogram) != 5 {
+		t.Errorf("unexpected histogram response %+v", body)
+	}
+}
+
+func sameBound(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
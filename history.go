@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Number of aggregations kept per group
+const historyDepth = 16
+
+// One aggregation of a group
+type snapshot struct {
+	At      time.Time `json:"at"`
+	Numbers []int     `json:"numbers"`
+}
+
+// Keeps the most recent aggregations of every group, newest last
+type historyStore struct {
+	mu      sync.RWMutex
+	entries map[string][]snapshot
+	now     func() time.Time
+}
+
+var history = newHistoryStore()
+
+func newHistoryStore() *historyStore {
+	return &historyStore{entries: make(map[string][]snapshot), now: time.Now}
+}
+
+// Records the sorted, de-duplicated result of an aggregation
+func (h *historyStore) record(name string, numbers []int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := append(h.entries[name], snapshot{At: h.now(), Numbers: numbers})
+	if len(e) > historyDepth {
+		e = e[len(e)-historyDepth:]
+	}
+	h.entries[name] = e
+}
+
+// Copy of every group's history
+func (h *historyStore) dump() map[string][]snapshot {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string][]snapshot, len(h.entries))
+	for name, e := range h.entries {
+		out[name] = append([]snapshot(nil), e...)
+	}
+	return out
+}
+
+// Replaces the history of every group
+func (h *historyStore) load(entries map[string][]snapshot) {
+	if entries == nil {
+		entries = make(map[string][]snapshot)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = entries
+}
+
+func (h *historyStore) latest(name string) (snapshot, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	e := h.entries[name]
+	if len(e) == 0 {
+		return snapshot{}, false
+	}
+	return e[len(e)-1], true
+}
+
+// Values in b but not in a, and values in a but not in b. Both must be sorted and de-duplicated.
+func diff(a, b []int) (added, removed []int) {
+	added, removed = []int{}, []int{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case a[i] < b[j]:
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	removed = append(removed, a[i:]...)
+	added = append(added, b[j:]...)
+	return added, removed
+}
+
+type delta struct {
+	Group   string     `json:"group"`
+	Since   *time.Time `json:"since"`
+	Added   []int      `json:"added"`
+	Removed []int      `json:"removed"`
+}
+
+// Options of aggregations compared with the history, which have no options but a deadline
+func historyOptions(q url.Values) (options, error) {
+	o, err := parseOptions(url.Values{"timeout": q["timeout"]})
+	// diff walks both results in order, whatever -sort.policy says
+	o.sortPolicy = sortWait
+	return o, err
+}
+
+// Aggregates a group now and reports what changed since its last recorded aggregation.
+// Without any history every value is reported as added. There is no delta when sources failed.
+func deltaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	q := r.URL.Query()
+	o, err := historyOptions(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
+		return
+	}
+	ctx, cancel := requestContext(r, o.deadline)
+	defer cancel()
+	name := q.Get("g")
+	gr, ok := groups.get(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - unknown group"))
+		return
+	}
+	if perr := checkTenantRequest(ctx, q, gr.URLs, o); perr != nil {
+		perr.write(w)
+		return
+	}
+	sum := run(ctx, gr.URLs, o)
+	if sum.failed > 0 {
+		// The values of the failed sources aren't gone
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("502 - %d of %d sources of group %s failed, no delta of an incomplete result", sum.failed, len(gr.URLs), name)))
+		return
+	}
+	current := sum.numbers
+	d := delta{Group: name}
+	var previous []int
+	if last, ok := history.latest(name); ok {
+		d.Since = &last.At
+		previous = last.Numbers
+	}
+	d.Added, d.Removed = diff(previous, current)
+	json.NewEncoder(w).Encode(d)
+}
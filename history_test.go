@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	added, removed := diff([]int{1, 2, 4, 7}, []int{2, 3, 4, 8, 9})
+	if !(&result{Numbers: added}).equals(result{Numbers: []int{3, 8, 9}}) {
+		t.Errorf("unexpected added %v", added)
+	}
+	if !(&result{Numbers: removed}).equals(result{Numbers: []int{1, 7}}) {
+		t.Errorf("unexpected removed %v", removed)
+	}
+}
+
+func TestHistoryDepth(t *testing.T) {
+	h := newHistoryStore()
+	for i := 0; i < historyDepth+5; i++ {
+		h.record("g", []int{i})
+	}
+	if n := len(h.entries["g"]); n != historyDepth {
+		t.Errorf("expected %d entries; got %d", historyDepth, n)
+	}
+	if s, _ := h.latest("g"); s.Numbers[0] != historyDepth+4 {
+		t.Errorf("expected the newest entry last; got %v", s.Numbers)
+	}
+}
+
+func TestDeltaHandler(t *testing.T) {
+	ts := newNumbersServer([]int{2, 3, 4})
+	defer ts.Close()
+	defer groups.set(groups.all())
+	groups.set(map[string]group{"d": {URLs: []string{ts.URL}}})
+	history.record("d", []int{1, 2, 3})
+
+	rec := httptest.NewRecorder()
+	deltaHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"/delta?g=d", nil))
+	var d delta
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if d.Since == nil || len(d.Added) != 1 || d.Added[0] != 4 || len(d.Removed) != 1 || d.Removed[0] != 1 {
+		t.Errorf("unexpected delta %+v", d)
+	}
+
+	rec = httptest.NewRecorder()
+	deltaHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"/delta?g=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status not found; got %v", rec.Code)
+	}
+	// A failed source's values would be reported as removed
+	down := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer down.Close()
+	groups.set(map[string]group{"d": {URLs: []string{ts.URL, down.URL}}})
+	rec = httptest.NewRecorder()
+	deltaHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"/delta?g=d", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected no delta of an incomplete result; got %v %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeltaHandlerPolicies(t *testing.T) {
+	// The source never answers in time, only the deadline ends the aggregation
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	defer groups.set(groups.all())
+	groups.set(map[string]group{"d": {URLs: []string{ts.URL}}, "two": {URLs: []string{ts.URL, ts.URL + "/b"}}})
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"acme": {MaxURLs: 1, Deadline: duration(200 * time.Millisecond)}})
+	tests := []struct {
+		query  string
+		tenant string
+		status int
+	}{
+		{query: "g=two", tenant: "acme", status: http.StatusForbidden},
+		{query: "g=d&timeout=1s", tenant: "acme", status: http.StatusForbidden},
+		{query: "g=missing&timeout=100ms", tenant: "acme", status: http.StatusNotFound},
+		{query: "g=d&timeout=1h", status: http.StatusBadRequest},
+		{query: "g=d&timeout=100ms", tenant: "acme", status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, endpoint+"/delta?"+tt.query, nil)
+		rec := httptest.NewRecorder()
+		deltaHandler(rec, req.WithContext(withTenant(req.Context(), tt.tenant)))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d; got %d %s", tt.query, tt.status, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestHistoryOptionsSorted(t *testing.T) {
+	defer setSortPolicy(currentSortPolicy())
+	for _, policy := range []string{sortPartial, sortUnsorted} {
+		setSortPolicy(policy)
+		if o, _ := historyOptions(nil); o.sortPolicy != sortWait {
+			t.Errorf("%s: expected results diffed against the history to be sorted; got %s", policy, o.sortPolicy)
+		}
+	}
+}
+
+func newNumbersServer(numbers []int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(simpleHandler(numbers)))
+}
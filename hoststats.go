@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of samples kept per host and how far back they are considered
+	statsSamples = 512
+	statsWindow  = 5 * time.Minute
+	// Consecutive failures after which a host's breaker opens, and how long it stays open
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+type sample struct {
+	at      time.Time
+	latency time.Duration
+	bytes   int64
+	ok      bool
+}
+
+type hostStats struct {
+	samples  []sample
+	next     int
+	failures int
+	state    string
+	openedAt time.Time
+}
+
+// Tracks rolling per-host statistics and the circuit breaker state derived from them
+type hostTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+	now   func() time.Time
+}
+
+var upstreamStats = newHostTracker()
+
+func newHostTracker() *hostTracker {
+	return &hostTracker{hosts: make(map[string]*hostStats), now: time.Now}
+}
+
+func (t *hostTracker) get(host string) *hostStats {
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &hostStats{samples: make([]sample, 0, statsSamples), state: breakerClosed}
+		t.hosts[host] = h
+	}
+	return h
+}
+
+// Reports whether a request to host may go ahead. Once the cooldown of an open breaker has
+// passed a single probe is let through.
+func (t *hostTracker) allow(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(host)
+	switch h.state {
+	case breakerOpen:
+		if t.now().Sub(h.openedAt) < breakerCooldown {
+			return false
+		}
+		h.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// Ends a probe without a verdict on the host, e.g. when its request was cancelled. The
+// breaker opens again for a cooldown, after which another probe is let through.
+func (t *hostTracker) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(host)
+	if h.state == breakerHalfOpen {
+		h.state = breakerOpen
+		h.openedAt = t.now()
+	}
+}
+
+func (t *hostTracker) record(host string, latency time.Duration, bytes int64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(host)
+	s := sample{at: t.now(), latency: latency, bytes: bytes, ok: ok}
+	if len(h.samples) < statsSamples {
+		h.samples = append(h.samples, s)
+	} else {
+		h.samples[h.next] = s
+	}
+	h.next = (h.next + 1) % statsSamples
+	if ok {
+		h.failures = 0
+		h.state = breakerClosed
+		return
+	}
+	h.failures++
+	if h.state == breakerHalfOpen || h.failures >= breakerThreshold {
+		h.state = breakerOpen
+		h.openedAt = s.at
+	}
+}
+
+// Point in time view of a host's rolling window
+type hostSnapshot struct {
+	Host        string  `json:"host"`
+	Requests    int     `json:"requests"`
+	SuccessRate float64 `json:"success_rate"`
+	LatencyP50  float64 `json:"latency_p50_ms"`
+	LatencyP90  float64 `json:"latency_p90_ms"`
+	LatencyP99  float64 `json:"latency_p99_ms"`
+	Bytes       int64   `json:"bytes"`
+	Breaker     string  `json:"breaker"`
+}
+
+func (t *hostTracker) snapshot() []hostSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-statsWindow)
+	out := make([]hostSnapshot, 0, len(t.hosts))
+	for host, h := range t.hosts {
+		snap := hostSnapshot{Host: host, Breaker: h.state}
+		latencies := make([]time.Duration, 0, len(h.samples))
+		ok := 0
+		for _, s := range h.samples {
+			if s.at.Before(cutoff) {
+				continue
+			}
+			latencies = append(latencies, s.latency)
+			snap.Bytes += s.bytes
+			if s.ok {
+				ok++
+			}
+		}
+		snap.Requests = len(latencies)
+		if snap.Requests > 0 {
+			snap.SuccessRate = float64(ok) / float64(snap.Requests)
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			snap.LatencyP50 = percentile(latencies, 0.50)
+			snap.LatencyP90 = percentile(latencies, 0.90)
+			snap.LatencyP99 = percentile(latencies, 0.99)
+		}
+		out = append(out, snap)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// Totals across every host for the samples taken within the last d, used to tune the worker pool
+func (t *hostTracker) overall(d time.Duration) (requests, failed int, p90 time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-d)
+	var latencies []time.Duration
+	for _, h := range t.hosts {
+		for _, s := range h.samples {
+			if s.at.Before(cutoff) {
+				continue
+			}
+			latencies = append(latencies, s.latency)
+			if !s.ok {
+				failed++
+			}
+		}
+	}
+	if len(latencies) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return len(latencies), failed, time.Duration(percentile(latencies, 0.90) * float64(time.Millisecond))
+}
+
+// Latency at percentile p of the successful fetches from host within the stats window
+func (t *hostTracker) okLatency(host string, p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[host]
+	if !ok {
+		return 0, false
+	}
+	cutoff := t.now().Add(-statsWindow)
+	var latencies []time.Duration
+	for _, s := range h.samples {
+		if s.ok && !s.at.Before(cutoff) {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return 0, false
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return time.Duration(percentile(latencies, p) * float64(time.Millisecond)), true
+}
+
+// Nearest-rank percentile of sorted latencies, in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+func upstreamStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"hosts": upstreamStats.snapshot()})
+}
+
+// Counts the bytes read from an upstream body
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostTrackerBreaker(t *testing.T) {
+	now := time.Now()
+	tr := newHostTracker()
+	tr.now = func() time.Time { return now }
+	for i := 0; i < breakerThreshold; i++ {
+		if !tr.allow("a") {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		tr.record("a", time.Millisecond, 0, false)
+	}
+	if tr.allow("a") {
+		t.Fatal("expected breaker to be open")
+	}
+	now = now.Add(breakerCooldown)
+	if !tr.allow("a") {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if tr.allow("a") {
+		t.Fatal("expected only a single probe while half open")
+	}
+	tr.record("a", time.Millisecond, 10, true)
+	if !tr.allow("a") {
+		t.Fatal("expected breaker to close after a successful probe")
+	}
+}
+
+func TestBreakerProbeCancelled(t *testing.T) {
+	defer func(tr *hostTracker) { upstreamStats = tr }(upstreamStats)
+	upstreamStats = newHostTracker()
+	now := time.Now()
+	upstreamStats.now = func() time.Time { return now }
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	for i := 0; i < breakerThreshold; i++ {
+		upstreamStats.record(host, time.Millisecond, 0, false)
+	}
+	now = now.Add(breakerCooldown)
+	// The probe's request is cancelled by the client
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	o, _ := parseOptions(nil)
+	if _, err := fetch(ctx, currentTransport(), o, ts.URL); err == nil {
+		t.Fatal("expected the probe to fail")
+	}
+	if upstreamStats.allow(host) {
+		t.Error("expected the breaker to open again for a cooldown")
+	}
+	now = now.Add(breakerCooldown)
+	if !upstreamStats.allow(host) {
+		t.Error("expected another probe after the cooldown")
+	}
+}
+
+func TestHostTrackerSnapshot(t *testing.T) {
+	tr := newHostTracker()
+	for i := 1; i <= 10; i++ {
+		tr.record("a", time.Duration(i)*time.Millisecond, 100, i%5 != 0)
+	}
+	snap := tr.snapshot()
+	if len(snap) != 1 {
+		t.Fatalf("expected a single host; got %v", snap)
+	}
+	s := snap[0]
+	if s.Requests != 10 || s.SuccessRate != 0.8 || s.Bytes != 1000 {
+		t.Errorf("unexpected counters %+v", s)
+	}
+	if s.LatencyP50 != 5 || s.LatencyP90 != 9 || s.LatencyP99 != 10 {
+		t.Errorf("unexpected percentiles %+v", s)
+	}
+	if s.Breaker != breakerClosed {
+		t.Errorf("expected closed breaker; got %v", s.Breaker)
+	}
+}
+
+func TestUpstreamStatsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	upstreamStatsHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/upstreams/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", rec.Code)
+	}
+	var body struct {
+		Hosts []hostSnapshot `json:"hosts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+}
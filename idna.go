@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rewrites the host of a source URL to its lowercase ASCII form, with internationalized labels
+// encoded as punycode, so that policy checks, host statistics and the transport all see the
+// name that is actually resolved. Labels which aren't valid IDNA2008, or which mix scripts the
+// way confusable look-alikes of other domains do, are rejected, whether given in Unicode or
+// already as xn-- labels.
+func normalizeURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		// Left to the request, which reports what's wrong with it
+		return raw, nil
+	}
+	host, port := u.Hostname(), u.Port()
+	if net.ParseIP(host) != nil {
+		return raw, nil
+	}
+	ascii, err := toASCIIHost(host)
+	if err != nil {
+		return "", err
+	}
+	if ascii == host {
+		return raw, nil
+	}
+	u.Host = ascii
+	if port != "" {
+		u.Host = net.JoinHostPort(ascii, port)
+	}
+	return u.String(), nil
+}
+
+// Longest DNS name without the trailing dot, and longest label
+const (
+	maxHostLength  = 253
+	maxLabelLength = 63
+)
+
+func toASCIIHost(host string) (string, error) {
+	host = strings.Map(mapIDNA, host)
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		// A trailing dot marks a fully qualified name
+		if label == "" && i == len(labels)-1 && i > 0 {
+			continue
+		}
+		ascii, err := toASCIILabel(label)
+		if err != nil {
+			return "", fmt.Errorf("invalid host %q - %v", host, err)
+		}
+		labels[i] = ascii
+	}
+	out := strings.Join(labels, ".")
+	if len(strings.TrimSuffix(out, ".")) > maxHostLength {
+		return "", fmt.Errorf("invalid host %q - longer than %d characters", host, maxHostLength)
+	}
+	return out, nil
+}
+
+// The part of the UTS #46 mapping that matters for host names: case folding and the full-width
+// and ideographic forms of ASCII and of the dot
+func mapIDNA(r rune) rune {
+	switch {
+	case r == '。' || r == '｡':
+		return '.'
+	case r >= '！' && r <= '～':
+		r -= 0xfee0
+	}
+	return unicode.ToLower(r)
+}
+
+func toASCIILabel(label string) (string, error) {
+	if label == "" {
+		return "", errors.New("empty label")
+	}
+	// Plain ASCII names are left alone, DNS allows more in them than IDNA, e.g. underscores
+	if isASCII(label) && !strings.HasPrefix(label, "xn--") {
+		return label, nil
+	}
+	ascii := label
+	if strings.HasPrefix(label, "xn--") {
+		decoded, err := punycodeDecode(label[4:])
+		if err != nil {
+			return "", fmt.Errorf("label %q is not valid punycode", label)
+		}
+		// Only the encoding of a lowercase Unicode label is accepted, so that every name has
+		// a single spelling
+		if enc, _ := punycodeEncode(decoded); isASCII(decoded) || decoded != strings.Map(mapIDNA, decoded) || enc != label[4:] {
+			return "", fmt.Errorf("label %q is not in canonical form", label)
+		}
+		label = decoded
+	} else {
+		enc, err := punycodeEncode(label)
+		if err != nil {
+			return "", err
+		}
+		ascii = "xn--" + enc
+	}
+	if len(label) >= 4 && label[2:4] == "--" {
+		return "", fmt.Errorf("label %q has hyphens in the third and fourth position", label)
+	}
+	if err := checkLabel(label); err != nil {
+		return "", err
+	}
+	if len(ascii) > maxLabelLength {
+		return "", fmt.Errorf("label %q is longer than %d characters", label, maxLabelLength)
+	}
+	return ascii, nil
+}
+
+// Script combinations that are commonly written together. Any other mix within a label is
+// rejected, as that is how look-alikes such as a Cyrillic "а" in "pаypal" are built.
+var compatibleScripts = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Hangul"},
+	{"Latin", "Han", "Bopomofo"},
+}
+
+func checkLabel(label string) error {
+	if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	scripts := make(map[string]bool)
+	for i, r := range label {
+		switch {
+		case r == '-':
+		case unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r):
+			if i == 0 {
+				return fmt.Errorf("label %q starts with a combining mark", label)
+			}
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if s := scriptOf(r); s != "Common" && s != "Inherited" {
+				scripts[s] = true
+			}
+		default:
+			return fmt.Errorf("label %q contains the disallowed character %U", label, r)
+		}
+	}
+	if len(scripts) < 2 {
+		return nil
+	}
+	for _, allowed := range compatibleScripts {
+		n := 0
+		for _, s := range allowed {
+			if scripts[s] {
+				n++
+			}
+		}
+		if n == len(scripts) {
+			return nil
+		}
+	}
+	return fmt.Errorf("label %q mixes scripts", label)
+}
+
+func scriptOf(r rune) string {
+	if r < utf8.RuneSelf {
+		if unicode.IsLetter(r) {
+			return "Latin"
+		}
+		return "Common"
+	}
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return "Unknown"
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Bootstring parameters of punycode, RFC 3492 section 5
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycodeOverflow = errors.New("punycode overflow")
+
+func punycodeEncode(s string) (string, error) {
+	runes := []rune(s)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h < len(runes) {
+		m := rune(math.MaxInt32)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (math.MaxInt32-delta)/(h+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func punycodeDecode(s string) (string, error) {
+	var out []rune
+	pos := 0
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		for j := 0; j < i; j++ {
+			if s[j] >= utf8.RuneSelf {
+				return "", errors.New("non-ASCII basic code point")
+			}
+			out = append(out, rune(s[j]))
+		}
+		pos = i + 1
+	}
+	n, bias, i := punyInitialN, punyInitialBias, 0
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos == len(s) {
+				return "", errors.New("truncated punycode")
+			}
+			d := punyDigitValue(s[pos])
+			pos++
+			if d < 0 {
+				return "", fmt.Errorf("invalid punycode digit %q", s[pos-1])
+			}
+			if d > (math.MaxInt32-i)/w {
+				return "", errPunycodeOverflow
+			}
+			i += d * w
+			t := punyThreshold(k, bias)
+			if d < t {
+				break
+			}
+			if w > math.MaxInt32/(punyBase-t) {
+				return "", errPunycodeOverflow
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(out)+1, oldi == 0)
+		if i/(len(out)+1) > math.MaxInt32-n {
+			return "", errPunycodeOverflow
+		}
+		n += i / (len(out) + 1)
+		if n > unicode.MaxRune {
+			return "", errPunycodeOverflow
+		}
+		i %= len(out) + 1
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = rune(n)
+		i++
+	}
+	return string(out), nil
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDigitValue(c byte) int {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	}
+	return -1
+}
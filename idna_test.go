@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "http://127.0.0.1:8080/primes", want: "http://127.0.0.1:8080/primes"},
+		{raw: "http://my_host/primes", want: "http://my_host/primes"},
+		{raw: "https://Numbers.EXAMPLE.com/odd", want: "https://numbers.example.com/odd"},
+		{raw: "https://bücher.example/odd", want: "https://xn--bcher-kva.example/odd"},
+		{raw: "https://BÜCHER.example:8443/odd?x=1", want: "https://xn--bcher-kva.example:8443/odd?x=1"},
+		{raw: "https://例え.テスト/", want: "https://xn--r8jz45g.xn--zckzah/"},
+		{raw: "https://ｅｘａｍｐｌｅ。com/", want: "https://example.com/"},
+		{raw: "https://xn--bcher-kva.example/", want: "https://xn--bcher-kva.example/"},
+		{raw: "https://münchen.example./", want: "https://xn--mnchen-3ya.example./"},
+		// Cyrillic "а" in an otherwise Latin label, as Unicode and as punycode
+		{raw: "https://pаypal.com/", wantErr: true},
+		{raw: "https://xn--pypal-4ve.com/", wantErr: true},
+		{raw: "https://XN--BCHER-KVA.example/", want: "https://xn--bcher-kva.example/"},
+		// Decodes to an ASCII label, which must not be spelled as punycode
+		{raw: "https://xn--abc-.example/", wantErr: true},
+		{raw: "https://xn--zz.example/", wantErr: true},
+		{raw: "https://bü..example/", wantErr: true},
+		{raw: "https://-bü.example/", wantErr: true},
+		{raw: "https://bü☃.example/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeURL(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v; got %v", tt.raw, tt.wantErr, err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: expected %s; got %s", tt.raw, tt.want, got)
+		}
+	}
+}
+
+func TestPunycodeRoundTrip(t *testing.T) {
+	// RFC 3492 section 7.1 samples
+	tests := map[string]string{
+		"他们为什么不说中文":         "ihqwcrb4cv8a8dqg056pqjye",
+		"ليهمابتكلموشعربي؟": "egbpdaj6bu4bxfgehfvwxn",
+		"3年b組金八先生":          "3b-ww4c5e180e575a65lsy2b",
+		"bücher":            "bcher-kva",
+	}
+	for in, want := range tests {
+		got, err := punycodeEncode(in)
+		if err != nil || got != want {
+			t.Errorf("encode %s: expected %s; got %s, %v", in, want, got, err)
+		}
+		back, err := punycodeDecode(want)
+		if err != nil || back != in {
+			t.Errorf("decode %s: expected %s; got %s, %v", want, in, back, err)
+		}
+	}
+}
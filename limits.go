@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Where the container limits are read from
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup v1 reports "no limit" as a huge page aligned value
+const cgroupUnlimited = 1 << 62
+
+func registerRuntimeFlags(fs *flag.FlagSet, procs *int, memLimit *string, ratio *float64) {
+	fs.IntVar(procs, "runtime.gomaxprocs", 0, "GOMAXPROCS, 0 uses $GOMAXPROCS or the container CPU quota")
+	fs.StringVar(memLimit, "runtime.memlimit", "", "soft memory limit such as 512MiB, empty uses $GOMEMLIMIT or a share of the container memory limit")
+	fs.Float64Var(ratio, "runtime.memlimit-ratio", 0.9, "share of the container memory limit used as soft memory limit")
+}
+
+// Sizes the scheduler and the garbage collector after the container limits, so a CPU quota
+// doesn't turn into throttling and the GC works harder before the kernel OOM kills us.
+// Explicit flags win over the environment, which wins over what is detected.
+func applyRuntimeLimits(procs int, memLimit string, ratio float64) error {
+	if ratio <= 0 || ratio > 1 {
+		return errors.New("-runtime.memlimit-ratio must be in (0, 1]")
+	}
+	source := "default"
+	switch {
+	case procs > 0:
+		runtime.GOMAXPROCS(procs)
+		source = "flag"
+	case os.Getenv("GOMAXPROCS") != "":
+		source = "$GOMAXPROCS"
+	default:
+		if quota, ok := cgroupCPUQuota(cgroupRoot); ok {
+			n := int(quota)
+			if n < 1 {
+				n = 1
+			}
+			runtime.GOMAXPROCS(n)
+			source = fmt.Sprintf("cgroup quota %.2f CPUs", quota)
+		}
+	}
+	log.Printf("runtime: GOMAXPROCS=%d (%s)", runtime.GOMAXPROCS(0), source)
+
+	source = "none"
+	switch {
+	case memLimit != "":
+		n, err := parseByteSize(memLimit)
+		if err != nil {
+			return fmt.Errorf("invalid -runtime.memlimit: %v", err)
+		}
+		debug.SetMemoryLimit(n)
+		source = "flag"
+	case os.Getenv("GOMEMLIMIT") != "":
+		source = "$GOMEMLIMIT"
+	default:
+		if limit, ok := cgroupMemoryLimit(cgroupRoot); ok {
+			debug.SetMemoryLimit(int64(float64(limit) * ratio))
+			source = fmt.Sprintf("%.0f%% of the cgroup limit %s", ratio*100, formatBytes(limit))
+		}
+	}
+	// A negative limit only reads the current value
+	if n := debug.SetMemoryLimit(-1); n != math.MaxInt64 {
+		log.Printf("runtime: memory limit %s (%s)", formatBytes(n), source)
+	} else {
+		log.Printf("runtime: no memory limit")
+	}
+	return nil
+}
+
+// CPUs granted by the cgroup v2 cpu.max or the v1 CFS quota
+func cgroupCPUQuota(root string) (float64, bool) {
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) == 2 && f[0] != "max" {
+			return quotaOf(f[0], f[1])
+		}
+		return 0, false
+	}
+	quota, err1 := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	period, err2 := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return quotaOf(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func quotaOf(quota, period string) (float64, bool) {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// Bytes allowed by the cgroup v2 memory.max or the v1 memory.limit_in_bytes
+func cgroupMemoryLimit(root string) (int64, bool) {
+	for _, name := range []string{"memory.max", filepath.Join("memory", "memory.limit_in_bytes")} {
+		b, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil || n <= 0 || n >= cgroupUnlimited {
+			// "max" or the v1 placeholder for no limit
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1},
+}
+
+// Parses sizes in the GOMEMLIMIT syntax, e.g. 512MiB or a plain number of bytes
+func parseByteSize(s string) (int64, error) {
+	mult := int64(1)
+	num := s
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			mult, num = u.size, strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("%q is not a positive size like 512MiB", s)
+	}
+	return n * mult, nil
+}
+
+func formatBytes(n int64) string {
+	for _, u := range byteUnits {
+		if n >= u.size && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
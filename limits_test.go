@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func cgroupDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCgroupLimits(t *testing.T) {
+	tt := []struct {
+		name   string
+		files  map[string]string
+		cpus   float64
+		memory int64
+	}{
+		{name: "V2", files: map[string]string{"cpu.max": "250000 100000\n", "memory.max": "1073741824\n"}, cpus: 2.5, memory: 1 << 30},
+		{name: "V2Unlimited", files: map[string]string{"cpu.max": "max 100000\n", "memory.max": "max\n"}},
+		{name: "V1", files: map[string]string{"cpu/cpu.cfs_quota_us": "50000\n", "cpu/cpu.cfs_period_us": "100000\n", "memory/memory.limit_in_bytes": "536870912\n"}, cpus: 0.5, memory: 512 << 20},
+		{name: "V1Unlimited", files: map[string]string{"cpu/cpu.cfs_quota_us": "-1\n", "cpu/cpu.cfs_period_us": "100000\n", "memory/memory.limit_in_bytes": "9223372036854771712\n"}},
+		{name: "None", files: map[string]string{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := cgroupDir(t, tc.files)
+			defer os.RemoveAll(dir)
+			cpus, ok := cgroupCPUQuota(dir)
+			if ok != (tc.cpus > 0) || cpus != tc.cpus {
+				t.Errorf("expected %v CPUs; got %v (%v)", tc.cpus, cpus, ok)
+			}
+			memory, ok := cgroupMemoryLimit(dir)
+			if ok != (tc.memory > 0) || memory != tc.memory {
+				t.Errorf("expected a limit of %d bytes; got %d (%v)", tc.memory, memory, ok)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tt := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "512MiB", want: 512 << 20},
+		{in: "2GiB", want: 2 << 30},
+		{in: "10B", want: 10},
+		{in: "1.5GiB", err: true},
+		{in: "-1", err: true},
+		{in: "lots", err: true},
+		{in: "9999999TiB", err: true},
+	}
+	for _, tc := range tt {
+		got, err := parseByteSize(tc.in)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("%q: expected %d (error %v); got %d (%v)", tc.in, tc.want, tc.err, got, err)
+		}
+	}
+	if s := formatBytes(900 << 20); s != "900MiB" {
+		t.Errorf("expected 900MiB; got %s", s)
+	}
+}
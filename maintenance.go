@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Routes that can be put into maintenance, the ones that fan out to upstreams
+var maintainableRoutes = []string{endpoint, endpoint + "/delta", "/aggregate"}
+
+// Default message of a maintenance window
+const maintenanceMessage = "Down for maintenance, try again later"
+
+// A route or group in maintenance. Requests to it get a 503 until the window is ended.
+type maintenanceWindow struct {
+	Route   string `json:"route,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Message string `json:"message"`
+	// Seconds clients are told to wait in Retry-After, 0 leaves the header out
+	RetryAfter int       `json:"retry_after"`
+	Since      time.Time `json:"since"`
+}
+
+type maintenanceState struct {
+	mu     sync.RWMutex
+	routes map[string]maintenanceWindow
+	groups map[string]maintenanceWindow
+}
+
+var maintenance = newMaintenanceState()
+
+func newMaintenanceState() *maintenanceState {
+	return &maintenanceState{routes: make(map[string]maintenanceWindow), groups: make(map[string]maintenanceWindow)}
+}
+
+func (m *maintenanceState) start(w maintenanceWindow) error {
+	if (w.Route == "") == (w.Group == "") {
+		return fmt.Errorf("exactly one of route and group is required")
+	}
+	if w.Route != "" && !containsString(maintainableRoutes, w.Route) {
+		return fmt.Errorf("invalid route %q, expected one of %v", w.Route, maintainableRoutes)
+	}
+	if _, ok := groups.get(w.Group); w.Group != "" && !ok {
+		return fmt.Errorf("unknown group %q", w.Group)
+	}
+	if w.RetryAfter < 0 {
+		return fmt.Errorf("invalid retry_after %d", w.RetryAfter)
+	}
+	if w.Message == "" {
+		w.Message = maintenanceMessage
+	}
+	w.Since = time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w.Route != "" {
+		m.routes[w.Route] = w
+	} else {
+		m.groups[w.Group] = w
+	}
+	return nil
+}
+
+// Ends the window of route or group, reports whether there was one
+func (m *maintenanceState) end(route, group string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, okRoute := m.routes[route]
+	_, okGroup := m.groups[group]
+	delete(m.routes, route)
+	delete(m.groups, group)
+	return okRoute || okGroup
+}
+
+// Window that applies to a request for path and groups, the route's before any group's
+func (m *maintenanceState) lookup(path string, groupNames []string) (maintenanceWindow, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if w, ok := m.routes[path]; ok {
+		return w, true
+	}
+	for _, name := range groupNames {
+		if w, ok := m.groups[name]; ok {
+			return w, true
+		}
+	}
+	return maintenanceWindow{}, false
+}
+
+func (m *maintenanceState) inGroup(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.groups[name]
+	return ok
+}
+
+func (m *maintenanceState) list() []maintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]maintenanceWindow, 0, len(m.routes)+len(m.groups))
+	for _, w := range m.routes {
+		out = append(out, w)
+	}
+	for _, w := range m.groups {
+		out = append(out, w)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route+" "+out[i].Group < out[j].Route+" "+out[j].Group })
+	return out
+}
+
+// Route middleware answering 503 while the route, or a group the request names, is in maintenance
+func underMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		win, ok := maintenance.lookup(r.URL.Path, r.URL.Query()["g"])
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		httpMetrics.Add("maintenance_rejected", 1)
+		if win.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(win.RetryAfter))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("503 - " + win.Message))
+	})
+}
+
+// GET lists the maintenance windows, POST starts one from a JSON maintenanceWindow and DELETE
+// ends the one named by the route or group query parameter
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var win maintenanceWindow
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&win)
+		if err == nil {
+			err = maintenance.start(win)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - " + err.Error()))
+			return
+		}
+	case http.MethodDelete:
+		q := r.URL.Query()
+		if !maintenance.end(q.Get("route"), q.Get("group")) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - not in maintenance"))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.list())
+}
+
+// Liveness probe. Stays green during maintenance, the service itself is fine.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "maintenance": len(maintenance.list())})
+}
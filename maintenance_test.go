@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	defer groups.set(groups.all())
+	groups.set(map[string]group{"g1": {URLs: []string{"http://a"}}})
+	defer func() { maintenance = newMaintenanceState() }()
+	maintenance = newMaintenanceState()
+	h := routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	for _, body := range []string{`{}`, `{"route":"/admin/pool"}`, `{"group":"nope"}`, `{"route":"/numbers","group":"g1"}`, `{"route":"/numbers","retry_after":-1}`, `{`} {
+		if rec := do(http.MethodPost, "/admin/maintenance", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400; got %d", body, rec.Code)
+		}
+	}
+	if rec := do(http.MethodPost, "/admin/maintenance", `{"route":"/numbers","message":"migrating","retry_after":600}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/admin/maintenance", `{"group":"g1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		target     string
+		code       int
+		retryAfter string
+		body       string
+	}{
+		{target: "/numbers?u=http://a", code: http.StatusServiceUnavailable, retryAfter: "600", body: "503 - migrating"},
+		{target: "/aggregate?g=g1", code: http.StatusServiceUnavailable, body: "503 - " + maintenanceMessage},
+		{target: "/healthz", code: http.StatusOK, body: `"status":"ok"`},
+	}
+	for _, tt := range tests {
+		rec := do(http.MethodGet, tt.target, "")
+		if rec.Code != tt.code || rec.Header().Get("Retry-After") != tt.retryAfter || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: expected %d %q %q; got %d %q %q", tt.target, tt.code, tt.retryAfter, tt.body, rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+		}
+	}
+	if !maintenance.inGroup("g1") {
+		t.Error("expected g1 in maintenance")
+	}
+
+	var listed []maintenanceWindow
+	if err := json.NewDecoder(do(http.MethodGet, "/admin/maintenance", "").Body).Decode(&listed); err != nil || len(listed) != 2 {
+		t.Fatalf("expected two windows; got %v %v", listed, err)
+	}
+	if rec := do(http.MethodDelete, "/admin/maintenance?route=/numbers", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected 200; got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/maintenance?route=/numbers", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404; got %d", rec.Code)
+	}
+	if _, ok := maintenance.lookup("/numbers", nil); ok {
+		t.Error("expected /numbers out of maintenance")
+	}
+	if _, ok := maintenance.lookup("/numbers", []string{"g1"}); !ok {
+		t.Error("expected g1 still in maintenance")
+	}
+}
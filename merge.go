@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Sources with fewer values are batched before being handed to the shards, so that tiny
+// sources don't pay for a round trip through every shard each
+const mergeBatch = 8192
+
+// Number of dedup shards, 0 picks GOMAXPROCS and 1 merges on the consumer goroutine
+var mergeShards = 0
+
+func registerMergeFlags(fs *flag.FlagSet, shards *int) {
+	fs.IntVar(shards, "merge.shards", 0, "goroutines deduplicating merged values by value range, 0 uses GOMAXPROCS and 1 disables parallel merging")
+}
+
+func mergeParallelism() int {
+	if mergeShards > 0 {
+		return mergeShards
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// Deduplicates values on several cores. Every shard owns the values that hash to it and keeps
+// its own set, so shards never share a map and their outputs can simply be concatenated.
+// With perSource the sets are reset for every source, which keeps multiplicity across sources.
+type shardedSet struct {
+	shards    []*shard
+	perSource bool
+	wg        sync.WaitGroup
+	pending   batch
+	size      int
+}
+
+type shard struct {
+	in   chan batch
+	seen map[int]struct{}
+	out  []int
+}
+
+// Sources handed to the shards together. Once every shard is through with them, every
+// source's added gets the number of values it added and then done runs.
+type batch struct {
+	sources [][]int
+	added   []func(int)
+	counts  []int64
+	left    *int32
+	done    func()
+}
+
+func newShardedSet(n int, perSource bool, hint int) *shardedSet {
+	s := &shardedSet{shards: make([]*shard, n), perSource: perSource}
+	s.wg.Add(n)
+	for i := range s.shards {
+		sh := &shard{in: make(chan batch, 4), seen: make(map[int]struct{}, hint/n), out: make([]int, 0, hint/n)}
+		s.shards[i] = sh
+		go func(i int) {
+			defer s.wg.Done()
+			sh.run(i, n, perSource)
+		}(i)
+	}
+	return s
+}
+
+func shardOf(v, n int) int {
+	h := uint64(v) * 0x9E3779B97F4A7C15
+	return int((h >> 32) % uint64(n))
+}
+
+func (sh *shard) run(i, n int, perSource bool) {
+	for b := range sh.in {
+		for k, values := range b.sources {
+			if perSource {
+				sh.seen = make(map[int]struct{})
+			}
+			added := len(sh.out)
+			for _, v := range values {
+				if shardOf(v, n) != i {
+					continue
+				}
+				if _, ok := sh.seen[v]; !ok {
+					sh.seen[v] = struct{}{}
+					sh.out = append(sh.out, v)
+				}
+			}
+			if added = len(sh.out) - added; added > 0 {
+				atomic.AddInt64(&b.counts[k], int64(added))
+			}
+		}
+		if atomic.AddInt32(b.left, -1) == 0 {
+			for k, f := range b.added {
+				if f != nil {
+					f(int(b.counts[k]))
+				}
+			}
+			if b.done != nil {
+				b.done()
+			}
+		}
+	}
+}
+
+// Queues the values of a source. release is called once they are no longer referenced by
+// the set, small sources give it back straight away since their batch is bounded anyway.
+// added, if not nil, gets the number of values the source added once they are merged.
+func (s *shardedSet) add(values []int, release func(), added func(int)) {
+	if len(values) >= mergeBatch {
+		s.dispatch(batch{sources: [][]int{values}, added: []func(int){added}, done: release})
+		return
+	}
+	s.pending.sources = append(s.pending.sources, values)
+	s.pending.added = append(s.pending.added, added)
+	s.size += len(values)
+	release()
+	if s.size >= mergeBatch {
+		s.flush()
+	}
+}
+
+func (s *shardedSet) flush() {
+	if len(s.pending.sources) == 0 {
+		return
+	}
+	s.dispatch(s.pending)
+	s.pending, s.size = batch{}, 0
+}
+
+func (s *shardedSet) dispatch(b batch) {
+	b.counts = make([]int64, len(b.sources))
+	b.left = new(int32)
+	*b.left = int32(len(s.shards))
+	for _, sh := range s.shards {
+		sh.in <- b
+	}
+}
+
+// Waits for the shards and appends the distinct values to acc
+func (s *shardedSet) close(acc []int) []int {
+	s.flush()
+	for _, sh := range s.shards {
+		close(sh.in)
+	}
+	s.wg.Wait()
+	for _, sh := range s.shards {
+		acc = append(acc, sh.out...)
+	}
+	return acc
+}
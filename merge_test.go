@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestShardedSet(t *testing.T) {
+	sources := [][]int{{1, 2, 2, 3}, {3, 4, -5}, make([]int, 0, 3*mergeBatch)}
+	for i := 0; i < 3*mergeBatch; i++ {
+		sources[2] = append(sources[2], rand.Intn(mergeBatch))
+	}
+	for _, perSource := range []bool{false, true} {
+		var want []int
+		visited := map[int]struct{}{}
+		for _, src := range sources {
+			if perSource {
+				visited = map[int]struct{}{}
+			}
+			want = appendUnique(want, src, visited)
+		}
+		released := 0
+		set := newShardedSet(4, perSource, 0)
+		for _, src := range sources {
+			set.add(src, func() { released++ }, nil)
+		}
+		got := set.close(nil)
+		sort.Ints(want)
+		sort.Ints(got)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("perSource=%v: expected %d values; got %d", perSource, len(want), len(got))
+		}
+		if released != len(sources) {
+			t.Errorf("perSource=%v: expected every source to be released; got %d", perSource, released)
+		}
+	}
+}
+
+func TestParallelMergeMatchesSequential(t *testing.T) {
+	defer func(n int) { mergeShards = n }(mergeShards)
+	var urls []string
+	for _, nums := range [][]int{{5, 1, 1, 3}, {3, 2, 9}, {9, 9, 100}} {
+		ts := httptest.NewServer(http.HandlerFunc(simpleHandler(nums)))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+	for _, q := range []url.Values{{"dedup": {"true"}}, {"dedup": {"per_source"}}, {"histogram": {"0,10"}}, {"bucket": {"4"}}} {
+		o, err := parseOptions(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mergeShards = 1
+		want := run(context.Background(), urls, o)
+		mergeShards = 3
+		got := run(context.Background(), urls, o)
+		if !reflect.DeepEqual(want.numbers, got.numbers) || !reflect.DeepEqual(want.histogram, got.histogram) {
+			t.Errorf("%v: expected %v %v; got %v %v", q, want.numbers, want.histogram, got.numbers, got.histogram)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "expvar"
+
+// Counters are published through expvar and served on /debug/vars alongside pprof
+var (
+	upstreamMetrics = expvar.NewMap("upstream")
+	httpMetrics     = expvar.NewMap("http")
+	mqttMetrics     = expvar.NewMap("mqtt")
+	natsMetrics     = expvar.NewMap("nats")
+	webhookMetrics  = expvar.NewMap("webhooks")
+	historyMetrics  = expvar.NewMap("history")
+	// Shadow runs of the experiments, see mergeShadow
+	experimentMetrics = expvar.NewMap("experiments")
+)
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware that can be named in -middleware.order
+var middlewareRegistry = map[string]middleware{
+	"recovery":         recovery,
+	"request_id":       assignRequestID,
+	"security_headers": secureHeaders,
+	"auth":             authenticate,
+	"ratelimit":        rateLimited,
+	"logging":          logRequests,
+	"metrics":          countRequests,
+	"request_limits":   limitRequests,
+}
+
+// Order in which every request passes the middleware, outermost first
+var defaultPipeline = "recovery,request_id,security_headers,auth,ratelimit,logging,metrics,request_limits"
+
+// Resolves a comma separated list of middleware names. Each middleware may only appear once.
+func buildPipeline(order string) ([]middleware, error) {
+	var mw []middleware
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		m, ok := middlewareRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware %q listed twice", name)
+		}
+		seen[name] = true
+		mw = append(mw, m)
+	}
+	return mw, nil
+}
+
+// Turns a panic in a handler into a 500 instead of a dropped connection
+func recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic serving %s: %v\n%s", r.URL.Path, err, debug.Stack())
+				if sr.status == 0 {
+					sr.WriteHeader(http.StatusInternalServerError)
+					sr.Write([]byte("500 - Internal server error!"))
+				}
+			}
+		}()
+		next.ServeHTTP(sr, r)
+	})
+}
+
+// Assigns every request an id, taken from X-Request-ID when the caller sent one, and echoes it back
+func assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// API keys mapped to the tenant they belong to, and the keys of the admin endpoints, which
+// tenant keys don't open. Without keys authentication is disabled.
+var (
+	apiKeysMu sync.RWMutex
+	apiKeys   = map[string]string{}
+	adminKeys = map[string]bool{}
+)
+
+// Parses "key:tenant,key:tenant"
+func parseAPIKeys(v string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid api key %q, expected key:tenant", pair)
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys, nil
+}
+
+func setAPIKeys(keys map[string]string) {
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+	apiKeys = keys
+}
+
+// Parses "key,key"
+func parseAdminKeys(v string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(v, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+func setAdminKeys(keys map[string]bool) {
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+	adminKeys = keys
+}
+
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// Requires a known key in X-API-Key or an Authorization bearer token when keys are configured.
+// The admin endpoints, which can replace groups and configuration, need an admin key.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKeysMu.RLock()
+		enabled := len(apiKeys) > 0 || len(adminKeys) > 0
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		tenant, ok := apiKeys[key]
+		admin := adminKeys[key]
+		apiKeysMu.RUnlock()
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isAdminPath(r.URL.Path) {
+			if admin {
+				next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal(key))))
+				return
+			}
+			if ok {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("403 - admin endpoints need an admin key"))
+				return
+			}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Unauthorized!"))
+			return
+		}
+		ctx := withPrincipal(withTenant(r.Context(), tenant), principal(key))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Identifies an API key in logs without revealing it
+func principal(key string) string {
+	if len(key) > 4 {
+		key = key[:4]
+	}
+	return "key:" + key + "..."
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		ctx := r.Context()
+		log.Printf("%s%s %s %d %v %s %s", logPrefix(ctx), r.Method, r.URL.Path, sr.code(), time.Since(start), clientKey(r), principalFrom(ctx))
+	})
+}
+
+// Counts requests per path and status on /debug/vars
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		httpMetrics.Add(fmt.Sprintf("requests %s %d", r.URL.Path, sr.code()), 1)
+		httpMetrics.AddFloat("duration_ms "+r.URL.Path, float64(time.Since(start))/float64(time.Millisecond))
+		if t := tenantFrom(r.Context()); t != "" {
+			httpMetrics.Add("requests_by_tenant "+t, 1)
+		}
+	})
+}
+
+// Remembers the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) code() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildPipeline(t *testing.T) {
+	tt := []struct {
+		order string
+		count int
+		valid bool
+	}{
+		{order: defaultPipeline, count: 8, valid: true},
+		{order: "logging, recovery", count: 2, valid: true},
+		{order: "", count: 0, valid: true},
+		{order: "recovery,recovery"},
+		{order: "recovery,bogus"},
+	}
+	for _, tc := range tt {
+		mw, err := buildPipeline(tc.order)
+		if tc.valid != (err == nil) || len(mw) != tc.count {
+			t.Errorf("%q: expected %d middleware (valid=%v); got %d, %v", tc.order, tc.count, tc.valid, len(mw), err)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	h := recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") }))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status internal server error; got %v", rec.Code)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer setAPIKeys(map[string]string{})
+	var tenant string
+	h := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = tenantFrom(r.Context())
+	}))
+	keys, err := parseAPIKeys("k1:acme, k2:globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name   string
+		keys   map[string]string
+		header string
+		value  string
+		status int
+		tenant string
+	}{
+		{name: "Disabled", keys: map[string]string{}, status: http.StatusOK},
+		{name: "Missing", keys: keys, status: http.StatusUnauthorized},
+		{name: "Wrong", keys: keys, header: "X-API-Key", value: "nope", status: http.StatusUnauthorized},
+		{name: "HeaderKey", keys: keys, header: "X-API-Key", value: "k1", status: http.StatusOK, tenant: "acme"},
+		{name: "Bearer", keys: keys, header: "Authorization", value: "Bearer k2", status: http.StatusOK, tenant: "globex"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tenant = ""
+			setAPIKeys(tc.keys)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.status || tenant != tc.tenant {
+				t.Errorf("expected %v for tenant %q; got %v for %q", tc.status, tc.tenant, rec.Code, tenant)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAdmin(t *testing.T) {
+	defer setAPIKeys(map[string]string{})
+	defer setAdminKeys(map[string]bool{})
+	h := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	keys, _ := parseAPIKeys("k1:acme")
+	tt := []struct {
+		name   string
+		admin  map[string]bool
+		method string
+		path   string
+		key    string
+		status int
+	}{
+		{name: "TenantKey", method: http.MethodPost, path: "/admin/snapshot", key: "k1", status: http.StatusForbidden},
+		{name: "TenantKeyRead", method: http.MethodGet, path: "/admin/features", key: "k1", status: http.StatusForbidden},
+		{name: "NoAdminKeys", method: http.MethodDelete, path: "/admin/maintenance", key: "k1", status: http.StatusForbidden},
+		{name: "AdminKey", admin: parseAdminKeys("root, ops"), method: http.MethodPost, path: "/admin/snapshot", key: "ops", status: http.StatusOK},
+		{name: "Missing", admin: parseAdminKeys("root"), method: http.MethodPost, path: "/admin/features", status: http.StatusUnauthorized},
+		{name: "AdminKeyElsewhere", admin: parseAdminKeys("root"), method: http.MethodGet, path: endpoint, key: "root", status: http.StatusUnauthorized},
+		{name: "TenantKeyElsewhere", admin: parseAdminKeys("root"), method: http.MethodGet, path: endpoint, key: "k1", status: http.StatusOK},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			setAPIKeys(keys)
+			setAdminKeys(tc.admin)
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("X-API-Key", tc.key)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("expected %v; got %v", tc.status, rec.Code)
+			}
+		})
+	}
+	// Admin keys alone protect the admin endpoints
+	setAPIKeys(map[string]string{})
+	setAdminKeys(parseAdminKeys("root"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/snapshot", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the admin endpoints to need a key; got %v", rec.Code)
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	mw, err := buildPipeline(defaultPipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := routes(mw...)
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?verbose=request_id", nil)
+	req.Header.Set("X-Request-ID", "trace-me")
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+	if rec.Header().Get("X-Request-ID") != "trace-me" || !strings.Contains(rec.Body.String(), "trace-me") {
+		t.Errorf("expected the request id to reach the handler; got %v %s", rec.Header(), rec.Body.String())
+	}
+}
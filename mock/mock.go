@@ -0,0 +1,224 @@
+// Package mock serves synthetic upstream sources for load and soak tests. Every property of
+// a source is encoded in its URL, so a single server can play any number of upstreams.
+package mock
+
+import (
+	"bufio"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Behaviour of a synthetic source
+type Source struct {
+	// Number of values returned and their exclusive upper bound
+	Numbers int
+	Max     int
+	// Fixed latency before answering plus a random share of Jitter
+	Delay  time.Duration
+	Jitter time.Duration
+	// Share of requests answered with a 500
+	ErrorRate float64
+	// Seed for the values, identical seeds return identical values. 0 picks a random seed
+	// for every request.
+	Seed int64
+	// Scripted latency on top of Delay and the distribution of the number of values
+	Latency Profile
+	Sizes   Sizes
+	// Sources of an endpoint share the clock of latency profiles and the sequence of SimSeed,
+	// defaults to the path of the URL
+	Endpoint string
+	// Seed for the latency, size and failure of requests: the nth request of an endpoint draws
+	// the same ones in every run. 0 picks a random seed for every request.
+	SimSeed int64
+}
+
+const (
+	defaultNumbers = 10
+	defaultMax     = 100000000
+)
+
+// Query parameters understood by Handler
+func (s Source) query() url.Values {
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(s.Numbers))
+	if s.Max > 0 {
+		q.Set("max", strconv.Itoa(s.Max))
+	}
+	if s.Delay > 0 {
+		q.Set("delay", s.Delay.String())
+	}
+	if s.Jitter > 0 {
+		q.Set("jitter", s.Jitter.String())
+	}
+	if s.ErrorRate > 0 {
+		q.Set("error_rate", strconv.FormatFloat(s.ErrorRate, 'f', -1, 64))
+	}
+	if s.Seed != 0 {
+		q.Set("seed", strconv.FormatInt(s.Seed, 10))
+	}
+	if s.Latency.Kind != "" {
+		q.Set("latency", s.Latency.String())
+	}
+	if s.Sizes.Kind != "" {
+		q.Set("sizes", s.Sizes.String())
+	}
+	if s.Endpoint != "" {
+		q.Set("endpoint", s.Endpoint)
+	}
+	if s.SimSeed != 0 {
+		q.Set("sim_seed", strconv.FormatInt(s.SimSeed, 10))
+	}
+	return q
+}
+
+// URL of s on a mock server listening at base
+func (s Source) URL(base string) string {
+	return base + "/source?" + s.query().Encode()
+}
+
+func parseSource(q url.Values) (Source, error) {
+	s := Source{Numbers: defaultNumbers, Max: defaultMax}
+	var err error
+	if v := q.Get("n"); v != "" {
+		if s.Numbers, err = strconv.Atoi(v); err != nil {
+			return s, err
+		}
+	}
+	if v := q.Get("max"); v != "" {
+		if s.Max, err = strconv.Atoi(v); err != nil {
+			return s, err
+		}
+	}
+	if v := q.Get("delay"); v != "" {
+		if s.Delay, err = time.ParseDuration(v); err != nil {
+			return s, err
+		}
+	}
+	if v := q.Get("jitter"); v != "" {
+		if s.Jitter, err = time.ParseDuration(v); err != nil {
+			return s, err
+		}
+	}
+	if v := q.Get("error_rate"); v != "" {
+		if s.ErrorRate, err = strconv.ParseFloat(v, 64); err != nil {
+			return s, err
+		}
+	}
+	if v := q.Get("seed"); v != "" {
+		if s.Seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return s, err
+		}
+	}
+	if s.Latency, err = ParseProfile(q.Get("latency")); err != nil {
+		return s, err
+	}
+	if s.Sizes, err = ParseSizes(q.Get("sizes")); err != nil {
+		return s, err
+	}
+	s.Endpoint = q.Get("endpoint")
+	if v := q.Get("sim_seed"); v != "" {
+		if s.SimSeed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return s, err
+		}
+	}
+	if s.Numbers < 0 || s.Max < 1 || s.Delay < 0 || s.Jitter < 0 {
+		return s, errors.New("n, delay and jitter must not be negative and max must be positive")
+	}
+	return s, nil
+}
+
+// Endpoints tracked at most, the requests of later ones start their clock and sequence afresh
+const maxEndpoints = 10000
+
+// State of an endpoint: when it was first requested and how many requests it had
+type endpoint struct {
+	start    time.Time
+	requests int64
+}
+
+type server struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+	now       func() time.Time
+}
+
+// Serves sources described by the query parameters of Source.URL on any path
+func Handler() http.Handler {
+	return &server{endpoints: make(map[string]*endpoint), now: time.Now}
+}
+
+// Time since the first request of an endpoint and the number of the current one
+func (m *server) arrive(name string) (time.Duration, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	e := m.endpoints[name]
+	if e == nil {
+		if len(m.endpoints) >= maxEndpoints {
+			return 0, 0
+		}
+		e = &endpoint{start: now}
+		m.endpoints[name] = e
+	}
+	n := e.requests
+	e.requests++
+	return now.Sub(e.start), n
+}
+
+func (m *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, err := parseSource(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
+		return
+	}
+	name := s.Endpoint
+	if name == "" {
+		name = r.URL.Path
+	}
+	elapsed, n := m.arrive(name)
+	simSeed := rand.Int63()
+	if s.SimSeed != 0 {
+		simSeed = s.SimSeed + n
+	}
+	sim := rand.New(rand.NewSource(simSeed))
+	delay := s.Delay + s.Latency.delay(elapsed, sim)
+	if s.Jitter > 0 {
+		delay += time.Duration(sim.Int63n(int64(s.Jitter)))
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if s.ErrorRate > 0 && sim.Float64() < s.ErrorRate {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - mock failure"))
+		return
+	}
+	count := s.Sizes.draw(s.Numbers, sim)
+	seed := s.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	w.Header().Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"numbers":[`)
+	buf := make([]byte, 0, 20)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(strconv.AppendInt(buf[:0], int64(rnd.Intn(s.Max)), 10))
+	}
+	bw.WriteString("]}\n")
+	bw.Flush()
+}
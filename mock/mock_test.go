@@ -0,0 +1,56 @@
+package mock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	ts := httptest.NewServer(Handler())
+	defer ts.Close()
+	get := func(s Source) (int, []int, string) {
+		res, err := http.Get(s.URL(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		var v struct {
+			Numbers []int `json:"numbers"`
+		}
+		json.Unmarshal(body, &v)
+		return res.StatusCode, v.Numbers, string(body)
+	}
+	code, nums, body := get(Source{Numbers: 5, Max: 10, Seed: 42})
+	if code != http.StatusOK || len(nums) != 5 {
+		t.Fatalf("expected 5 numbers; got %d %s", code, body)
+	}
+	for _, n := range nums {
+		if n < 0 || n >= 10 {
+			t.Errorf("expected values below 10; got %v", nums)
+		}
+	}
+	if _, _, again := get(Source{Numbers: 5, Max: 10, Seed: 42}); again != body {
+		t.Errorf("expected the same seed to return the same body; got %s and %s", body, again)
+	}
+	if code, _, _ := get(Source{Numbers: 5, ErrorRate: 1}); code != http.StatusInternalServerError {
+		t.Errorf("expected a failure; got %d", code)
+	}
+	start := time.Now()
+	get(Source{Numbers: 1, Delay: 20 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected a delay of 20ms; took %v", elapsed)
+	}
+	res, err := http.Get(ts.URL + "/source?n=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad request; got %d", res.StatusCode)
+	}
+}
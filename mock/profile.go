@@ -0,0 +1,216 @@
+package mock
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scripted latency of a source, added to its Delay. Ramps and spikes follow the time since the
+// source's endpoint was first requested, so every source of an endpoint sees the same phase.
+type Profile struct {
+	// "ramp", "spike" or "bimodal", "" for none
+	Kind string
+	// ramp: rises from Low to High over Period, then starts over.
+	// spike: High for Burst at the start of every Period, Low otherwise.
+	// bimodal: High for a share P of the requests, Low for the others.
+	Low, High     time.Duration
+	Period, Burst time.Duration
+	P             float64
+}
+
+// Parses "ramp:LOW-HIGH/PERIOD", "spike:LOW,HIGH/PERIOD+BURST" or "bimodal:LOW,HIGH@P", e.g.
+// "ramp:10ms-500ms/1m", "spike:20ms,2s/30s+5s" or "bimodal:20ms,300ms@0.1"
+func ParseProfile(s string) (Profile, error) {
+	invalid := fmt.Errorf("invalid latency profile %q, expected ramp:LOW-HIGH/PERIOD, spike:LOW,HIGH/PERIOD+BURST or bimodal:LOW,HIGH@P", s)
+	kind, spec := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		kind, spec = s[:i], s[i+1:]
+	}
+	p := Profile{Kind: kind}
+	var low, high, rest string
+	var err error
+	switch kind {
+	case "":
+		return p, nil
+	case "ramp":
+		var ok bool
+		if low, rest, ok = cut(spec, "-"); !ok {
+			return p, invalid
+		}
+		if high, rest, ok = cut(rest, "/"); !ok {
+			return p, invalid
+		}
+		p.Period, err = time.ParseDuration(rest)
+	case "spike":
+		var ok bool
+		if low, rest, ok = cut(spec, ","); !ok {
+			return p, invalid
+		}
+		if high, rest, ok = cut(rest, "/"); !ok {
+			return p, invalid
+		}
+		var period, burst string
+		if period, burst, ok = cut(rest, "+"); !ok {
+			return p, invalid
+		}
+		if p.Period, err = time.ParseDuration(period); err == nil {
+			p.Burst, err = time.ParseDuration(burst)
+		}
+	case "bimodal":
+		var ok bool
+		if low, rest, ok = cut(spec, ","); !ok {
+			return p, invalid
+		}
+		if high, rest, ok = cut(rest, "@"); !ok {
+			return p, invalid
+		}
+		p.P, err = strconv.ParseFloat(rest, 64)
+	default:
+		return p, invalid
+	}
+	if err == nil {
+		if p.Low, err = time.ParseDuration(low); err == nil {
+			p.High, err = time.ParseDuration(high)
+		}
+	}
+	if err != nil || p.Low < 0 || p.High < 0 || p.Period < 0 || p.Burst < 0 || p.P < 0 || p.P > 1 || kind != "bimodal" && p.Period == 0 {
+		return p, invalid
+	}
+	return p, nil
+}
+
+func cut(s, sep string) (string, string, bool) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func (p Profile) String() string {
+	switch p.Kind {
+	case "ramp":
+		return fmt.Sprintf("ramp:%v-%v/%v", p.Low, p.High, p.Period)
+	case "spike":
+		return fmt.Sprintf("spike:%v,%v/%v+%v", p.Low, p.High, p.Period, p.Burst)
+	case "bimodal":
+		return fmt.Sprintf("bimodal:%v,%v@%s", p.Low, p.High, strconv.FormatFloat(p.P, 'f', -1, 64))
+	}
+	return ""
+}
+
+// Latency of a request arriving elapsed after the first one of its endpoint
+func (p Profile) delay(elapsed time.Duration, rnd *rand.Rand) time.Duration {
+	switch p.Kind {
+	case "ramp":
+		phase := float64(elapsed%p.Period) / float64(p.Period)
+		return p.Low + time.Duration(phase*float64(p.High-p.Low))
+	case "spike":
+		if elapsed%p.Period < p.Burst {
+			return p.High
+		}
+		return p.Low
+	case "bimodal":
+		if rnd.Float64() < p.P {
+			return p.High
+		}
+		return p.Low
+	}
+	return 0
+}
+
+// Upper bound of the values a size distribution returns, so that a heavy tail can't exhaust memory
+const maxSize = 10000000
+
+// Distribution of the number of values a source returns, replacing its fixed Numbers
+type Sizes struct {
+	// "uniform", "exp" or "pareto", "" for none
+	Kind string
+	// uniform: between Min and Max inclusive. exp: exponential with mean Mean.
+	// pareto: at least Min with tail index Alpha, the smaller the heavier the tail.
+	Min, Max    int
+	Mean, Alpha float64
+}
+
+// Parses "uniform:MIN-MAX", "exp:MEAN" or "pareto:MIN,ALPHA", e.g. "pareto:100,1.5"
+func ParseSizes(s string) (Sizes, error) {
+	invalid := fmt.Errorf("invalid size distribution %q, expected uniform:MIN-MAX, exp:MEAN or pareto:MIN,ALPHA", s)
+	kind, spec := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		kind, spec = s[:i], s[i+1:]
+	}
+	d := Sizes{Kind: kind}
+	var err error
+	switch kind {
+	case "":
+		return d, nil
+	case "uniform":
+		min, max, ok := cut(spec, "-")
+		if !ok {
+			return d, invalid
+		}
+		if d.Min, err = strconv.Atoi(min); err == nil {
+			d.Max, err = strconv.Atoi(max)
+		}
+		if err == nil && (d.Min < 0 || d.Max < d.Min || d.Max > maxSize) {
+			return d, invalid
+		}
+	case "exp":
+		d.Mean, err = strconv.ParseFloat(spec, 64)
+		if err == nil && (d.Mean <= 0 || d.Mean > maxSize) {
+			return d, invalid
+		}
+	case "pareto":
+		min, alpha, ok := cut(spec, ",")
+		if !ok {
+			return d, invalid
+		}
+		if d.Min, err = strconv.Atoi(min); err == nil {
+			d.Alpha, err = strconv.ParseFloat(alpha, 64)
+		}
+		if err == nil && (d.Min < 1 || d.Min > maxSize || d.Alpha <= 0) {
+			return d, invalid
+		}
+	default:
+		return d, invalid
+	}
+	if err != nil {
+		return d, invalid
+	}
+	return d, nil
+}
+
+func (d Sizes) String() string {
+	switch d.Kind {
+	case "uniform":
+		return fmt.Sprintf("uniform:%d-%d", d.Min, d.Max)
+	case "exp":
+		return "exp:" + strconv.FormatFloat(d.Mean, 'f', -1, 64)
+	case "pareto":
+		return fmt.Sprintf("pareto:%d,%s", d.Min, strconv.FormatFloat(d.Alpha, 'f', -1, 64))
+	}
+	return ""
+}
+
+// Number of values of a request, n when there is no distribution
+func (d Sizes) draw(n int, rnd *rand.Rand) int {
+	var v float64
+	switch d.Kind {
+	case "uniform":
+		return d.Min + rnd.Intn(d.Max-d.Min+1)
+	case "exp":
+		v = rnd.ExpFloat64() * d.Mean
+	case "pareto":
+		v = float64(d.Min) / math.Pow(1-rnd.Float64(), 1/d.Alpha)
+	default:
+		return n
+	}
+	if v > maxSize {
+		return maxSize
+	}
+	return int(v)
+}
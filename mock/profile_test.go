@@ -0,0 +1,141 @@
+package mock
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Profile
+		err  bool
+	}{
+		{in: ""},
+		{in: "ramp:10ms-500ms/1m0s", want: Profile{Kind: "ramp", Low: 10 * time.Millisecond, High: 500 * time.Millisecond, Period: time.Minute}},
+		{in: "spike:20ms,2s/30s+5s", want: Profile{Kind: "spike", Low: 20 * time.Millisecond, High: 2 * time.Second, Period: 30 * time.Second, Burst: 5 * time.Second}},
+		{in: "bimodal:20ms,300ms@0.1", want: Profile{Kind: "bimodal", Low: 20 * time.Millisecond, High: 300 * time.Millisecond, P: 0.1}},
+		{in: "ramp:10ms-500ms/0s", err: true},
+		{in: "ramp:10ms/1m", err: true},
+		{in: "spike:20ms,2s/30s", err: true},
+		{in: "bimodal:20ms,300ms@1.5", err: true},
+		{in: "bimodal:-1s,1s@0.5", err: true},
+		{in: "sine:1s", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProfile(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error; got %+v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %+v; got %+v, %v", tt.in, tt.want, got, err)
+		}
+		if again, err := ParseProfile(got.String()); err != nil || again != got {
+			t.Errorf("%q: expected %q to parse back; got %+v, %v", tt.in, got, again, err)
+		}
+	}
+}
+
+func TestProfileDelay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ramp, _ := ParseProfile("ramp:100ms-200ms/10s")
+	spike, _ := ParseProfile("spike:10ms,1s/10s+2s")
+	for _, tt := range []struct {
+		p       Profile
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{ramp, 0, 100 * time.Millisecond},
+		{ramp, 5 * time.Second, 150 * time.Millisecond},
+		{ramp, 12500 * time.Millisecond, 125 * time.Millisecond},
+		{spike, time.Second, time.Second},
+		{spike, 5 * time.Second, 10 * time.Millisecond},
+		{spike, 21 * time.Second, time.Second},
+	} {
+		if got := tt.p.delay(tt.elapsed, rnd); got != tt.want {
+			t.Errorf("%s after %v: expected %v; got %v", tt.p, tt.elapsed, tt.want, got)
+		}
+	}
+	bimodal, _ := ParseProfile("bimodal:1ms,100ms@0.25")
+	slow := 0
+	for i := 0; i < 4000; i++ {
+		if bimodal.delay(0, rnd) == 100*time.Millisecond {
+			slow++
+		}
+	}
+	if slow < 900 || slow > 1100 {
+		t.Errorf("expected about a quarter of the requests to be slow; got %d of 4000", slow)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	for _, bad := range []string{"uniform:5-1", "uniform:5", "exp:0", "pareto:0,1", "pareto:10,-1", "zipf:1"} {
+		if _, err := ParseSizes(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, spec := range []string{"uniform:10-20", "exp:50", "pareto:100,1.5"} {
+		d, err := ParseSizes(spec)
+		if err != nil || d.String() != spec {
+			t.Fatalf("%q: got %+v, %v", spec, d, err)
+		}
+		total := 0
+		for i := 0; i < 1000; i++ {
+			n := d.draw(7, rnd)
+			if n < d.Min || d.Max > 0 && n > d.Max {
+				t.Fatalf("%q: drew %d out of range", spec, n)
+			}
+			total += n
+		}
+		if spec == "exp:50" && (total < 40000 || total > 60000) {
+			t.Errorf("expected a mean of about 50; got %d", total/1000)
+		}
+	}
+	if n := (Sizes{}).draw(7, rnd); n != 7 {
+		t.Errorf("expected the fixed number without a distribution; got %d", n)
+	}
+}
+
+func TestEndpointSequence(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := &server{endpoints: make(map[string]*endpoint), now: func() time.Time { return now }}
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	src := Source{Numbers: 1, Seed: 1, Sizes: Sizes{Kind: "uniform", Min: 0, Max: 1000}, ErrorRate: 0.5, SimSeed: 7, Endpoint: "search"}
+	// The outcome of the nth request, a status and a body size
+	run := func() []int64 {
+		var out []int64
+		for i := 0; i < 8; i++ {
+			res, err := http.Get(src.URL(ts.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			out = append(out, int64(res.StatusCode)<<32|res.ContentLength)
+		}
+		return out
+	}
+	first := run()
+	// Another endpoint name starts its own sequence, which repeats the first one
+	src.Endpoint = "other"
+	second := run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same sequence for the same sim seed; got %v and %v", first, second)
+		}
+	}
+	if m.endpoints["search"].requests != 8 || len(m.endpoints) != 2 {
+		t.Errorf("expected two endpoints of 8 requests; got %+v", m.endpoints)
+	}
+	now = now.Add(time.Minute)
+	if elapsed, n := m.arrive("search"); elapsed != time.Minute || n != 8 {
+		t.Errorf("expected the endpoint's clock and count to carry on; got %v and %d", elapsed, n)
+	}
+}
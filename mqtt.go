@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, already shifted into the high nibble of the fixed header
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xe0
+)
+
+// Time a broker has to accept a connection or acknowledge a QoS 1 message
+const mqttTimeout = 5 * time.Second
+
+// Payloads published for a scheduled group
+const (
+	mqttPayloadResult = "result"
+	mqttPayloadDelta  = "delta"
+)
+
+type mqttConfig struct {
+	broker   string
+	topic    string
+	payload  string
+	qos      int
+	retain   bool
+	clientID string
+}
+
+// Publishes scheduled group results when -mqtt.broker is set, nil otherwise
+var resultPublisher *mqttPublisher
+
+func registerMQTTFlags(fs *flag.FlagSet, c *mqttConfig) {
+	fs.StringVar(&c.broker, "mqtt.broker", "", "MQTT broker as tcp://[user:password@]host:1883 or tls://..., scheduled group results are published there when set")
+	fs.StringVar(&c.topic, "mqtt.topic", "ta-go/groups/{group}", "topic of the published results, {group} is replaced with the group name")
+	fs.StringVar(&c.payload, "mqtt.payload", mqttPayloadResult, "what to publish after every refresh: result or delta")
+	fs.IntVar(&c.qos, "mqtt.qos", 0, "MQTT quality of service, 0 or 1")
+	fs.BoolVar(&c.retain, "mqtt.retain", false, "ask the broker to keep the last message of every topic for new subscribers")
+	fs.StringVar(&c.clientID, "mqtt.client-id", "", "MQTT client identifier, defaults to ta-go-<hostname>-<pid>")
+}
+
+// Minimal MQTT 3.1.1 client which can only publish. It connects on first use and after a
+// failed publish, and keeps the connection open in between.
+type mqttPublisher struct {
+	cfg        mqttConfig
+	addr       string
+	tls        bool
+	user, pass *string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+func newMQTTPublisher(c mqttConfig) (*mqttPublisher, error) {
+	u, err := url.Parse(c.broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -mqtt.broker %q - %v", c.broker, err)
+	}
+	p := &mqttPublisher{cfg: c, addr: u.Host}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		p.tls = true
+	default:
+		return nil, fmt.Errorf("invalid -mqtt.broker %q, expected tcp:// or tls://", c.broker)
+	}
+	if u.Port() == "" {
+		port := "1883"
+		if p.tls {
+			port = "8883"
+		}
+		p.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		user := u.User.Username()
+		p.user = &user
+		if pass, ok := u.User.Password(); ok {
+			p.pass = &pass
+		}
+	}
+	if c.payload != mqttPayloadResult && c.payload != mqttPayloadDelta {
+		return nil, fmt.Errorf("invalid -mqtt.payload %q, expected result or delta", c.payload)
+	}
+	if c.qos != 0 && c.qos != 1 {
+		return nil, fmt.Errorf("invalid -mqtt.qos %d, expected 0 or 1", c.qos)
+	}
+	if c.topic == "" || strings.ContainsAny(c.topic, "+#") {
+		return nil, fmt.Errorf("invalid -mqtt.topic %q, wildcards are not allowed", c.topic)
+	}
+	if p.cfg.clientID == "" {
+		host, _ := os.Hostname()
+		p.cfg.clientID = fmt.Sprintf("ta-go-%s-%d", host, os.Getpid())
+	}
+	return p, nil
+}
+
+// Message published for a group in result mode
+type groupResult struct {
+	Group   string    `json:"group"`
+	At      time.Time `json:"at"`
+	Numbers []int     `json:"numbers"`
+}
+
+// Publishes a new aggregation of a group, or what changed since prev. Failures are logged and
+// counted, the next refresh publishes again.
+func (p *mqttPublisher) publishGroup(name string, prev *snapshot, cur snapshot) {
+	if p == nil {
+		return
+	}
+	var v interface{} = groupResult{Group: name, At: cur.At, Numbers: cur.Numbers}
+	if p.cfg.payload == mqttPayloadDelta {
+		d := delta{Group: name}
+		var previous []int
+		if prev != nil {
+			d.Since, previous = &prev.At, prev.Numbers
+		}
+		d.Added, d.Removed = diff(previous, cur.Numbers)
+		v = d
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("mqtt: group %s could not be encoded - %v", name, err)
+		return
+	}
+	topic := strings.Replace(p.cfg.topic, "{group}", name, -1)
+	if err := p.publish(topic, payload); err != nil {
+		mqttMetrics.Add("publish_failed", 1)
+		log.Printf("mqtt: publishing group %s to %s failed - %v", name, topic, err)
+		return
+	}
+	mqttMetrics.Add("published", 1)
+}
+
+func (p *mqttPublisher) publish(topic string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.publishLocked(topic, payload)
+	if err != nil && p.conn != nil {
+		// A connection the broker dropped while idle only fails on use, so retry once on a new one
+		p.closeLocked()
+		err = p.publishLocked(topic, payload)
+	}
+	if err != nil {
+		p.closeLocked()
+	}
+	return err
+}
+
+func (p *mqttPublisher) publishLocked(topic string, payload []byte) error {
+	if p.conn == nil {
+		if err := p.connectLocked(); err != nil {
+			return err
+		}
+	}
+	flags := byte(p.cfg.qos << 1)
+	if p.cfg.retain {
+		flags |= 1
+	}
+	var body []byte
+	body = appendMQTTString(body, topic)
+	var id uint16
+	if p.cfg.qos > 0 {
+		p.packetID++
+		if p.packetID == 0 {
+			p.packetID = 1
+		}
+		id = p.packetID
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+	p.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+	if err := writeMQTTPacket(p.conn, mqttPublish|flags, body); err != nil {
+		return err
+	}
+	if p.cfg.qos == 0 {
+		return nil
+	}
+	for {
+		typ, ack, err := readMQTTPacket(p.r)
+		if err != nil {
+			return err
+		}
+		// Acknowledgements of messages that timed out earlier may still arrive
+		if typ&0xf0 == mqttPuback && len(ack) == 2 && binary.BigEndian.Uint16(ack) == id {
+			return nil
+		}
+	}
+}
+
+func (p *mqttPublisher) connectLocked() error {
+	var conn net.Conn
+	var err error
+	d := &net.Dialer{Timeout: mqttTimeout}
+	if p.tls {
+		host, _, _ := net.SplitHostPort(p.addr)
+		conn, err = tls.DialWithDialer(d, "tcp", p.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", p.addr)
+	}
+	if err != nil {
+		return err
+	}
+	// Clean session, no keep alive: the broker never drops us for being idle between refreshes
+	flags := byte(0x02)
+	if p.user != nil {
+		flags |= 0x80
+	}
+	if p.pass != nil {
+		flags |= 0x40
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 0)
+	body = appendMQTTString(body, p.cfg.clientID)
+	if p.user != nil {
+		body = appendMQTTString(body, *p.user)
+	}
+	if p.pass != nil {
+		body = appendMQTTString(body, *p.pass)
+	}
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	r := bufio.NewReader(conn)
+	if err := writeMQTTPacket(conn, mqttConnect, body); err != nil {
+		conn.Close()
+		return err
+	}
+	typ, ack, err := readMQTTPacket(r)
+	if err == nil && (typ != mqttConnack || len(ack) != 2) {
+		err = fmt.Errorf("expected CONNACK, got packet type %d", typ>>4)
+	}
+	if err == nil && ack[1] != 0 {
+		err = fmt.Errorf("connection refused by broker with return code %d", ack[1])
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	mqttMetrics.Add("connects", 1)
+	p.conn, p.r = conn, r
+	return nil
+}
+
+func (p *mqttPublisher) closeLocked() {
+	if p.conn == nil {
+		return
+	}
+	p.conn.SetDeadline(time.Now().Add(time.Second))
+	writeMQTTPacket(p.conn, mqttDisconnect, nil)
+	p.conn.Close()
+	p.conn, p.r = nil, nil
+}
+
+// Sends DISCONNECT and closes the connection, if any
+func (p *mqttPublisher) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked()
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// Largest remaining length the four byte encoding can express
+const mqttMaxPacket = 268435455
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	if len(body) > mqttMaxPacket {
+		return fmt.Errorf("packet of %d bytes exceeds the MQTT limit", len(body))
+	}
+	buf := make([]byte, 0, 5+len(body))
+	buf = append(buf, header)
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MessagePack for upstreams and clients preferring a compact binary format. Extension types,
+// timestamps included, are kept as opaque values.
+func init() {
+	registerCodec(&codec{
+		name:       "msgpack",
+		mediaTypes: []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		parse: func(data []byte) (interface{}, error) {
+			r := &msgpackReader{byteReader{data: data}}
+			return r.end(r.value())
+		},
+		writer: func(buf *bytes.Buffer) valueWriter { return msgpackWriter{buf} },
+		binary: true,
+	})
+}
+
+// An extension value, which can't be a number
+type msgpackExt struct{}
+
+type msgpackReader struct {
+	byteReader
+}
+
+func (r *msgpackReader) value() (interface{}, error) {
+	c, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c <= 0x8f:
+		return r.object(uint64(c & 0x0f))
+	case c <= 0x9f:
+		return r.array(uint64(c & 0x0f))
+	case c <= 0xbf:
+		b, err := r.take(uint64(c & 0x1f))
+		return string(b), err
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return r.take(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		// The type byte and the data
+		_, err = r.take(n + 1)
+		return msgpackExt{}, err
+	case 0xca:
+		v, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := r.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (c - 0xcc))
+		if err != nil || v > math.MaxInt64 {
+			return v, err
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := r.uint(size)
+		// Sign extend from the size of the value
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		_, err := r.take(1 + 1<<(c-0xd4))
+		return msgpackExt{}, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.take(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(n)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.object(n)
+	}
+	return nil, fmt.Errorf("msgpack: invalid type byte 0x%02x", c)
+}
+
+func (r *msgpackReader) array(n uint64) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { r.depth-- }()
+	a := make([]interface{}, 0, r.capacity(n))
+	for i := uint64(0); i < n; i++ {
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (r *msgpackReader) object(n uint64) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { r.depth-- }()
+	m := make(map[string]interface{}, r.capacity(n))
+	for i := uint64(0); i < n; i++ {
+		k, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key of type %s, expected a string", valueKind(k))
+		}
+		if m[key], err = r.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type msgpackWriter struct {
+	buf *bytes.Buffer
+}
+
+// Writes the type byte c followed by v in size bytes
+func (w msgpackWriter) sized(c byte, v uint64, size int) {
+	var b [9]byte
+	b[0] = c
+	switch size {
+	case 1:
+		b[1] = byte(v)
+	case 2:
+		binary.BigEndian.PutUint16(b[1:], uint16(v))
+	case 4:
+		binary.BigEndian.PutUint32(b[1:], uint32(v))
+	case 8:
+		binary.BigEndian.PutUint64(b[1:], v)
+	}
+	w.buf.Write(b[:1+size])
+}
+
+// Writes a length with the smallest of the fix, 8 (unless b8 is 0), 16 and 32 bit forms
+func (w msgpackWriter) length(n int, fix byte, fixMax int, b8, b16 byte) {
+	switch {
+	case n <= fixMax:
+		w.buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		w.sized(b8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		w.sized(b16, uint64(n), 2)
+	default:
+		w.sized(b16+1, uint64(n), 4)
+	}
+}
+
+func (w msgpackWriter) null() { w.buf.WriteByte(0xc0) }
+
+func (w msgpackWriter) boolean(v bool) {
+	if v {
+		w.buf.WriteByte(0xc3)
+		return
+	}
+	w.buf.WriteByte(0xc2)
+}
+
+func (w msgpackWriter) integer(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f, v < 0 && v >= -32:
+		w.buf.WriteByte(byte(v))
+	case v > 0 && v <= math.MaxUint8:
+		w.sized(0xcc, uint64(v), 1)
+	case v > 0 && v <= math.MaxUint16:
+		w.sized(0xcd, uint64(v), 2)
+	case v > 0 && v <= math.MaxUint32:
+		w.sized(0xce, uint64(v), 4)
+	case v > 0:
+		w.sized(0xcf, uint64(v), 8)
+	case v >= math.MinInt8:
+		w.sized(0xd0, uint64(v), 1)
+	case v >= math.MinInt16:
+		w.sized(0xd1, uint64(v), 2)
+	case v >= math.MinInt32:
+		w.sized(0xd2, uint64(v), 4)
+	default:
+		w.sized(0xd3, uint64(v), 8)
+	}
+}
+
+func (w msgpackWriter) float(v float64) { w.sized(0xcb, math.Float64bits(v), 8) }
+
+func (w msgpackWriter) str(v string) {
+	w.length(len(v), 0xa0, 31, 0xd9, 0xda)
+	w.buf.WriteString(v)
+}
+
+func (w msgpackWriter) array(n int)  { w.length(n, 0x90, 15, 0, 0xdc) }
+func (w msgpackWriter) object(n int) { w.length(n, 0x80, 15, 0, 0xde) }
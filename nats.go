@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type natsConfig struct {
+	url         string
+	subject     string
+	queue       string
+	concurrency int
+}
+
+func registerNATSFlags(fs *flag.FlagSet, c *natsConfig) {
+	fs.StringVar(&c.url, "nats.url", "", "NATS server as nats://[user:password@|token@]host:4222 or tls://..., aggregation requests on -nats.subject are answered when set")
+	fs.StringVar(&c.subject, "nats.subject", "ta-go.numbers", "subject aggregation requests are received on")
+	fs.StringVar(&c.queue, "nats.queue", "ta-go", "queue group, so that each request is answered by a single replica; empty answers on every replica")
+	fs.IntVar(&c.concurrency, "nats.concurrency", 64, "NATS requests aggregated at the same time")
+}
+
+// Time the NATS server has to answer the handshake
+const natsTimeout = 5 * time.Second
+
+// Longest pause between reconnect attempts
+const natsMaxBackoff = 30 * time.Second
+
+// A NATS aggregation request: either a JSON list of URLs or an object which can also carry
+// the query parameters and headers of a /numbers request, e.g. {"urls": [...], "query": "dedup=false"}
+type natsRequest struct {
+	URLs    []string          `json:"urls"`
+	Query   string            `json:"query"`
+	Headers map[string]string `json:"headers"`
+}
+
+func (r *natsRequest) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, &r.URLs)
+	}
+	type plain natsRequest
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// Reply to a request /numbers didn't answer with a 200
+type natsError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Answers aggregation requests received over NATS request-reply with h, the same handler
+// that serves HTTP. Reconnects with backoff until ctx is done.
+func serveNATS(ctx context.Context, c natsConfig, h http.Handler) error {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return fmt.Errorf("invalid -nats.url %q - %v", c.url, err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return fmt.Errorf("invalid -nats.url %q, expected nats:// or tls://", c.url)
+	}
+	if c.subject == "" || c.concurrency < 1 {
+		return errors.New("-nats.subject must be set and -nats.concurrency must be at least 1")
+	}
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := newNATSConn(c, u, h).serve(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		natsMetrics.Add("disconnects", 1)
+		// A connection that was up for a while starts over with a short pause
+		if time.Since(start) > natsMaxBackoff {
+			backoff = time.Second
+		}
+		log.Printf("nats: connection to %s lost, reconnecting in %v - %v", u.Host, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		if backoff *= 2; backoff > natsMaxBackoff {
+			backoff = natsMaxBackoff
+		}
+	}
+}
+
+// Server settings from the INFO line that matter to us
+type natsInfo struct {
+	MaxPayload  int  `json:"max_payload"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+type natsConn struct {
+	cfg  natsConfig
+	url  *url.URL
+	h    http.Handler
+	info natsInfo
+	sem  chan struct{}
+
+	wmu  sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func newNATSConn(c natsConfig, u *url.URL, h http.Handler) *natsConn {
+	return &natsConn{cfg: c, url: u, h: h, sem: make(chan struct{}, c.concurrency)}
+}
+
+func (n *natsConn) serve(ctx context.Context) error {
+	addr := n.url.Host
+	if n.url.Port() == "" {
+		addr = net.JoinHostPort(n.url.Hostname(), "4222")
+	}
+	conn, err := (&net.Dialer{Timeout: natsTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Stops reading, the connection stays open until the answers in flight are published
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	line, err := readNATSLine(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO, got %q", line)
+	}
+	if err := json.Unmarshal([]byte(line[5:]), &n.info); err != nil {
+		return fmt.Errorf("invalid INFO - %v", err)
+	}
+	if n.url.Scheme == "tls" || n.info.TLSRequired {
+		tc := tls.Client(conn, &tls.Config{ServerName: n.url.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		conn, r = tc, bufio.NewReader(tc)
+		defer conn.Close()
+	}
+	n.conn, n.w = conn, bufio.NewWriter(conn)
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "ta-go", "lang": "go", "version": version, "protocol": 1}
+	if user := n.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			connect["user"], connect["pass"] = user.Username(), pass
+		} else {
+			connect["auth_token"] = user.Username()
+		}
+	}
+	b, _ := json.Marshal(connect)
+	sub := "SUB " + n.cfg.subject + " 1\r\n"
+	if n.cfg.queue != "" {
+		sub = "SUB " + n.cfg.subject + " " + n.cfg.queue + " 1\r\n"
+	}
+	// The PONG confirms that CONNECT and SUB were accepted, errors arrive before it
+	if err := n.write("CONNECT "+string(b)+"\r\n"+sub+"PING\r\n", nil); err != nil {
+		return err
+	}
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			return fmt.Errorf("server refused the connection %s", line[4:])
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Printf("nats: answering requests on %s at %s", n.cfg.subject, n.url.Host)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PING":
+			if err := n.write("PONG\r\n", nil); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "MSG "):
+			reply, payload, err := readNATSMsg(r, line)
+			if err != nil {
+				return err
+			}
+			if reply == "" {
+				// Published without a reply subject, nobody is waiting for an answer
+				natsMetrics.Add("no_reply", 1)
+				continue
+			}
+			select {
+			case n.sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wg.Add(1)
+			go func() {
+				defer func() { <-n.sem; wg.Done() }()
+				// Requests are bounded by their own timeout and outlive a stopped subscription
+				n.answer(context.Background(), reply, payload)
+			}()
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error %s", line[4:])
+		}
+	}
+}
+
+// Runs a request through h as GET /numbers and publishes the body to reply
+func (n *natsConn) answer(ctx context.Context, reply string, payload []byte) {
+	natsMetrics.Add("requests", 1)
+	var out []byte
+	status, body := n.handle(ctx, reply, payload)
+	if status == http.StatusOK {
+		out = body
+	} else {
+		natsMetrics.Add("failed", 1)
+		out, _ = json.Marshal(natsError{Status: status, Error: strings.TrimSpace(string(body))})
+	}
+	if n.info.MaxPayload > 0 && len(out) > n.info.MaxPayload {
+		natsMetrics.Add("too_large", 1)
+		out, _ = json.Marshal(natsError{Status: http.StatusInsufficientStorage, Error: fmt.Sprintf("result of %d bytes exceeds the server's max_payload of %d", len(out), n.info.MaxPayload)})
+	}
+	if err := n.write("PUB "+reply+" "+strconv.Itoa(len(out))+"\r\n", out); err != nil {
+		log.Printf("nats: reply to %s failed - %v", reply, err)
+	}
+}
+
+func (n *natsConn) handle(ctx context.Context, reply string, payload []byte) (int, []byte) {
+	var nr natsRequest
+	if err := json.Unmarshal(payload, &nr); err != nil {
+		return http.StatusBadRequest, []byte("400 - invalid request, expected a JSON list of URLs or {\"urls\": [...]} - " + err.Error())
+	}
+	q, err := url.ParseQuery(nr.Query)
+	if err != nil {
+		return http.StatusBadRequest, []byte("400 - invalid query - " + err.Error())
+	}
+	for _, u := range nr.URLs {
+		q.Add("u", u)
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return http.StatusBadRequest, []byte("400 - " + err.Error())
+	}
+	for k, v := range nr.Headers {
+		req.Header.Set(k, v)
+	}
+	// The inbox prefix identifies the requesting connection, so rate limits apply per client
+	// rather than to all of NATS at once
+	client := reply
+	if i := strings.LastIndexByte(reply, '.'); i > 0 {
+		client = reply[:i]
+	}
+	req.RemoteAddr = "nats:" + client
+	w := &bufferedResponse{header: make(http.Header)}
+	n.h.ServeHTTP(w, req.WithContext(ctx))
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.status, w.body.Bytes()
+}
+
+func (n *natsConn) write(head string, payload []byte) error {
+	n.wmu.Lock()
+	defer n.wmu.Unlock()
+	n.w.WriteString(head)
+	if payload != nil {
+		n.w.Write(payload)
+		n.w.WriteString("\r\n")
+	}
+	return n.w.Flush()
+}
+
+// Collects a response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Reads the payload announced by a MSG <subject> <sid> [reply-to] <#bytes> line
+func readNATSMsg(r *bufio.Reader, line string) (string, []byte, error) {
+	f := strings.Fields(line)
+	if len(f) != 4 && len(f) != 5 {
+		return "", nil, fmt.Errorf("malformed %q", line)
+	}
+	size, err := strconv.Atoi(f[len(f)-1])
+	if err != nil || size < 0 {
+		return "", nil, fmt.Errorf("malformed %q", line)
+	}
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	var reply string
+	if len(f) == 5 {
+		reply = f[3]
+	}
+	return reply, payload[:size], nil
+}
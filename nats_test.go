@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSRequestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    natsRequest
+		wantErr bool
+	}{
+		{name: "List", payload: ` ["http://a", "http://b"]`, want: natsRequest{URLs: []string{"http://a", "http://b"}}},
+		{name: "Object", payload: `{"urls": ["http://a"], "query": "dedup=false", "headers": {"X-API-Key": "k"}}`, want: natsRequest{URLs: []string{"http://a"}, Query: "dedup=false", Headers: map[string]string{"X-API-Key": "k"}}},
+		{name: "Invalid", payload: `"http://a"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got natsRequest
+			err := json.Unmarshal([]byte(tt.payload), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v; got %v", tt.wantErr, err)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v; got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestServeNATSConfig(t *testing.T) {
+	for _, c := range []natsConfig{
+		{url: "http://localhost", subject: "s", concurrency: 1},
+		{url: "nats://localhost", subject: "", concurrency: 1},
+		{url: "nats://localhost", subject: "s", concurrency: 0},
+	} {
+		if err := serveNATS(context.Background(), c, http.NotFoundHandler()); err == nil {
+			t.Errorf("expected %+v to be rejected", c)
+		}
+	}
+}
+
+// Speaks just enough of the NATS protocol to accept one client, check its subscription, send it
+// requests and collect the replies published to their inboxes
+func fakeNATSServer(t *testing.T, requests []string, replies chan<- string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "INFO {\"max_payload\":1048576}\r\n")
+		for _, want := range []string{"CONNECT ", "SUB ta.numbers ta 1", "PING"} {
+			line, err := readNATSLine(r)
+			if err != nil || !strings.HasPrefix(line, want) {
+				t.Errorf("expected %q; got %q", want, line)
+				return
+			}
+		}
+		fmt.Fprintf(conn, "PONG\r\nPING\r\n")
+		if line, _ := readNATSLine(r); line != "PONG" {
+			t.Errorf("expected PONG; got %q", line)
+		}
+		for i, req := range requests {
+			fmt.Fprintf(conn, "MSG ta.numbers 1 _INBOX.client.%d %d\r\n%s\r\n", i, len(req), req)
+		}
+		for range requests {
+			line, err := readNATSLine(r)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(line, "PUB ") {
+				t.Errorf("expected PUB; got %q", line)
+				return
+			}
+			// PUB <subject> <#bytes> has the same shape as a MSG without sid
+			_, payload, err := readNATSMsg(r, "MSG "+strings.Replace(line[4:], " ", " 1 ", 1))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			replies <- strings.Fields(line)[1] + " " + string(payload)
+		}
+	}()
+	return "nats://" + l.Addr().String(), func() { l.Close() }
+}
+
+func TestServeNATS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{5, 1, 3})))
+	defer ts.Close()
+	pipeline, err := buildPipeline(defaultPipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []string{
+		fmt.Sprintf(`[%q]`, ts.URL),
+		fmt.Sprintf(`{"urls": [%q], "query": "upstream_timeout_ms=abc"}`, ts.URL),
+		`not json`,
+	}
+	replies := make(chan string, len(requests))
+	addr, stop := fakeNATSServer(t, requests, replies)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- serveNATS(ctx, natsConfig{url: addr, subject: "ta.numbers", queue: "ta", concurrency: 2}, routes(pipeline...))
+	}()
+	got := make(map[string]string)
+	for range requests {
+		select {
+		case r := <-replies:
+			f := strings.SplitN(r, " ", 2)
+			got[f[0]] = f[1]
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing replies")
+		}
+	}
+	var res result
+	if err := json.Unmarshal([]byte(got["_INBOX.client.0"]), &res); err != nil || !res.equals(result{Numbers: []int{1, 3, 5}}) {
+		t.Errorf("expected the merged numbers; got %s", got["_INBOX.client.0"])
+	}
+	for _, inbox := range []string{"_INBOX.client.1", "_INBOX.client.2"} {
+		var e natsError
+		if err := json.Unmarshal([]byte(got[inbox]), &e); err != nil || e.Status != http.StatusBadRequest {
+			t.Errorf("expected a 400 on %s; got %s", inbox, got[inbox])
+		}
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a clean shutdown; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveNATS didn't return after cancel")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are renewed this long before they expire, so that one isn't rejected in flight
+const tokenExpiryMargin = 30 * time.Second
+
+// Largest token response read
+const maxTokenResponse = 1 << 16
+
+// OAuth2 client credentials of a source (RFC 6749 section 4.4)
+type oauth2Config struct {
+	TokenURL string `json:"token_url"`
+	ClientID string `json:"client_id"`
+	// Either the secret itself or the environment variable holding it, which keeps the secret
+	// out of the groups file and of snapshots
+	ClientSecret    string   `json:"client_secret,omitempty"`
+	ClientSecretEnv string   `json:"client_secret_env,omitempty"`
+	Scopes          []string `json:"scopes,omitempty"`
+	// "basic" (default) sends the credentials as HTTP Basic auth, "params" in the form body
+	AuthStyle string `json:"auth_style,omitempty"`
+}
+
+func (c *oauth2Config) validate() error {
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid token_url %q", c.TokenURL)
+	}
+	if c.ClientID == "" {
+		return errors.New("client_id is required")
+	}
+	if (c.ClientSecret == "") == (c.ClientSecretEnv == "") {
+		return errors.New("exactly one of client_secret and client_secret_env is required")
+	}
+	if c.AuthStyle != "" && c.AuthStyle != "basic" && c.AuthStyle != "params" {
+		return fmt.Errorf("invalid auth_style %q, expected basic or params", c.AuthStyle)
+	}
+	return nil
+}
+
+// Sources sharing a token endpoint, client and scopes share their token
+func (c *oauth2Config) key() string {
+	return c.TokenURL + " " + c.ClientID + " " + strings.Join(c.Scopes, " ")
+}
+
+func (c *oauth2Config) secret() string {
+	if c.ClientSecretEnv != "" {
+		return os.Getenv(c.ClientSecretEnv)
+	}
+	return c.ClientSecret
+}
+
+// Caches client credentials tokens and fetches a new one when the cached one is about to expire
+// or was rejected. Concurrent fetches needing the same token wait for a single token request.
+type tokenManager struct {
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+	now    func() time.Time
+}
+
+type cachedToken struct {
+	mu     sync.Mutex
+	header string
+	expiry time.Time
+}
+
+var tokens = newTokenManager()
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{tokens: make(map[string]*cachedToken), now: time.Now}
+}
+
+func (m *tokenManager) entry(c *oauth2Config) *cachedToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[c.key()]
+	if !ok {
+		t = &cachedToken{}
+		m.tokens[c.key()] = t
+	}
+	return t
+}
+
+// Authorization header value for c, e.g. "Bearer abc"
+func (m *tokenManager) authorization(ctx context.Context, c *oauth2Config) (string, error) {
+	t := m.entry(c)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.header != "" && m.now().Before(t.expiry) {
+		return t.header, nil
+	}
+	upstreamMetrics.Add("oauth_token_requests", 1)
+	header, lifetime, err := requestToken(ctx, c)
+	if err != nil {
+		upstreamMetrics.Add("oauth_token_failures", 1)
+		return "", err
+	}
+	margin := tokenExpiryMargin
+	if lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	t.header, t.expiry = header, m.now().Add(lifetime-margin)
+	return header, nil
+}
+
+// Drops the token of c after the source answered 401, so the next fetch gets a new one
+func (m *tokenManager) rejected(c *oauth2Config, header string) {
+	t := m.entry(c)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// A concurrent fetch may already have replaced it
+	if t.header == header {
+		t.header = ""
+	}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Tokens without expires_in are assumed to be valid this long
+const defaultTokenLifetime = time.Hour
+
+func requestToken(ctx context.Context, c *oauth2Config) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	if c.AuthStyle == "params" {
+		form.Set("client_id", c.ClientID)
+		form.Set("client_secret", c.secret())
+	}
+	req, err := http.NewRequest(http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", upstream.userAgentHeader())
+	if c.AuthStyle != "params" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.secret()))
+	}
+	res, err := (&http.Client{Transport: currentTransport()}).Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxTokenResponse))
+	if err != nil {
+		return "", 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %s - %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("invalid token response - %v", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, errors.New("token response without access_token")
+	}
+	typ := tr.TokenType
+	if typ == "" || strings.EqualFold(typ, "bearer") {
+		typ = "Bearer"
+	}
+	lifetime := defaultTokenLifetime
+	if tr.ExpiresIn > 0 {
+		lifetime = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	return typ + " " + tr.AccessToken, lifetime, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Issues tok-1, tok-2, ... to client "id" with secret "s3cret"
+func fakeTokenServer(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	var issued int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if r.Method != http.MethodPost || !ok || id != "id" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "numbers:read" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "tok-%d", "token_type": "bearer", "expires_in": %d}`, n, expiresIn)
+	}))
+	return ts, &issued
+}
+
+func TestTokenManager(t *testing.T) {
+	ts, issued := fakeTokenServer(t, 3600)
+	defer ts.Close()
+	m := newTokenManager()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	c := &oauth2Config{TokenURL: ts.URL, ClientID: "id", ClientSecret: "s3cret", Scopes: []string{"numbers:read"}}
+	steps := []struct {
+		name   string
+		before func()
+		want   string
+	}{
+		{name: "First", want: "Bearer tok-1"},
+		{name: "Cached", want: "Bearer tok-1"},
+		{name: "Rejected", before: func() { m.rejected(c, "Bearer tok-1") }, want: "Bearer tok-2"},
+		{name: "StaleRejection", before: func() { m.rejected(c, "Bearer tok-1") }, want: "Bearer tok-2"},
+		{name: "Expiring", before: func() { now = now.Add(time.Hour - tokenExpiryMargin) }, want: "Bearer tok-3"},
+	}
+	for _, s := range steps {
+		if s.before != nil {
+			s.before()
+		}
+		got, err := m.authorization(context.Background(), c)
+		if err != nil || got != s.want {
+			t.Errorf("%s: expected %s; got %s, %v", s.name, s.want, got, err)
+		}
+	}
+	if *issued != 3 {
+		t.Errorf("expected 3 token requests; got %d", *issued)
+	}
+	bad := &oauth2Config{TokenURL: ts.URL, ClientID: "id", ClientSecret: "wrong"}
+	if _, err := m.authorization(context.Background(), bad); err == nil {
+		t.Error("expected an error for rejected credentials")
+	}
+}
+
+func TestOAuth2Source(t *testing.T) {
+	tokenServer, _ := fakeTokenServer(t, 3600)
+	defer tokenServer.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		simpleHandler([]int{4, 2})(w, r)
+	}))
+	defer ts.Close()
+	defer func(m *tokenManager) { tokens = m }(tokens)
+	tokens = newTokenManager()
+	t.Setenv("TA_TEST_SECRET", "s3cret")
+	defer groups.set(groups.all())
+	all := map[string]group{"secured": {URLs: []string{ts.URL}, Sources: map[string]sourceConfig{
+		ts.URL: {OAuth2: &oauth2Config{TokenURL: tokenServer.URL, ClientID: "id", ClientSecretEnv: "TA_TEST_SECRET", Scopes: []string{"numbers:read"}}},
+	}}}
+	if err := validateGroups(all); err != nil {
+		t.Fatal(err)
+	}
+	groups.set(all)
+	if errs := verboseErrors(t, endpoint+"?verbose=errors&g=secured"); len(errs) != 0 {
+		t.Errorf("expected the source to accept the token; got %+v", errs)
+	}
+}
+
+func TestOAuth2ConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     oauth2Config
+		wantErr bool
+	}{
+		{name: "Secret", cfg: oauth2Config{TokenURL: "https://auth/token", ClientID: "id", ClientSecret: "s"}},
+		{name: "SecretEnv", cfg: oauth2Config{TokenURL: "https://auth/token", ClientID: "id", ClientSecretEnv: "S", AuthStyle: "params"}},
+		{name: "NoSecret", cfg: oauth2Config{TokenURL: "https://auth/token", ClientID: "id"}, wantErr: true},
+		{name: "BothSecrets", cfg: oauth2Config{TokenURL: "https://auth/token", ClientID: "id", ClientSecret: "s", ClientSecretEnv: "S"}, wantErr: true},
+		{name: "TokenURL", cfg: oauth2Config{TokenURL: "auth/token", ClientID: "id", ClientSecret: "s"}, wantErr: true},
+		{name: "AuthStyle", cfg: oauth2Config{TokenURL: "https://auth/token", ClientID: "id", ClientSecret: "s", AuthStyle: "header"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v; got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings of the top offenders report and of the sampled log of slow fetches
+type offenderConfig struct {
+	// How often the report is logged, 0 disables it
+	interval time.Duration
+	// Hosts per list and requests a host needs within the window to be ranked at all
+	top, minRequests int
+	// Fetches slower than slowThreshold are logged, one in slowLogEvery of them
+	slowThreshold time.Duration
+	slowLogEvery  int
+}
+
+var (
+	offendersMu  sync.RWMutex
+	offenderConf = offenderConfig{interval: 5 * time.Minute, top: 5, minRequests: 10, slowThreshold: time.Second, slowLogEvery: 100}
+	// Slow fetches seen, the sampled log keeps one in slowLogEvery
+	slowFetches int64
+)
+
+func registerOffenderFlags(fs *flag.FlagSet, c *offenderConfig) {
+	fs.DurationVar(&c.interval, "offenders.interval", c.interval, "how often the slowest and most failing upstream hosts are logged, 0 disables the report")
+	fs.IntVar(&c.top, "offenders.top", c.top, "hosts listed per ranking of the offenders report")
+	fs.IntVar(&c.minRequests, "offenders.min-requests", c.minRequests, "requests a host needs within the stats window to be ranked")
+	fs.DurationVar(&c.slowThreshold, "offenders.slow-threshold", c.slowThreshold, "fetches taking longer are slow, a sample of them is logged")
+	fs.IntVar(&c.slowLogEvery, "offenders.slow-log-every", c.slowLogEvery, "log one in this many slow fetches, 0 disables the log")
+}
+
+func setOffenderConfig(c offenderConfig) error {
+	if c.top < 1 || c.minRequests < 1 || c.slowThreshold <= 0 || c.slowLogEvery < 0 || c.interval < 0 {
+		return fmt.Errorf("-offenders.top, -offenders.min-requests and -offenders.slow-threshold must be positive, -offenders.interval and -offenders.slow-log-every not negative")
+	}
+	offendersMu.Lock()
+	defer offendersMu.Unlock()
+	offenderConf = c
+	return nil
+}
+
+func currentOffenderConfig() offenderConfig {
+	offendersMu.RLock()
+	defer offendersMu.RUnlock()
+	return offenderConf
+}
+
+// Logs a sample of the fetches slower than the threshold
+func noteSlowFetch(ctx context.Context, u string, took time.Duration) {
+	c := currentOffenderConfig()
+	if took < c.slowThreshold {
+		return
+	}
+	upstreamMetrics.Add("slow_fetches", 1)
+	if c.slowLogEvery > 0 && (atomic.AddInt64(&slowFetches, 1)-1)%int64(c.slowLogEvery) == 0 {
+		log.Printf("%sslow upstream %s took %v (1 in %d slow fetches is logged)", logPrefix(ctx), redact(u), took.Round(time.Millisecond), c.slowLogEvery)
+	}
+}
+
+// Hosts worth a word with their owners: the slowest by p90 and the ones failing most often
+type offenderReport struct {
+	Window     string         `json:"window"`
+	Slowest    []hostSnapshot `json:"slowest"`
+	MostErrors []hostSnapshot `json:"most_errors"`
+}
+
+func rankOffenders(hosts []hostSnapshot, top, minRequests int) offenderReport {
+	r := offenderReport{Window: statsWindow.String(), Slowest: []hostSnapshot{}, MostErrors: []hostSnapshot{}}
+	var ranked []hostSnapshot
+	for _, h := range hosts {
+		if h.Requests >= minRequests {
+			ranked = append(ranked, h)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].LatencyP90 > ranked[j].LatencyP90 })
+	for _, h := range ranked {
+		if len(r.Slowest) == top {
+			break
+		}
+		r.Slowest = append(r.Slowest, h)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].SuccessRate != ranked[j].SuccessRate {
+			return ranked[i].SuccessRate < ranked[j].SuccessRate
+		}
+		return ranked[i].Requests > ranked[j].Requests
+	})
+	for _, h := range ranked {
+		if len(r.MostErrors) == top || h.SuccessRate == 1 {
+			break
+		}
+		r.MostErrors = append(r.MostErrors, h)
+	}
+	return r
+}
+
+// "a.example p90 1200ms (45 requests), ..." and "b.example 40% failed (30 requests), ..."
+func (r offenderReport) String() string {
+	var slow, failing []string
+	for _, h := range r.Slowest {
+		slow = append(slow, fmt.Sprintf("%s p90 %.0fms (%d requests)", h.Host, h.LatencyP90, h.Requests))
+	}
+	for _, h := range r.MostErrors {
+		failing = append(failing, fmt.Sprintf("%s %.0f%% failed (%d requests)", h.Host, (1-h.SuccessRate)*100, h.Requests))
+	}
+	return fmt.Sprintf("slowest: %s; most errors: %s", orNone(slow), orNone(failing))
+}
+
+func orNone(parts []string) string {
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func currentOffenders() offenderReport {
+	c := currentOffenderConfig()
+	return rankOffenders(upstreamStats.snapshot(), c.top, c.minRequests)
+}
+
+// Logs the offenders every interval until ctx is done
+func reportOffenders(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r := currentOffenders(); len(r.Slowest) > 0 || len(r.MostErrors) > 0 {
+				log.Printf("upstream offenders over the last %s - %s", r.Window, r)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func init() {
+	upstreamMetrics.Set("offenders", expvar.Func(func() interface{} { return currentOffenders() }))
+}
+
+// The offenders report. The n and min_requests query parameters override the configured
+// list length and minimum number of requests.
+func offendersHandler(w http.ResponseWriter, r *http.Request) {
+	c := currentOffenderConfig()
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"n", &c.top}, {"min_requests", &c.minRequests}} {
+		if s := q.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("400 - invalid " + p.name))
+				return
+			}
+			*p.v = n
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rankOffenders(upstreamStats.snapshot(), c.top, c.minRequests))
+}
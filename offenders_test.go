@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRankOffenders(t *testing.T) {
+	hosts := []hostSnapshot{
+		{Host: "fast", Requests: 50, SuccessRate: 1, LatencyP90: 10},
+		{Host: "slow", Requests: 50, SuccessRate: 0.9, LatencyP90: 900},
+		{Host: "slower", Requests: 20, SuccessRate: 1, LatencyP90: 1500},
+		{Host: "broken", Requests: 30, SuccessRate: 0.2, LatencyP90: 50},
+		{Host: "flaky", Requests: 100, SuccessRate: 0.9, LatencyP90: 20},
+		{Host: "rare", Requests: 2, SuccessRate: 0, LatencyP90: 5000},
+	}
+	r := rankOffenders(hosts, 2, 10)
+	names := func(hs []hostSnapshot) []string {
+		var out []string
+		for _, h := range hs {
+			out = append(out, h.Host)
+		}
+		return out
+	}
+	if got := names(r.Slowest); !reflect.DeepEqual(got, []string{"slower", "slow"}) {
+		t.Errorf("unexpected slowest %v", got)
+	}
+	if got := names(r.MostErrors); !reflect.DeepEqual(got, []string{"broken", "flaky"}) {
+		t.Errorf("unexpected most errors %v", got)
+	}
+	want := "slowest: slower p90 1500ms (20 requests), slow p90 900ms (50 requests); most errors: broken 80% failed (30 requests), flaky 10% failed (100 requests)"
+	if r.String() != want {
+		t.Errorf("expected %q; got %q", want, r.String())
+	}
+	if r := rankOffenders(hosts[:1], 5, 10); len(r.MostErrors) != 0 || r.String() != "slowest: fast p90 10ms (50 requests); most errors: none" {
+		t.Errorf("expected a healthy host to be left out of the errors; got %q", r)
+	}
+}
+
+func TestOffendersHandler(t *testing.T) {
+	defer func(t *hostTracker) { upstreamStats = t }(upstreamStats)
+	upstreamStats = newHostTracker()
+	for i := 0; i < 3; i++ {
+		upstreamStats.record("a:80", time.Second, 10, true)
+		upstreamStats.record("b:80", time.Millisecond, 10, i > 0)
+	}
+	get := func(target string) (*httptest.ResponseRecorder, offenderReport) {
+		rec := httptest.NewRecorder()
+		offendersHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var r offenderReport
+		json.NewDecoder(rec.Body).Decode(&r)
+		return rec, r
+	}
+	if _, r := get("/admin/upstreams/offenders"); len(r.Slowest) != 0 {
+		t.Errorf("expected hosts below -offenders.min-requests to be left out; got %+v", r)
+	}
+	_, r := get("/admin/upstreams/offenders?n=1&min_requests=3")
+	if len(r.Slowest) != 1 || r.Slowest[0].Host != "a:80" || len(r.MostErrors) != 1 || r.MostErrors[0].Host != "b:80" {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if rec, _ := get("/admin/upstreams/offenders?n=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400; got %d", rec.Code)
+	}
+}
+
+func TestNoteSlowFetch(t *testing.T) {
+	defer setOffenderConfig(currentOffenderConfig())
+	c := currentOffenderConfig()
+	c.slowThreshold = 10 * time.Millisecond
+	if err := setOffenderConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	count := func() string {
+		if v := upstreamMetrics.Get("slow_fetches"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	start := count()
+	noteSlowFetch(context.Background(), "http://a", time.Millisecond)
+	if count() != start {
+		t.Errorf("expected a fast fetch not to be counted; got %s after %s", count(), start)
+	}
+	noteSlowFetch(context.Background(), "http://a", time.Second)
+	if count() == start {
+		t.Error("expected the slow fetch to be counted")
+	}
+	c.top = 0
+	if err := setOffenderConfig(c); err == nil {
+		t.Error("expected an error for -offenders.top=0")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Page size of requests that only pass a cursor
+	defaultPageSize = 10000
+	// Upper bound for the page_size query parameter
+	maxPageSize = 1000000
+)
+
+// Sorted results of paginated requests. Following pages are cut from the stored result, so
+// a client pulling a huge set in chunks sees every value exactly once and in order, however
+// the sources change in the meantime.
+type pageStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*pagedResult
+	now        func() time.Time
+}
+
+type pagedResult struct {
+	sum summary
+	// Number of URLs the result was merged from
+	sources int
+	// Cursors only resolve for the tenant that made the first request
+	tenant  string
+	created time.Time
+	expires time.Time
+}
+
+var pagedResults = newPageStore(5*time.Minute, 100)
+
+func newPageStore(ttl time.Duration, maxEntries int) *pageStore {
+	return &pageStore{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*pagedResult), now: time.Now}
+}
+
+func registerPageFlags(fs *flag.FlagSet, ttl *time.Duration, max *int) {
+	fs.DurationVar(ttl, "pages.ttl", 5*time.Minute, "how long the result of a paginated request can be paged through")
+	fs.IntVar(max, "pages.max-entries", 100, "maximum number of results kept for pagination, the oldest is dropped first")
+}
+
+// Keeps a result for pagination and returns its id
+func (s *pageStore) put(tenant string, sum summary, sources int) (string, *pagedResult) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if len(s.entries) >= s.maxEntries {
+		s.evict(now)
+	}
+	p := &pagedResult{sum: sum, sources: sources, tenant: tenant, created: now, expires: now.Add(s.ttl)}
+	s.entries[id] = p
+	httpMetrics.Add("paged_results", 1)
+	return id, p
+}
+
+func (s *pageStore) get(id, tenant string) (*pagedResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.entries[id]
+	if !ok || p.tenant != tenant {
+		return nil, false
+	}
+	if !s.now().Before(p.expires) {
+		delete(s.entries, id)
+		return nil, false
+	}
+	return p, true
+}
+
+// Drops expired results, or the oldest one if none has expired
+func (s *pageStore) evict(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	for id, p := range s.entries {
+		if !now.Before(p.expires) {
+			delete(s.entries, id)
+			continue
+		}
+		if oldest == "" || p.created.Before(oldestAt) {
+			oldest, oldestAt = id, p.created
+		}
+	}
+	if len(s.entries) >= s.maxEntries && oldest != "" {
+		delete(s.entries, oldest)
+	}
+}
+
+// The page of size values starting at offset, and the cursor of the next page. The cursor is
+// empty on the last page.
+func (p *pagedResult) page(id string, offset, size int) (summary, string) {
+	sum := p.sum
+	if offset > len(sum.numbers) {
+		offset = len(sum.numbers)
+	}
+	end := offset + size
+	if end >= len(sum.numbers) {
+		sum.numbers = sum.numbers[offset:]
+		return sum, ""
+	}
+	sum.numbers = sum.numbers[offset:end]
+	return sum, encodeCursor(id, end)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Cursors are opaque to clients, they only have to pass back what they were given
+func encodeCursor(id string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id + ":" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(c string) (string, int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return "", 0, errInvalidCursor
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i <= 0 {
+		return "", 0, errInvalidCursor
+	}
+	offset, err := strconv.Atoi(string(b[i+1:]))
+	if err != nil || offset < 0 {
+		return "", 0, errInvalidCursor
+	}
+	return string(b[:i]), offset, nil
+}
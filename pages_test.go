@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	c := encodeCursor("abc", 20000)
+	id, offset, err := decodeCursor(c)
+	if err != nil || id != "abc" || offset != 20000 {
+		t.Fatalf("expected abc 20000; got %q %d %v", id, offset, err)
+	}
+	for _, c := range []string{"", "!!", encodeCursor("", 1), "YWJj", "YWJjOi0x", "YWJjOng"} {
+		if _, _, err := decodeCursor(c); err == nil {
+			t.Errorf("%q: expected an error", c)
+		}
+	}
+}
+
+func TestPageStore(t *testing.T) {
+	s := newPageStore(time.Minute, 2)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	sum := summary{numbers: []int{1, 2, 3, 4, 5}, ok: 2}
+	id, p := s.put("acme", sum, 2)
+	if _, ok := s.get(id, "other"); ok {
+		t.Error("expected the result to be hidden from other tenants")
+	}
+	if got, ok := s.get(id, "acme"); !ok || got != p {
+		t.Fatal("expected the stored result")
+	}
+	tests := []struct {
+		offset, size int
+		want         []int
+		next         bool
+	}{
+		{offset: 0, size: 2, want: []int{1, 2}, next: true},
+		{offset: 2, size: 2, want: []int{3, 4}, next: true},
+		{offset: 4, size: 2, want: []int{5}},
+		{offset: 3, size: 2, want: []int{4, 5}},
+		{offset: 9, size: 2, want: []int{}},
+	}
+	for _, tt := range tests {
+		page, next := p.page(id, tt.offset, tt.size)
+		if !reflect.DeepEqual(page.numbers, tt.want) || (next != "") != tt.next || page.ok != 2 {
+			t.Errorf("%d+%d: expected %v; got %v %q", tt.offset, tt.size, tt.want, page.numbers, next)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Second)
+		s.put("acme", sum, 2)
+	}
+	if _, ok := s.get(id, "acme"); ok {
+		t.Error("expected the oldest result to be evicted")
+	}
+	now = now.Add(time.Minute)
+	if len(s.entries) != 2 {
+		t.Fatalf("expected 2 entries; got %d", len(s.entries))
+	}
+	for id := range s.entries {
+		if _, ok := s.get(id, "acme"); ok {
+			t.Error("expected the result to expire")
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	defer func(s *pageStore) { pagedResults = s }(pagedResults)
+	pagedResults = newPageStore(time.Minute, 10)
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{9, 3, 7, 1, 5, 3})))
+	defer ts.Close()
+	var got []int
+	pages := 0
+	target := localhost + "?u=" + url.QueryEscape(ts.URL) + "&page_size=2"
+	for target != "" {
+		req := httptest.NewRequest(http.MethodGet, "http://"+target, nil)
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("page %d: expected 200; got %d %s", pages, rec.Code, rec.Body)
+		}
+		var e struct {
+			Numbers    []int  `json:"numbers"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if len(e.Numbers) > 2 {
+			t.Errorf("page %d: expected at most 2 values; got %v", pages, e.Numbers)
+		}
+		got = append(got, e.Numbers...)
+		pages++
+		target = ""
+		if e.NextCursor != "" {
+			target = localhost + "?cursor=" + e.NextCursor + "&page_size=2"
+		}
+	}
+	if want := []int{1, 3, 5, 7, 9}; !reflect.DeepEqual(got, want) || pages != 3 {
+		t.Errorf("expected %v in 3 pages; got %v in %d", want, got, pages)
+	}
+
+	for cursor, code := range map[string]int{"bogus!": http.StatusBadRequest, encodeCursor("gone", 2): http.StatusGone} {
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, httptest.NewRequest(http.MethodGet, "http://"+localhost+"?cursor="+url.QueryEscape(cursor), nil))
+		if rec.Code != code {
+			t.Errorf("%s: expected %d; got %d", cursor, code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A path to the values of a document in the XPath style: names separated by "/", "*" for any
+// name and a leading "//" to start the path anywhere in the document. In XML the names are
+// elements, matched by their local name so that namespace prefixes don't matter, and a last step
+// "@name" takes the attribute instead of the text, e.g. "//GetNumbersResult/int" or
+// "/Envelope/Body/*/item/@value". In other formats they are keys of maps, e.g. "/data/ids".
+type docPath struct {
+	steps    []string
+	anywhere bool
+	attr     string
+}
+
+func parseDocPath(p string) (*docPath, error) {
+	x := &docPath{}
+	switch {
+	case strings.HasPrefix(p, "//"):
+		x.anywhere, p = true, p[2:]
+	case strings.HasPrefix(p, "/"):
+		p = p[1:]
+	default:
+		return nil, fmt.Errorf("invalid path %q, expected it to start with / or //", p)
+	}
+	steps := strings.Split(p, "/")
+	if last := steps[len(steps)-1]; strings.HasPrefix(last, "@") {
+		x.attr, steps = last[1:], steps[:len(steps)-1]
+		if x.attr == "" {
+			return nil, fmt.Errorf("invalid path %q, expected an attribute name after @", p)
+		}
+	}
+	for _, s := range steps {
+		if s == "" || strings.ContainsAny(s, "@[]()= \t") {
+			return nil, fmt.Errorf("invalid path step %q, expected a name or *", s)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("path %q has no names", p)
+	}
+	x.steps = steps
+	return x, nil
+}
+
+// Whether the element at the end of stack is selected
+func (x *docPath) matches(stack []string) bool {
+	if len(stack) < len(x.steps) || !x.anywhere && len(stack) != len(x.steps) {
+		return false
+	}
+	off := len(stack) - len(x.steps)
+	for i, s := range x.steps {
+		if s != "*" && s != stack[off+i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Values of a parsed document at the path. Arrays on the way are passed through, as if their
+// elements were at the position of the array, and a selected array gives all its elements.
+func (x *docPath) selectValues(doc interface{}) []interface{} {
+	var out []interface{}
+	var visit func(v interface{}, stack []string)
+	visit = func(v interface{}, stack []string) {
+		switch t := v.(type) {
+		case []interface{}:
+			for _, e := range t {
+				visit(e, stack)
+			}
+		case map[string]interface{}:
+			if !x.anywhere && len(stack) >= len(x.steps) {
+				return
+			}
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				next := append(stack[:len(stack):len(stack)], k)
+				if x.matches(next) {
+					out = appendFlat(out, t[k])
+					continue
+				}
+				visit(t[k], next)
+			}
+		}
+	}
+	visit(doc, nil)
+	return out
+}
+
+func appendFlat(out []interface{}, v interface{}) []interface{} {
+	a, ok := v.([]interface{})
+	if !ok {
+		return append(out, v)
+	}
+	for _, e := range a {
+		out = appendFlat(out, e)
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDocPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *docPath
+	}{
+		{in: "/a/b", want: &docPath{steps: []string{"a", "b"}}},
+		{in: "//b/*", want: &docPath{steps: []string{"b", "*"}, anywhere: true}},
+		{in: "//item/@value", want: &docPath{steps: []string{"item"}, anywhere: true, attr: "value"}},
+		{in: "a/b"},
+		{in: "/a//b"},
+		{in: "//@value"},
+		{in: "/a/@"},
+		{in: "/a[1]"},
+	}
+	for _, tt := range tests {
+		got, err := parseDocPath(tt.in)
+		if tt.want == nil && err == nil {
+			t.Errorf("%q: expected an error; got %+v", tt.in, got)
+		}
+		if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %+v; got %+v, %v", tt.in, tt.want, got, err)
+		}
+	}
+}
+
+func TestSelectValues(t *testing.T) {
+	doc := map[string]interface{}{
+		"data": map[string]interface{}{
+			"ids":   []interface{}{int64(1), int64(2)},
+			"pages": []interface{}{map[string]interface{}{"ids": int64(3)}, map[string]interface{}{"ids": []interface{}{int64(4)}}},
+		},
+		"ids": int64(5),
+	}
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{path: "/data/ids", want: []interface{}{int64(1), int64(2)}},
+		{path: "/data/pages/ids", want: []interface{}{int64(3), int64(4)}},
+		{path: "//ids", want: []interface{}{int64(1), int64(2), int64(3), int64(4), int64(5)}},
+		{path: "/data/*/ids", want: []interface{}{int64(3), int64(4)}},
+		{path: "/missing"},
+	}
+	for _, tt := range tests {
+		p, err := parseDocPath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.selectValues(doc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %v; got %v", tt.path, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+)
+
+// Decoded results a fan-out lets wait for the merge stage by default
+const defaultPipelineDepth = 8
+
+var pipelineDepth = defaultPipelineDepth
+
+func registerPipelineFlags(fs *flag.FlagSet, depth *int) {
+	fs.IntVar(depth, "pipeline.depth", defaultPipelineDepth, "decoded upstream results per request waiting to be merged, fetches pause before decoding beyond that")
+}
+
+// Credits for decoded results that haven't been merged yet. Workers take one before decoding
+// a body and the consumer returns it once the result is merged, so when merging falls behind
+// the next bodies stay unread instead of piling up millions of decoded numbers in memory.
+// A nil gate never blocks.
+type mergeGate chan struct{}
+
+type mergeGateKeyType struct{}
+
+func withMergeGate(ctx context.Context, g mergeGate) context.Context {
+	return context.WithValue(ctx, mergeGateKeyType{}, g)
+}
+
+func mergeGateFrom(ctx context.Context) mergeGate {
+	g, _ := ctx.Value(mergeGateKeyType{}).(mergeGate)
+	return g
+}
+
+func (g mergeGate) acquire(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	select {
+	case g <- struct{}{}:
+		return nil
+	default:
+	}
+	upstreamMetrics.Add("merge_waits", 1)
+	select {
+	case g <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g mergeGate) release() {
+	if g != nil {
+		<-g
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMergeGate(t *testing.T) {
+	g := make(mergeGate, 1)
+	if err := g.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.acquire(ctx); err == nil {
+		t.Fatal("expected a full gate to block until the context is done")
+	}
+	done := make(chan error)
+	go func() { done <- g.acquire(context.Background()) }()
+	g.release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	var none mergeGate
+	if err := none.acquire(ctx); err != nil {
+		t.Errorf("expected a nil gate never to block; got %v", err)
+	}
+	none.release()
+}
+
+func TestRunWithShallowPipeline(t *testing.T) {
+	defer func(d int) { pipelineDepth = d }(pipelineDepth)
+	pipelineDepth = 1
+	var urls []string
+	for i := 0; i < 20; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{i, i + 1})))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+	o, _ := parseOptions(nil)
+	sum := run(context.Background(), urls, o)
+	if sum.ok != 20 || len(sum.numbers) != 21 {
+		t.Errorf("expected 20 sources and 21 distinct numbers; got %d and %v", sum.ok, sum.numbers)
+	}
+}
+
+func TestFetchGivesUpWaitingForMerge(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer ts.Close()
+	g := make(mergeGate, 1)
+	g.acquire(context.Background())
+	o, _ := parseOptions(url.Values{"upstream_timeout_ms": {"20"}})
+	_, err := fetch(withMergeGate(context.Background(), g), currentTransport(), o, ts.URL)
+	if code := errorCodeOf(err); code != codeBudgetExceeded {
+		t.Errorf("expected %s; got %s (%v)", codeBudgetExceeded, code, err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the tuner revisits the pool size and how far back it looks at upstream samples
+	poolAdjustInterval = 5 * time.Second
+	poolSignalWindow   = 30 * time.Second
+	// Upstream error rate above which the pool backs off instead of growing
+	poolBackoffErrorRate = 0.5
+	// Upstream p90 above which a backlog grows the pool faster, as workers spend most of
+	// their time waiting on slow sources
+	poolSlowLatency = time.Second
+)
+
+// A job of some fan-out together with everything a worker needs to run it
+type task struct {
+	job
+	ctx    context.Context
+	t      *http.Transport
+	o      options
+	events chan<- event
+	done   func()
+	// When the fan-out queued the job
+	queued time.Time
+	// Slot of the job in the fan-out's stageBoard, if it keeps one
+	stage *int32
+}
+
+// Goroutines shared by all fan-outs. The pool size bounds the number of concurrent upstream
+// fetches across the server, which keeps us from running out of sockets or hitting file
+// descriptor limits. With min < max the tuner resizes it from the observed load.
+type workerPool struct {
+	tasks chan task
+	quit  chan struct{}
+	// Jobs waiting for a worker and jobs being fetched
+	backlog int64
+	busy    int64
+	// Jobs given up on because no worker became free before the deadline
+	starved int64
+	// Time jobs waited for a worker and workers waited to hand a result to the merge
+	wait, dispatch *latencyHistogram
+
+	mu          sync.Mutex
+	workers     int
+	min, max    int
+	stats       map[*workerStats]struct{}
+	utilization utilizationView
+}
+
+var pool = newWorkerPool(maxConnections, maxConnections)
+
+func newWorkerPool(min, max int) *workerPool {
+	p := &workerPool{
+		tasks:    make(chan task),
+		quit:     make(chan struct{}),
+		min:      min,
+		max:      max,
+		wait:     newLatencyHistogram(),
+		dispatch: newLatencyHistogram(),
+		stats:    make(map[*workerStats]struct{}),
+	}
+	p.resize(min)
+	return p
+}
+
+func registerPoolFlags(fs *flag.FlagSet, min, max *int) {
+	fs.IntVar(min, "pool.min", maxConnections, "minimum number of fetch workers")
+	fs.IntVar(max, "pool.max", maxConnections, "maximum number of fetch workers, the pool is auto-tuned when larger than -pool.min")
+}
+
+func init() {
+	poolMetrics := expvar.NewMap("pool")
+	poolMetrics.Set("size", expvar.Func(func() interface{} { return pool.size() }))
+	poolMetrics.Set("busy", expvar.Func(func() interface{} { return atomic.LoadInt64(&pool.busy) }))
+	poolMetrics.Set("backlog", expvar.Func(func() interface{} { return atomic.LoadInt64(&pool.backlog) }))
+	poolMetrics.Set("starved", expvar.Func(func() interface{} { return atomic.LoadInt64(&pool.starved) }))
+	poolMetrics.Set("queue_wait", expvar.Func(func() interface{} { return pool.wait.view() }))
+	poolMetrics.Set("dispatch", expvar.Func(func() interface{} { return pool.dispatch.view() }))
+	poolMetrics.Set("utilization", expvar.Func(func() interface{} { return pool.utilizationView() }))
+	poolMetrics.Set("decoders", expvar.Func(func() interface{} { return decoders.size() }))
+	poolMetrics.Set("decoding", expvar.Func(func() interface{} { return atomic.LoadInt64(&decoders.busy) }))
+	poolMetrics.Set("decode_wait", expvar.Func(func() interface{} { return decoders.wait.view() }))
+}
+
+// Changes the bounds and moves the current size into them
+func (p *workerPool) setBounds(min, max int) error {
+	if min < 1 || max < min {
+		return errors.New("pool bounds must satisfy 1 <= min <= max")
+	}
+	p.mu.Lock()
+	p.min, p.max = min, max
+	n := clampInt(p.workers, min, max)
+	p.mu.Unlock()
+	p.resize(n)
+	return nil
+}
+
+func (p *workerPool) bounds() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.min, p.max
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.workers
+}
+
+// Workers not fetching right now
+func (p *workerPool) idle() int {
+	return p.size() - int(atomic.LoadInt64(&p.busy))
+}
+
+// Starts or stops workers until n are running. Stopped workers finish their current fetch first.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; p.workers < n; p.workers++ {
+		s := newWorkerStats(time.Now())
+		p.stats[s] = struct{}{}
+		go p.work(s)
+	}
+	for ; p.workers > n; p.workers-- {
+		go func() { p.quit <- struct{}{} }()
+	}
+}
+
+func (p *workerPool) work(s *workerStats) {
+	for {
+		select {
+		case t := <-p.tasks:
+			start := time.Now()
+			if !t.queued.IsZero() {
+				p.wait.observe(start.Sub(t.queued))
+			}
+			s.begin(start)
+			atomic.AddInt64(&p.busy, 1)
+			ctx := t.ctx
+			if t.stage != nil {
+				ctx = withFetchStage(ctx, t.stage)
+			}
+			key := coalesceKey(t.o, t.url)
+			call, leader := fetches.join(key)
+			if !leader {
+				// Another request is fetching the URL already
+				if res, shared, err := call.follow(ctx, t.url, t.o.upstreamTimeout); shared {
+					atomic.AddInt64(&p.busy, -1)
+					p.deliver(t, res, err)
+					s.end(time.Now())
+					continue
+				}
+				call = nil
+			}
+			deliver := func(res result, err error) {
+				fetches.finish(key, call, res, err)
+				p.deliver(t, res, err)
+			}
+			b, err := fetchBody(ctx, t.t, t.o, t.url)
+			if err == nil && decoders.submit(b, deliver) {
+				// The body is read, parsing it is up to the decoders
+				atomic.AddInt64(&p.busy, -1)
+				s.end(time.Now())
+				continue
+			}
+			var res result
+			if err == nil {
+				res, err = b.decode()
+			}
+			atomic.AddInt64(&p.busy, -1)
+			deliver(res, err)
+			s.end(time.Now())
+		case <-p.quit:
+			p.mu.Lock()
+			delete(p.stats, s)
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Hands the outcome of t to its fan-out
+func (p *workerPool) deliver(t task, res result, err error) {
+	fetched := time.Now()
+	t.events <- event{job: t.job, res: res, err: err}
+	p.dispatch.observe(time.Since(fetched))
+	t.done()
+}
+
+// Records n jobs that are about to be submitted
+func (p *workerPool) addBacklog(n int) {
+	atomic.AddInt64(&p.backlog, int64(n))
+}
+
+// Records n jobs of the backlog that will never be submitted since the deadline passed
+func (p *workerPool) abandon(n int) {
+	atomic.AddInt64(&p.backlog, -int64(n))
+	atomic.AddInt64(&p.starved, int64(n))
+}
+
+// Hands t to the next free worker. It gives up and reports false once ctx is done.
+func (p *workerPool) submit(ctx context.Context, t task) bool {
+	select {
+	case p.tasks <- t:
+		atomic.AddInt64(&p.backlog, -1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Load observed by the tuner. fdFree is -1 when the descriptor headroom is unknown.
+type poolSignals struct {
+	size, busy, backlog int
+	errorRate           float64
+	p90                 time.Duration
+	fdFree              int
+}
+
+// Size the pool should have given the signals. Running low on file descriptors or struggling
+// upstreams shrink it, a backlog grows it and an idle pool slowly gives workers back.
+func nextPoolSize(s poolSignals, min, max int) int {
+	n := s.size
+	switch {
+	case s.fdFree >= 0 && s.fdFree < s.size/4:
+		n = s.size / 2
+	case s.errorRate > poolBackoffErrorRate:
+		n = s.size * 3 / 4
+	case s.backlog > 0:
+		step := s.size / 4
+		if s.p90 > poolSlowLatency {
+			step = s.size / 2
+		}
+		if step > s.backlog {
+			step = s.backlog
+		}
+		// Every new worker may hold a socket
+		if s.fdFree >= 0 && step > s.fdFree/2 {
+			step = s.fdFree / 2
+		}
+		if step < 1 {
+			step = 1
+		}
+		n = s.size + step
+	case s.busy < s.size/2:
+		n = s.size - s.size/10
+	}
+	return clampInt(n, min, max)
+}
+
+func clampInt(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+func (p *workerPool) signals() poolSignals {
+	requests, failed, p90 := upstreamStats.overall(poolSignalWindow)
+	s := poolSignals{
+		size:    p.size(),
+		busy:    int(atomic.LoadInt64(&p.busy)),
+		backlog: int(atomic.LoadInt64(&p.backlog)),
+		p90:     p90,
+		fdFree:  -1,
+	}
+	if requests > 0 {
+		s.errorRate = float64(failed) / float64(requests)
+	}
+	if free, ok := fdHeadroom(); ok {
+		s.fdFree = free
+	}
+	return s
+}
+
+func (p *workerPool) adjust() {
+	s := p.signals()
+	min, max := p.bounds()
+	if n := nextPoolSize(s, min, max); n != s.size {
+		log.Printf("pool: resizing from %d to %d workers (backlog %d, error rate %.2f, p90 %v, free fds %d)",
+			s.size, n, s.backlog, s.errorRate, s.p90, s.fdFree)
+		p.resize(n)
+	}
+}
+
+// Periodically resizes the pool until ctx is done
+func (p *workerPool) tune(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.adjust()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func poolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	min, max := pool.bounds()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"size":     pool.size(),
+		"min":      min,
+		"max":      max,
+		"autotune": min < max,
+		"busy":     atomic.LoadInt64(&pool.busy),
+		"backlog":  atomic.LoadInt64(&pool.backlog),
+		"starved":  atomic.LoadInt64(&pool.starved),
+		// Histograms since the start
+		"queue_wait":  pool.wait.view(),
+		"dispatch":    pool.dispatch.view(),
+		"utilization": pool.utilizationView(),
+		"decoders":    decoders.size(),
+		"decoding":    atomic.LoadInt64(&decoders.busy),
+		"decode_wait": decoders.wait.view(),
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNextPoolSize(t *testing.T) {
+	tests := []struct {
+		name string
+		s    poolSignals
+		want int
+	}{
+		{"Steady", poolSignals{size: 100, busy: 80, fdFree: -1}, 100},
+		{"Backlog", poolSignals{size: 100, busy: 100, backlog: 1000, fdFree: -1}, 125},
+		{"SmallBacklog", poolSignals{size: 100, busy: 100, backlog: 3, fdFree: -1}, 103},
+		{"SlowUpstreams", poolSignals{size: 100, busy: 100, backlog: 1000, p90: 2 * time.Second, fdFree: -1}, 150},
+		{"FDLimitedGrowth", poolSignals{size: 100, busy: 100, backlog: 1000, fdFree: 40}, 120},
+		{"FDExhausted", poolSignals{size: 100, busy: 100, backlog: 1000, fdFree: 10}, 50},
+		{"Errors", poolSignals{size: 100, busy: 100, backlog: 1000, errorRate: 0.8, fdFree: -1}, 75},
+		{"Idle", poolSignals{size: 100, busy: 10, fdFree: -1}, 90},
+		{"AtMax", poolSignals{size: 190, busy: 190, backlog: 1000, fdFree: -1}, 200},
+		{"AtMin", poolSignals{size: 20, busy: 0, fdFree: -1}, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextPoolSize(tt.s, 20, 200); got != tt.want {
+				t.Errorf("expected %d workers; got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 2})))
+	defer ts.Close()
+	p := newWorkerPool(2, 8)
+	if err := p.setBounds(4, 8); err != nil {
+		t.Fatal(err)
+	}
+	if p.size() != 4 {
+		t.Fatalf("expected the size to be moved into the bounds; got %d", p.size())
+	}
+	if err := p.setBounds(5, 3); err == nil {
+		t.Error("expected an error for min > max")
+	}
+	p.resize(1)
+	o, _ := parseOptions(nil)
+	// Work still gets done while surplus workers are stopped
+	events := make(chan event, 3)
+	for i := 0; i < 3; i++ {
+		p.addBacklog(1)
+		if !p.submit(context.Background(), task{job: job{index: i, url: ts.URL}, ctx: context.Background(), t: currentTransport(), o: o, events: events, done: func() {}}) {
+			t.Fatal("submit failed")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if ev := <-events; ev.err != nil {
+			t.Fatal(ev.err)
+		}
+	}
+	if p.backlog != 0 || p.size() != 1 {
+		t.Errorf("expected an empty backlog and a single worker; got %d, %d", p.backlog, p.size())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Without workers the only way out is the context
+	if newWorkerPool(0, 0).submit(ctx, task{}) {
+		t.Error("expected submit to give up once the context is done")
+	}
+}
+
+func TestPoolHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	poolHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/pool", nil))
+	var got map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["size"] != float64(pool.size()) || got["autotune"] != false {
+		t.Errorf("unexpected pool state %v", got)
+	}
+}
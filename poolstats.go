@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets of the pool's latency histograms, the last bucket is unbounded
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, 25 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// How often the utilization of every worker is sampled
+const poolSampleInterval = 10 * time.Second
+
+// Counts durations into latencyBuckets, safe for concurrent use
+type latencyHistogram struct {
+	counts []int64
+	sum    int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, len(latencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// JSON form of a histogram. Buckets aren't cumulative, le is the bucket's upper bound.
+type histogramView struct {
+	Count   int64         `json:"count"`
+	MeanMS  float64       `json:"mean_ms"`
+	Buckets []bucketCount `json:"buckets"`
+}
+
+type bucketCount struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+func (h *latencyHistogram) view() histogramView {
+	var v histogramView
+	for i := range h.counts {
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = latencyBuckets[i].String()
+		}
+		n := atomic.LoadInt64(&h.counts[i])
+		v.Count += n
+		v.Buckets = append(v.Buckets, bucketCount{LE: le, Count: n})
+	}
+	if v.Count > 0 {
+		v.MeanMS = float64(atomic.LoadInt64(&h.sum)) / float64(v.Count) / float64(time.Millisecond)
+	}
+	return v
+}
+
+// Busy time of a worker. The worker updates busy and since, the sampler owns the rest.
+type workerStats struct {
+	// Nanoseconds spent on finished jobs and the start of the current job, 0 when idle
+	busy  int64
+	since int64
+
+	sampledBusy int64
+	sampledAt   time.Time
+}
+
+func newWorkerStats(now time.Time) *workerStats {
+	return &workerStats{sampledAt: now}
+}
+
+func (s *workerStats) begin(now time.Time) {
+	atomic.StoreInt64(&s.since, now.UnixNano())
+}
+
+func (s *workerStats) end(now time.Time) {
+	since := atomic.SwapInt64(&s.since, 0)
+	atomic.AddInt64(&s.busy, now.UnixNano()-since)
+}
+
+// Share of the time since the previous sample the worker spent on jobs
+func (s *workerStats) sample(now time.Time) float64 {
+	busy := atomic.LoadInt64(&s.busy)
+	if since := atomic.LoadInt64(&s.since); since != 0 {
+		busy += now.UnixNano() - since
+	}
+	elapsed := now.Sub(s.sampledAt)
+	used := busy - s.sampledBusy
+	s.sampledBusy, s.sampledAt = busy, now
+	if elapsed <= 0 {
+		return 0
+	}
+	return clampFloat(float64(used)/float64(elapsed), 0, 1)
+}
+
+func clampFloat(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Workers by utilization in the last sample period, in ten buckets of 10%
+type utilizationView struct {
+	At      time.Time     `json:"at"`
+	Workers int           `json:"workers"`
+	Mean    float64       `json:"mean"`
+	Buckets []bucketCount `json:"buckets"`
+}
+
+func utilizationHistogram(now time.Time, utilizations []float64) utilizationView {
+	v := utilizationView{At: now, Workers: len(utilizations), Buckets: make([]bucketCount, 10)}
+	for i := range v.Buckets {
+		v.Buckets[i].LE = fmt.Sprintf("%d%%", (i+1)*10)
+	}
+	for _, u := range utilizations {
+		v.Mean += u
+		i := int(u * 10)
+		if i > 9 {
+			i = 9
+		}
+		v.Buckets[i].Count++
+	}
+	if len(utilizations) > 0 {
+		v.Mean /= float64(len(utilizations))
+	}
+	return v
+}
+
+// Samples the utilization of every worker
+func (p *workerPool) sampleUtilization(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	utilizations := make([]float64, 0, len(p.stats))
+	for s := range p.stats {
+		utilizations = append(utilizations, s.sample(now))
+	}
+	p.utilization = utilizationHistogram(now, utilizations)
+}
+
+func (p *workerPool) utilizationView() utilizationView {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.utilization
+}
+
+// Samples the utilization every interval until ctx is done
+func (p *workerPool) sampleLoop(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.sampleUtilization(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
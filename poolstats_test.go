@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	for _, d := range []time.Duration{50 * time.Microsecond, time.Millisecond, 2 * time.Millisecond, time.Minute} {
+		h.observe(d)
+	}
+	v := h.view()
+	if v.Count != 4 || len(v.Buckets) != len(latencyBuckets)+1 {
+		t.Fatalf("unexpected view %+v", v)
+	}
+	want := map[string]int64{"100µs": 1, "1ms": 1, "5ms": 1, "+Inf": 1}
+	for _, b := range v.Buckets {
+		if b.Count != want[b.LE] {
+			t.Errorf("bucket %s: expected %d; got %d", b.LE, want[b.LE], b.Count)
+		}
+	}
+	if mean := (50e-3 + 1 + 2 + 60000) / 4; v.MeanMS != mean {
+		t.Errorf("expected a mean of %vms; got %v", mean, v.MeanMS)
+	}
+}
+
+func TestWorkerUtilization(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := newWorkerStats(start)
+	s.begin(start.Add(2 * time.Second))
+	s.end(start.Add(4 * time.Second))
+	s.begin(start.Add(8 * time.Second))
+	// 2s done plus 2s of the running job
+	if u := s.sample(start.Add(10 * time.Second)); u != 0.4 {
+		t.Errorf("expected 40%% utilization; got %v", u)
+	}
+	// Only the running job counts in the next period
+	if u := s.sample(start.Add(20 * time.Second)); u != 1 {
+		t.Errorf("expected 100%% utilization; got %v", u)
+	}
+	s.end(start.Add(20 * time.Second))
+	if u := s.sample(start.Add(30 * time.Second)); u != 0 {
+		t.Errorf("expected an idle worker; got %v", u)
+	}
+
+	v := utilizationHistogram(start, []float64{0, 0.05, 0.5, 1})
+	if v.Workers != 4 || v.Mean != 1.55/4 {
+		t.Errorf("unexpected summary %+v", v)
+	}
+	for i, want := range []int64{2, 0, 0, 0, 0, 1, 0, 0, 0, 1} {
+		if v.Buckets[i].Count != want {
+			t.Errorf("bucket %s: expected %d; got %d", v.Buckets[i].LE, want, v.Buckets[i].Count)
+		}
+	}
+}
+
+func TestPoolInstrumentation(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer ts.Close()
+	p := newWorkerPool(2, 2)
+	o, _ := parseOptions(nil)
+	events := make(chan event, 3)
+	for i := 0; i < 3; i++ {
+		p.addBacklog(1)
+		if !p.submit(context.Background(), task{job: job{index: i, url: ts.URL}, ctx: context.Background(), t: currentTransport(), o: o, events: events, done: func() {}, queued: time.Now()}) {
+			t.Fatal("submit failed")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-events
+	}
+	p.sampleUtilization(time.Now())
+	if n := p.wait.view().Count; n != 3 {
+		t.Errorf("expected 3 queue waits; got %d", n)
+	}
+	if u := p.utilizationView(); u.Workers != 2 || u.Mean <= 0 {
+		t.Errorf("expected busy workers; got %+v", u)
+	}
+	p.addBacklog(5)
+	p.abandon(5)
+	if p.backlog != 0 || p.starved != 5 {
+		t.Errorf("expected an empty backlog and 5 starved jobs; got %d, %d", p.backlog, p.starved)
+	}
+	p.resize(0)
+	// The stopped workers drop out of the samples
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		p.sampleUtilization(time.Now())
+		if p.utilizationView().Workers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no workers; got %d", p.utilizationView().Workers)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// One URL per distinct upstream host of the configured groups
+func warmTargets() []string {
+	seen := make(map[string]string)
+	for _, gr := range groups.all() {
+		for _, raw := range gr.URLs {
+			raw, err := normalizeURL(raw)
+			if err != nil {
+				continue
+			}
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" || upstream.checkScheme(u) != nil {
+				continue
+			}
+			key := u.Scheme + "://" + u.Host
+			if _, ok := seen[key]; !ok {
+				seen[key] = raw
+			}
+		}
+	}
+	targets := make([]string, 0, len(seen))
+	for _, raw := range seen {
+		targets = append(targets, raw)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Opens conns connections to every target with concurrent HEAD requests so that they sit in the
+// transport's idle pool, TLS handshake included, before the first real request arrives.
+func prewarm(ctx context.Context, t *http.Transport, targets []string, conns int) {
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		for i := 0; i < conns; i++ {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				if err := warmOne(ctx, t, target); err != nil {
+					upstreamMetrics.Add("prewarm_failed", 1)
+					log.Printf("%s could not be pre-warmed - %v", redact(target), redact(err.Error()))
+					return
+				}
+				upstreamMetrics.Add("prewarm_ok", 1)
+			}(target)
+		}
+	}
+	wg.Wait()
+}
+
+func warmOne(ctx context.Context, t *http.Transport, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, maxUpstreamTimeout*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := t.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	// Drain so the connection goes back to the pool
+	io.Copy(ioutil.Discard, res.Body)
+	return res.Body.Close()
+}
+
+// Re-warms the group hosts a little more often than idle connections are evicted, until ctx is done
+func keepWarm(ctx context.Context, conns int) {
+	interval := currentTransportConfig().idleConnTimeout * 9 / 10
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	prewarm(ctx, currentTransport(), warmTargets(), conns)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			prewarm(ctx, currentTransport(), warmTargets(), conns)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
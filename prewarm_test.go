@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWarmTargets(t *testing.T) {
+	defer groups.set(groups.all())
+	groups.set(map[string]group{
+		"a": {URLs: []string{"http://one/x", "http://one/y", "https://two/z"}},
+		"b": {URLs: []string{"http://one/w", "://bad"}},
+	})
+	targets := warmTargets()
+	if len(targets) != 2 {
+		t.Errorf("expected one target per host; got %v", targets)
+	}
+}
+
+func TestPrewarmFillsPool(t *testing.T) {
+	var heads int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+		}
+		w.Write([]byte(`{"numbers":[1]}`))
+	}))
+	defer ts.Close()
+	tr := newTransport(transportCfg)
+	defer tr.CloseIdleConnections()
+	prewarm(context.Background(), tr, []string{ts.URL}, 3)
+	if n := atomic.LoadInt32(&heads); n != 3 {
+		t.Fatalf("expected 3 warm-up requests; got %d", n)
+	}
+	before := counter(upstreamMetrics.Get("conns_reused"))
+	o, _ := parseOptions(nil)
+	if _, err := fetch(context.Background(), tr, o, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if counter(upstreamMetrics.Get("conns_reused")) <= before {
+		t.Error("expected the first real fetch to use a pre-warmed connection")
+	}
+}
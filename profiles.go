@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Key the profiles are kept under in Redis, shared by the replicas using the same server
+	profilesRedisKey = "ta-go:profiles"
+	// Profiles of another format are ignored
+	profilesVersion = 1
+)
+
+type profilesConfig struct {
+	// File or redis:// URL, empty keeps the profiles in memory only
+	store    string
+	interval time.Duration
+}
+
+func registerProfileFlags(fs *flag.FlagSet, c *profilesConfig) {
+	fs.StringVar(&c.store, "profiles.store", "", "file or Redis server (redis://[user:password@]host:6379[/db] or rediss://...) the upstream latency and yield profiles are saved to and loaded from at startup")
+	fs.DurationVar(&c.interval, "profiles.interval", time.Minute, "how often the profiles are saved, they are saved on shutdown too")
+}
+
+// Latency samples and yields of the upstream hosts, what adaptive timeouts, hedging and
+// prioritization go by
+type upstreamProfiles struct {
+	Version int                    `json:"version"`
+	SavedAt time.Time              `json:"saved_at"`
+	Hosts   map[string]hostProfile `json:"hosts"`
+}
+
+type hostProfile struct {
+	// Oldest first
+	Samples []profileSample `json:"samples,omitempty"`
+	Yield   *float64        `json:"yield,omitempty"`
+}
+
+type profileSample struct {
+	At      time.Time `json:"at"`
+	Latency duration  `json:"latency"`
+	Bytes   int64     `json:"bytes"`
+	OK      bool      `json:"ok"`
+}
+
+// Where the profiles are kept. load returns nil without an error when none were saved yet.
+type profileStore interface {
+	load() ([]byte, error)
+	save(b []byte) error
+}
+
+func newProfileStore(target string) (profileStore, error) {
+	if strings.HasPrefix(target, "redis://") || strings.HasPrefix(target, "rediss://") {
+		c, err := newRedisClient(target)
+		if err != nil {
+			return nil, fmt.Errorf("-profiles.store: %v", err)
+		}
+		return &redisProfileStore{client: c, key: profilesRedisKey}, nil
+	}
+	return fileProfileStore(target), nil
+}
+
+type fileProfileStore string
+
+func (f fileProfileStore) load() ([]byte, error) {
+	b, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// Writes next to the file and renames, so a crash mid-write leaves the previous profiles
+func (f fileProfileStore) save(b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(string(f)), filepath.Base(string(f))+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+type redisProfileStore struct {
+	client *redisClient
+	key    string
+}
+
+func (s *redisProfileStore) load() ([]byte, error) {
+	v, err := s.client.do("GET", s.key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %v to GET %s", v, s.key)
+	}
+	return []byte(str), nil
+}
+
+func (s *redisProfileStore) save(b []byte) error {
+	_, err := s.client.do("SET", s.key, string(b))
+	return err
+}
+
+// Profiles of the hosts with samples in the stats window or a yield
+func takeProfiles(t *hostTracker, y *yieldTracker) upstreamProfiles {
+	p := upstreamProfiles{Version: profilesVersion, SavedAt: t.now(), Hosts: map[string]hostProfile{}}
+	for host, samples := range t.recent() {
+		hp := hostProfile{Samples: make([]profileSample, len(samples))}
+		for i, s := range samples {
+			hp.Samples[i] = profileSample{At: s.at, Latency: duration(s.latency), Bytes: s.bytes, OK: s.ok}
+		}
+		p.Hosts[host] = hp
+	}
+	for host, v := range y.snapshot() {
+		v := v
+		hp := p.Hosts[host]
+		hp.Yield = &v
+		p.Hosts[host] = hp
+	}
+	return p
+}
+
+// Hands the profiles to the trackers. Hosts measured since the start keep their own numbers,
+// samples older than the stats window are dropped and breakers start closed.
+func applyProfiles(p upstreamProfiles, t *hostTracker, y *yieldTracker) {
+	for host, hp := range p.Hosts {
+		if len(hp.Samples) > 0 {
+			samples := make([]sample, len(hp.Samples))
+			for i, s := range hp.Samples {
+				samples[i] = sample{at: s.At, latency: time.Duration(s.Latency), bytes: s.Bytes, ok: s.OK}
+			}
+			t.restore(host, samples)
+		}
+		if hp.Yield != nil {
+			y.restore(host, *hp.Yield)
+		}
+	}
+}
+
+// Samples of every host within the stats window, oldest first
+func (t *hostTracker) recent() map[string][]sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-statsWindow)
+	out := make(map[string][]sample)
+	for host, h := range t.hosts {
+		var samples []sample
+		// Once the ring is full its oldest sample is the one at next
+		for i := range h.samples {
+			if s := h.samples[(h.next+i)%len(h.samples)]; !s.at.Before(cutoff) {
+				samples = append(samples, s)
+			}
+		}
+		if len(samples) > 0 {
+			out[host] = samples
+		}
+	}
+	return out
+}
+
+// Seeds the samples of a host without any
+func (t *hostTracker) restore(host string, samples []sample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(host)
+	if len(h.samples) > 0 {
+		return
+	}
+	cutoff := t.now().Add(-statsWindow)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].at.Before(samples[j].at) })
+	for _, s := range samples {
+		if !s.at.Before(cutoff) {
+			h.samples = append(h.samples, s)
+		}
+	}
+	if len(h.samples) > statsSamples {
+		h.samples = append(h.samples[:0:0], h.samples[len(h.samples)-statsSamples:]...)
+	}
+	h.next = len(h.samples) % statsSamples
+}
+
+// Seeds the yield of a host without one
+func (y *yieldTracker) restore(host string, v float64) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if _, ok := y.hosts[host]; ok || len(y.hosts) >= yieldMaxHosts {
+		return
+	}
+	y.hosts[host] = v
+}
+
+func saveProfiles(s profileStore) error {
+	b, err := json.Marshal(takeProfiles(upstreamStats, yields))
+	if err != nil {
+		return err
+	}
+	return s.save(b)
+}
+
+// Loads the saved profiles into the trackers, it's no error if there are none
+func loadProfiles(s profileStore) error {
+	b, err := s.load()
+	if err != nil || b == nil {
+		return err
+	}
+	var p upstreamProfiles
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("profiles decoding error - %v", err)
+	}
+	if p.Version != profilesVersion {
+		log.Printf("profiles: ignoring profiles of version %d", p.Version)
+		return nil
+	}
+	applyProfiles(p, upstreamStats, yields)
+	return nil
+}
+
+func saveProfilesLoop(ctx context.Context, s profileStore, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveProfiles(s); err != nil {
+				log.Printf("profiles: saving failed - %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfilesRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	old := &hostTracker{hosts: map[string]*hostStats{}, now: clock}
+	for i := 0; i < statsSamples+10; i++ {
+		old.record("busy.test:80", time.Duration(i)*time.Millisecond, 10, i%10 != 0)
+	}
+	now = now.Add(-statsWindow - time.Minute)
+	old.record("gone.test:80", time.Second, 0, false)
+	now = now.Add(statsWindow + time.Minute)
+	oldYields := &yieldTracker{hosts: map[string]float64{"busy.test:80": 12.5, "quiet.test:80": 3}}
+	p := takeProfiles(old, oldYields)
+	if _, ok := p.Hosts["gone.test:80"]; ok {
+		t.Errorf("expected no profile for a host without samples in the window; got %+v", p.Hosts["gone.test:80"])
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded upstreamProfiles
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// A minute after the restart, with a host that was already measured again
+	now = now.Add(time.Minute)
+	fresh := &hostTracker{hosts: map[string]*hostStats{}, now: clock}
+	fresh.record("quiet.test:80", 5*time.Millisecond, 1, true)
+	freshYields := &yieldTracker{hosts: map[string]float64{"quiet.test:80": 1}}
+	applyProfiles(decoded, fresh, freshYields)
+	want, _ := old.okLatency("busy.test:80", 0.95)
+	if got, ok := fresh.okLatency("busy.test:80", 0.95); !ok || got != want {
+		t.Errorf("expected the restored p95 %v; got %v, %v", want, got, ok)
+	}
+	if got := fresh.recent()["busy.test:80"]; len(got) != statsSamples || got[len(got)-1].latency != time.Duration(statsSamples+9)*time.Millisecond {
+		t.Errorf("expected the full ring oldest first; got %d samples", len(got))
+	}
+	fresh.record("busy.test:80", time.Hour, 1, true)
+	if got := fresh.recent()["busy.test:80"]; len(got) != statsSamples || got[len(got)-1].latency != time.Hour {
+		t.Errorf("expected a new sample to replace the oldest restored one; got %d samples", len(got))
+	}
+	if got := fresh.recent()["quiet.test:80"]; len(got) != 1 {
+		t.Errorf("expected the samples since the restart to be kept; got %v", got)
+	}
+	if y := freshYields.snapshot(); y["busy.test:80"] != 12.5 || y["quiet.test:80"] != 1 {
+		t.Errorf("expected the saved yield only for hosts without one; got %v", y)
+	}
+	// Samples that aged out of the window while the service was down are dropped
+	now = now.Add(statsWindow)
+	later := &hostTracker{hosts: map[string]*hostStats{}, now: clock}
+	applyProfiles(decoded, later, &yieldTracker{hosts: map[string]float64{}})
+	if _, ok := later.okLatency("busy.test:80", 0.5); ok {
+		t.Errorf("expected samples older than %v to be dropped", statsWindow)
+	}
+}
+
+func TestProfileStores(t *testing.T) {
+	addr, stop := fakeRedis(t, "")
+	defer stop()
+	dir := t.TempDir()
+	for _, target := range []string{filepath.Join(dir, "profiles.json"), "redis://" + addr} {
+		s, err := newProfileStore(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.load(); b != nil || err != nil {
+			t.Errorf("%s: expected nothing saved yet; got %q, %v", target, b, err)
+		}
+		for _, saved := range []string{`{"version":1}`, `{"version":1,"hosts":{}}`} {
+			if err := s.save([]byte(saved)); err != nil {
+				t.Fatalf("%s: %v", target, err)
+			}
+		}
+		if b, err := s.load(); string(b) != `{"version":1,"hosts":{}}` || err != nil {
+			t.Errorf("%s: expected the last profiles; got %q, %v", target, b, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left; got %d files", len(entries))
+	}
+	if _, err := newProfileStore("redis://localhost/db"); err == nil {
+		t.Error("expected an error for an invalid database")
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	s := fileProfileStore(path)
+	if err := loadProfiles(s); err != nil {
+		t.Errorf("expected no error without saved profiles; got %v", err)
+	}
+	os.WriteFile(path, []byte("{"), 0o600)
+	if err := loadProfiles(s); err == nil {
+		t.Error("expected an error for corrupt profiles")
+	}
+	upstreamStats.record("profiled.test:80", 42*time.Millisecond, 1, true)
+	if err := saveProfiles(s); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(path)
+	var p upstreamProfiles
+	if err := json.Unmarshal(b, &p); err != nil || p.Version != profilesVersion || len(p.Hosts["profiled.test:80"].Samples) == 0 {
+		t.Errorf("expected the profile of the host; got %s, %v", b, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Proxies whose X-Forwarded-For and X-Real-IP headers are believed. Without any the client is
+// always the peer address, so clients can't pick the address they are rate limited by.
+var (
+	proxiesMu      sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+func registerProxyFlags(fs *flag.FlagSet, trusted *string) {
+	fs.StringVar(trusted, "proxy.trusted", "", "comma separated CIDRs or addresses of proxies whose X-Forwarded-For and X-Real-IP headers are honored")
+}
+
+// Parses "10.0.0.0/8,192.168.1.1,::1"
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func setTrustedProxies(nets []*net.IPNet) {
+	proxiesMu.Lock()
+	defer proxiesMu.Unlock()
+	trustedProxies = nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	proxiesMu.RLock()
+	defer proxiesMu.RUnlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the client behind the trusted proxies. X-Forwarded-For is walked from the peer
+// towards the client, the first hop that isn't a trusted proxy is the client. Hops further
+// left were added by the client itself and are ignored.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		// Not a network peer, e.g. the inbox of a NATS client
+		return r.RemoteAddr
+	}
+	peer := ip.String()
+	if !isTrustedProxy(ip) {
+		return peer
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real.String()
+		}
+		return peer
+	}
+	client := ip
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Garbage can't be attributed, the last hop known to be good is the client
+			break
+		}
+		client = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client.String()
+}
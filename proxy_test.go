@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer setTrustedProxies(nil)
+	nets, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTrustedProxies(nets)
+	tests := []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{name: "direct", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer", remote: "203.0.113.5:1234", header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}, want: "203.0.113.5"},
+		{name: "trusted peer", remote: "10.1.2.3:1234", header: http.Header{"X-Forwarded-For": {"198.51.100.7"}}, want: "198.51.100.7"},
+		{name: "proxy chain", remote: "10.1.2.3:1234", header: http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7", "192.168.1.1"}}, want: "198.51.100.7"},
+		{name: "only proxies", remote: "10.1.2.3:1234", header: http.Header{"X-Forwarded-For": {"10.0.0.9"}}, want: "10.0.0.9"},
+		{name: "garbage", remote: "10.1.2.3:1234", header: http.Header{"X-Forwarded-For": {"1.1.1.1, bogus, 10.0.0.9"}}, want: "10.0.0.9"},
+		{name: "real ip", remote: "[fd00::1]:1234", header: http.Header{"X-Real-Ip": {"2001:db8::1"}}, want: "2001:db8::1"},
+		{name: "no headers", remote: "192.168.1.1:1234", want: "192.168.1.1"},
+		{name: "nats", remote: "nats:_INBOX.abc", want: "nats:_INBOX.abc"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/numbers", nil)
+		req.RemoteAddr = tt.remote
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("%s: expected %s; got %s", tt.name, tt.want, got)
+		}
+	}
+	for _, v := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies(v); err == nil {
+			t.Errorf("%s: expected an error", v)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Writes v as a body clients can fetch in parts with Range: bytes=, so that an interrupted
+// download of a large result can resume where it stopped. Only stable bodies are served this
+// way: cached results and the pages of a stored result. The ETag is derived from the body, so
+// If-Range falls back to the whole body once the result changed.
+func serveRanged(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - " + err.Error()))
+		return
+	}
+	// Same body as writeTraced
+	b = append(b, '\n')
+	sum := sha256.Sum256(b)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Range") != "" {
+		httpMetrics.Add("range_requests", 1)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+}
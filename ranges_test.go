@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRangeRequests(t *testing.T) {
+	defer func(c *resultCache) { requestCache = c }(requestCache)
+	requestCache = newResultCache(time.Minute, 10)
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{3, 1, 2})))
+	defer ts.Close()
+	target := "http://" + localhost + "?u=" + url.QueryEscape(ts.URL)
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, req)
+		return rec
+	}
+	full := get(http.Header{})
+	body, etag := full.Body.String(), full.Header().Get("ETag")
+	if body != "{\"numbers\":[1,2,3]}\n" || etag == "" || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected full response %q %v", body, full.Header())
+	}
+	tests := []struct {
+		header http.Header
+		code   int
+		body   string
+	}{
+		{header: http.Header{"Range": {"bytes=12-"}}, code: http.StatusPartialContent, body: body[12:]},
+		{header: http.Header{"Range": {"bytes=0-9"}}, code: http.StatusPartialContent, body: body[:10]},
+		{header: http.Header{"Range": {"bytes=12-"}, "If-Range": {etag}}, code: http.StatusPartialContent, body: body[12:]},
+		// A changed result is sent whole
+		{header: http.Header{"Range": {"bytes=12-"}, "If-Range": {`"stale"`}}, code: http.StatusOK, body: body},
+		{header: http.Header{"Range": {"bytes=100-"}}, code: http.StatusRequestedRangeNotSatisfiable},
+		{header: http.Header{"If-None-Match": {etag}}, code: http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		rec := get(tt.header)
+		if rec.Code != tt.code || (tt.body != "" && rec.Body.String() != tt.body) {
+			t.Errorf("%v: expected %d %q; got %d %q", tt.header, tt.code, tt.body, rec.Code, rec.Body)
+		}
+	}
+}
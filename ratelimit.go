@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Entries are swept once the limiter tracks more clients than this
+const rateLimitSweep = 10000
+
+// Fixed window request limiter keyed by client. A limit of 0 disables it.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	clients map[string]*rateWindow
+	now     func() time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Outcome of a rate limit check, rendered as RateLimit-* headers
+type limitStatus struct {
+	allowed   bool
+	limit     int
+	remaining int
+	reset     time.Duration
+}
+
+// Rate limit backends selectable with -limiter.backend
+const (
+	limiterMemory = "memory"
+	limiterRedis  = "redis"
+)
+
+// Counts requests per client in fixed windows. A limit of 0 disables rate limiting.
+type limitStore interface {
+	allow(key string) limitStatus
+	limitPerWindow() int
+}
+
+var limiter limitStore = newRateLimiter(0, time.Minute)
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, clients: make(map[string]*rateWindow), now: time.Now}
+}
+
+func registerRateLimitFlags(fs *flag.FlagSet, limit *int, window *time.Duration) {
+	fs.IntVar(limit, "ratelimit.requests", 0, "requests allowed per client and window, 0 disables rate limiting")
+	fs.DurationVar(window, "ratelimit.window", time.Minute, "rate limit window")
+}
+
+func registerLimiterFlags(fs *flag.FlagSet, backend, redisURL *string) {
+	fs.StringVar(backend, "limiter.backend", limiterMemory, "where rate limit counters are kept: memory limits every instance on its own, redis shares the limit across replicas")
+	fs.StringVar(redisURL, "limiter.redis-url", "redis://localhost:6379", "Redis server of the redis backend as redis://[user:password@]host:6379[/db] or rediss://...")
+}
+
+// Rate limiter for the given backend
+func newLimitStore(backend, redisURL string, limit int, window time.Duration) (limitStore, error) {
+	switch backend {
+	case limiterMemory:
+		return newRateLimiter(limit, window), nil
+	case limiterRedis:
+		return newRedisLimiter(limit, window, redisURL)
+	}
+	return nil, fmt.Errorf("invalid -limiter.backend %q, expected memory or redis", backend)
+}
+
+func (l *rateLimiter) limitPerWindow() int { return l.limit }
+
+func (l *rateLimiter) allow(key string) limitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	w, ok := l.clients[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		if !ok && len(l.clients) >= rateLimitSweep {
+			l.sweep(now)
+		}
+		w = &rateWindow{start: now}
+		l.clients[key] = w
+	}
+	st := limitStatus{limit: l.limit, reset: w.start.Add(l.window).Sub(now)}
+	if w.count >= l.limit {
+		return st
+	}
+	w.count++
+	st.allowed = true
+	st.remaining = l.limit - w.count
+	return st
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, w := range l.clients {
+		if now.Sub(w.start) >= l.window {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Wraps h with the rate limiter. Every response carries the RateLimit-* headers, requests over
+// the limit get a 429 with Retry-After.
+func rateLimited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter.limitPerWindow() <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		st := limiter.allow(clientKey(r))
+		reset := strconv.Itoa(int((st.reset + time.Second - 1) / time.Second))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(st.limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(st.remaining))
+		w.Header().Set("RateLimit-Reset", reset)
+		if !st.allowed {
+			w.Header().Set("Retry-After", reset)
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("429 - Too many requests!"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Identifies the client a request is accounted to
+func clientKey(r *http.Request) string {
+	return clientIP(r)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+	for i, expected := range []bool{true, true, false} {
+		if st := l.allow("a"); st.allowed != expected {
+			t.Errorf("request %d: expected allowed=%v; got %+v", i, expected, st)
+		}
+	}
+	if st := l.allow("b"); !st.allowed || st.remaining != 1 {
+		t.Errorf("clients should be limited independently; got %+v", st)
+	}
+	now = now.Add(time.Minute)
+	if st := l.allow("a"); !st.allowed || st.reset != time.Minute {
+		t.Errorf("expected a fresh window; got %+v", st)
+	}
+}
+
+func TestRateLimitedHeaders(t *testing.T) {
+	defer func(l limitStore) { limiter = l }(limiter)
+	limiter = newRateLimiter(1, 30*time.Second)
+	h := rateLimited(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tt := []struct {
+		status    int
+		remaining string
+	}{
+		{status: http.StatusOK, remaining: "0"},
+		{status: http.StatusTooManyRequests, remaining: "0"},
+	}
+	for i, tc := range tt {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, endpoint, nil))
+		if rec.Code != tc.status {
+			t.Errorf("request %d: expected status %v; got %v", i, tc.status, rec.Code)
+		}
+		if rec.Header().Get("RateLimit-Limit") != "1" || rec.Header().Get("RateLimit-Remaining") != tc.remaining || rec.Header().Get("RateLimit-Reset") != "30" {
+			t.Errorf("request %d: unexpected headers %v", i, rec.Header())
+		}
+	}
+}
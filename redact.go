@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Replaces the values of sensitive query parameters and URL passwords
+const redactedValue = "REDACTED"
+
+// Query parameters whose values are redacted by default
+const defaultRedactParams = "api_key,apikey,key,token,*_token,access_token,secret,*secret*,password,passwd,pwd,auth,authorization,sig,signature,credential*"
+
+var (
+	redactMu sync.RWMutex
+	// Patterns of parameter names as matched by path.Match, lowercase
+	redactParams = strings.Split(defaultRedactParams, ",")
+)
+
+// A query parameter anywhere in a text, e.g. in the URL quoted by a transport error
+var queryParamPattern = regexp.MustCompile(`([?&;])([^=&;?#\s"'<>]+)=([^&;#\s"'<>]*)`)
+
+// The password of a URL
+var userinfoPattern = regexp.MustCompile(`(://[^/@:\s"'<>]*):([^/@\s"'<>]*)@`)
+
+func registerRedactFlags(fs *flag.FlagSet, params *string) {
+	fs.StringVar(params, "redact.params", defaultRedactParams, "comma separated query parameters, * globs allowed, whose values are redacted from logs, traces and errors")
+}
+
+func setRedactParams(v string) error {
+	var patterns []string
+	for _, p := range strings.Split(v, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid redact pattern %q", p)
+		}
+		patterns = append(patterns, p)
+	}
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	redactParams = patterns
+	return nil
+}
+
+func isSensitiveParam(name string) bool {
+	if n, err := url.QueryUnescape(name); err == nil {
+		name = n
+	}
+	name = strings.ToLower(name)
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	for _, p := range redactParams {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces URL passwords and the values of sensitive query parameters in s, which is either
+// a URL or a message quoting URLs. Applied to every URL before it is logged, traced or echoed
+// in a response.
+func redact(s string) string {
+	if !strings.ContainsAny(s, "?&;@") {
+		return s
+	}
+	s = userinfoPattern.ReplaceAllString(s, "$1:"+redactedValue+"@")
+	return queryParamPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := queryParamPattern.FindStringSubmatch(m)
+		if !isSensitiveParam(sub[2]) {
+			return m
+		}
+		return sub[1] + sub[2] + "=" + redactedValue
+	})
+}
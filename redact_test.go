@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := map[string]string{
+		"http://a/p":                                  "http://a/p",
+		"http://a/p?n=1&api_key=s3cr3t":               "http://a/p?n=1&api_key=REDACTED",
+		"http://a/p?Token=x&AUTH_TOKEN=y&page=2#frag": "http://a/p?Token=REDACTED&AUTH_TOKEN=REDACTED&page=2#frag",
+		"http://a/p?client_secret=x;sig=y":            "http://a/p?client_secret=REDACTED;sig=REDACTED",
+		"http://a/p?api%5Fkey=x&key=":                 "http://a/p?api%5Fkey=REDACTED&key=REDACTED",
+		"https://user:pa55@a:8080/p?keys=1":           "https://user:REDACTED@a:8080/p?keys=1",
+		// A transport error quoting the URL
+		`Get "http://a/p?password=x": dial tcp: connection refused`: `Get "http://a/p?password=REDACTED": dial tcp: connection refused`,
+	}
+	for in, want := range tests {
+		if got := redact(in); got != want {
+			t.Errorf("%s: expected %s; got %s", in, want, got)
+		}
+	}
+}
+
+func TestRedactParams(t *testing.T) {
+	defer setRedactParams(defaultRedactParams)
+	if err := setRedactParams("session, X-*"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := redact("http://a/?session=1&x-sig=2&token=3"), "http://a/?session=REDACTED&x-sig=REDACTED&token=3"; got != want {
+		t.Errorf("expected %s; got %s", want, got)
+	}
+	if err := setRedactParams("[a"); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestFetchErrorRedacted(t *testing.T) {
+	err := newFetchError(codeUpstreamError, "http://a/?key=k1", `returned an error - Get "http://a/?key=k1": timeout`)
+	if d := detailOf(err); strings.Contains(d.URL, "k1") || strings.Contains(d.Message, "k1") || strings.Contains(err.Error(), "k1") {
+		t.Errorf("expected the key to be redacted; got %+v", d)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time a Redis command may take before the request falls back to the local limiter
+const redisTimeout = 100 * time.Millisecond
+
+// Idle connections kept open to Redis
+const redisMaxIdle = 16
+
+// Keys of the shared rate limit counters are prefixed with this
+const redisLimitPrefix = "ta-go:ratelimit:"
+
+// Counts a request and starts the window on the first one, atomically so that concurrent
+// replicas agree on the count. Returns the count and the milliseconds left in the window.
+const redisLimitScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) ttl = tonumber(ARGV[1]) end
+return {n, ttl}`
+
+// Fixed window limiter whose counters live in Redis, so the limit holds across all replicas
+// sharing it. While Redis is unreachable requests are counted by a per-instance limiter instead.
+type redisLimiter struct {
+	limit    int
+	window   time.Duration
+	client   *redisClient
+	fallback *rateLimiter
+	// Set while Redis is unreachable, so that only changes are logged
+	degraded int32
+}
+
+func newRedisLimiter(limit int, window time.Duration, rawURL string) (*redisLimiter, error) {
+	c, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("-limiter.redis-url: %v", err)
+	}
+	return &redisLimiter{limit: limit, window: window, client: c, fallback: newRateLimiter(limit, window)}, nil
+}
+
+func (l *redisLimiter) limitPerWindow() int { return l.limit }
+
+func (l *redisLimiter) allow(key string) limitStatus {
+	v, err := l.client.do("EVAL", redisLimitScript, "1", redisLimitPrefix+key, strconv.FormatInt(int64(l.window/time.Millisecond), 10))
+	res, ok := v.([]interface{})
+	if err == nil && (!ok || len(res) != 2) {
+		err = fmt.Errorf("unexpected reply %v", v)
+	}
+	if err != nil {
+		httpMetrics.Add("ratelimit_store_errors", 1)
+		if atomic.CompareAndSwapInt32(&l.degraded, 0, 1) {
+			log.Printf("ratelimit: redis unavailable, limiting per instance - %v", err)
+		}
+		return l.fallback.allow(key)
+	}
+	if atomic.CompareAndSwapInt32(&l.degraded, 1, 0) {
+		log.Printf("ratelimit: redis available again")
+	}
+	count, _ := res[0].(int64)
+	ttl, _ := res[1].(int64)
+	st := limitStatus{limit: l.limit, reset: time.Duration(ttl) * time.Millisecond}
+	if count > int64(l.limit) {
+		return st
+	}
+	st.allowed = true
+	st.remaining = l.limit - int(count)
+	return st
+}
+
+// Minimal RESP2 client with a small pool of connections
+type redisClient struct {
+	addr     string
+	tls      bool
+	user     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url %q - %v", rawURL, err)
+	}
+	c := &redisClient{addr: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = true
+	default:
+		return nil, fmt.Errorf("invalid redis url %q, expected redis:// or rediss://", rawURL)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid database %q in redis url %q", db, rawURL)
+		}
+	}
+	return c, nil
+}
+
+// Runs a command and returns its reply: a string, an int64, nil or a []interface{} of those
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := rc.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection is in an unknown state after a network error
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return v, err
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return rc, nil
+	}
+	c.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.user != "" {
+			auth = []string{"AUTH", c.user, c.password}
+		}
+		if _, err := rc.do(auth...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *redisClient) put(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= redisMaxIdle {
+		rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+// Error reply of the server, the connection is still usable after one
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	defer rc.conn.SetDeadline(time.Time{})
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(rc.r)
+}
+
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) < 1 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				// An error element doesn't fail the whole reply
+				var rerr redisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+				items[i] = rerr
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
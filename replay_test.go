@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A recorded request with the answers of its upstreams, stored in testdata/replay. {0}, {1}, ...
+// in the request stand for the URLs of the sources in order.
+type replayFixture struct {
+	Request  string           `json:"request"`
+	Sources  []replayResponse `json:"sources"`
+	Response replayResponse   `json:"response"`
+}
+
+type replayResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+}
+
+func loadReplayFixtures(tb testing.TB) map[string]replayFixture {
+	paths, err := filepath.Glob(filepath.Join("testdata", "replay", "*.json"))
+	if err != nil || len(paths) == 0 {
+		tb.Fatalf("no replay fixtures: %v", err)
+	}
+	fixtures := make(map[string]replayFixture)
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		var f replayFixture
+		if err := json.Unmarshal(b, &f); err != nil {
+			tb.Fatalf("%s: %v", path, err)
+		}
+		fixtures[strings.TrimSuffix(filepath.Base(path), ".json")] = f
+	}
+	return fixtures
+}
+
+// Starts the upstreams of f and returns its request against them, plus a func undoing the
+// substitution in a response
+func (f replayFixture) serve() (target string, restore func(string) string, stop func()) {
+	servers := make([]*httptest.Server, len(f.Sources))
+	target = f.Request
+	for i, src := range f.Sources {
+		src := src
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if src.ContentType != "" {
+				w.Header().Set("Content-Type", src.ContentType)
+			}
+			w.WriteHeader(src.Status)
+			w.Write([]byte(src.Body))
+		}))
+		target = strings.Replace(target, fmt.Sprintf("{%d}", i), servers[i].URL, -1)
+	}
+	restore = func(s string) string {
+		for i, ts := range servers {
+			s = strings.Replace(s, ts.URL, fmt.Sprintf("{%d}", i), -1)
+		}
+		return durationField.ReplaceAllString(s, `"duration_ms":0`)
+	}
+	stop = func() {
+		for _, ts := range servers {
+			ts.Close()
+		}
+	}
+	return target, restore, stop
+}
+
+func replay(h http.Handler, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("X-Request-ID", "replay")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// The fixtures still produce the recorded responses, otherwise the benchmarks would measure
+// something else. -update records the current responses.
+func TestReplayFixtures(t *testing.T) {
+	defer func(t *hostTracker) { upstreamStats = t }(upstreamStats)
+	upstreamStats = newHostTracker()
+	h := routes()
+	for name, f := range loadReplayFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			target, restore, stop := f.serve()
+			defer stop()
+			rec := replay(h, target)
+			got := replayResponse{Status: rec.Code, ContentType: rec.Header().Get("Content-Type"), Body: restore(rec.Body.String())}
+			if *update {
+				f.Response = got
+				var buf bytes.Buffer
+				enc := json.NewEncoder(&buf)
+				enc.SetEscapeHTML(false)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(f); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join("testdata", "replay", name+".json"), buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if got != f.Response {
+				t.Errorf("response differs from the recorded one, run with -update if the change is intended\n--- want\n%+v\n--- got\n%+v", f.Response, got)
+			}
+		})
+	}
+}
+
+// Replays every fixture through the aggregation core. Compare runs across commits with
+// go run ./cmd/benchcmp.
+func BenchmarkReplay(b *testing.B) {
+	defer func(t *hostTracker) { upstreamStats = t }(upstreamStats)
+	// Log lines about failing sources would end up in the middle of the benchmark results
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	h := routes()
+	for name, f := range loadReplayFixtures(b) {
+		b.Run(name, func(b *testing.B) {
+			target, _, stop := f.serve()
+			defer stop()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Failing sources of a fixture would otherwise trip their breakers after a few rounds
+				b.StopTimer()
+				upstreamStats = newHostTracker()
+				b.StartTimer()
+				if rec := replay(h, target); rec.Code != f.Response.Status {
+					b.Fatalf("expected status %d; got %d", f.Response.Status, rec.Code)
+				}
+			}
+		})
+	}
+}
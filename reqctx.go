@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Keys for per-request metadata carried through the worker pool in the request context
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	tenantKey
+	principalKey
+	deadlineSourceKey
+	clientIPKey
+)
+
+// Where the deadline of a request came from
+const (
+	deadlineServer = "server"
+	deadlineClient = "client"
+	deadlineTenant = "tenant"
+)
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// Tenant the request is accounted to, empty when authentication is disabled
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey).(string)
+	return t
+}
+
+func withPrincipal(ctx context.Context, p string) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// Authenticated caller, empty when authentication is disabled
+func principalFrom(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey).(string)
+	return p
+}
+
+func withDeadlineSource(ctx context.Context, src string) context.Context {
+	return context.WithValue(ctx, deadlineSourceKey, src)
+}
+
+func deadlineSourceFrom(ctx context.Context) string {
+	src, _ := ctx.Value(deadlineSourceKey).(string)
+	if src == "" {
+		return deadlineServer
+	}
+	return src
+}
+
+func withClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// Address of the client the request is made on behalf of
+func clientIPFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// Context for the fan-out of an incoming request: the request metadata plus the deadline the
+// client asked for, the server's when that is 0, or the shorter one of its tenant
+func requestContext(r *http.Request, client time.Duration) (context.Context, context.CancelFunc) {
+	ctx := withClientIP(withDeadlineSource(r.Context(), deadlineServer), clientKey(r))
+	d := timeout * time.Millisecond
+	if client > 0 {
+		d = client
+		ctx = withDeadlineSource(ctx, deadlineClient)
+	}
+	d, shorter := tenantDeadline(ctx, d)
+	if shorter {
+		ctx = withDeadlineSource(ctx, deadlineTenant)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Prefix for log lines about a request, so lines from the worker pool can be correlated
+func logPrefix(ctx context.Context) string {
+	id := requestIDFrom(ctx)
+	if id == "" {
+		return ""
+	}
+	if t := tenantFrom(ctx); t != "" {
+		return "[" + id + " " + t + "] "
+	}
+	return "[" + id + "] "
+}
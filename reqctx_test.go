@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContextAccessors(t *testing.T) {
+	ctx := context.Background()
+	if requestIDFrom(ctx) != "" || tenantFrom(ctx) != "" || principalFrom(ctx) != "" || logPrefix(ctx) != "" {
+		t.Error("expected empty metadata on a bare context")
+	}
+	if deadlineSourceFrom(ctx) != deadlineServer {
+		t.Errorf("expected the server deadline by default; got %q", deadlineSourceFrom(ctx))
+	}
+	ctx = withDeadlineSource(withPrincipal(withTenant(withRequestID(ctx, "id1"), "acme"), "key:abcd..."), deadlineClient)
+	if requestIDFrom(ctx) != "id1" || tenantFrom(ctx) != "acme" || principalFrom(ctx) != "key:abcd..." || deadlineSourceFrom(ctx) != deadlineClient {
+		t.Error("metadata did not survive the context")
+	}
+	if logPrefix(ctx) != "[id1 acme] " {
+		t.Errorf("unexpected log prefix %q", logPrefix(ctx))
+	}
+}
+
+func TestRequestIDPropagatesUpstream(t *testing.T) {
+	got := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("X-Request-ID")
+		w.Write([]byte(`{"numbers":[1]}`))
+	}))
+	defer ts.Close()
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL, nil)
+	req = req.WithContext(withRequestID(req.Context(), "propagated"))
+	numbersHandler(httptest.NewRecorder(), req)
+	if id := <-got; id != "propagated" {
+		t.Errorf("expected the request id upstream; got %q", id)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Hard limits on what a request may carry, checked before the query or the body is parsed.
+// 0 disables a limit.
+type requestLimits struct {
+	maxQueryBytes  int
+	maxQueryParams int
+	maxHeaders     int
+	maxHeaderBytes int
+	maxBodyBytes   int64
+}
+
+var limits = requestLimits{
+	maxQueryBytes:  1 << 20,
+	maxQueryParams: 10000,
+	maxHeaders:     100,
+	maxHeaderBytes: 64 << 10,
+	maxBodyBytes:   64 << 20,
+}
+
+func registerRequestLimitFlags(fs *flag.FlagSet, l *requestLimits) {
+	fs.IntVar(&l.maxQueryBytes, "limits.max-query-bytes", l.maxQueryBytes, "longest query string accepted, longer ones get a 414")
+	fs.IntVar(&l.maxQueryParams, "limits.max-query-params", l.maxQueryParams, "most query parameters accepted, e.g. u and g, more get a 414")
+	fs.IntVar(&l.maxHeaders, "limits.max-headers", l.maxHeaders, "most request header fields accepted, more get a 431")
+	fs.IntVar(&l.maxHeaderBytes, "limits.max-header-bytes", l.maxHeaderBytes, "largest request header accepted, larger ones get a 431")
+	fs.Int64Var(&l.maxBodyBytes, "limits.max-body-bytes", l.maxBodyBytes, "largest request body accepted, e.g. a snapshot upload, larger ones get a 413")
+}
+
+// RFC 7807 problem details
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// The limit that was exceeded
+	Limit int64 `json:"limit,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, limit int64, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: fmt.Sprintf(format, args...), Limit: limit})
+}
+
+// Size of the header as sent, "Name: value\r\n" per field
+func headerBytes(h http.Header) (fields, size int) {
+	for name, values := range h {
+		for _, v := range values {
+			fields++
+			size += len(name) + len(v) + 4
+		}
+	}
+	return fields, size
+}
+
+// Rejects requests over the limits. Query parameters are counted without parsing the query,
+// so a request with 100k parameters costs a scan rather than a map of 100k entries.
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := limits
+		reject := func(reason string, status int, limit int64, format string, args ...interface{}) {
+			httpMetrics.Add("rejected "+reason, 1)
+			writeProblem(w, status, limit, format, args...)
+		}
+		q := r.URL.RawQuery
+		if l.maxQueryBytes > 0 && len(q) > l.maxQueryBytes {
+			reject("query_bytes", http.StatusRequestURITooLong, int64(l.maxQueryBytes), "query string of %d bytes exceeds the limit", len(q))
+			return
+		}
+		if n := strings.Count(q, "&") + strings.Count(q, ";") + 1; l.maxQueryParams > 0 && q != "" && n > l.maxQueryParams {
+			reject("query_params", http.StatusRequestURITooLong, int64(l.maxQueryParams), "%d query parameters exceed the limit", n)
+			return
+		}
+		fields, size := headerBytes(r.Header)
+		if l.maxHeaders > 0 && fields > l.maxHeaders {
+			reject("headers", http.StatusRequestHeaderFieldsTooLarge, int64(l.maxHeaders), "%d header fields exceed the limit", fields)
+			return
+		}
+		if l.maxHeaderBytes > 0 && size > l.maxHeaderBytes {
+			reject("header_bytes", http.StatusRequestHeaderFieldsTooLarge, int64(l.maxHeaderBytes), "header of %d bytes exceeds the limit", size)
+			return
+		}
+		if l.maxBodyBytes > 0 && r.Body != nil {
+			if r.ContentLength > l.maxBodyBytes {
+				reject("body_bytes", http.StatusRequestEntityTooLarge, l.maxBodyBytes, "body of %d bytes exceeds the limit", r.ContentLength)
+				return
+			}
+			// Bodies without a length are cut off once they exceed the limit
+			r.Body = http.MaxBytesReader(w, r.Body, l.maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether err was caused by a body longer than -limits.max-body-bytes
+func bodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
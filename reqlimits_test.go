@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitRequests(t *testing.T) {
+	defer func(l requestLimits) { limits = l }(limits)
+	limits = requestLimits{maxQueryBytes: 200, maxQueryParams: 3, maxHeaders: 3, maxHeaderBytes: 100, maxBodyBytes: 10}
+	h := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); bodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+		body   string
+		chunk  bool
+		code   int
+	}{
+		{name: "ok", target: "/numbers?u=a&u=b&u=c", code: http.StatusOK},
+		{name: "query bytes", target: "/numbers?u=" + strings.Repeat("a", 200), code: http.StatusRequestURITooLong},
+		{name: "query params", target: "/numbers?u=a&u=b;u=c&u=d", code: http.StatusRequestURITooLong},
+		{name: "headers", target: "/numbers", header: http.Header{"A": {"1"}, "B": {"2", "3"}, "C": {"4"}}, code: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "header bytes", target: "/numbers", header: http.Header{"Cookie": {strings.Repeat("c", 100)}}, code: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "body", target: "/admin/snapshot", body: strings.Repeat("x", 11), code: http.StatusRequestEntityTooLarge},
+		{name: "chunked body", target: "/admin/snapshot", body: strings.Repeat("x", 11), chunk: true, code: http.StatusRequestEntityTooLarge},
+		{name: "small body", target: "/admin/snapshot", body: "{}", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+		if tt.chunk {
+			req.ContentLength = -1
+		}
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected %d; got %d", tt.name, tt.code, rec.Code)
+			continue
+		}
+		if tt.code == http.StatusOK || tt.chunk {
+			continue
+		}
+		var p problem
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: expected a problem; got %s", tt.name, ct)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&p); err != nil || p.Status != tt.code || p.Limit == 0 || p.Detail == "" {
+			t.Errorf("%s: unexpected problem %+v %v", tt.name, p, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rough in-memory size of a recorded aggregation besides its values
+const snapshotOverhead = 64
+
+// Limits on the history store. Zero values don't limit.
+type retentionPolicy struct {
+	// Aggregations older than this are dropped
+	maxAge time.Duration
+	// Oldest aggregations, across all groups, are dropped until the store is below this size
+	maxBytes int64
+}
+
+// What a purge dropped
+type purgeResult struct {
+	At        time.Time `json:"at"`
+	Snapshots int       `json:"snapshots"`
+	Bytes     int64     `json:"bytes"`
+}
+
+var (
+	retentionMu sync.Mutex
+	retention   retentionPolicy
+	lastPurge   purgeResult
+)
+
+func registerRetentionFlags(fs *flag.FlagSet, maxAge *time.Duration, maxBytes *int64, interval *time.Duration) {
+	fs.DurationVar(maxAge, "history.max-age", 0, "group aggregations older than this are purged from the history, 0 keeps them")
+	fs.Int64Var(maxBytes, "history.max-bytes", 0, "approximate size the history is purged down to, oldest aggregations first, 0 doesn't limit it")
+	fs.DurationVar(interval, "history.purge-interval", time.Minute, "how often the history and expired pages are purged")
+}
+
+func setRetention(p retentionPolicy) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	retention = p
+}
+
+func currentRetention() retentionPolicy {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	return retention
+}
+
+func snapshotSize(s snapshot) int64 {
+	return snapshotOverhead + 8*int64(len(s.Numbers))
+}
+
+// Drops the aggregations p doesn't allow
+func (h *historyStore) purge(p retentionPolicy) purgeResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	res := purgeResult{At: now}
+	drop := func(name string, n int) {
+		for _, s := range h.entries[name][:n] {
+			res.Snapshots++
+			res.Bytes += snapshotSize(s)
+		}
+		if h.entries[name] = h.entries[name][n:]; len(h.entries[name]) == 0 {
+			delete(h.entries, name)
+		}
+	}
+	if p.maxAge > 0 {
+		cutoff := now.Add(-p.maxAge)
+		for name, e := range h.entries {
+			n := sort.Search(len(e), func(i int) bool { return !e[i].At.Before(cutoff) })
+			if n > 0 {
+				drop(name, n)
+			}
+		}
+	}
+	if p.maxBytes > 0 {
+		var total int64
+		for _, e := range h.entries {
+			for _, s := range e {
+				total += snapshotSize(s)
+			}
+		}
+		for total > p.maxBytes {
+			// Entries are kept newest last, so the oldest aggregation overall is the oldest first entry
+			var oldest string
+			for name, e := range h.entries {
+				if oldest == "" || e[0].At.Before(h.entries[oldest][0].At) {
+					oldest = name
+				}
+			}
+			total -= snapshotSize(h.entries[oldest][0])
+			drop(oldest, 1)
+		}
+	}
+	return res
+}
+
+// Size of the history store
+type historyUsage struct {
+	Groups    int        `json:"groups"`
+	Snapshots int        `json:"snapshots"`
+	Bytes     int64      `json:"bytes"`
+	Oldest    *time.Time `json:"oldest,omitempty"`
+}
+
+func (h *historyStore) usage() historyUsage {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	u := historyUsage{Groups: len(h.entries)}
+	for _, e := range h.entries {
+		for _, s := range e {
+			u.Snapshots++
+			u.Bytes += snapshotSize(s)
+		}
+		if len(e) > 0 && (u.Oldest == nil || e[0].At.Before(*u.Oldest)) {
+			at := e[0].At
+			u.Oldest = &at
+		}
+	}
+	return u
+}
+
+// Drops the expired pages
+func (s *pageStore) purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for id, p := range s.entries {
+		if !now.Before(p.expires) {
+			delete(s.entries, id)
+		}
+	}
+}
+
+func (s *pageStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Applies p to the history and drops expired pages
+func purgeStores(p retentionPolicy) purgeResult {
+	pagedResults.purge()
+	res := history.purge(p)
+	historyMetrics.Add("purged_snapshots", int64(res.Snapshots))
+	historyMetrics.Add("purged_bytes", res.Bytes)
+	retentionMu.Lock()
+	lastPurge = res
+	retentionMu.Unlock()
+	return res
+}
+
+// Purges the stores every interval until ctx is done
+func purgeLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if res := purgeStores(currentRetention()); res.Snapshots > 0 {
+				log.Printf("retention: purged %d aggregations, about %d bytes", res.Snapshots, res.Bytes)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type retentionStatus struct {
+	MaxAge    string       `json:"max_age"`
+	MaxBytes  int64        `json:"max_bytes"`
+	History   historyUsage `json:"history"`
+	Pages     int          `json:"pages"`
+	LastPurge *purgeResult `json:"last_purge,omitempty"`
+}
+
+func currentRetentionStatus() retentionStatus {
+	p := currentRetention()
+	st := retentionStatus{MaxAge: p.maxAge.String(), MaxBytes: p.maxBytes, History: history.usage(), Pages: pagedResults.len()}
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	if !lastPurge.At.IsZero() {
+		last := lastPurge
+		st.LastPurge = &last
+	}
+	return st
+}
+
+// GET reports the retention policy and the size of the stores. POST purges them right away,
+// max_age and max_bytes tighten the configured policy for that purge.
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		p, err := purgeOverrides(currentRetention(), r.URL.Query().Get("max_age"), r.URL.Query().Get("max_bytes"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - " + err.Error()))
+			return
+		}
+		res := purgeStores(p)
+		log.Printf("retention: purge requested, dropped %d aggregations, about %d bytes", res.Snapshots, res.Bytes)
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentRetentionStatus())
+}
+
+func purgeOverrides(p retentionPolicy, maxAge, maxBytes string) (retentionPolicy, error) {
+	if maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("invalid max_age %q", maxAge)
+		}
+		if p.maxAge == 0 || d < p.maxAge {
+			p.maxAge = d
+		}
+	}
+	if maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("invalid max_bytes %q", maxBytes)
+		}
+		if p.maxBytes == 0 || n < p.maxBytes {
+			p.maxBytes = n
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistoryPurge(t *testing.T) {
+	start := time.Now()
+	record := func(h *historyStore, name string, at time.Duration, values int) {
+		h.now = func() time.Time { return start.Add(at) }
+		h.record(name, make([]int, values))
+	}
+	fill := func() *historyStore {
+		h := newHistoryStore()
+		record(h, "a", 0, 10)
+		record(h, "b", time.Minute, 10)
+		record(h, "a", 2*time.Minute, 10)
+		record(h, "b", 3*time.Minute, 10)
+		h.now = func() time.Time { return start.Add(4 * time.Minute) }
+		return h
+	}
+	size := snapshotOverhead + 80
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		left   map[string]int
+	}{
+		{name: "none", left: map[string]int{"a": 2, "b": 2}},
+		{name: "age", policy: retentionPolicy{maxAge: 150 * time.Second}, left: map[string]int{"a": 1, "b": 1}},
+		{name: "everything", policy: retentionPolicy{maxAge: time.Second}, left: map[string]int{}},
+		{name: "bytes", policy: retentionPolicy{maxBytes: int64(3 * size)}, left: map[string]int{"a": 1, "b": 2}},
+		{name: "both", policy: retentionPolicy{maxAge: 210 * time.Second, maxBytes: int64(2 * size)}, left: map[string]int{"a": 1, "b": 1}},
+		{name: "small", policy: retentionPolicy{maxBytes: 1}, left: map[string]int{}},
+	}
+	for _, tt := range tests {
+		h := fill()
+		res := h.purge(tt.policy)
+		left := 0
+		for name, n := range tt.left {
+			if got := len(h.entries[name]); got != n {
+				t.Errorf("%s: expected %d entries for %s; got %d", tt.name, n, name, got)
+			}
+			left += n
+		}
+		if len(h.entries) != len(tt.left) || res.Snapshots != 4-left || res.Bytes != int64((4-left)*size) {
+			t.Errorf("%s: unexpected purge %+v of %v", tt.name, res, h.entries)
+		}
+		if u := h.usage(); u.Snapshots != left || u.Bytes != int64(left*size) {
+			t.Errorf("%s: unexpected usage %+v", tt.name, u)
+		}
+	}
+}
+
+func TestRetentionHandler(t *testing.T) {
+	defer func(h *historyStore) { history = h }(history)
+	defer setRetention(currentRetention())
+	history = newHistoryStore()
+	now := time.Now()
+	history.now = func() time.Time { return now.Add(-time.Hour) }
+	history.record("g", []int{1, 2, 3})
+	history.now = func() time.Time { return now }
+	history.record("g", []int{1, 2})
+	setRetention(retentionPolicy{maxAge: 24 * time.Hour})
+
+	status := func(method, target string) (int, retentionStatus) {
+		rec := httptest.NewRecorder()
+		retentionHandler(rec, httptest.NewRequest(method, target, nil))
+		var st retentionStatus
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, st
+	}
+	code, st := status(http.MethodGet, "/admin/retention")
+	if code != http.StatusOK || st.MaxAge != "24h0m0s" || st.History.Snapshots != 2 || st.History.Groups != 1 {
+		t.Errorf("unexpected status %d %+v", code, st)
+	}
+	if code, st = status(http.MethodPost, "/admin/retention"); st.LastPurge == nil || st.LastPurge.Snapshots != 0 {
+		t.Errorf("expected nothing to be purged; got %d %+v", code, st.LastPurge)
+	}
+	// Overrides can only tighten the policy
+	if code, st = status(http.MethodPost, "/admin/retention?max_age=48h"); st.History.Snapshots != 2 {
+		t.Errorf("expected both aggregations to be kept; got %d %+v", code, st)
+	}
+	if code, st = status(http.MethodPost, "/admin/retention?max_age=30m"); st.History.Snapshots != 1 || st.LastPurge.Snapshots != 1 {
+		t.Errorf("expected the older aggregation to be purged; got %d %+v", code, st)
+	}
+	for _, target := range []string{"/admin/retention?max_age=soon", "/admin/retention?max_bytes=-1"} {
+		if code, _ := status(http.MethodPost, target); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400; got %d", target, code)
+		}
+	}
+}
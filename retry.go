@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Latency percentile of a host's successful fetches a suggested deadline has to cover
+	retryPercentile = 0.95
+	// Headroom on top of that latency for merging and rendering
+	retryMargin = 1.2
+	// Suggestions are rounded up to a multiple of this
+	retryStep = 50 * time.Millisecond
+)
+
+var (
+	retryMu sync.RWMutex
+	// Completeness below which a response suggests a longer deadline, 0 disables the hints
+	retryHintBelow = 0.9
+)
+
+func registerRetryFlags(fs *flag.FlagSet, below *float64) {
+	fs.Float64Var(below, "retry.hint-below", 0.9, "completeness below which responses suggest a deadline likely to get the sources that timed out, 0 disables the hints")
+}
+
+func setRetryHintBelow(v float64) error {
+	if v < 0 || v > 1 {
+		return fmt.Errorf("-retry.hint-below must be in [0, 1]")
+	}
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retryHintBelow = v
+	return nil
+}
+
+func currentRetryHintBelow() float64 {
+	retryMu.RLock()
+	defer retryMu.RUnlock()
+	return retryHintBelow
+}
+
+// Deadline a retry of an incomplete request would need for the sources that timed out to answer,
+// judged by how long their hosts recently took to answer successfully. ok is false when the
+// request was complete enough, its sources failed for other reasons than time, their hosts have
+// no successful fetches to go by, or the deadline they would need is no longer than the one the
+// request had or more than its tenant may have.
+func suggestDeadline(ctx context.Context, sum summary, total int, o options, start time.Time) (time.Duration, bool) {
+	below := currentRetryHintBelow()
+	if completeness(sum.ok, total) >= below {
+		return 0, false
+	}
+	var need time.Duration
+	for _, err := range sum.errs {
+		var fe *fetchError
+		if !errors.As(err, &fe) || fe.code != codeUpstreamTimeout && fe.code != codeBudgetExceeded {
+			continue
+		}
+		u, perr := url.Parse(fe.url)
+		if perr != nil {
+			continue
+		}
+		if d, ok := upstreamStats.okLatency(u.Host, retryPercentile); ok && d > need {
+			need = d
+		}
+	}
+	if need == 0 {
+		return 0, false
+	}
+	had := o.upstreamTimeout
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(start) < had {
+		had = deadline.Sub(start)
+	}
+	suggested := time.Duration(float64(need) * retryMargin)
+	suggested = (suggested + retryStep - 1) / retryStep * retryStep
+	_, longest := currentTimeoutBounds()
+	ceiling, _ := tenantDeadline(ctx, longest)
+	if suggested > ceiling {
+		suggested = ceiling
+	}
+	if suggested <= had {
+		return 0, false
+	}
+	httpMetrics.Add("retry_hints", 1)
+	return suggested, true
+}
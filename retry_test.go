@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSuggestDeadline(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		upstreamStats.record("slow.test:80", 400*time.Millisecond, 10, true)
+		upstreamStats.record("down.test:80", time.Second, 0, false)
+	}
+	timedOut := func(host string) error {
+		return newFetchError(codeBudgetExceeded, "http://"+host+"/numbers", "did not answer before the deadline")
+	}
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"capped": {Deadline: duration(300 * time.Millisecond)}, "tight": {Deadline: duration(150 * time.Millisecond)}})
+	o, _ := parseOptions(nil)
+	tests := []struct {
+		name   string
+		tenant string
+		sum    summary
+		total  int
+		want   time.Duration
+	}{
+		{name: "complete enough", sum: summary{ok: 9, errs: []error{timedOut("slow.test:80")}}, total: 10},
+		{name: "timed out", sum: summary{ok: 1, errs: []error{timedOut("slow.test:80")}}, total: 2, want: 500 * time.Millisecond},
+		{name: "upstream timeout", sum: summary{ok: 0, errs: []error{newFetchError(codeUpstreamTimeout, "http://slow.test:80/", "timed out")}}, total: 1, want: 500 * time.Millisecond},
+		{name: "failed otherwise", sum: summary{ok: 1, errs: []error{newFetchError(codeUpstream5xx, "http://slow.test:80/", "503")}}, total: 2},
+		{name: "no successes", sum: summary{ok: 1, errs: []error{timedOut("down.test:80")}}, total: 2},
+		{name: "unknown host", sum: summary{ok: 1, errs: []error{timedOut("new.test:80")}}, total: 2},
+		{name: "tenant ceiling", tenant: "capped", sum: summary{ok: 1, errs: []error{timedOut("slow.test:80")}}, total: 2, want: 300 * time.Millisecond},
+		{name: "ceiling reached", tenant: "tight", sum: summary{ok: 1, errs: []error{timedOut("slow.test:80")}}, total: 2},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(withTenant(context.Background(), tt.tenant), start.Add(200*time.Millisecond))
+		got, ok := suggestDeadline(ctx, tt.sum, tt.total, o, start)
+		cancel()
+		if got != tt.want || ok != (tt.want > 0) {
+			t.Errorf("%s: expected %v; got %v, %v", tt.name, tt.want, got, ok)
+		}
+	}
+}
+
+func TestRetryHintResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{"numbers":[1]}`))
+	}))
+	defer ts.Close()
+	// The first request has time for the source, so its host has a latency to go by
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL, nil))
+	if h := rec.Header().Get("X-Suggested-Deadline-Ms"); h != "" {
+		t.Errorf("expected no hint for a complete response; got %s", h)
+	}
+	rec = httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+"&upstream_timeout_ms=20&verbose=suggested_deadline_ms,completeness", nil))
+	ms, err := strconv.Atoi(rec.Header().Get("X-Suggested-Deadline-Ms"))
+	if err != nil || ms < 100 || ms%50 != 0 {
+		t.Fatalf("expected a hint covering the source's latency; got %q", rec.Header().Get("X-Suggested-Deadline-Ms"))
+	}
+	var body struct {
+		Completeness        float64 `json:"completeness"`
+		SuggestedDeadlineMS int     `json:"suggested_deadline_ms"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Completeness != 0 || body.SuggestedDeadlineMS != ms {
+		t.Errorf("expected the hint in the envelope; got %+v, %v", body, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Wraps a handler with cross-cutting behaviour
+type middleware func(http.Handler) http.Handler
+
+// Small router matching on method and path. Patterns are split on "/" and a segment written as
+// {name} matches any single segment, available to the handler through pathParam.
+type router struct {
+	routes     []route
+	middleware []middleware
+	// Serves requests no route matched, e.g. the pprof and expvar handlers on http.DefaultServeMux
+	fallback http.Handler
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+type paramsKey struct{}
+
+func newRouter() *router {
+	return &router{fallback: http.NotFoundHandler()}
+}
+
+// Adds middleware applied to every route, outermost first
+func (rt *router) use(mw ...middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+}
+
+// Registers h for method and pattern. Route specific middleware wraps h inside the router wide one.
+func (rt *router) handle(method, pattern string, h http.HandlerFunc, mw ...middleware) {
+	rt.routes = append(rt.routes, route{method: method, segments: splitPath(pattern), handler: chain(h, mw...)})
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chain(http.HandlerFunc(rt.dispatch), rt.middleware...).ServeHTTP(w, r)
+}
+
+func (rt *router) dispatch(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	pathMatched := false
+	for _, rte := range rt.routes {
+		params, ok := match(rte.segments, segments)
+		if !ok {
+			continue
+		}
+		if rte.method != r.Method {
+			pathMatched = true
+			continue
+		}
+		if len(params) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), paramsKey{}, params))
+		}
+		rte.handler.ServeHTTP(w, r)
+		return
+	}
+	if pathMatched {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+		return
+	}
+	rt.fallback.ServeHTTP(w, r)
+}
+
+// Value of the {name} segment the request matched
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// Applies mw to h so that mw[0] runs first
+func chain(h http.Handler, mw ...middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func match(pattern, segments []string) (map[string]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[p[1:len(p)-1]] = segments[i]
+			continue
+		}
+		if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	rt := newRouter()
+	var trace []string
+	tag := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				trace = append(trace, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	rt.use(tag("outer"))
+	rt.handle(http.MethodGet, "/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("job " + pathParam(r, "id")))
+	}, tag("route"))
+	rt.handle(http.MethodDelete, "/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tt := []struct {
+		method string
+		path   string
+		status int
+		body   string
+		trace  string
+	}{
+		{method: http.MethodGet, path: "/jobs/42", status: http.StatusOK, body: "job 42", trace: "outer,route"},
+		{method: http.MethodGet, path: "/jobs/42/", status: http.StatusOK, body: "job 42", trace: "outer,route"},
+		{method: http.MethodDelete, path: "/jobs/42", status: http.StatusNoContent, trace: "outer"},
+		{method: http.MethodPost, path: "/jobs/42", status: http.StatusForbidden, trace: "outer"},
+		{method: http.MethodGet, path: "/jobs", status: http.StatusNotFound, trace: "outer"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.method+tc.path, func(t *testing.T) {
+			trace = nil
+			rec := httptest.NewRecorder()
+			rt.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			if rec.Code != tc.status {
+				t.Errorf("expected status %v; got %v", tc.status, rec.Code)
+			}
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, rec.Body.String())
+			}
+			if got := strings.Join(trace, ","); got != tc.trace {
+				t.Errorf("expected middleware %q; got %q", tc.trace, got)
+			}
+		})
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	rt := routes()
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, endpoint, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status OK; got %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "upstream") {
+		t.Errorf("expected expvar through the fallback; got %v", rec.Code)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers the security_headers middleware adds to responses, by route. A route is a path
+// prefix matched on segment boundaries, "" applies to every response. More specific routes
+// override less specific ones, an empty value removes the header.
+type headerRules map[string]http.Header
+
+var (
+	securityMu    sync.RWMutex
+	securityRules = defaultSecurityRules()
+	// max-age of Strict-Transport-Security, 0 leaves the header out
+	hstsMaxAge = 365 * 24 * time.Hour
+)
+
+func defaultSecurityRules() headerRules {
+	return headerRules{
+		"": {
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"DENY"},
+			"Referrer-Policy":        {"no-referrer"},
+			// Results are per tenant and change all the time
+			"Cache-Control": {"no-store"},
+		},
+		"/ui": {
+			"Content-Security-Policy": {uiContentSecurityPolicy()},
+			"Cache-Control":           {"no-cache"},
+		},
+	}
+}
+
+// The page may only run its own inline script and call back into the service
+func uiContentSecurityPolicy() string {
+	script := uiPage
+	if i := bytes.Index(script, []byte("<script>")); i >= 0 {
+		script = script[i+len("<script>"):]
+	}
+	if i := bytes.Index(script, []byte("</script>")); i >= 0 {
+		script = script[:i]
+	}
+	sum := sha256.Sum256(script)
+	return "default-src 'none'; script-src 'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'; " +
+		"style-src 'unsafe-inline'; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+}
+
+// Collects repeated "[/route ]Name: value" flags into rules
+type securityHeaderFlag headerRules
+
+func (f securityHeaderFlag) String() string {
+	return ""
+}
+
+func (f securityHeaderFlag) Set(v string) error {
+	route := ""
+	if strings.HasPrefix(v, "/") {
+		i := strings.IndexByte(v, ' ')
+		if i < 0 {
+			return fmt.Errorf("invalid security header %q, expected [/route ]Name: value", v)
+		}
+		route, v = strings.TrimSuffix(v[:i], "/"), strings.TrimSpace(v[i+1:])
+	}
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("invalid security header %q, expected [/route ]Name: value", v)
+	}
+	if headerRules(f)[route] == nil {
+		headerRules(f)[route] = http.Header{}
+	}
+	headerRules(f)[route].Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+func registerSecurityFlags(fs *flag.FlagSet, overrides headerRules, hsts *time.Duration) {
+	fs.Var(securityHeaderFlag(overrides), "security.header", "\"[/route ]Name: value\" header added to responses, overriding the defaults, an empty value removes it, repeatable")
+	fs.DurationVar(hsts, "security.hsts-max-age", 365*24*time.Hour, "max-age of Strict-Transport-Security sent on TLS requests, 0 disables it")
+}
+
+// Applies overrides on top of the default rules
+func setSecurityHeaders(overrides headerRules, hsts time.Duration) {
+	rules := defaultSecurityRules()
+	for route, h := range overrides {
+		if rules[route] == nil {
+			rules[route] = http.Header{}
+		}
+		for name, values := range h {
+			rules[route][name] = values
+		}
+	}
+	securityMu.Lock()
+	defer securityMu.Unlock()
+	securityRules, hstsMaxAge = rules, hsts
+}
+
+// Headers for path, the rules of less specific routes first
+func securityHeadersFor(path string) http.Header {
+	securityMu.RLock()
+	defer securityMu.RUnlock()
+	var routes []string
+	for route := range securityRules {
+		if route == "" || path == route || strings.HasPrefix(path, route+"/") {
+			routes = append(routes, route)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i]) < len(routes[j]) })
+	out := http.Header{}
+	for _, route := range routes {
+		for name, values := range securityRules[route] {
+			out[name] = values
+		}
+	}
+	return out
+}
+
+// Sets the security headers of the route before the handler runs, so handlers can still
+// override them. Strict-Transport-Security is only sent over TLS, including TLS terminated
+// by a proxy that sets X-Forwarded-Proto.
+func secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for name, values := range securityHeadersFor(r.URL.Path) {
+			if len(values) > 0 && values[0] != "" {
+				h[name] = values
+			}
+		}
+		securityMu.RLock()
+		maxAge := hstsMaxAge
+		securityMu.RUnlock()
+		if maxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(maxAge/time.Second)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	defer setSecurityHeaders(nil, 365*24*time.Hour)
+	overrides := headerRules{}
+	for _, v := range []string{"/admin/ Cache-Control: private", "/ui X-Frame-Options:", "Permissions-Policy: interest-cohort=()"} {
+		if err := securityHeaderFlag(overrides).Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setSecurityHeaders(overrides, time.Hour)
+	h := secureHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		path   string
+		tls    bool
+		header string
+		want   string
+	}{
+		{path: "/numbers", header: "X-Content-Type-Options", want: "nosniff"},
+		{path: "/numbers", header: "Cache-Control", want: "no-store"},
+		{path: "/numbers", header: "Permissions-Policy", want: "interest-cohort=()"},
+		{path: "/numbers", header: "Strict-Transport-Security"},
+		{path: "/numbers", tls: true, header: "Strict-Transport-Security", want: "max-age=3600"},
+		{path: "/admin/pool", header: "Cache-Control", want: "private"},
+		{path: "/administrator", header: "Cache-Control", want: "no-store"},
+		{path: "/ui", header: "Cache-Control", want: "no-cache"},
+		{path: "/ui", header: "X-Frame-Options"},
+		{path: "/numbers", header: "X-Frame-Options", want: "DENY"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Header().Get(tt.header); got != tt.want {
+			t.Errorf("%s %s: expected %q; got %q", tt.path, tt.header, tt.want, got)
+		}
+	}
+	for _, v := range []string{"/ui", "/ui nonsense", ": value"} {
+		if err := securityHeaderFlag(headerRules{}).Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestUIContentSecurityPolicy(t *testing.T) {
+	csp := uiContentSecurityPolicy()
+	if !strings.Contains(csp, "script-src 'sha256-") || !strings.Contains(csp, "default-src 'none'") {
+		t.Errorf("unexpected policy %q", csp)
+	}
+	// The page has a single inline script, which the hash has to cover
+	if n := strings.Count(string(uiPage), "<script"); n != 1 {
+		t.Errorf("expected one script in the page; got %d", n)
+	}
+}
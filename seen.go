@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixed size Bloom filter over ints
+type bloom struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// Sizes a filter for n values at false positive rate p
+func newBloom(n int, p float64) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloom{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// Double hashing over two mixes of v
+func (b *bloom) index(v int, i uint64) uint64 {
+	h1 := mix64(uint64(v))
+	h2 := mix64(uint64(v)^0x9e3779b97f4a7c15) | 1
+	return (h1 + i*h2) % b.m
+}
+
+func (b *bloom) add(v int) {
+	for i := uint64(0); i < b.k; i++ {
+		idx := b.index(v, i)
+		b.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (b *bloom) test(v int) bool {
+	for i := uint64(0); i < b.k; i++ {
+		idx := b.index(v, i)
+		if b.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Remembers values for roughly a window by spreading it over generations of Bloom filters.
+// Values are added to the newest generation and the oldest is dropped every window/generations.
+type rotatingBloom struct {
+	gens    []*bloom
+	rotated time.Time
+	every   time.Duration
+	n       int
+	p       float64
+}
+
+const seenGenerations = 4
+
+func newRotatingBloom(window time.Duration, n int, p float64, now time.Time) *rotatingBloom {
+	r := &rotatingBloom{every: window / seenGenerations, n: n, p: p, rotated: now}
+	for i := 0; i < seenGenerations; i++ {
+		r.gens = append(r.gens, newBloom(n, p))
+	}
+	return r
+}
+
+func (r *rotatingBloom) rotate(now time.Time) {
+	for now.Sub(r.rotated) >= r.every && r.every > 0 {
+		copy(r.gens, r.gens[1:])
+		r.gens[len(r.gens)-1] = newBloom(r.n, r.p)
+		r.rotated = r.rotated.Add(r.every)
+		// After a long idle period every generation is stale, start over
+		if now.Sub(r.rotated) >= r.every*seenGenerations {
+			r.rotated = now
+			for i := range r.gens {
+				r.gens[i] = newBloom(r.n, r.p)
+			}
+		}
+	}
+}
+
+func (r *rotatingBloom) seen(v int) bool {
+	for _, g := range r.gens {
+		if g.test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rotatingBloom) add(v int) {
+	r.gens[len(r.gens)-1].add(v)
+}
+
+// Dedup windows keyed by tenant and group set
+type seenWindows struct {
+	mu       sync.Mutex
+	window   time.Duration
+	capacity int
+	fpRate   float64
+	scopes   map[string]*rotatingBloom
+	now      func() time.Time
+}
+
+var seenValues = newSeenWindows(10*time.Minute, 100000, 0.01)
+
+func newSeenWindows(window time.Duration, capacity int, fpRate float64) *seenWindows {
+	return &seenWindows{window: window, capacity: capacity, fpRate: fpRate, scopes: make(map[string]*rotatingBloom), now: time.Now}
+}
+
+func registerSeenFlags(fs *flag.FlagSet, window *time.Duration, capacity *int, fpRate *float64) {
+	fs.DurationVar(window, "seen.window", 10*time.Minute, "how long values are remembered for exclude_seen")
+	fs.IntVar(capacity, "seen.capacity", 100000, "values per generation the exclude_seen filters are sized for")
+	fs.Float64Var(fpRate, "seen.fp-rate", 0.01, "false positive rate of the exclude_seen filters")
+}
+
+// Scope of a dedup window: the tenant and the sorted groups of the request
+func seenScope(tenant string, groupNames []string) string {
+	sorted := append([]string(nil), groupNames...)
+	sort.Strings(sorted)
+	return tenant + "|" + strings.Join(sorted, ",")
+}
+
+// Returns the values not seen in scope within the window and remembers all of them.
+// A false positive drops a new value, so results may miss values at roughly fpRate.
+func (s *seenWindows) filter(scope string, values []int) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	r, ok := s.scopes[scope]
+	if !ok {
+		r = newRotatingBloom(s.window, s.capacity, s.fpRate, now)
+		s.scopes[scope] = r
+	}
+	r.rotate(now)
+	out := make([]int, 0, len(values))
+	for _, v := range values {
+		if !r.seen(v) {
+			out = append(out, v)
+		}
+	}
+	for _, v := range values {
+		r.add(v)
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	b := newBloom(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		b.add(i)
+	}
+	for i := 0; i < 10000; i++ {
+		if !b.test(i) {
+			t.Fatalf("false negative for %d", i)
+		}
+	}
+	fp := 0
+	for i := 10000; i < 110000; i++ {
+		if b.test(i) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 100000; rate > 0.02 {
+		t.Errorf("false positive rate %v is way above 0.01", rate)
+	}
+}
+
+func TestSeenWindows(t *testing.T) {
+	now := time.Now()
+	s := newSeenWindows(4*time.Minute, 1000, 0.001)
+	s.now = func() time.Time { return now }
+
+	if got := s.filter("t|g", []int{1, 2, 3}); len(got) != 3 {
+		t.Fatalf("nothing was seen yet; got %v", got)
+	}
+	if got := s.filter("t|g", []int{2, 3, 4}); len(got) != 1 || got[0] != 4 {
+		t.Errorf("expected only the new value; got %v", got)
+	}
+	if got := s.filter("other|g", []int{1}); len(got) != 1 {
+		t.Errorf("scopes must not share their window; got %v", got)
+	}
+	now = now.Add(3 * time.Minute)
+	if got := s.filter("t|g", []int{1}); len(got) != 0 {
+		t.Errorf("expected 1 to still be within the window; got %v", got)
+	}
+	// 1 was re-added a minute after 2 and 3, so those drop out first
+	now = now.Add(2 * time.Minute)
+	if got := s.filter("t|g", []int{1, 2}); len(got) != 1 || got[0] != 2 {
+		t.Errorf("expected 2 to have left the window; got %v", got)
+	}
+	now = now.Add(time.Hour)
+	if got := s.filter("t|g", []int{1, 2, 3, 4}); len(got) != 4 {
+		t.Errorf("expected everything to be forgotten after a long pause; got %v", got)
+	}
+}
+
+func TestSeenScope(t *testing.T) {
+	if seenScope("acme", []string{"b", "a"}) != seenScope("acme", []string{"a", "b"}) {
+		t.Error("group order must not matter")
+	}
+}
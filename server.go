@@ -2,152 +2,1164 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	_ "net/http/pprof"
+	"net/url"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	endpoint = "/numbers"
 	// The below 3 values should reside as environment variables for flexibility
-	// Max number of simultaneous workers
+	// Default number of simultaneous workers, see -pool.min and -pool.max
 	maxConnections = 200
 	// Timeout for requests. This is high in case the result of each URL contains millions of digits
 	individualTimeout = 50000
 	// Timeout for context. This is high in case we have to process large number of URLs
 	timeout = 50000
+	// Upper bound for the upstream_timeout_ms query parameter. Callers can only tighten the
+	// per-URL timeout, never extend it past the server policy.
+	maxUpstreamTimeout = individualTimeout
+	// Upper bound for the hint_total query parameter so a client can't make us allocate arbitrary memory
+	maxHintTotal = 10000000
 )
 
 //Type which represents the response of the given URLs as well as our response
 type result struct {
 	Numbers []int `json:"numbers"`
+	// Elements dropped by decoding and values adjusted to an int, e.g. 3.0 or "3"
+	skipped, coerced int
 }
 
-type payload struct {
-	res chan result
-	err chan error
+// Outcome of merging the results of all the URLs of a request
+type summary struct {
+	numbers []int
+	// Sources that answered successfully and sources that didn't
+	ok, failed int
+	// Elements skipped and values coerced per URL
+	skipped, coerced map[string]int
+	// Bucket counts, replaces numbers when a histogram was requested
+	histogram *histogram
+	// Why sources didn't contribute
+	errs []error
+	// Stage the request was in when its deadline passed, empty when it finished in time
+	deadlineStage string
+	// orderPartial or orderUnsorted when the deadline cut the sort short, empty when sorted
+	order string
+	// Sources of every value, nil unless the request asked for attribution
+	attribution *attribution
+	// What the client's Bloom filter dropped, nil without one
+	bloom *bloomDisclosure
+}
+
+// Per-request knobs parsed from the query string
+type options struct {
+	// Deadline of the request the client asked for with timeout, 0 leaves it to the server
+	deadline time.Duration
+	// Timeout applied to every individual upstream fetch
+	upstreamTimeout time.Duration
+	// Expected number of distinct values, used to pre-size the accumulator and dedup map
+	hintTotal int
+	// Coerce or skip malformed elements instead of failing the whole source
+	lenient bool
+	// Extra envelope fields to include in the response
+	fields map[string]bool
+	// Encode values as JSON strings
+	stringify bool
+	// One of dedupAll, dedupNone or dedupPerSource
+	dedup string
+	// Histogram spec. Empty unless the caller asked for bucket counts instead of values.
+	histogram string
+	// Drop values returned to the same tenant and groups within the seen window
+	excludeSeen bool
+	// Return a timeline of internal events under _trace
+	trace bool
+	// Filter specs as given, e.g. "mod:7:0", and the predicates they compile to
+	filter  []string
+	filters []predicate
+	// Values are floored to a multiple of bucket before dedup, 0 leaves them as they are
+	bucket int
+	// Values per page of a paginated response, 0 returns every value at once
+	pageSize int
+	// Position in a stored result, returned as next_cursor by the previous page
+	cursor string
+	// What to do when the sort would exceed the deadline, see sortWait
+	sortPolicy string
+	// Encoding of the response, nil until resolveShape picked the tenant's
+	shape *responseShape
+	// attributeSources or attributeCount to report the sources of every value, empty not to
+	attribute string
+}
+
+// Values of the dedup query parameter
+const (
+	dedupAll       = "true"
+	dedupNone      = "false"
+	dedupPerSource = "per_source"
+)
+
+func parseOptions(q url.Values) (options, error) {
+	o := options{upstreamTimeout: individualTimeout * time.Millisecond, dedup: dedupAll, sortPolicy: currentSortPolicy()}
+	if v := q.Get("upstream_timeout_ms"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return o, fmt.Errorf("invalid upstream_timeout_ms %q", v)
+		}
+		if ms > maxUpstreamTimeout {
+			ms = maxUpstreamTimeout
+		}
+		o.upstreamTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if v := q.Get("timeout"); v != "" {
+		d, err := parseTimeout(v)
+		if err != nil {
+			return o, err
+		}
+		o.deadline = d
+		// No fetch outlives the request, one may take all of it unless upstream_timeout_ms says otherwise
+		if q.Get("upstream_timeout_ms") == "" || o.upstreamTimeout > d {
+			o.upstreamTimeout = d
+		}
+	}
+	if v := q.Get("hint_total"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return o, fmt.Errorf("invalid hint_total %q", v)
+		}
+		if n > maxHintTotal {
+			n = maxHintTotal
+		}
+		o.hintTotal = n
+	}
+	if v := q.Get("lenient"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid lenient %q", v)
+		}
+		o.lenient = b
+	}
+	if v := q.Get("stringify"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid stringify %q", v)
+		}
+		o.stringify = b
+	}
+	switch v := q.Get("dedup"); v {
+	case "":
+	case dedupAll, dedupNone, dedupPerSource:
+		o.dedup = v
+	default:
+		return o, fmt.Errorf("invalid dedup %q", v)
+	}
+	if v := q.Get("histogram"); v != "" {
+		if _, err := parseHistogram(v); err != nil {
+			return o, err
+		}
+		o.histogram = v
+	}
+	if v := q.Get("exclude_seen"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid exclude_seen %q", v)
+		}
+		if b && o.histogram != "" {
+			return o, fmt.Errorf("exclude_seen can't be combined with histogram")
+		}
+		o.excludeSeen = b
+	}
+	if v := q.Get("trace"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid trace %q", v)
+		}
+		o.trace = b
+	}
+	for _, v := range q["filter"] {
+		for _, spec := range strings.Split(v, ",") {
+			if spec = strings.TrimSpace(spec); spec != "" {
+				o.filter = append(o.filter, spec)
+			}
+		}
+	}
+	preds, err := parseFilters(o.filter)
+	if err != nil {
+		return o, err
+	}
+	o.filters = preds
+	if v := q.Get("bucket"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return o, fmt.Errorf("invalid bucket %q", v)
+		}
+		o.bucket = n
+	}
+	if v := q.Get("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return o, fmt.Errorf("invalid page_size %q", v)
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		o.pageSize = n
+	}
+	if o.cursor = q.Get("cursor"); o.cursor != "" && o.pageSize == 0 {
+		o.pageSize = defaultPageSize
+	}
+	if v := q.Get("sort_policy"); v != "" {
+		if !validSortPolicy(v) {
+			return o, fmt.Errorf("invalid sort_policy %q", v)
+		}
+		o.sortPolicy = v
+	}
+	if o.pageSize > 0 && o.histogram != "" {
+		return o, fmt.Errorf("page_size can't be combined with histogram")
+	}
+	if o.attribute, err = parseAttribute(q.Get("attribute")); err != nil {
+		return o, err
+	}
+	if o.attribute != "" && o.histogram != "" {
+		return o, fmt.Errorf("attribute can't be combined with histogram")
+	}
+	if v := q.Get("shape"); v != "" {
+		s, err := parseShape(v)
+		if err != nil {
+			return o, err
+		}
+		o.shape = &s
+	}
+	fields, err := parseFields(q.Get("verbose"))
+	if err != nil {
+		return o, err
+	}
+	o.fields = fields
+	return o, nil
 }
 
 func main() {
-	listenAddr := flag.String("http.addr", ":8000", "http listen address")
+	listenAddr := flag.String("http.addr", ":8000", "http listen address, empty disables HTTP when -nats.url is set")
+	transportCfg.registerFlags(flag.CommandLine)
+	upstream.registerFlags(flag.CommandLine)
+	var redactParams string
+	registerRedactFlags(flag.CommandLine, &redactParams)
+	fields := flag.String("response.fields", "", "comma separated envelope fields added to every response, or \"all\"")
+	var shapes string
+	registerShapeFlags(flag.CommandLine, &shapes)
+	groupsFile := flag.String("groups.file", "", "JSON file with named upstream groups")
+	var featuresFile string
+	registerFeatureFlags(flag.CommandLine, &featuresFile)
+	var tenantsFile string
+	registerTenantFlags(flag.CommandLine, &tenantsFile)
+	var rateLimit int
+	var rateWindow time.Duration
+	registerRateLimitFlags(flag.CommandLine, &rateLimit, &rateWindow)
+	var limiterBackend, limiterRedisURL string
+	registerLimiterFlags(flag.CommandLine, &limiterBackend, &limiterRedisURL)
+	securityOverrides := headerRules{}
+	var hsts time.Duration
+	registerSecurityFlags(flag.CommandLine, securityOverrides, &hsts)
+	registerRequestLimitFlags(flag.CommandLine, &limits)
+	var proxies string
+	registerProxyFlags(flag.CommandLine, &proxies)
+	offenders := currentOffenderConfig()
+	registerOffenderFlags(flag.CommandLine, &offenders)
+	order := flag.String("middleware.order", defaultPipeline, "comma separated middleware applied to every request, outermost first")
+	keys := flag.String("auth.keys", "", "comma separated key:tenant API keys, authentication is disabled when empty")
+	admin := flag.String("auth.admin-keys", "", "comma separated keys of the /admin endpoints, which tenant keys don't open")
+	warmConns := flag.Int("groups.prewarm", 0, "connections per group host to open at startup and keep warm, 0 disables pre-warming")
+	var cacheTTL time.Duration
+	var cacheMax int
+	var finishOnDisconnect bool
+	registerCacheFlags(flag.CommandLine, &cacheTTL, &cacheMax, &finishOnDisconnect)
+	var refreshConcurrency, refreshMinHits int
+	registerRefreshFlags(flag.CommandLine, &refreshConcurrency, &refreshMinHits)
+	var seenWindow time.Duration
+	var seenCapacity int
+	var seenFPRate float64
+	registerSeenFlags(flag.CommandLine, &seenWindow, &seenCapacity, &seenFPRate)
+	var pagesTTL time.Duration
+	var pagesMax int
+	registerPageFlags(flag.CommandLine, &pagesTTL, &pagesMax)
+	var historyMaxAge, purgeInterval time.Duration
+	var historyMaxBytes int64
+	registerRetentionFlags(flag.CommandLine, &historyMaxAge, &historyMaxBytes, &purgeInterval)
+	var poolMin, poolMax int
+	registerPoolFlags(flag.CommandLine, &poolMin, &poolMax)
+	var decodeWorkers int
+	registerDecoderFlags(flag.CommandLine, &decodeWorkers)
+	registerPipelineFlags(flag.CommandLine, &pipelineDepth)
+	registerMergeFlags(flag.CommandLine, &mergeShards)
+	var fdReserve int
+	registerFDFlags(flag.CommandLine, &fdReserve)
+	var procs int
+	var memLimit string
+	var memRatio float64
+	registerRuntimeFlags(flag.CommandLine, &procs, &memLimit, &memRatio)
+	registerUIFlags(flag.CommandLine, &uiEnabled)
+	var mqttCfg mqttConfig
+	registerMQTTFlags(flag.CommandLine, &mqttCfg)
+	var natsCfg natsConfig
+	registerNATSFlags(flag.CommandLine, &natsCfg)
+	var drain time.Duration
+	registerUpgradeFlags(flag.CommandLine, &drain)
+	var grace time.Duration
+	registerGraceFlags(flag.CommandLine, &grace)
+	render := currentRenderConfig()
+	registerRenderFlags(flag.CommandLine, &render)
+	var sortPolicy string
+	registerSortFlags(flag.CommandLine, &sortPolicy)
+	var egressGlobal, egressTenant int64
+	var egressWindow time.Duration
+	var egressMode string
+	registerEgressFlags(flag.CommandLine, &egressGlobal, &egressTenant, &egressWindow, &egressMode)
+	var slo sloConfig
+	registerSLOFlags(flag.CommandLine, &slo)
+	var retryBelow float64
+	registerRetryFlags(flag.CommandLine, &retryBelow)
+	var dnsPin bool
+	registerDNSFlags(flag.CommandLine, &dnsPin)
+	var conditionalValues int
+	registerConditionalFlags(flag.CommandLine, &conditionalValues)
+	var profilesCfg profilesConfig
+	registerProfileFlags(flag.CommandLine, &profilesCfg)
+	var timeoutMin, timeoutMax time.Duration
+	registerTimeoutFlags(flag.CommandLine, &timeoutMin, &timeoutMax)
+	var dictSamples int
+	var dictInterval time.Duration
+	registerDictFlags(flag.CommandLine, &dictSamples, &dictInterval)
+	soak := flag.Duration("soak", 0, "instead of serving, exercise the aggregation path against embedded mock upstreams for this long and fail if goroutines or the heap keep growing")
+	snapshotFile := flag.String("snapshot.restore", "", "snapshot file from GET /admin/snapshot to restore at startup")
+	var snapshotKeyEnv, snapshotKeyFile string
+	registerEncryptionFlags(flag.CommandLine, &snapshotKeyEnv, &snapshotKeyFile)
 	flag.Parse()
-	http.HandleFunc(endpoint, numbersHandler)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	if err := applyRuntimeLimits(procs, memLimit, memRatio); err != nil {
+		log.Fatal(err)
+	}
+	// The transport's header timeout has to allow the longest timeout
+	if err := setTimeoutBounds(timeoutMin, timeoutMax); err != nil {
+		log.Fatal(err)
+	}
+	setTransportConfig(transportCfg)
+	decoders.resize(decodeWorkers)
+	if err := pool.setBounds(poolMin, poolMax); err != nil {
+		log.Fatal(err)
+	}
+	if pipelineDepth < 1 {
+		log.Fatal("-pipeline.depth must be at least 1")
+	}
+	if err := limitSockets(fdReserve, poolMax); err != nil {
+		log.Fatal(err)
+	}
+	if poolMin < poolMax {
+		go pool.tune(context.Background(), poolAdjustInterval)
+	}
+	go pool.sampleLoop(context.Background(), poolSampleInterval)
+	store, err := newLimitStore(limiterBackend, limiterRedisURL, rateLimit, rateWindow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limiter = store
+	requestCache = newResultCache(cacheTTL, cacheMax)
+	seenValues = newSeenWindows(seenWindow, seenCapacity, seenFPRate)
+	if dictSamples < 0 {
+		log.Fatal("-dict.samples must not be negative")
+	}
+	dictionaries = newDictionaryStore(dictSamples, dictInterval)
+	pagedResults = newPageStore(pagesTTL, pagesMax)
+	setRetention(retentionPolicy{maxAge: historyMaxAge, maxBytes: historyMaxBytes})
+	go purgeLoop(context.Background(), purgeInterval)
+	requestCache.refreshConcurrency, requestCache.refreshMinHits = refreshConcurrency, refreshMinHits
+	requestCache.finishOnDisconnect = finishOnDisconnect
+	go requestCache.refresher(context.Background())
+	if err := setDefaultFields(*fields); err != nil {
+		log.Fatal(err)
+	}
+	shaped, err := parseTenantShapes(shapes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setTenantShapes(shaped)
+	if err := setRedactParams(redactParams); err != nil {
+		log.Fatal(err)
+	}
+	setSecurityHeaders(securityOverrides, hsts)
+	trusted, err := parseTrustedProxies(proxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setTrustedProxies(trusted)
+	setLateGrace(grace)
+	if err := setRenderConfig(render); err != nil {
+		log.Fatal(err)
+	}
+	if err := setSortPolicy(sortPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if err := egress.configure(egressGlobal, egressTenant, egressWindow, egressMode); err != nil {
+		log.Fatal(err)
+	}
+	if err := slos.configure(slo); err != nil {
+		log.Fatal(err)
+	}
+	if err := setRetryHintBelow(retryBelow); err != nil {
+		log.Fatal(err)
+	}
+	setDNSPinning(dnsPin)
+	validators.setMaxValues(conditionalValues)
+	if err := setOffenderConfig(offenders); err != nil {
+		log.Fatal(err)
+	}
+	go reportOffenders(context.Background(), offenders.interval)
+	if *groupsFile != "" {
+		all, err := loadGroups(*groupsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		groups.set(all)
+	}
+	if featuresFile != "" {
+		all, err := loadFeatures(featuresFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setFeatures(all)
+	}
+	if tenantsFile != "" {
+		all, err := loadTenants(tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tenants.set(all)
+	}
+	if snapshotSealer, err = loadSealer(snapshotKeyEnv, snapshotKeyFile); err != nil {
+		log.Fatal(err)
+	}
+	// A snapshot overrides the flags and the groups file
+	if *snapshotFile != "" {
+		if err := restoreSnapshotFile(*snapshotFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var profiles profileStore
+	if profilesCfg.store != "" {
+		if profiles, err = newProfileStore(profilesCfg.store); err != nil {
+			log.Fatal(err)
+		}
+		// Unreadable profiles only cost the warm-up they would have saved
+		if err := loadProfiles(profiles); err != nil {
+			log.Printf("profiles: loading failed - %v", err)
+		}
+		go saveProfilesLoop(context.Background(), profiles, profilesCfg.interval)
+	}
+	if *warmConns > 0 {
+		go keepWarm(context.Background(), *warmConns)
+	}
+	if mqttCfg.broker != "" {
+		p, err := newMQTTPublisher(mqttCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resultPublisher = p
+	}
+	schedule(context.Background())
+	keyTenants, err := parseAPIKeys(*keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setAPIKeys(keyTenants)
+	setAdminKeys(parseAdminKeys(*admin))
+	pipeline, err := buildPipeline(*order)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *soak > 0 {
+		if err := soakTest(*soak, routes(pipeline...), os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Without an HTTP address the service only answers over NATS, unless it was handed a socket
+	l, err := listen(*listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if l == nil && natsCfg.url == "" {
+		log.Fatal("-http.addr must be set unless -nats.url is")
+	}
+	serve(l, routes(pipeline...), natsCfg, drain)
+	if profiles != nil {
+		if err := saveProfiles(profiles); err != nil {
+			log.Printf("profiles: saving failed - %v", err)
+		}
+	}
+}
+
+// Serves h on l and over NATS until SIGHUP handed both to a new process, then waits up to drain
+// for in-flight requests
+func serve(l net.Listener, h http.Handler, nc natsConfig, drain time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifyReady(ctx)
+	var wg sync.WaitGroup
+	if nc.url != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveNATS(ctx, nc, h); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	// The header limit is also enforced while parsing, before a request reaches the middleware
+	srv := &http.Server{Handler: h, MaxHeaderBytes: limits.maxHeaderBytes}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		awaitUpgrade(l)
+		// serveNATS returns once the answers it's working on are published
+		cancel()
+		if l != nil {
+			dctx, dcancel := context.WithTimeout(context.Background(), drain)
+			defer dcancel()
+			if err := srv.Shutdown(dctx); err != nil {
+				log.Printf("upgrade: requests still running after %v - %v", drain, err)
+			}
+		}
+	}()
+	if l != nil {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-drained
+	wg.Wait()
+}
+
+// All the endpoints of the service behind the middleware pipeline. Anything unmatched, e.g. pprof,
+// goes to http.DefaultServeMux.
+func routes(pipeline ...middleware) *router {
+	rt := newRouter()
+	rt.fallback = http.DefaultServeMux
+	rt.use(pipeline...)
+	rt.handle(http.MethodGet, endpoint, numbersHandler, underMaintenance, egressLimited)
+	rt.handle(http.MethodPost, endpoint, numbersHandler, underMaintenance, egressLimited)
+	rt.handle(http.MethodGet, endpoint+"/delta", deltaHandler, underMaintenance, egressLimited)
+	rt.handle(http.MethodGet, "/aggregate", aggregateHandler, underMaintenance, egressLimited)
+	rt.handle(http.MethodPost, "/batch", batchHandler, underMaintenance, egressLimited)
+	rt.handle(http.MethodGet, "/dict", dictHandler)
+	rt.handle(http.MethodGet, "/healthz", healthHandler)
+	rt.handle(http.MethodGet, "/admin/upstreams/stats", upstreamStatsHandler)
+	rt.handle(http.MethodGet, "/admin/upstreams/offenders", offendersHandler)
+	rt.handle(http.MethodGet, "/admin/upstreams/tls", upstreamTLSHandler)
+	rt.handle(http.MethodGet, "/admin/upstreams/decoding", upstreamDecodingHandler)
+	rt.handle(http.MethodGet, "/admin/pool", poolHandler)
+	rt.handle(http.MethodGet, "/admin/egress", egressHandler)
+	rt.handle(http.MethodGet, "/admin/snapshot", snapshotHandler)
+	rt.handle(http.MethodPost, "/admin/snapshot", snapshotHandler)
+	rt.handle(http.MethodGet, "/admin/retention", retentionHandler)
+	rt.handle(http.MethodPost, "/admin/retention", retentionHandler)
+	rt.handle(http.MethodGet, "/admin/maintenance", maintenanceHandler)
+	rt.handle(http.MethodPost, "/admin/maintenance", maintenanceHandler)
+	rt.handle(http.MethodDelete, "/admin/maintenance", maintenanceHandler)
+	rt.handle(http.MethodGet, "/admin/features", featuresHandler)
+	rt.handle(http.MethodPost, "/admin/features", featuresHandler)
+	rt.handle(http.MethodDelete, "/admin/features", featuresHandler)
+	rt.handle(http.MethodGet, "/admin/tenants", tenantsHandler)
+	rt.handle(http.MethodGet, "/admin/slo", sloHandler)
+	if uiEnabled {
+		rt.handle(http.MethodGet, "/ui", uiHandler)
+	}
+	return rt
 }
 
 func numbersHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	start := time.Now()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("403 - Method not supported!"))
 		return
 	}
-	ctx := r.Context()
-	ctx, cancel := context.WithTimeout(ctx, timeout*time.Millisecond)
-	defer cancel()
 	u := r.URL
 	q := u.Query()
-	params := q["u"]
-	if len(params) == 0 {
-		json.NewEncoder(w).Encode(result{Numbers: []int{}})
-	} else {
-		// Create the http transport for reuse
-		t := &http.Transport{
-			Proxy:               http.ProxyFromEnvironment,
-			MaxIdleConnsPerHost: maxConnections,
-			// Timeout for individual requests
-			ResponseHeaderTimeout: individualTimeout * time.Millisecond,
-		}
-		res := make(chan result, maxConnections)
-		err := make(chan error, maxConnections)
-		p := payload{res: res, err: err}
-		// Spawn go routines for worker to consume
-		go fetchAll(ctx, t, params, &p)
-		// Consumer to consume from channels
-		json.NewEncoder(w).Encode(result{Numbers: consume(ctx, len(params), &p)})
-	}
-}
-
-// Spawns worker goroutines and generate work
-func fetchAll(ctx context.Context, t *http.Transport, urls []string, p *payload) {
-	c := make(chan string)
-	// Spin up workers. Only 200 workers will be concurrently fetching from URLs.
-	// This will ensure we do not run out of sockets or hit file descriptor limits
-	for i := 0; i < maxConnections; i++ {
-		go doWork(ctx, t, c, p)
-	}
-	// Queue up work by putting URLs in a queue. The doWork goroutine will consume this channel.
-	for _, u := range urls {
-		c <- u
-	}
-	// Closing channel to indicate to doWork that we have processed all URLs
-	close(c)
-}
-
-func doWork(ctx context.Context, t *http.Transport, u chan string, p *payload) {
-	// Consume URLs until the channel is closed
-	for {
-		url, ok := <-u
-		//Channel is closed signaling all URLs have been processed
-		if !ok {
+	opts, err := parseOptions(q)
+	ctx, cancel := requestContext(r, opts.deadline)
+	defer cancel()
+	if err == nil {
+		err = resolveShape(ctx, &opts)
+	}
+	var body numbersRequest
+	if err == nil {
+		body, err = decodeNumbersBody(r)
+		if bodyTooLarge(err) {
+			writeProblem(w, http.StatusRequestEntityTooLarge, limits.maxBodyBytes, "body exceeds the body limit")
 			return
 		}
-		fetch(ctx, t, url, p)
 	}
-}
-
-func fetch(ctx context.Context, t *http.Transport, u string, p *payload) {
-	var number result
-	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err == nil {
+		err = body.validate(opts)
+	}
 	if err != nil {
-		p.err <- fmt.Errorf("%s returned an error while creating a request- %v", u, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
 		return
 	}
-	req = req.WithContext(ctx)
-	res, err := t.RoundTrip(req)
+	if opts.cursor != "" {
+		nextPage(w, r, opts, start)
+		return
+	}
+	params, err := resolveURLs(q)
+	if err == nil {
+		err = checkAttribute(opts, params)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
+		return
+	}
+	fetched := params
+	if body.ExcludeURL != "" {
+		fetched = append(params[:len(params):len(params)], body.ExcludeURL)
+	}
+	if perr := checkTenantRequest(ctx, q, fetched, opts); perr != nil {
+		perr.write(w)
+		return
+	}
+	var tr *tracer
+	if opts.trace {
+		tr = newTracer(start)
+		ctx = withTracer(ctx, tr)
+	}
+	var excluded func() (map[int]struct{}, error)
+	if body.excludes() {
+		excluded = body.exclusions(ctx, opts)
+	}
+	sum := cachedRun(ctx, w, params, opts)
+	observeCompleteness(sum.ok, len(params))
+	// Counted once the response is written, so that encoding counts against the latency objective
+	defer func(ok int) { slos.record(tenantFrom(ctx), time.Since(start), ok, len(params)) }(sum.ok)
+	if excluded != nil {
+		set, err := excluded()
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("502 - " + err.Error()))
+			return
+		}
+		sum.numbers = dropExcluded(sum.numbers, set)
+		if body.ExcludeBloom != nil {
+			sum.numbers, sum.bloom = body.ExcludeBloom.drop(sum.numbers)
+		}
+	}
+	if opts.excludeSeen {
+		// The summary may be shared with the cache, filter returns a new slice
+		sum.numbers = seenValues.filter(seenScope(tenantFrom(ctx), q["g"]), sum.numbers)
+	}
+	var next string
+	if opts.pageSize > 0 && len(sum.numbers) > opts.pageSize {
+		id, p := pagedResults.put(tenantFrom(ctx), sum, len(params))
+		sum, next = p.page(id, 0, opts.pageSize)
+	}
+	if perr := checkTenantResult(ctx, opts, len(sum.numbers)); perr != nil {
+		perr.write(w)
+		return
+	}
+	e := newEnvelope(opts, sum, len(params), time.Since(start), requestID(r))
+	e.NextCursor = next
+	if d, ok := suggestDeadline(ctx, sum, len(params), opts, start); ok {
+		ms := d.Milliseconds()
+		w.Header().Set("X-Suggested-Deadline-Ms", strconv.FormatInt(ms, 10))
+		if opts.fields["suggested_deadline_ms"] {
+			e.SuggestedDeadlineMS = &ms
+		}
+	}
+	encoding := time.Now()
+	defer func() { renderCosts.observeEncode(len(sum.numbers), time.Since(encoding)) }()
+	w.Header().Add("Vary", "Accept")
+	if c := responseCodec(r.Header.Get("Accept")); c != nil && tr == nil {
+		writeCodec(w, c, e)
+		return
+	}
+	if g := dictGroup(q); g != "" && tr == nil && serveWithDictionary(w, r, g, e) {
+		return
+	}
+	if tr == nil && (requestCache.enabled() || next != "") {
+		serveRanged(w, r, e)
+		return
+	}
+	writeTraced(w, e, tr)
+}
+
+// Serves the page of a stored result a cursor points to
+func nextPage(w http.ResponseWriter, r *http.Request, opts options, start time.Time) {
+	id, offset, err := decodeCursor(opts.cursor)
 	if err != nil {
-		p.err <- fmt.Errorf("%s returned an error while performing a request  - %v", u, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - " + err.Error()))
 		return
 	}
-	// Close body so that sockets can be reused.
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		p.err <- fmt.Errorf("%s server returned an error - %v", u, res.Status)
+	p, ok := pagedResults.get(id, tenantFrom(r.Context()))
+	if !ok {
+		httpMetrics.Add("cursor_expired", 1)
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("410 - cursor expired, request the first page again"))
 		return
 	}
-	if err := json.NewDecoder(res.Body).Decode(&number); err != nil {
-		p.err <- fmt.Errorf("%s decoding error - %v", u, err)
+	sum, next := p.page(id, offset, opts.pageSize)
+	e := newEnvelope(opts, sum, p.sources, time.Since(start), requestID(r))
+	e.NextCursor = next
+	w.Header().Add("Vary", "Accept")
+	if c := responseCodec(r.Header.Get("Accept")); c != nil {
+		writeCodec(w, c, e)
 		return
 	}
-	//log.Println("success")
-	p.res <- number
+	serveRanged(w, r, e)
 }
 
-// Consumer to drain result and error channel. Also handles context timeouts.
-func consume(ctx context.Context, count int, p *payload) []int {
-	accumulator := make([]int, 0)
-	visited := make(map[int]struct{})
-	for i := 0; i < count; i++ {
+// Fans out to the given URLs and merges their results
+func run(ctx context.Context, urls []string, o options) summary {
+	if len(urls) == 0 {
+		return summary{numbers: []int{}}
+	}
+	if sum, denied := egressDenied(ctx, urls); denied {
+		return sum
+	}
+	atomic.AddInt64(&inflight, 1)
+	defer atomic.AddInt64(&inflight, -1)
+	// Both the events and the decoded results in flight are bounded, so the fetches are
+	// paced by the merge stage rather than by the number of URLs
+	ctx = withMergeGate(ctx, make(mergeGate, pipelineDepth))
+	ctx = withStageBoard(ctx, make(stageBoard, len(urls)))
+	ctx = withContentSet(ctx)
+	if currentDNSPinning() {
+		ctx = withDNSPins(ctx)
+	}
+	events := make(chan event, pipelineDepth)
+	fetchCtx, cancel := graceContext(ctx)
+	defer cancel()
+	// Spawn go routines for worker to consume
+	go fetchAll(fetchCtx, currentTransport(), o, urls, events)
+	// Consumer to consume from the channel
+	return consume(ctx, urls, o, events)
+}
+
+// Number of fan-outs currently running
+var inflight int64
+
+func inflightRuns() int64 {
+	return atomic.LoadInt64(&inflight)
+}
+
+// A URL to fetch and its position in the request
+type job struct {
+	index int
+	url   string
+}
+
+// Outcome of a single job. Exactly one event is sent per job that was started.
+type event struct {
+	job
+	res result
+	err error
+}
+
+// Queues the URLs on the shared worker pool. events is closed once every started job is done.
+func fetchAll(ctx context.Context, t *http.Transport, o options, urls []string, events chan<- event) {
+	// The pool bounds the number of concurrent fetches across all requests, so a large fan-out
+	// waits for free workers instead of opening ever more sockets.
+	// Once the deadline has passed there is no point in starting more fetches.
+	pool.addBacklog(len(urls))
+	queued := time.Now()
+	board := stageBoardFrom(ctx)
+	tenant := tenantFrom(ctx)
+	var wg sync.WaitGroup
+	order := dispatchOrder(urls)
+	for k := range urls {
+		i := k
+		if order != nil {
+			i = order[k]
+		}
+		wg.Add(1)
+		// A tenant with a worker share waits for one of its slots before it competes for the pool
+		release, ok := tenants.acquire(ctx, tenant)
+		done := func() {
+			release()
+			wg.Done()
+		}
+		if !ok || !pool.submit(ctx, task{job: job{index: i, url: urls[i]}, ctx: ctx, t: t, o: o, events: events, done: done, queued: queued, stage: board.slot(i)}) {
+			done()
+			pool.abandon(len(urls) - k)
+			break
+		}
+	}
+	wg.Wait()
+	close(events)
+}
+
+func fetch(ctx context.Context, t *http.Transport, o options, u string) (result, error) {
+	b, err := fetchBody(ctx, t, o, u)
+	if err != nil {
+		return result{}, err
+	}
+	return b.decode()
+}
+
+// Sends the request for u and waits for the merge stage to take another body. On success the
+// caller owns the returned body and must decode it.
+func fetchBody(ctx context.Context, t *http.Transport, o options, u string) (b *pendingBody, err error) {
+	parent := ctx
+	timeout := o.upstreamTimeout
+	if tuned := groups.timeout(u); tuned > 0 && tuned < timeout {
+		timeout = tuned
+	}
+	// The header timeout on the transport doesn't cover reading the body, so bound the whole fetch
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer func() {
+		if b == nil {
+			cancel()
+		}
+	}()
+	target, err := normalizeURL(u)
+	if err != nil {
+		return nil, newFetchError(codeValidation, u, "%v", err)
+	}
+	src := groups.source(u)
+	req, err := src.newRequest(ctx, target)
+	if err != nil {
+		return nil, newFetchError(codeValidation, u, "returned an error while creating a request- %v", err)
+	}
+	if err := upstream.checkScheme(req.URL); err != nil {
+		return nil, newFetchError(codePolicy, u, "%v", err)
+	}
+	host := req.URL.Host
+	if !upstreamStats.allow(host) {
+		return nil, newFetchError(codeShed, u, "skipped, circuit breaker for %s is open", host)
+	}
+	stage := fetchStageFrom(ctx)
+	setStage(stage, stageDial)
+	start := time.Now()
+	body := &countingReader{}
+	// Records the fetch in the host stats. Don't blame the host when the whole request was cancelled.
+	finish := func(ok, blame bool, end time.Time) {
+		egress.charge(tenantFrom(ctx), body.n)
+		if ok || (blame && parent.Err() == nil) {
+			took := end.Sub(start)
+			upstreamStats.record(host, took, body.n, ok)
+			noteSlowFetch(ctx, u, took)
+			return
+		}
+		// A probe that isn't held against the host must not keep the breaker half open
+		upstreamStats.release(host)
+	}
+	blame := true
+	defer func() {
+		if b == nil {
+			finish(false, blame, time.Now())
+		}
+	}()
+	if err := src.authorize(ctx, req); err != nil {
+		blame = false
+		return nil, newFetchError(codeUpstreamError, u, "could not obtain a token - %v", err)
+	}
+	tracerFrom(ctx).mark("dispatch", u)
+	ctx, queued := withSocketWait(ctx)
+	// connTrace goes first: WithClientTrace composes the hooks already in the context into
+	// the trace it is given, which must not be the shared one.
+	req = req.WithContext(traceConnAddr(traceTLS(traceStages(traceFetch(httptrace.WithClientTrace(ctx, connTrace), u), stage), host), u, host))
+	upstream.prepare(req)
+	src.prepare(req)
+	condKey := validators.key(req, o.lenient)
+	cached := validators.prepare(condKey, req)
+	// Let upstream owners correlate their logs with ours
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	res, err := t.RoundTrip(req)
+	if err != nil {
+		// Running out of sockets is our capacity problem, not the host's
+		if atomic.LoadInt32(queued) == 1 {
+			blame = false
+			return nil, newFetchError(codeShed, u, "shed, no upstream socket became available - %v", err)
+		}
+		return nil, newFetchError(transportCode(err), u, "returned an error while performing a request  - %v", err).at(loadStage(stage))
+	}
+	// Close body so that sockets can be reused. Once handed over, the body closes it.
+	defer func() {
+		if b == nil {
+			res.Body.Close()
+		}
+	}()
+	src.checkAuthorized(req, res)
+	notModified := res.StatusCode == http.StatusNotModified && cached != nil
+	if res.StatusCode != http.StatusOK && !notModified {
+		return nil, newFetchError(statusCode(res.StatusCode), u, "server returned an error - %v", res.Status)
+	}
+	if notModified {
+		upstreamMetrics.Add("conditional_hits", 1)
+	} else if err := src.checkContentType(res); err != nil {
+		return nil, newFetchError(codeContentType, u, "%v", err)
+	}
+	// Wait for the merge stage to catch up before decoding another body
+	gate := mergeGateFrom(ctx)
+	setStage(stage, stageMergeWait)
+	if err := gate.acquire(ctx); err != nil {
+		blame = false
+		return nil, newFetchError(codeBudgetExceeded, u, "merge stage did not catch up - %v", err).at(stageMergeWait)
+	}
+	setStage(stage, stageBody)
+	body.r = res.Body
+	ct := res.Header.Get("Content-Type")
+	dec, path := src.decoder(ct)
+	b = &pendingBody{ctx: ctx, cancel: cancel, url: u, lenient: o.lenient, xml: src.xmlPath(), codec: dec, path: path, contentType: ct, charset: src.bodyCharset(), body: body, closer: res.Body, gate: gate, stage: stage, finish: finish}
+	if notModified {
+		b.cached = cached
+	} else if v := validatorsOf(res.Header); v != nil && condKey != "" {
+		b.condKey, b.validators = condKey, v
+	}
+	return b, nil
+}
+
+// Consumer to drain the event channel. Also handles context timeouts: every URL that hasn't
+// answered by then is reported as budget_exceeded and late events are drained in the background.
+// hintTotal pre-sizes the accumulator and the dedup map to avoid repeated growth during large merges.
+func consume(ctx context.Context, urls []string, o options, events <-chan event) summary {
+	sum := summary{numbers: make([]int, 0, o.hintTotal)}
+	var visited map[int]struct{}
+	var set *shardedSet
+	if n := mergeParallelism(); n > 1 && o.dedup != dedupNone {
+		// Map inserts are the bottleneck of large merges, spread them over the cores
+		set = newShardedSet(n, o.dedup == dedupPerSource, o.hintTotal)
+	} else if o.dedup == dedupAll {
+		visited = make(map[int]struct{}, o.hintTotal)
+	}
+	if o.histogram != "" {
+		// Already validated by parseOptions
+		sum.histogram, _ = parseHistogram(o.histogram)
+	}
+	answered := make([]bool, len(urls))
+	// Index of the URL of every error in sum.errs
+	var errIndex []int
+	closed := false
+	gate := mergeGateFrom(ctx)
+	board := stageBoardFrom(ctx)
+	shadow := newMergeShadow(ctx, o)
+	if o.attribute != "" {
+		sum.attribution = newAttribution(urls, o.attribute)
+	}
+	// Set to nil once the deadline passed, answers are then only taken during the grace period
+	done := ctx.Done()
+	var grace <-chan time.Time
+	// Fires once the rest of the deadline is needed to sort and encode the values merged so far
+	cutoff := newFetchCutoff(ctx)
+	defer cutoff.stop()
+	cut := cutoff.C()
+	values := 0
+loop:
+	for remaining := len(urls); remaining > 0; {
 		select {
-		case res := <-p.res:
-			for _, val := range res.Numbers {
-				if _, ok := visited[val]; !ok {
-					accumulator = append(accumulator, val)
-					visited[val] = struct{}{}
-				}
+		case ev, ok := <-events:
+			if !ok {
+				closed = true
+				break loop
+			}
+			answered[ev.index] = true
+			remaining--
+			if done == nil {
+				upstreamMetrics.Add("late_accepted", 1)
 			}
-		case err := <-p.err:
-			log.Println(err)
-		case <-ctx.Done():
-			log.Println(ctx.Err())
-			sort.Ints(accumulator)
-			return accumulator
+			if ev.err != nil {
+				log.Println(logPrefix(ctx) + ev.err.Error())
+				sum.addError(ev.err)
+				errIndex = append(errIndex, ev.index)
+				continue
+			}
+			sum.ok++
+			ev.res.Numbers = applyFilters(o.filters, ev.res.Numbers)
+			bucketValues(o.bucket, ev.res.Numbers)
+			sum.attribution.add(ev.index, ev.res.Numbers)
+			shadow.add(ev.res.Numbers)
+			if sum.histogram == nil {
+				values += len(ev.res.Numbers)
+				cutoff.update(values)
+			}
+			if set != nil {
+				host := yieldHost(ev.url)
+				sum.noteSkipped(ev)
+				set.add(ev.res.Numbers, gate.release, func(n int) { yields.observe(host, n) })
+				continue
+			}
+			yields.observe(yieldHost(ev.url), sum.merge(ev, o.dedup, visited))
+			gate.release()
+		case <-cut:
+			if cutoff.extend() {
+				continue
+			}
+			httpMetrics.Add("render_cutoffs", 1)
+			sum.deadlineStage = requestStageFetch
+			d := currentLateGrace()
+			if d <= 0 {
+				break loop
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			done, cut, grace = nil, nil, timer.C
+		case <-done:
+			sum.deadlineStage = requestStageFetch
+			d := currentLateGrace()
+			if d <= 0 || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				break loop
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			done, cut, grace = nil, nil, timer.C
+		case <-grace:
+			break loop
+		}
+	}
+	failed := len(sum.errs)
+	for i, u := range urls {
+		if !answered[i] {
+			sum.addError(newFetchError(codeBudgetExceeded, u, "did not answer before the deadline").at(board.get(i)))
+			errIndex = append(errIndex, i)
+		}
+	}
+	if sum.deadlineStage != "" {
+		unanswered := sum.errs[failed:]
+		// Before the deadline only the render reserve stops the fetches
+		reason := "render reserve reached"
+		if err := ctx.Err(); err != nil {
+			reason = err.Error()
+		}
+		log.Printf("%s%s (%s deadline) waiting on %d sources: %s", logPrefix(ctx), reason, deadlineSourceFrom(ctx), len(unanswered), stageCounts(unanswered))
+	}
+	// Errors arrive in any order, responses list them in the order of the URLs
+	sort.Sort(errorsByURL{sum.errs, errIndex})
+	if !closed {
+		go drainLate(ctx, events)
+	}
+	if set != nil {
+		sum.numbers = set.close(sum.numbers)
+		sum.countHistogram(0)
+	}
+	tr := tracerFrom(ctx)
+	tr.mark("merge_done", "")
+	if sum.deadlineStage == "" && ctx.Err() != nil {
+		sum.deadlineStage = requestStageMerge
+	}
+	sorting := time.Now()
+	if sum.order = sortWithin(ctx, sum.numbers, o.sortPolicy); sum.order == "" {
+		renderCosts.observeSort(len(sum.numbers), time.Since(sorting))
+	} else {
+		httpMetrics.Add("sort_order "+sum.order, 1)
+	}
+	tr.mark("sort_done", "")
+	if sum.deadlineStage == "" && ctx.Err() != nil {
+		sum.deadlineStage = requestStageSort
+	}
+	if sum.deadlineStage != "" {
+		httpMetrics.Add("deadline_stage "+sum.deadlineStage, 1)
+	}
+	shadow.compare(ctx, sum.numbers)
+	return sum
+}
+
+// Merges the values of ev and returns how many it added
+func (s *summary) merge(ev event, dedup string, visited map[int]struct{}) int {
+	res := ev.res
+	s.noteSkipped(ev)
+	start := len(s.numbers)
+	switch dedup {
+	case dedupNone:
+		s.numbers = append(s.numbers, res.Numbers...)
+	case dedupPerSource:
+		// A fresh set per source keeps multiplicity across sources
+		s.numbers = appendUnique(s.numbers, res.Numbers, make(map[int]struct{}, len(res.Numbers)))
+	default:
+		s.numbers = appendUnique(s.numbers, res.Numbers, visited)
+	}
+	added := len(s.numbers) - start
+	s.countHistogram(start)
+	return added
+}
+
+func (s *summary) noteSkipped(ev event) {
+	if ev.res.skipped > 0 {
+		if s.skipped == nil {
+			s.skipped = make(map[string]int)
+		}
+		s.skipped[redact(ev.url)] = ev.res.skipped
+	}
+	if ev.res.coerced > 0 {
+		if s.coerced == nil {
+			s.coerced = make(map[string]int)
+		}
+		s.coerced[redact(ev.url)] = ev.res.coerced
+	}
+}
+
+// Counts the values from start on and drops them, there is no need to keep or sort them
+func (s *summary) countHistogram(start int) {
+	if s.histogram != nil {
+		for _, val := range s.numbers[start:] {
+			s.histogram.add(val)
+		}
+		s.numbers = s.numbers[:start]
+	}
+}
+
+// Receives the events still in flight after the response was assembled so that workers never
+// block, and accounts for them in the logs and metrics.
+func drainLate(ctx context.Context, events <-chan event) {
+	gate := mergeGateFrom(ctx)
+	for ev := range events {
+		if ev.err == nil {
+			gate.release()
+		}
+		upstreamMetrics.Add("late_events", 1)
+		log.Printf("%s%s answered after the deadline", logPrefix(ctx), redact(ev.url))
+	}
+}
+
+// Errors ordered by the index of their URL, each URL has at most one
+type errorsByURL struct {
+	errs  []error
+	index []int
+}
+
+func (e errorsByURL) Len() int           { return len(e.errs) }
+func (e errorsByURL) Less(i, j int) bool { return e.index[i] < e.index[j] }
+func (e errorsByURL) Swap(i, j int) {
+	e.errs[i], e.errs[j] = e.errs[j], e.errs[i]
+	e.index[i], e.index[j] = e.index[j], e.index[i]
+}
+
+func (s *summary) addError(err error) {
+	s.failed++
+	s.errs = append(s.errs, err)
+	upstreamMetrics.Add("errors "+string(errorCodeOf(err)), 1)
+	if stage := stageOf(err); stage != "" {
+		upstreamMetrics.Add("timeouts "+stage, 1)
+	}
+}
+
+// Appends the values not yet in visited to acc, recording them in visited
+func appendUnique(acc, values []int, visited map[int]struct{}) []int {
+	for _, val := range values {
+		if _, ok := visited[val]; !ok {
+			acc = append(acc, val)
+			visited[val] = struct{}{}
 		}
 	}
-	sort.Ints(accumulator)
-	return accumulator
+	return acc
 }
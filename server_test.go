@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -16,6 +14,7 @@ const (
 	invalidURL     = "InvalidURL"
 	randomURL      = "RandomURL"
 	forbiddenTest  = "403Test"
+	badTimeoutTest = "400Test"
 )
 
 func Test_numberHandler(t *testing.T) {
@@ -24,6 +23,8 @@ func Test_numberHandler(t *testing.T) {
 	tt := []struct {
 		name     string
 		handler  func(http.ResponseWriter, *http.Request)
+		query    string
+		status   int
 		expected result
 	}{
 		{name: "Simple", handler: simpleHandler(actual), expected: result{Numbers: expected}},
@@ -32,10 +33,17 @@ func Test_numberHandler(t *testing.T) {
 		{name: "InvalidRequest", handler: nil, expected: result{Numbers: []int{}}},
 		{name: "RandomURL", handler: nil, expected: result{Numbers: []int{}}},
 		{name: "SimpleError", handler: errHandler(), expected: result{Numbers: []int{}}},
-		{name: "SimpleTimeOut", handler: timeOutHandler(actual), expected: result{Numbers: []int{}}},
-		{name: "JustInTime", handler: justInTimeHandler(actual), expected: result{Numbers: expected}},
-		{name: "ErrorAfterTime", handler: errAfterTimeHandler(), expected: result{Numbers: []int{}}},
-		{name: forbiddenTest, handler: nil, expected: result{Numbers: []int{}}},
+		{name: "SimpleTimeOut", handler: timeOutHandler(actual), query: "&upstream_timeout_ms=450", expected: result{Numbers: []int{}}},
+		{name: "JustInTime", handler: justInTimeHandler(actual), query: "&upstream_timeout_ms=450", expected: result{Numbers: expected}},
+		{name: "ErrorAfterTime", handler: errAfterTimeHandler(), query: "&upstream_timeout_ms=450", expected: result{Numbers: []int{}}},
+		{name: "UpstreamTimeoutClamped", handler: simpleHandler(actual), query: "&upstream_timeout_ms=999999999", expected: result{Numbers: expected}},
+		{name: forbiddenTest, handler: nil, status: http.StatusForbidden, expected: result{Numbers: []int{}}},
+		{name: badTimeoutTest, handler: simpleHandler(actual), query: "&upstream_timeout_ms=soon", status: http.StatusBadRequest},
+		{name: "HintTotal", handler: simpleHandler(actual), query: "&hint_total=16", expected: result{Numbers: expected}},
+		{name: "Lenient", handler: rawHandler(`{"numbers":[3,"2",null,1.0]}`), query: "&lenient=true", expected: result{Numbers: []int{1, 2, 3}}},
+		{name: "Strict", handler: rawHandler(`{"numbers":[3,"2",null,1.0]}`), expected: result{Numbers: []int{}}},
+		{name: "BadDedup", handler: simpleHandler(actual), query: "&dedup=maybe", status: http.StatusBadRequest},
+		{name: "BadHintTotal", handler: simpleHandler(actual), query: "&hint_total=-1", status: http.StatusBadRequest},
 	}
 
 	for _, tc := range tt {
@@ -45,7 +53,7 @@ func Test_numberHandler(t *testing.T) {
 			if tc.handler != nil {
 				ts := httptest.NewServer(http.HandlerFunc(tc.handler))
 				defer ts.Close()
-				req, err = http.NewRequest(http.MethodGet, localhost+"?u="+ts.URL, nil)
+				req, err = http.NewRequest(http.MethodGet, localhost+"?u="+ts.URL+tc.query, nil)
 				if err != nil {
 					t.Fatalf("could not create request: %v", err)
 				}
@@ -66,7 +74,7 @@ func Test_numberHandler(t *testing.T) {
 						t.Fatalf("could not create request: %v", err)
 					}
 				} else if tc.name == forbiddenTest {
-					req, err = http.NewRequest(http.MethodPost, localhost+"?u=http://www.google.com", nil)
+					req, err = http.NewRequest(http.MethodPut, localhost+"?u=http://www.google.com", nil)
 					if err != nil {
 						t.Fatalf("could not create request: %v", err)
 					}
@@ -81,7 +89,7 @@ func Test_numberHandler(t *testing.T) {
 			numbersHandler(rec, req)
 			res := rec.Result()
 			defer res.Body.Close()
-			if tc.name != forbiddenTest {
+			if tc.status == 0 {
 				if res.StatusCode != http.StatusOK {
 					t.Fatalf("expected status OK; got %v", res.Status)
 				}
@@ -92,8 +100,38 @@ func Test_numberHandler(t *testing.T) {
 				if !num.equals(tc.expected) {
 					t.Errorf("expected %v but got %v", tc.expected, num)
 				}
-			} else if res.StatusCode != http.StatusForbidden {
-				t.Fatalf("expected status forbidden; got %v", res.Status)
+			} else if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v; got %v", tc.status, res.Status)
+			}
+		})
+	}
+}
+
+func TestDedupModes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{3, 1, 1, 2})))
+	defer ts.Close()
+	tt := []struct {
+		dedup    string
+		expected []int
+	}{
+		{dedup: "true", expected: []int{1, 2, 3}},
+		{dedup: "false", expected: []int{1, 1, 1, 1, 2, 2, 3, 3}},
+		{dedup: "per_source", expected: []int{1, 1, 2, 2, 3, 3}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.dedup, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, localhost+"?u="+ts.URL+"&u="+ts.URL+"/again&dedup="+tc.dedup, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			rec := httptest.NewRecorder()
+			numbersHandler(rec, req)
+			var num result
+			if err = json.NewDecoder(rec.Body).Decode(&num); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if !num.equals(result{Numbers: tc.expected}) {
+				t.Errorf("expected %v but got %v", tc.expected, num.Numbers)
 			}
 		})
 	}
@@ -105,6 +143,12 @@ func simpleHandler(numbers []int) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+func rawHandler(body string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
+
 func errHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
@@ -151,49 +195,3 @@ func (a *result) equals(b result) bool {
 	}
 	return true
 }
-
-func BenchmarkNumbersHandler(b *testing.B) {
-	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 1, 2, 3, 5, 8, 13, 21})))
-	var buf bytes.Buffer
-	for i := 0; i < 100000; i++ {
-		buf.WriteString("&u=")
-		buf.WriteString(ts.URL)
-	}
-	req, _ := http.NewRequest(http.MethodGet, localhost+"?u="+ts.URL+buf.String(), nil)
-	tsLoad := httptest.NewServer(http.HandlerFunc(loadHandler()))
-
-	reqLoad, _ := http.NewRequest(http.MethodGet, localhost+"?u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL+"&u="+tsLoad.URL, nil)
-	tt := []struct {
-		name string
-		req  *http.Request
-	}{
-		{name: "tonsOfUrls", req: req},
-		{name: "tonsOfNumbers", req: reqLoad},
-	}
-
-	for _, tc := range tt {
-		b.Run(tc.name, func(b *testing.B) {
-			for i := 0; i < b.N; i++ {
-				rec := httptest.NewRecorder()
-				numbersHandler(rec, tc.req)
-				res := rec.Result()
-				defer res.Body.Close()
-			}
-		})
-	}
-}
-
-func loadHandler() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode(map[string]interface{}{"numbers": foo()})
-	}
-}
-
-func foo() []int {
-	hold := make([]int, 1000000)
-	for i := 0; i < 1000000; i++ {
-		a := rand.Intn(100000000)
-		hold = append(hold, a)
-	}
-	return hold
-}
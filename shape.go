@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Shape value of a response that is only the array of values
+const shapeArray = "array"
+
+// How the values of a response are encoded, for consumers of older aggregators that expect
+// {"values": [...]} or a bare array. The zero value is the usual envelope.
+type responseShape struct {
+	// Name of the values key, empty is "numbers"
+	key string
+	// Only the values, without any envelope
+	bare bool
+}
+
+// Response shapes of tenants, set by -response.shapes
+var (
+	shapesMu     sync.RWMutex
+	tenantShapes = map[string]responseShape{}
+)
+
+func registerShapeFlags(fs *flag.FlagSet, shapes *string) {
+	fs.StringVar(shapes, "response.shapes", "", "comma separated tenant:shape response shapes, a shape is a key name for the values like \"values\" or \"array\" for a bare array")
+}
+
+// Parses a shape: "array" or the name of the values key
+func parseShape(v string) (responseShape, error) {
+	switch v {
+	case shapeArray:
+		return responseShape{bare: true}, nil
+	case "numbers":
+		return responseShape{}, nil
+	}
+	if v == "" || strings.Trim(v, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") != "" {
+		return responseShape{}, fmt.Errorf("invalid shape %q, expected array or a key of letters, digits, _ and -", v)
+	}
+	if reservedKey(v) {
+		return responseShape{}, fmt.Errorf("invalid shape %q, the key is an envelope field", v)
+	}
+	return responseShape{key: v}, nil
+}
+
+func reservedKey(k string) bool {
+	switch k {
+	case "histogram", "skipped", "coerced", "attribution", "bloom", "order", "next_cursor", "_trace":
+		return true
+	}
+	return isEnvelopeField(k)
+}
+
+func parseTenantShapes(v string) (map[string]responseShape, error) {
+	shapes := make(map[string]responseShape)
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid response shape %q, expected tenant:shape", pair)
+		}
+		s, err := parseShape(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		shapes[parts[0]] = s
+	}
+	return shapes, nil
+}
+
+func setTenantShapes(shapes map[string]responseShape) {
+	shapesMu.Lock()
+	defer shapesMu.Unlock()
+	tenantShapes = shapes
+}
+
+func tenantShape(tenant string) responseShape {
+	shapesMu.RLock()
+	defer shapesMu.RUnlock()
+	return tenantShapes[tenant]
+}
+
+// Picks the shape the request asked for, or else its tenant's. A bare array can't carry the
+// parts of a response that need the envelope.
+func resolveShape(ctx context.Context, o *options) error {
+	if o.shape == nil {
+		s := tenantShape(tenantFrom(ctx))
+		o.shape = &s
+	}
+	if !o.shape.bare {
+		return nil
+	}
+	if o.histogram != "" || o.pageSize > 0 || o.trace || o.attribute != "" {
+		return fmt.Errorf("shape array can't be combined with histogram, page_size, cursor, trace or attribute")
+	}
+	return nil
+}
+
+// Encodes e in its shape. The values are always the first key of the envelope, so renaming
+// them doesn't need another pass over the values.
+func (e envelope) MarshalJSON() ([]byte, error) {
+	if e.shape.bare {
+		httpMetrics.Add("response_shaped", 1)
+		if n, ok := e.Numbers.([]int); e.Numbers == nil || ok && n == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(e.Numbers)
+	}
+	type plain envelope
+	b, err := json.Marshal(plain(e))
+	if err != nil || e.shape.key == "" || e.Numbers == nil {
+		return b, err
+	}
+	httpMetrics.Add("response_shaped", 1)
+	const prefix = `{"numbers":`
+	return append([]byte(`{"`+e.shape.key+`":`), b[len(prefix):]...), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseShape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want responseShape
+		err  bool
+	}{
+		{in: "numbers", want: responseShape{}},
+		{in: "values", want: responseShape{key: "values"}},
+		{in: "array", want: responseShape{bare: true}},
+		{in: "count", err: true},
+		{in: "next_cursor", err: true},
+		{in: `a"b`, err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseShape(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%q: expected %+v, error %v; got %+v, %v", tt.in, tt.want, tt.err, got, err)
+		}
+	}
+	if _, err := parseTenantShapes("legacy:values,old"); err == nil {
+		t.Error("expected an error for a pair without a shape")
+	}
+	shapes, err := parseTenantShapes("legacy:values, old:array")
+	if err != nil || shapes["legacy"].key != "values" || !shapes["old"].bare {
+		t.Errorf("unexpected shapes %+v, %v", shapes, err)
+	}
+}
+
+func TestResponseShape(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{2, 1})))
+	defer ts.Close()
+	defer setTenantShapes(map[string]responseShape{})
+	setTenantShapes(map[string]responseShape{"legacy": {key: "values"}, "old": {bare: true}})
+	tests := []struct {
+		tenant, query string
+		code          int
+		want          string
+	}{
+		{query: "", code: 200, want: `{"numbers":[1,2]}`},
+		{tenant: "legacy", code: 200, want: `{"values":[1,2]}`},
+		{tenant: "legacy", query: "&verbose=count", code: 200, want: `{"values":[1,2],"count":2}`},
+		{tenant: "old", code: 200, want: `[1,2]`},
+		{tenant: "old", query: "&stringify=true&verbose=count", code: 200, want: `["1","2"]`},
+		// The request's shape wins over the tenant's
+		{tenant: "old", query: "&shape=numbers", code: 200, want: `{"numbers":[1,2]}`},
+		{query: "&shape=data", code: 200, want: `{"data":[1,2]}`},
+		{query: "&shape=array&histogram=auto", code: 400},
+		{tenant: "old", query: "&page_size=1", code: 400},
+		{query: "&shape=count", code: 400},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+tt.query, nil)
+		req = req.WithContext(withTenant(req.Context(), tt.tenant))
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s%s: expected %d; got %d %s", tt.tenant, tt.query, tt.code, rec.Code, rec.Body)
+			continue
+		}
+		if got := strings.TrimSpace(rec.Body.String()); tt.want != "" && got != tt.want {
+			t.Errorf("%s%s: expected %s; got %s", tt.tenant, tt.query, tt.want, got)
+		}
+	}
+}
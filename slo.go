@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Requests are counted per minute, the resolution of the burn rates
+const sloBucketWidth = time.Minute
+
+// Windows the burn rate is reported for, the short ones catch fast burns and the long ones slow
+// leaks. Windows longer than the SLO window are left out.
+var sloBurnWindows = []struct {
+	name string
+	d    time.Duration
+}{{"5m", 5 * time.Minute}, {"1h", time.Hour}, {"6h", 6 * time.Hour}}
+
+// What a good request is and the share of requests that must be good. A request is good when
+// it was answered within Latency and at least a share Completeness of its sources contributed.
+type sloObjective struct {
+	Latency      duration `json:"latency,omitempty"`
+	Completeness float64  `json:"completeness,omitempty"`
+	Target       float64  `json:"target,omitempty"`
+}
+
+// Checks an objective whose zero fields are taken from another one
+func (o sloObjective) validate() error {
+	if o.Latency < 0 || o.Completeness < 0 || o.Completeness > 1 || o.Target < 0 || o.Target >= 1 {
+		return errors.New("slo latency must not be negative, completeness must be in [0, 1] and target in (0, 1)")
+	}
+	return nil
+}
+
+// o with the fields it leaves zero taken from def
+func (o sloObjective) or(def sloObjective) sloObjective {
+	if o.Latency == 0 {
+		o.Latency = def.Latency
+	}
+	if o.Completeness == 0 {
+		o.Completeness = def.Completeness
+	}
+	if o.Target == 0 {
+		o.Target = def.Target
+	}
+	return o
+}
+
+type sloConfig struct {
+	// Objective of tenants without one of their own, tracking is off while its latency is 0
+	objective sloObjective
+	// Period the error budget is spent over
+	window time.Duration
+}
+
+func registerSLOFlags(fs *flag.FlagSet, c *sloConfig) {
+	fs.Var((*durationFlag)(&c.objective.Latency), "slo.latency", "requests answered within this are good if complete enough, 0 disables SLO tracking unless a tenant has an slo")
+	fs.Float64Var(&c.objective.Completeness, "slo.completeness", 0.9, "share of the sources that must contribute for a request to be good")
+	fs.Float64Var(&c.objective.Target, "slo.target", 0.99, "share of the requests that must be good, the rest is the error budget")
+	fs.DurationVar(&c.window, "slo.window", 24*time.Hour, "period the error budget is spent over, at most 30 days")
+}
+
+// Flag value of a JSON duration
+type durationFlag duration
+
+func (d *durationFlag) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationFlag) Set(v string) error {
+	p, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = durationFlag(p)
+	return nil
+}
+
+// Requests and good requests of a minute
+type sloBucket struct {
+	minute      int64
+	total, good int64
+}
+
+// Per-tenant counts of good and bad requests over the SLO window
+type sloTracker struct {
+	mu   sync.Mutex
+	conf sloConfig
+	// Rings of per-minute buckets, indexed by the minute modulo their length
+	tenants map[string][]sloBucket
+	now     func() time.Time
+}
+
+var slos = &sloTracker{conf: sloConfig{objective: sloObjective{Completeness: 0.9, Target: 0.99}, window: 24 * time.Hour}, tenants: map[string][]sloBucket{}, now: time.Now}
+
+func init() {
+	sloMetrics := expvar.NewMap("slo")
+	for _, w := range sloBurnWindows {
+		w := w
+		sloMetrics.Set("burn_rate_"+w.name, expvar.Func(func() interface{} { return slos.gauge(func(r sloReport) float64 { return r.BurnRates[w.name] }) }))
+	}
+	sloMetrics.Set("budget_remaining", expvar.Func(func() interface{} { return slos.gauge(func(r sloReport) float64 { return r.BudgetRemaining }) }))
+	sloMetrics.Set("compliance", expvar.Func(func() interface{} { return slos.gauge(func(r sloReport) float64 { return r.Compliance }) }))
+}
+
+// Replaces the configuration, dropping the counts when the window changes
+func (t *sloTracker) configure(c sloConfig) error {
+	if err := c.objective.validate(); err != nil {
+		return err
+	}
+	if c.objective.Latency > 0 && (c.objective.Completeness == 0 || c.objective.Target == 0) {
+		return errors.New("-slo.completeness and -slo.target must be set with -slo.latency")
+	}
+	if c.window < sloBucketWidth || c.window > 30*24*time.Hour {
+		return fmt.Errorf("-slo.window must be between %v and 30 days", sloBucketWidth)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.window != t.conf.window {
+		t.tenants = map[string][]sloBucket{}
+	}
+	t.conf = c
+	return nil
+}
+
+// Objective of tenant, ok is false when its requests aren't tracked
+func (t *sloTracker) objective(tenant string) (sloObjective, bool) {
+	t.mu.Lock()
+	def := t.conf.objective
+	t.mu.Unlock()
+	o := def
+	if p := tenants.policy(tenant); p.SLO != nil {
+		o = p.SLO.or(def)
+	}
+	return o, o.Latency > 0
+}
+
+// Counts a request of tenant that took took and got answers from ok of its sources
+func (t *sloTracker) record(tenant string, took time.Duration, ok, sources int) {
+	o, tracked := t.objective(tenant)
+	if !tracked {
+		return
+	}
+	good := took <= time.Duration(o.Latency) && completeness(ok, sources) >= o.Completeness
+	if !good {
+		httpMetrics.Add("slo_bad "+tenantLabel(tenant), 1)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ring, found := t.tenants[tenant]
+	if !found {
+		ring = make([]sloBucket, t.conf.window/sloBucketWidth)
+		t.tenants[tenant] = ring
+	}
+	minute := t.now().Unix() / int64(sloBucketWidth/time.Second)
+	b := &ring[minute%int64(len(ring))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// Requests and good requests of the last n minutes of ring up to minute
+func sloSum(ring []sloBucket, minute int64, n int64) (total, good int64) {
+	for _, b := range ring {
+		if b.minute > minute-n && b.minute <= minute {
+			total += b.total
+			good += b.good
+		}
+	}
+	return total, good
+}
+
+// Error budget of a tenant over the SLO window
+type sloReport struct {
+	// The tenant, "default" for requests without authentication
+	Tenant    string       `json:"tenant"`
+	Objective sloObjective `json:"objective"`
+	Window    duration     `json:"window"`
+	Requests  int64        `json:"requests"`
+	Good      int64        `json:"good"`
+	// Share of good requests, 1 without requests
+	Compliance float64 `json:"compliance"`
+	// Share of the error budget left, negative once the objective is breached
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// How many times faster than sustainable the budget was spent in each burn window: 1 uses up
+	// the budget exactly at the end of the SLO window
+	BurnRates map[string]float64 `json:"burn_rates"`
+	Breached  bool               `json:"breached"`
+}
+
+// Reports of every tenant with tracked requests, ordered by tenant
+func (t *sloTracker) reports() []sloReport {
+	t.mu.Lock()
+	conf := t.conf
+	minute := t.now().Unix() / int64(sloBucketWidth/time.Second)
+	type counts struct {
+		tenant string
+		ring   []sloBucket
+	}
+	var all []counts
+	for tenant, ring := range t.tenants {
+		all = append(all, counts{tenant, append([]sloBucket(nil), ring...)})
+	}
+	t.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].tenant < all[j].tenant })
+	out := make([]sloReport, 0, len(all))
+	for _, c := range all {
+		o, _ := t.objective(c.tenant)
+		r := sloReport{Tenant: tenantLabel(c.tenant), Objective: o, Window: duration(conf.window), Compliance: 1, BudgetRemaining: 1, BurnRates: map[string]float64{}}
+		r.Requests, r.Good = sloSum(c.ring, minute, int64(len(c.ring)))
+		budget := 1 - o.Target
+		if r.Requests > 0 {
+			r.Compliance = float64(r.Good) / float64(r.Requests)
+			r.BudgetRemaining = 1 - (1-r.Compliance)/budget
+		}
+		for _, w := range sloBurnWindows {
+			if w.d > conf.window {
+				continue
+			}
+			total, good := sloSum(c.ring, minute, int64(w.d/sloBucketWidth))
+			r.BurnRates[w.name] = 0
+			if total > 0 {
+				r.BurnRates[w.name] = float64(total-good) / float64(total) / budget
+			}
+		}
+		r.Breached = r.BudgetRemaining < 0
+		out = append(out, r)
+	}
+	return out
+}
+
+// A value of every tenant's report, keyed by tenantLabel
+func (t *sloTracker) gauge(value func(sloReport) float64) map[string]float64 {
+	out := make(map[string]float64)
+	for _, r := range t.reports() {
+		out[r.Tenant] = value(r)
+	}
+	return out
+}
+
+// Name of a tenant in metrics, requests without authentication are "default"
+func tenantLabel(tenant string) string {
+	if tenant == "" {
+		return "default"
+	}
+	return tenant
+}
+
+// Lists the error budget reports, of the tenant named by the tenant query parameter if given
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	all := slos.reports()
+	if name := r.URL.Query().Get("tenant"); name != "" {
+		var one []sloReport
+		for _, rep := range all {
+			if rep.Tenant == name {
+				one = append(one, rep)
+			}
+		}
+		if len(one) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - no requests of tenant " + name + " were tracked"))
+			return
+		}
+		all = one
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tenants": all})
+}
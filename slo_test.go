@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSLOConfigure(t *testing.T) {
+	tests := []struct {
+		name string
+		conf sloConfig
+		err  bool
+	}{
+		{name: "off", conf: sloConfig{objective: sloObjective{Completeness: 0.9, Target: 0.99}, window: time.Hour}},
+		{name: "on", conf: sloConfig{objective: sloObjective{Latency: duration(500 * time.Millisecond), Completeness: 0.9, Target: 0.99}, window: 24 * time.Hour}},
+		{name: "target of 1", conf: sloConfig{objective: sloObjective{Latency: duration(time.Second), Completeness: 0.9, Target: 1}, window: time.Hour}, err: true},
+		{name: "no target", conf: sloConfig{objective: sloObjective{Latency: duration(time.Second), Completeness: 0.9}, window: time.Hour}, err: true},
+		{name: "completeness", conf: sloConfig{objective: sloObjective{Completeness: 1.5, Target: 0.99}, window: time.Hour}, err: true},
+		{name: "short window", conf: sloConfig{objective: sloObjective{Completeness: 0.9, Target: 0.99}, window: time.Second}, err: true},
+		{name: "long window", conf: sloConfig{objective: sloObjective{Completeness: 0.9, Target: 0.99}, window: 31 * 24 * time.Hour}, err: true},
+	}
+	for _, tt := range tests {
+		tr := &sloTracker{tenants: map[string][]sloBucket{}, now: time.Now}
+		if err := tr.configure(tt.conf); (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v; got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestSLOReports(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tr := &sloTracker{tenants: map[string][]sloBucket{}, now: func() time.Time { return now }}
+	if err := tr.configure(sloConfig{objective: sloObjective{Latency: duration(500 * time.Millisecond), Completeness: 0.9, Target: 0.9}, window: 2 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"strict": {SLO: &sloObjective{Latency: duration(100 * time.Millisecond)}}, "free": {}})
+	// 90 minutes ago the default tenant had 10 good requests, in the last 5 minutes 8 good and
+	// 2 bad ones, one slow and one incomplete
+	now = now.Add(-90 * time.Minute)
+	for i := 0; i < 10; i++ {
+		tr.record("", 10*time.Millisecond, 10, 10)
+	}
+	now = now.Add(88 * time.Minute)
+	for i := 0; i < 8; i++ {
+		tr.record("", 10*time.Millisecond, 9, 10)
+	}
+	tr.record("", time.Second, 10, 10)
+	tr.record("", 10*time.Millisecond, 8, 10)
+	// 200ms is fine by the default objective but not by the tenant's own
+	tr.record("strict", 200*time.Millisecond, 1, 1)
+	now = now.Add(2 * time.Minute)
+	reports := tr.reports()
+	if len(reports) != 2 || reports[0].Tenant != "default" || reports[1].Tenant != "strict" {
+		t.Fatalf("expected the reports of two tenants; got %+v", reports)
+	}
+	r := reports[0]
+	if r.Requests != 20 || r.Good != 18 || r.Compliance != 0.9 || math.Abs(r.BudgetRemaining) > 1e-9 || r.Breached {
+		t.Errorf("expected the budget of the default tenant to be used up exactly; got %+v", r)
+	}
+	if math.Abs(r.BurnRates["5m"]-2) > 1e-9 || math.Abs(r.BurnRates["1h"]-2) > 1e-9 {
+		t.Errorf("expected the recent requests to burn twice the sustainable rate; got %v", r.BurnRates)
+	}
+	if _, ok := r.BurnRates["6h"]; ok {
+		t.Errorf("expected no burn rate for a window beyond the SLO window; got %v", r.BurnRates)
+	}
+	if s := reports[1]; s.Good != 0 || !s.Breached || s.Objective.Latency != duration(100*time.Millisecond) || s.Objective.Target != 0.9 {
+		t.Errorf("expected the strict tenant to breach its own objective; got %+v", s)
+	}
+	// Once the window moved past them the requests no longer count
+	now = now.Add(3 * time.Hour)
+	if r := tr.reports()[0]; r.Requests != 0 || r.Compliance != 1 || r.BudgetRemaining != 1 {
+		t.Errorf("expected an empty window; got %+v", r)
+	}
+}
+
+func TestSLOHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"numbers": [1]}`))
+	}))
+	defer ts.Close()
+	defer func(c sloConfig, all map[string][]sloBucket) { slos.conf, slos.tenants = c, all }(slos.conf, slos.tenants)
+	slos.tenants = map[string][]sloBucket{}
+	if err := slos.configure(sloConfig{objective: sloObjective{Latency: duration(time.Minute), Completeness: 1, Target: 0.99}, window: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL, nil)
+	numbersHandler(httptest.NewRecorder(), req.WithContext(withTenant(req.Context(), "acme")))
+	rec := httptest.NewRecorder()
+	sloHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/slo?tenant=acme", nil))
+	var res struct {
+		Tenants []sloReport `json:"tenants"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tenants) != 1 || res.Tenants[0].Requests != 1 || res.Tenants[0].Good != 1 {
+		t.Errorf("expected one good request of acme; got %+v", res.Tenants)
+	}
+	rec = httptest.NewRecorder()
+	sloHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/slo?tenant=nobody", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 for a tenant without requests; got %d", rec.Code)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Bumped whenever the snapshot layout changes incompatibly
+const snapshotVersion = 1
+
+// Everything needed to bring another instance to the same state: cached results, upstream
+// groups and the settings that can be changed at runtime.
+type stateSnapshot struct {
+	Version   int                   `json:"version"`
+	CreatedAt time.Time             `json:"created_at"`
+	Config    runtimeConfig         `json:"config"`
+	Groups    map[string]group      `json:"groups"`
+	History   map[string][]snapshot `json:"history"`
+}
+
+type runtimeConfig struct {
+	ResponseFields string                 `json:"response_fields"`
+	Transport      transportSettings      `json:"transport"`
+	Features       map[string]featureRule `json:"features,omitempty"`
+}
+
+// JSON form of transportConfig
+type transportSettings struct {
+	DialTimeout           duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   duration `json:"tls_handshake_timeout"`
+	ExpectContinueTimeout duration `json:"expect_continue_timeout"`
+	IdleConnTimeout       duration `json:"idle_conn_timeout"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"`
+	// Missing in older snapshots, which keep the current values
+	MinTLSVersion   string    `json:"min_tls_version,omitempty"`
+	TLSSessionCache *int      `json:"tls_session_cache,omitempty"`
+	IPFamily        string    `json:"ip_family,omitempty"`
+	FallbackDelay   *duration `json:"fallback_delay,omitempty"`
+}
+
+func takeSnapshot() stateSnapshot {
+	c := currentTransportConfig()
+	return stateSnapshot{
+		Version:   snapshotVersion,
+		CreatedAt: time.Now(),
+		Config: runtimeConfig{
+			ResponseFields: currentDefaultFields(),
+			Features:       currentFeatures(),
+			Transport: transportSettings{
+				DialTimeout:           duration(c.dialTimeout),
+				TLSHandshakeTimeout:   duration(c.tlsHandshakeTimeout),
+				ExpectContinueTimeout: duration(c.expectContinueTimeout),
+				IdleConnTimeout:       duration(c.idleConnTimeout),
+				MaxIdleConnsPerHost:   c.maxIdleConnsPerHost,
+				MinTLSVersion:         tlsVersionString(c.minTLSVersion),
+				TLSSessionCache:       &c.tlsSessionCache,
+				IPFamily:              c.ipFamily,
+				FallbackDelay:         (*duration)(&c.fallbackDelay),
+			},
+		},
+		Groups:  groups.all(),
+		History: history.dump(),
+	}
+}
+
+// Validates a snapshot completely before applying any part of it
+func restoreSnapshot(s stateSnapshot) error {
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	if err := validateGroups(s.Groups); err != nil {
+		return err
+	}
+	t := s.Config.Transport
+	if t.MaxIdleConnsPerHost <= 0 {
+		return fmt.Errorf("invalid max_idle_conns_per_host %d", t.MaxIdleConnsPerHost)
+	}
+	current := currentTransportConfig()
+	minTLS, sessions := current.minTLSVersion, current.tlsSessionCache
+	if t.MinTLSVersion != "" {
+		if err := (tlsVersionFlag{&minTLS}).Set(t.MinTLSVersion); err != nil {
+			return err
+		}
+	}
+	family, fallback := current.ipFamily, current.fallbackDelay
+	if t.IPFamily != "" {
+		if err := (ipFamilyFlag{&family}).Set(t.IPFamily); err != nil {
+			return err
+		}
+	}
+	if t.FallbackDelay != nil {
+		fallback = time.Duration(*t.FallbackDelay)
+	}
+	if t.TLSSessionCache != nil {
+		if sessions = *t.TLSSessionCache; sessions < 0 {
+			return fmt.Errorf("invalid tls_session_cache %d", sessions)
+		}
+	}
+	if err := validateFeatures(s.Config.Features); err != nil {
+		return err
+	}
+	// Last check, everything below can't fail
+	if err := setDefaultFields(s.Config.ResponseFields); err != nil {
+		return err
+	}
+	setTransportConfig(transportConfig{
+		dialTimeout:           time.Duration(t.DialTimeout),
+		tlsHandshakeTimeout:   time.Duration(t.TLSHandshakeTimeout),
+		expectContinueTimeout: time.Duration(t.ExpectContinueTimeout),
+		idleConnTimeout:       time.Duration(t.IdleConnTimeout),
+		maxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		minTLSVersion:         minTLS,
+		tlsSessionCache:       sessions,
+		ipFamily:              family,
+		fallbackDelay:         fallback,
+	})
+	if s.Groups == nil {
+		s.Groups = make(map[string]group)
+	}
+	groups.set(s.Groups)
+	setFeatures(s.Config.Features)
+	history.load(s.History)
+	return nil
+}
+
+// Encodes s, encrypted when a snapshot key is configured
+func encodeSnapshot(s stateSnapshot) ([]byte, error) {
+	b, err := json.Marshal(s)
+	if err != nil || snapshotSealer == nil {
+		return b, err
+	}
+	return snapshotSealer.seal(b)
+}
+
+// Decodes a plaintext or an encrypted snapshot
+func decodeSnapshot(r io.Reader) (stateSnapshot, error) {
+	var s stateSnapshot
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return s, err
+	}
+	if isSealed(b) {
+		if snapshotSealer == nil {
+			return s, errors.New("snapshot is encrypted, configure -snapshot.key-env or -snapshot.key-file")
+		}
+		if b, err = snapshotSealer.open(b); err != nil {
+			return s, err
+		}
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("snapshot decoding error - %v", err)
+	}
+	return s, nil
+}
+
+// Restores the snapshot written to path by GET /admin/snapshot
+func restoreSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := decodeSnapshot(f)
+	if err != nil {
+		return err
+	}
+	return restoreSnapshot(s)
+}
+
+// GET downloads the current state, POST replaces it with the uploaded snapshot
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		b, err := encodeSnapshot(takeSnapshot())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 - " + err.Error()))
+			return
+		}
+		if snapshotSealer != nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="snapshot.json.enc"`)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="snapshot.json"`)
+		}
+		w.Write(b)
+	case http.MethodPost:
+		s, err := decodeSnapshot(r.Body)
+		if err == nil {
+			err = restoreSnapshot(s)
+		}
+		if bodyTooLarge(err) {
+			writeProblem(w, http.StatusRequestEntityTooLarge, limits.maxBodyBytes, "snapshot exceeds the body limit")
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - " + err.Error()))
+			return
+		}
+		log.Printf("restored snapshot created at %v", s.CreatedAt)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Method not supported!"))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	defer groups.set(groups.all())
+	defer history.load(history.dump())
+	defer setTransportConfig(currentTransportConfig())
+	defer setDefaultFields(currentDefaultFields())
+	defer setFeatures(currentFeatures())
+
+	groups.set(map[string]group{"g": {URLs: []string{"http://a"}, Refresh: duration(time.Minute)}})
+	history.load(nil)
+	history.record("g", []int{1, 2, 3})
+	setDefaultFields("count")
+	setFeatures(map[string]featureRule{"streaming": {Percent: 10}})
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", rec.Code)
+	}
+	exported := rec.Body.Bytes()
+
+	// Simulate a fresh instance
+	groups.set(map[string]group{})
+	history.load(nil)
+	setDefaultFields("")
+	setFeatures(nil)
+
+	rec = httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/snapshot", bytes.NewReader(exported)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status no content; got %v: %s", rec.Code, rec.Body.String())
+	}
+	if gr, ok := groups.get("g"); !ok || time.Duration(gr.Refresh) != time.Minute {
+		t.Errorf("group was not restored: %+v", gr)
+	}
+	if s, ok := history.latest("g"); !ok || len(s.Numbers) != 3 {
+		t.Errorf("history was not restored: %+v", s)
+	}
+	if currentDefaultFields() != "count" {
+		t.Errorf("response fields were not restored: %q", currentDefaultFields())
+	}
+	if currentFeatures()["streaming"].Percent != 10 {
+		t.Errorf("feature flags were not restored: %v", currentFeatures())
+	}
+}
+
+func TestSnapshotRejectsInvalid(t *testing.T) {
+	defer groups.set(groups.all())
+	s := takeSnapshot()
+	s.Groups = map[string]group{"bad": {}}
+	b, _ := json.Marshal(s)
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/snapshot", bytes.NewReader(b)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status bad request; got %v", rec.Code)
+	}
+	if _, ok := groups.get("bad"); ok {
+		t.Error("invalid snapshot was partially applied")
+	}
+}
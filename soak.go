@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karthikraobr/ta-go/mock"
+)
+
+const (
+	// Requests the soak test keeps in flight
+	soakConcurrency = 8
+	// Samples taken over a soak run, and the share of them ignored while pools fill up
+	soakSamples = 60
+	soakWarmup  = 0.2
+)
+
+// Goroutine and heap counts at one point of a soak run
+type soakSample struct {
+	at         time.Duration
+	goroutines int
+	heap       uint64
+	requests   int64
+}
+
+// Exercises the aggregation path served by h against embedded mock upstreams for d, and
+// reports an error when goroutines or the live heap keep growing. The server logs are
+// silenced while it runs, progress is reported on w.
+func soakTest(d time.Duration, h http.Handler, w io.Writer) error {
+	out := log.New(w, "soak: ", log.LstdFlags)
+	interval := d / soakSamples
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	samples, err := runSoak(d, interval, h, func(s soakSample) {
+		out.Printf("%v: %d requests, %d goroutines, %s live heap", s.at.Round(time.Second), s.requests, s.goroutines, mib(s.heap))
+	})
+	if err != nil {
+		return err
+	}
+	if leaks := soakLeaks(samples); len(leaks) > 0 {
+		out.Print("goroutines still running:")
+		pprof.Lookup("goroutine").WriteTo(w, 1)
+		return fmt.Errorf("soak: possible leak, %v", leaks)
+	}
+	out.Printf("passed after %d requests", samples[len(samples)-1].requests)
+	return nil
+}
+
+func runSoak(d, interval time.Duration, h http.Handler, progress func(soakSample)) ([]soakSample, error) {
+	// Failing and slow sources live on their own host, so that its open circuit breaker
+	// doesn't shed the healthy ones
+	var hosts [2]string
+	for i := range hosts {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		go http.Serve(l, mock.Handler())
+		hosts[i] = "http://" + l.Addr().String()
+	}
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	go http.Serve(server, h)
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	base := "http://" + server.Addr().String() + endpoint
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: soakConcurrency}}
+	var requests int64
+	var wg sync.WaitGroup
+	wg.Add(soakConcurrency)
+	for i := 0; i < soakConcurrency; i++ {
+		go func(rnd *rand.Rand) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				res, err := client.Get(base + "?" + soakQuery(hosts[0], hosts[1], rnd).Encode())
+				if err == nil {
+					io.Copy(ioutil.Discard, res.Body)
+					res.Body.Close()
+				}
+				atomic.AddInt64(&requests, 1)
+			}
+		}(rand.New(rand.NewSource(int64(i))))
+	}
+
+	start := time.Now()
+	var samples []soakSample
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			done = true
+		}
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		s := soakSample{at: time.Since(start), goroutines: runtime.NumGoroutine(), heap: m.HeapAlloc, requests: atomic.LoadInt64(&requests)}
+		samples = append(samples, s)
+		progress(s)
+	}
+	wg.Wait()
+	return samples, nil
+}
+
+// A random request touching the interesting paths: failing and slow sources, timeouts,
+// every dedup mode, histograms and the verbose envelope
+func soakQuery(healthy, flaky string, rnd *rand.Rand) url.Values {
+	q := url.Values{}
+	for i := rnd.Intn(20) + 1; i > 0; i-- {
+		s := mock.Source{Numbers: rnd.Intn(2000), Seed: rnd.Int63() + 1}
+		host := healthy
+		switch rnd.Intn(10) {
+		case 0:
+			s.ErrorRate, host = 1, flaky
+		case 1:
+			// Outlives the upstream timeout below, so it answers late
+			s.Delay, host = 80*time.Millisecond, flaky
+		}
+		q.Add("u", s.URL(host))
+	}
+	q.Set("upstream_timeout_ms", "50")
+	q.Set("dedup", []string{dedupAll, dedupNone, dedupPerSource}[rnd.Intn(3)])
+	if rnd.Intn(4) == 0 {
+		q.Set("histogram", "auto")
+	}
+	if rnd.Intn(2) == 0 {
+		q.Set("verbose", "all")
+	}
+	q.Set("hint_total", strconv.Itoa(rnd.Intn(1000)))
+	return q
+}
+
+// Reports goroutine and heap counts that rose for good: after the warmup, every sample of
+// the last third stays above every sample of the first third by more than the slack.
+func soakLeaks(samples []soakSample) []string {
+	samples = samples[int(float64(len(samples))*soakWarmup):]
+	if len(samples) < 6 {
+		return nil
+	}
+	third := len(samples) / 3
+	first, last := samples[:third], samples[len(samples)-third:]
+	var leaks []string
+	maxG, minG := 0, int(^uint(0)>>1)
+	var maxH, minH uint64 = 0, ^uint64(0)
+	for _, s := range first {
+		if s.goroutines > maxG {
+			maxG = s.goroutines
+		}
+		if s.heap > maxH {
+			maxH = s.heap
+		}
+	}
+	for _, s := range last {
+		if s.goroutines < minG {
+			minG = s.goroutines
+		}
+		if s.heap < minH {
+			minH = s.heap
+		}
+	}
+	if minG > maxG+maxG/10+10 {
+		leaks = append(leaks, fmt.Sprintf("goroutines grew from at most %d to at least %d", maxG, minG))
+	}
+	if minH > maxH+maxH/4+1<<20 {
+		leaks = append(leaks, fmt.Sprintf("live heap grew from at most %s to at least %s", mib(maxH), mib(minH)))
+	}
+	return leaks
+}
+
+func mib(n uint64) string {
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
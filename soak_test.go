@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSoakLeaks(t *testing.T) {
+	series := func(g func(i int) int, h func(i int) uint64) []soakSample {
+		var s []soakSample
+		for i := 0; i < 30; i++ {
+			s = append(s, soakSample{goroutines: g(i), heap: h(i)})
+		}
+		return s
+	}
+	flatG := func(i int) int { return 500 + i%7 }
+	flatH := func(i int) uint64 { return 8<<20 + uint64(i%5)<<20 }
+	tt := []struct {
+		name    string
+		samples []soakSample
+		leaks   int
+	}{
+		{name: "Flat", samples: series(flatG, flatH)},
+		{name: "Warmup", samples: series(func(i int) int {
+			if i < 3 {
+				return 10 * i
+			}
+			return 500
+		}, flatH)},
+		{name: "Goroutines", samples: series(func(i int) int { return 500 + 20*i }, flatH), leaks: 1},
+		{name: "Heap", samples: series(flatG, func(i int) uint64 { return 8<<20 + uint64(i)<<20 }), leaks: 1},
+		{name: "TooShort", samples: series(func(i int) int { return 500 + 20*i }, flatH)[:5]},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if leaks := soakLeaks(tc.samples); len(leaks) != tc.leaks {
+				t.Errorf("expected %d leaks; got %v", tc.leaks, leaks)
+			}
+		})
+	}
+}
+
+func TestRunSoak(t *testing.T) {
+	n := 0
+	samples, err := runSoak(300*time.Millisecond, 50*time.Millisecond, routes(), func(soakSample) { n++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) < 3 || n != len(samples) {
+		t.Fatalf("expected a sample per interval; got %d (%d reported)", len(samples), n)
+	}
+	if samples[len(samples)-1].requests == 0 {
+		t.Error("expected the soak to send requests")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Descriptors kept free for accepted client connections, log files and the like
+const defaultFDReserve = 128
+
+var errSocketBudget = errors.New("upstream socket budget exhausted")
+
+// Caps the number of open upstream sockets so the process stays below its descriptor limit.
+// Dials beyond the cap wait for a socket to be closed and are shed once their context is done,
+// instead of failing with "too many open files" halfway through a fan-out. A zero limit
+// disables the cap.
+type socketBudget struct {
+	mu        sync.Mutex
+	limit     int
+	open      int
+	exhausted bool
+	// Called when the budget runs out, to hand back idle sockets
+	onExhausted func()
+	// Closed and replaced whenever a socket is released
+	freed chan struct{}
+}
+
+var sockets = newSocketBudget(0)
+
+func newSocketBudget(limit int) *socketBudget {
+	return &socketBudget{limit: limit, freed: make(chan struct{})}
+}
+
+func registerFDFlags(fs *flag.FlagSet, reserve *int) {
+	fs.IntVar(reserve, "fd.reserve", defaultFDReserve, "file descriptors kept free for client connections, the rest of the process limit is the upstream socket budget")
+}
+
+func init() {
+	upstreamMetrics.Set("sockets_open", expvar.Func(func() interface{} { return sockets.inUse() }))
+	// Idle keep-alive connections are the cheapest sockets to give back
+	sockets.onExhausted = func() { currentTransport().CloseIdleConnections() }
+}
+
+// Caps upstream sockets at the descriptors left after reserve. It is called once at startup,
+// workers is only used to warn about a pool that can't be fully served.
+func limitSockets(reserve, workers int) error {
+	free, ok := fdHeadroom()
+	if !ok {
+		log.Printf("capacity: file descriptor limit unknown, upstream sockets are not capped")
+		return nil
+	}
+	n := free - reserve
+	if n < 1 {
+		return fmt.Errorf("capacity: %d file descriptors available but %d reserved, raise the limit (ulimit -n) or lower -fd.reserve", free, reserve)
+	}
+	sockets.setLimit(n)
+	log.Printf("capacity: %d file descriptors available, %d reserved, upstream sockets capped at %d", free, reserve, n)
+	if workers > n {
+		log.Printf("capacity: -pool.max=%d exceeds the socket budget of %d, fetches beyond it queue for a socket", workers, n)
+	}
+	return nil
+}
+
+func (b *socketBudget) setLimit(n int) {
+	b.mu.Lock()
+	b.limit = n
+	b.mu.Unlock()
+}
+
+func (b *socketBudget) inUse() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+type socketWaitKeyType struct{}
+
+// Marks fetches whose dial queued on the budget. The transport reports a fetch that timed out
+// while waiting as a plain deadline error, the flag lets the fetch tell it apart and shed it.
+func withSocketWait(ctx context.Context) (context.Context, *int32) {
+	queued := new(int32)
+	return context.WithValue(ctx, socketWaitKeyType{}, queued), queued
+}
+
+// Takes a socket from the budget, waiting for one to be released while it is exhausted
+func (b *socketBudget) acquire(ctx context.Context) error {
+	queued, _ := ctx.Value(socketWaitKeyType{}).(*int32)
+	for {
+		b.mu.Lock()
+		if b.limit == 0 || b.open < b.limit {
+			b.open++
+			b.mu.Unlock()
+			if queued != nil {
+				atomic.StoreInt32(queued, 0)
+			}
+			return nil
+		}
+		freed, limit := b.freed, b.limit
+		first := !b.exhausted
+		b.exhausted = true
+		b.mu.Unlock()
+		if queued != nil {
+			atomic.StoreInt32(queued, 1)
+		}
+		if first {
+			log.Printf("capacity: all %d upstream sockets in use, queueing new connections", limit)
+			upstreamMetrics.Add("sockets_exhausted", 1)
+			if b.onExhausted != nil {
+				b.onExhausted()
+			}
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: all %d sockets in use", errSocketBudget, limit)
+		}
+	}
+}
+
+func (b *socketBudget) release() {
+	b.mu.Lock()
+	b.open--
+	if b.open < b.limit {
+		b.exhausted = false
+	}
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Wraps dial so that every connection holds a socket of the budget until it is closed
+func (b *socketBudget) dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := b.acquire(ctx); err != nil {
+			return nil, err
+		}
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			b.release()
+			return nil, err
+		}
+		return &budgetConn{Conn: c, b: b}, nil
+	}
+}
+
+type budgetConn struct {
+	net.Conn
+	b    *socketBudget
+	once sync.Once
+}
+
+func (c *budgetConn) Close() error {
+	c.once.Do(c.b.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSocketBudget(t *testing.T) {
+	b := newSocketBudget(1)
+	if err := b.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.acquire(ctx); !errors.Is(err, errSocketBudget) {
+		t.Fatalf("expected the budget to be exhausted; got %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- b.acquire(context.Background()) }()
+	b.release()
+	if err := <-done; err != nil {
+		t.Fatalf("expected a queued dial to get the released socket; got %v", err)
+	}
+	if b.inUse() != 1 {
+		t.Errorf("expected a single socket in use; got %d", b.inUse())
+	}
+}
+
+func TestSocketBudgetShedsFetches(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		simpleHandler([]int{1})(w, r)
+	}))
+	defer ts.Close()
+	defer close(release)
+	b := newSocketBudget(1)
+	tr := &http.Transport{DialContext: b.dialer((&net.Dialer{}).DialContext)}
+	defer tr.CloseIdleConnections()
+	slow, _ := parseOptions(nil)
+	o, _ := parseOptions(url.Values{"upstream_timeout_ms": {"50"}})
+	// The first fetch holds the only socket until the handler is released
+	go fetch(context.Background(), tr, slow, ts.URL+"/slow")
+	for b.inUse() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err := fetch(context.Background(), tr, o, ts.URL)
+	if code := errorCodeOf(err); code != codeShed {
+		t.Fatalf("expected %s; got %s (%v)", codeShed, code, err)
+	}
+	u, _ := url.Parse(ts.URL)
+	for _, s := range upstreamStats.snapshot() {
+		if s.Host == u.Host && s.Requests > 0 && s.SuccessRate == 0 {
+			t.Errorf("expected a shed fetch not to count against the host; got %+v", s)
+		}
+	}
+}
+
+func TestLimitSockets(t *testing.T) {
+	if _, ok := fdHeadroom(); !ok {
+		t.Skip("file descriptor limit unknown on this platform")
+	}
+	defer sockets.setLimit(0)
+	if err := limitSockets(1<<40, 1); err == nil {
+		t.Error("expected an error when the reserve exceeds the limit")
+	}
+	if err := limitSockets(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if sockets.limit <= 0 {
+		t.Errorf("expected a socket cap; got %d", sockets.limit)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What a request does when sorting its result would take longer than the time it has left
+const (
+	// Sort anyway, the response is late but sorted
+	sortWait = "wait"
+	// Sort in chunks and stop at the deadline, the response holds sorted runs
+	sortPartial = "partial"
+	// Skip the sort when it's not expected to finish in time, the response is in merge order
+	sortUnsorted = "unsorted"
+)
+
+// Values of the order envelope field, which is only set when the numbers aren't fully sorted
+const (
+	orderPartial  = "partial"
+	orderUnsorted = "unsorted"
+)
+
+// Values sorted between two deadline checks, and the length of the runs a partial sort leaves
+const sortChunk = 1 << 16
+
+var (
+	sortPolicyMu      sync.RWMutex
+	defaultSortPolicy = sortWait
+)
+
+func registerSortFlags(fs *flag.FlagSet, policy *string) {
+	fs.StringVar(policy, "sort.policy", sortWait, "what to do when sorting a result would exceed the deadline: wait, partial (return sorted runs) or unsorted (skip the sort)")
+}
+
+func validSortPolicy(p string) bool {
+	return p == sortWait || p == sortPartial || p == sortUnsorted
+}
+
+func setSortPolicy(p string) error {
+	if !validSortPolicy(p) {
+		return fmt.Errorf("invalid sort policy %q", p)
+	}
+	sortPolicyMu.Lock()
+	defer sortPolicyMu.Unlock()
+	defaultSortPolicy = p
+	return nil
+}
+
+func currentSortPolicy() string {
+	sortPolicyMu.RLock()
+	defer sortPolicyMu.RUnlock()
+	return defaultSortPolicy
+}
+
+// Sorts a in place as far as the deadline of ctx and the policy allow. Returns the order the
+// values are left in, empty when they are fully sorted.
+func sortWithin(ctx context.Context, a []int, policy string) string {
+	switch policy {
+	case sortPartial:
+		return sortChunked(ctx, a)
+	case sortUnsorted:
+		if deadline, ok := ctx.Deadline(); ok && len(a) > 1 {
+			if ctx.Err() != nil || renderCosts.estimateSort(len(a)) > time.Until(deadline) {
+				return orderUnsorted
+			}
+		}
+	}
+	sort.Ints(a)
+	return ""
+}
+
+// Sorts chunks of a, then merges them pairwise, checking the deadline between chunks. When it
+// passes, a is left as sorted runs: every chunk merged so far is sorted, the rest as it was.
+func sortChunked(ctx context.Context, a []int) string {
+	if ctx.Err() != nil && len(a) > 1 {
+		return orderUnsorted
+	}
+	for lo := 0; lo < len(a); lo += sortChunk {
+		if lo > 0 && ctx.Err() != nil {
+			return orderPartial
+		}
+		sort.Ints(a[lo:min(lo+sortChunk, len(a))])
+	}
+	if len(a) <= sortChunk {
+		return ""
+	}
+	src, dst := a, make([]int, len(a))
+	for width := sortChunk; width < len(a); width *= 2 {
+		for lo := 0; lo < len(a); lo += 2 * width {
+			mid, hi := min(lo+width, len(a)), min(lo+2*width, len(a))
+			if ctx.Err() != nil {
+				// Runs of this pass not merged yet are still sorted on their own
+				copy(dst[lo:], src[lo:])
+				copy(a, dst)
+				return orderPartial
+			}
+			mergeRuns(dst[lo:hi], src[lo:mid], src[mid:hi])
+		}
+		src, dst = dst, src
+	}
+	if &src[0] != &a[0] {
+		copy(a, src)
+	}
+	return ""
+}
+
+// Merges the sorted runs x and y into out, which has room for both
+func mergeRuns(out, x, y []int) {
+	i, j, k := 0, 0, 0
+	for i < len(x) && j < len(y) {
+		if y[j] < x[i] {
+			out[k] = y[j]
+			j++
+		} else {
+			out[k] = x[i]
+			i++
+		}
+		k++
+	}
+	k += copy(out[k:], x[i:])
+	copy(out[k:], y[j:])
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Context whose deadline passes after n checks
+type countdownCtx struct {
+	context.Context
+	n int
+}
+
+func (c *countdownCtx) Err() error {
+	if c.n <= 0 {
+		return context.DeadlineExceeded
+	}
+	c.n--
+	return nil
+}
+
+func randomValues(n int) []int {
+	r := rand.New(rand.NewSource(1))
+	a := make([]int, n)
+	for i := range a {
+		a[i] = r.Intn(1 << 30)
+	}
+	return a
+}
+
+// Checks a holds the values of orig and its first n values are runs of width sorted values
+func checkRuns(t *testing.T, name string, orig, a []int, n, width int) {
+	t.Helper()
+	for lo := 0; lo < n; lo += width {
+		if run := a[lo:min(lo+width, n)]; !sort.IntsAreSorted(run) {
+			t.Errorf("%s: expected the run at %d to be sorted", name, lo)
+		}
+	}
+	got, want := append([]int(nil), a...), append([]int(nil), orig...)
+	sort.Ints(got)
+	sort.Ints(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: expected the values to be kept", name)
+	}
+}
+
+func TestSortChunked(t *testing.T) {
+	n := 4*sortChunk + 5
+	tests := []struct {
+		name   string
+		checks int
+		want   string
+		// The first sorted values are expected in sorted runs of width
+		sorted, width int
+	}{
+		{name: "in time", checks: 1 << 20, sorted: n, width: n},
+		{name: "expired", checks: 0, want: orderUnsorted},
+		// 1 check up front, then one before each chunk but the first
+		{name: "during the chunks", checks: 3, want: orderPartial, sorted: 3 * sortChunk, width: sortChunk},
+		// Every chunk sorted, then the first pass merges 2 of its 3 pairs
+		{name: "during the merge", checks: 1 + 4 + 2, want: orderPartial, sorted: 4 * sortChunk, width: 2 * sortChunk},
+	}
+	for _, tt := range tests {
+		orig := randomValues(n)
+		a := append([]int(nil), orig...)
+		if got := sortChunked(&countdownCtx{Context: context.Background(), n: tt.checks}, a); got != tt.want {
+			t.Errorf("%s: expected order %q; got %q", tt.name, tt.want, got)
+		}
+		checkRuns(t, tt.name, orig, a, tt.sorted, max(tt.width, 1))
+	}
+}
+
+func TestSortWithin(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{policy: sortWait},
+		{policy: sortUnsorted, want: orderUnsorted},
+		{policy: sortPartial, want: orderUnsorted},
+	}
+	for _, tt := range tests {
+		orig := randomValues(1000)
+		a := append([]int(nil), orig...)
+		if got := sortWithin(expired, a, tt.policy); got != tt.want {
+			t.Errorf("%s: expected order %q; got %q", tt.policy, tt.want, got)
+		}
+		if tt.want == "" && !sort.IntsAreSorted(a) {
+			t.Errorf("%s: expected the values to be sorted", tt.policy)
+		}
+		if tt.want == orderUnsorted && !reflect.DeepEqual(a, orig) {
+			t.Errorf("%s: expected the values in merge order", tt.policy)
+		}
+	}
+	// Enough time left, the sort isn't skipped
+	a := randomValues(1000)
+	if got := sortWithin(context.Background(), a, sortUnsorted); got != "" || !sort.IntsAreSorted(a) {
+		t.Errorf("expected a sorted result; got order %q", got)
+	}
+}
+
+func TestSortPolicyOption(t *testing.T) {
+	defer setSortPolicy(currentSortPolicy())
+	if err := setSortPolicy("fast"); err == nil {
+		t.Error("expected an error")
+	}
+	setSortPolicy(sortPartial)
+	if o, _ := parseOptions(nil); o.sortPolicy != sortPartial {
+		t.Errorf("expected the default policy; got %q", o.sortPolicy)
+	}
+	if o, _ := parseOptions(url.Values{"sort_policy": {sortUnsorted}}); o.sortPolicy != sortUnsorted {
+		t.Errorf("expected the query to override the default; got %q", o.sortPolicy)
+	}
+	if _, err := parseOptions(url.Values{"sort_policy": {"fast"}}); err == nil {
+		t.Error("expected an error")
+	}
+	e := newEnvelope(options{}, summary{numbers: []int{2, 1}, order: orderPartial}, 1, 0, "")
+	if e.Order != orderPartial {
+		t.Errorf("expected the order without verbose; got %q", e.Order)
+	}
+}
@@ -0,0 +1,171 @@
+// Package sourcecheck verifies that an HTTP endpoint can serve as an upstream of the
+// aggregator: it must answer 200 with a JSON content type and a {"numbers":[...]} body of
+// integers, within the time budget. Source owners can call Test from their own tests, or run
+// `ta-cli check-source <url>`.
+package sourcecheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The aggregator's default deadline leaves 50ms of its 500ms for merging and sorting
+const DefaultBudget = 450 * time.Millisecond
+
+// Media types the aggregator accepts by default, * matches within a media type
+var DefaultContentTypes = []string{"application/json", "application/*+json", "text/json", "text/plain"}
+
+// Options of a check. Zero values pick the defaults.
+type Options struct {
+	Budget       time.Duration
+	ContentTypes []string
+	Client       *http.Client
+}
+
+// Outcome of a single check
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Outcome of every check against one URL
+type Report struct {
+	URL     string        `json:"url"`
+	Latency time.Duration `json:"latency_ns"`
+	Numbers int           `json:"numbers"`
+	Checks  []Check       `json:"checks"`
+}
+
+// Reports whether every check passed
+func (r Report) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) add(name string, err error) {
+	c := Check{Name: name, OK: err == nil}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// Fetches url once and checks the response. Checks that depend on a failed one are skipped.
+func Run(ctx context.Context, url string, o Options) Report {
+	if o.Budget <= 0 {
+		o.Budget = DefaultBudget
+	}
+	if o.ContentTypes == nil {
+		o.ContentTypes = DefaultContentTypes
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	r := Report{URL: url}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		r.add("request", err)
+		return r
+	}
+	req.Header.Set("Accept", "application/json")
+	// Twice the budget, so that a slow source is reported as such rather than as unreachable
+	ctx, cancel := context.WithTimeout(ctx, 2*o.Budget)
+	defer cancel()
+	start := time.Now()
+	res, err := o.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		r.add("request", err)
+		return r
+	}
+	defer res.Body.Close()
+	r.add("request", nil)
+	if res.StatusCode != http.StatusOK {
+		r.add("status", fmt.Errorf("expected 200 OK, got %s", res.Status))
+		io.Copy(ioutil.Discard, res.Body)
+		return r
+	}
+	r.add("status", nil)
+	r.add("content_type", checkContentType(res.Header.Get("Content-Type"), o.ContentTypes))
+	n, err := checkBody(res.Body)
+	r.Latency = time.Since(start)
+	r.Numbers = n
+	r.add("numbers", err)
+	var slow error
+	if r.Latency > o.Budget {
+		slow = fmt.Errorf("answered in %v, the budget is %v", r.Latency.Round(time.Millisecond), o.Budget)
+	}
+	r.add("budget", slow)
+	return r
+}
+
+func checkContentType(ct string, accepted []string) error {
+	if ct == "" {
+		// Accepted, but content sniffing on the way may get it wrong
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q", ct)
+	}
+	for _, pattern := range accepted {
+		pattern = strings.ToLower(pattern)
+		i := strings.Index(pattern, "*")
+		if i < 0 && pattern == mt {
+			return nil
+		}
+		if i >= 0 && len(mt) >= len(pattern)-1 && strings.HasPrefix(mt, pattern[:i]) && strings.HasSuffix(mt, pattern[i+1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("content type %q is not one of %s", mt, strings.Join(accepted, ", "))
+}
+
+// Decodes the body and reports the number of values
+func checkBody(r io.Reader) (int, error) {
+	var body struct {
+		Numbers *[]json.RawMessage `json:"numbers"`
+	}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return 0, fmt.Errorf("body is not a JSON object with a numbers list: %v", err)
+	}
+	if body.Numbers == nil {
+		return 0, fmt.Errorf(`body has no "numbers" list`)
+	}
+	for i, raw := range *body.Numbers {
+		// Quoted numbers and fractions are rejected by the aggregator unless lenient=true
+		if _, err := strconv.ParseInt(string(raw), 10, 64); err != nil {
+			return 0, fmt.Errorf("numbers[%d] = %s is not an integer", i, raw)
+		}
+	}
+	return len(*body.Numbers), nil
+}
+
+// Subset of testing.TB used by Test
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Runs the checks against url and reports every failed one on t
+func Test(t TB, url string, o Options) {
+	t.Helper()
+	r := Run(context.Background(), url, o)
+	for _, c := range r.Checks {
+		if !c.OK {
+			t.Errorf("%s: %s check failed: %s", url, c.Name, c.Detail)
+		}
+	}
+}
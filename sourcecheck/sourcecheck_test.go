@@ -0,0 +1,84 @@
+package sourcecheck
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func source(contentType, body string, status int, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestRun(t *testing.T) {
+	tt := []struct {
+		name   string
+		ts     *httptest.Server
+		failed string
+	}{
+		{name: "Good", ts: source("application/json", `{"numbers":[1,2,3]}`, http.StatusOK, 0)},
+		{name: "ProblemJSON", ts: source("application/problem+json", `{"numbers":[]}`, http.StatusOK, 0)},
+		{name: "Status", ts: source("application/json", `{}`, http.StatusServiceUnavailable, 0), failed: "status"},
+		{name: "HTML", ts: source("text/html", `{"numbers":[1]}`, http.StatusOK, 0), failed: "content_type"},
+		{name: "NoNumbers", ts: source("application/json", `{"values":[1]}`, http.StatusOK, 0), failed: "numbers"},
+		{name: "Fraction", ts: source("application/json", `{"numbers":[1,2.5]}`, http.StatusOK, 0), failed: "numbers"},
+		{name: "Quoted", ts: source("application/json", `{"numbers":["1"]}`, http.StatusOK, 0), failed: "numbers"},
+		{name: "NotJSON", ts: source("text/plain", `1,2,3`, http.StatusOK, 0), failed: "numbers"},
+		{name: "Slow", ts: source("application/json", `{"numbers":[1]}`, http.StatusOK, 60*time.Millisecond), failed: "budget"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			defer tc.ts.Close()
+			r := Run(context.Background(), tc.ts.URL, Options{Budget: 50 * time.Millisecond})
+			var failed string
+			for _, c := range r.Checks {
+				if !c.OK {
+					failed = c.Name
+				}
+			}
+			if failed != tc.failed || r.OK() != (tc.failed == "") {
+				t.Errorf("expected failed check %q; got %+v", tc.failed, r.Checks)
+			}
+		})
+	}
+}
+
+func TestRunUnreachable(t *testing.T) {
+	ts := source("", "", http.StatusOK, 0)
+	ts.Close()
+	r := Run(context.Background(), ts.URL, Options{})
+	if r.OK() || len(r.Checks) != 1 || r.Checks[0].Name != "request" {
+		t.Errorf("expected only the request check to fail; got %+v", r.Checks)
+	}
+}
+
+type recorder struct{ errors []string }
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestTest(t *testing.T) {
+	good := source("application/json", `{"numbers":[1]}`, http.StatusOK, 0)
+	defer good.Close()
+	Test(t, good.URL, Options{})
+	bad := source("text/html", `<html>`, http.StatusOK, 0)
+	defer bad.Close()
+	var rec recorder
+	Test(&rec, bad.URL, Options{})
+	if len(rec.errors) != 2 {
+		t.Errorf("expected the content type and numbers checks to fail; got %v", rec.errors)
+	}
+}
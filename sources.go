@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How a source is requested when a plain GET doesn't do, e.g. a search API that takes a JSON
+// query. Configured per URL under "sources" of a group.
+type sourceConfig struct {
+	// GET, POST or PUT. Defaults to POST when there is a body.
+	Method string `json:"method,omitempty"`
+	// text/template rendered for every fetch with .RequestID, .Tenant and .Now
+	Body string `json:"body,omitempty"`
+	// Defaults to application/json, or text/xml for XML sources, when there is a body
+	ContentType string `json:"content_type,omitempty"`
+	// Fetches carry a client credentials token obtained from the source's token endpoint
+	OAuth2 *oauth2Config `json:"oauth2,omitempty"`
+	// The source answers XML, e.g. a SOAP endpoint, and the values are taken from its elements
+	XML *xmlConfig `json:"xml,omitempty"`
+	// Format the source answers in whatever its Content-Type says, e.g. yaml for a config service
+	// answering text/plain. One of the names of registerCodec.
+	Format string `json:"format,omitempty"`
+	// Values are taken from this path of the document instead of "numbers", see parseDocPath
+	Path string `json:"path,omitempty"`
+	// Charset of the source's text when its Content-Type doesn't say or lies, e.g. windows-1252
+	Charset string `json:"charset,omitempty"`
+}
+
+// Values available to body templates
+type sourceVars struct {
+	RequestID string
+	Tenant    string
+	Now       time.Time
+}
+
+// A source config ready to use, with its body template parsed
+type sourceRequest struct {
+	method      string
+	contentType string
+	body        *template.Template
+	oauth       *oauth2Config
+	xml         *docPath
+	soapAction  string
+	format      *codec
+	path        *docPath
+	charset     string
+}
+
+func compileSource(c sourceConfig) (*sourceRequest, error) {
+	s := &sourceRequest{method: strings.ToUpper(c.Method), contentType: c.ContentType, oauth: c.OAuth2}
+	if c.OAuth2 != nil {
+		if err := c.OAuth2.validate(); err != nil {
+			return nil, fmt.Errorf("oauth2 - %v", err)
+		}
+	}
+	if c.XML != nil {
+		if c.Format != "" || c.Path != "" {
+			return nil, fmt.Errorf("xml sources take no format or path, their path is under xml")
+		}
+		p, err := parseDocPath(c.XML.Path)
+		if err != nil {
+			return nil, fmt.Errorf("xml - %v", err)
+		}
+		s.xml, s.soapAction = p, c.XML.SOAPAction
+	}
+	if c.Format != "" {
+		if s.format = codecNamed(c.Format); s.format == nil {
+			return nil, fmt.Errorf("unknown format %q", c.Format)
+		}
+	}
+	if c.Charset != "" {
+		if _, _, err := charsetDecoder(c.Charset); err != nil {
+			return nil, err
+		}
+		s.charset = c.Charset
+	}
+	if c.Path != "" {
+		p, err := parseDocPath(c.Path)
+		if err != nil {
+			return nil, fmt.Errorf("path - %v", err)
+		}
+		if p.attr != "" {
+			return nil, fmt.Errorf("path - only XML has attributes")
+		}
+		s.path = p
+	}
+	if c.Body != "" {
+		t, err := template.New("body").Option("missingkey=error").Parse(c.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body template - %v", err)
+		}
+		s.body = t
+		if s.method == "" {
+			s.method = http.MethodPost
+		}
+		if s.contentType == "" && s.xml != nil {
+			s.contentType = "text/xml; charset=utf-8"
+		}
+		if s.contentType == "" {
+			s.contentType = "application/json"
+		}
+	}
+	switch s.method {
+	case "":
+		s.method = http.MethodGet
+	case http.MethodGet, http.MethodPost, http.MethodPut:
+	default:
+		return nil, fmt.Errorf("unsupported method %q, expected GET, POST or PUT", c.Method)
+	}
+	return s, nil
+}
+
+// Builds the request for url, whose body is rendered for the request in ctx
+func (s *sourceRequest) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	if s == nil {
+		return http.NewRequest(http.MethodGet, url, nil)
+	}
+	var body io.Reader
+	if s.body != nil {
+		var buf bytes.Buffer
+		vars := sourceVars{RequestID: requestIDFrom(ctx), Tenant: tenantFrom(ctx), Now: time.Now().UTC()}
+		if err := s.body.Execute(&buf, vars); err != nil {
+			return nil, fmt.Errorf("body template - %v", err)
+		}
+		body = &buf
+	}
+	req, err := http.NewRequest(s.method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.contentType != "" {
+		req.Header.Set("Content-Type", s.contentType)
+	}
+	return req, nil
+}
+
+// Asks XML sources for XML and sources with a format for it, after upstream.prepare asked for JSON
+func (s *sourceRequest) prepare(req *http.Request) {
+	if s != nil && s.format != nil {
+		req.Header.Set("Accept", strings.Join(s.format.mediaTypes, ", "))
+	}
+	if s == nil || s.xml == nil {
+		return
+	}
+	req.Header.Set("Accept", strings.Join(xmlContentTypes[:2], ", "))
+	if s.soapAction != "" {
+		// Quoted as SOAP 1.1 requires
+		req.Header.Set("SOAPAction", `"`+s.soapAction+`"`)
+	}
+}
+
+// Rejects responses of a media type the source's decoder can't read
+func (s *sourceRequest) checkContentType(res *http.Response) error {
+	switch {
+	case s != nil && s.xml != nil:
+		return checkXMLContentType(res)
+	case s != nil && s.format != nil:
+		// Config services often label documents as plain text
+		p := upstreamPolicy{contentTypes: append(s.format.mediaTypes[:len(s.format.mediaTypes):len(s.format.mediaTypes)], "text/plain")}
+		return p.checkContentType(res)
+	}
+	return upstream.checkContentType(res)
+}
+
+// Path of the values of an XML source, nil for other sources
+func (s *sourceRequest) xmlPath() *docPath {
+	if s == nil {
+		return nil
+	}
+	return s.xml
+}
+
+// Charset the source's bodies are read in, "" to detect it
+func (s *sourceRequest) bodyCharset() string {
+	if s == nil {
+		return ""
+	}
+	return s.charset
+}
+
+// Codec and path a body of contentType is decoded with. A nil codec leaves it to the JSON
+// decoders, which only read "numbers".
+func (s *sourceRequest) decoder(contentType string) (*codec, *docPath) {
+	c := codecFor(contentType)
+	var path *docPath
+	if s != nil {
+		if s.format != nil {
+			c = s.format
+		}
+		path = s.path
+	}
+	if c == nil && path != nil {
+		c = jsonDocument
+	}
+	return c, path
+}
+
+// Adds the token of sources with OAuth2 credentials to req
+func (s *sourceRequest) authorize(ctx context.Context, req *http.Request) error {
+	if s == nil || s.oauth == nil {
+		return nil
+	}
+	h, err := tokens.authorization(ctx, s.oauth)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", h)
+	return nil
+}
+
+// Forgets a token the source rejected with a 401
+func (s *sourceRequest) checkAuthorized(req *http.Request, res *http.Response) {
+	if s != nil && s.oauth != nil && res.StatusCode == http.StatusUnauthorized {
+		tokens.rejected(s.oauth, req.Header.Get("Authorization"))
+	}
+}
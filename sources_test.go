@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var q struct {
+			Query     string `json:"query"`
+			RequestID string `json:"request_id"`
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(b, &q) != nil || q.Query != "primes" || q.RequestID != "req-1" {
+			http.Error(w, "bad query "+string(b), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"numbers": []int{2, 3, 5}})
+	}))
+	defer ts.Close()
+	defer groups.set(groups.all())
+	all := map[string]group{"search": {URLs: []string{ts.URL}, Sources: map[string]sourceConfig{
+		ts.URL: {Body: `{"query": "primes", "request_id": "{{.RequestID}}"}`},
+	}}}
+	if err := validateGroups(all); err != nil {
+		t.Fatal(err)
+	}
+	groups.set(all)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?verbose=errors&g=search", nil)
+	numbersHandler(rec, req.WithContext(withRequestID(req.Context(), "req-1")))
+	var res struct {
+		Numbers []int         `json:"numbers"`
+		Errors  []errorDetail `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Numbers) != 3 || len(res.Errors) != 0 {
+		t.Errorf("expected the numbers of the POST source; got %+v", res)
+	}
+}
+
+func TestCompileSource(t *testing.T) {
+	tests := []struct {
+		cfg         sourceConfig
+		method      string
+		contentType string
+	}{
+		{cfg: sourceConfig{}, method: http.MethodGet},
+		{cfg: sourceConfig{Body: "{}"}, method: http.MethodPost, contentType: "application/json"},
+		{cfg: sourceConfig{Method: "put", Body: "q=1", ContentType: "application/x-www-form-urlencoded"}, method: http.MethodPut, contentType: "application/x-www-form-urlencoded"},
+	}
+	for _, tt := range tests {
+		s, err := compileSource(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.method != tt.method || s.contentType != tt.contentType {
+			t.Errorf("%+v: expected %s %s; got %s %s", tt.cfg, tt.method, tt.contentType, s.method, s.contentType)
+		}
+	}
+}
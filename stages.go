@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Where a fetch was when its deadline passed. Stage names are part of the verbose response and
+// of the metric names, so they must not change once released.
+type fetchStage int32
+
+const (
+	// Waiting for a worker
+	stageQueued fetchStage = iota
+	// Getting a connection: waiting for a socket, dialing and the TLS handshake
+	stageDial
+	// Request sent, awaiting the response headers
+	stageHeaders
+	// Headers received, waiting for the merge stage to catch up
+	stageMergeWait
+	// Reading and decoding the body
+	stageBody
+	stageDone
+)
+
+var fetchStageNames = [...]string{"queued", "dial", "headers", "merge_wait", "body", "done"}
+
+func (s fetchStage) String() string {
+	if int(s) < len(fetchStageNames) {
+		return fetchStageNames[s]
+	}
+	return fmt.Sprintf("stage(%d)", int32(s))
+}
+
+// Stages of a request beyond the fetches, reported when its deadline passed during them
+const (
+	requestStageFetch = "fetch"
+	requestStageMerge = "merge"
+	requestStageSort  = "sort"
+)
+
+// Stage of every job of a fan-out, indexed like its URLs. Fetches update their slot while
+// the consumer reads it to attribute the jobs that didn't answer in time.
+type stageBoard []int32
+
+type stageBoardKeyType struct{}
+
+func withStageBoard(ctx context.Context, b stageBoard) context.Context {
+	return context.WithValue(ctx, stageBoardKeyType{}, b)
+}
+
+func stageBoardFrom(ctx context.Context) stageBoard {
+	b, _ := ctx.Value(stageBoardKeyType{}).(stageBoard)
+	return b
+}
+
+// Slot of job i, nil without a board
+func (b stageBoard) slot(i int) *int32 {
+	if i >= len(b) {
+		return nil
+	}
+	return &b[i]
+}
+
+func (b stageBoard) get(i int) fetchStage {
+	if i >= len(b) {
+		return stageQueued
+	}
+	return fetchStage(atomic.LoadInt32(&b[i]))
+}
+
+type fetchStageKeyType struct{}
+
+func withFetchStage(ctx context.Context, slot *int32) context.Context {
+	return context.WithValue(ctx, fetchStageKeyType{}, slot)
+}
+
+// Slot the fetch of ctx records its stage in, a private one when the fan-out keeps no board
+func fetchStageFrom(ctx context.Context) *int32 {
+	if slot, ok := ctx.Value(fetchStageKeyType{}).(*int32); ok && slot != nil {
+		return slot
+	}
+	return new(int32)
+}
+
+func setStage(slot *int32, s fetchStage) {
+	atomic.StoreInt32(slot, int32(s))
+}
+
+func loadStage(slot *int32) fetchStage {
+	return fetchStage(atomic.LoadInt32(slot))
+}
+
+// Moves the slot through dial and headers as the transport gets a connection and sends the request
+func traceStages(ctx context.Context, slot *int32) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) { setStage(slot, stageDial) },
+		GotConn: func(httptrace.GotConnInfo) { setStage(slot, stageHeaders) },
+	})
+}
+
+// Attributes a timeout to the stage the fetch was in. Other errors don't depend on the stage.
+func (e *fetchError) at(s fetchStage) *fetchError {
+	if e.code == codeUpstreamTimeout || e.code == codeBudgetExceeded {
+		e.stage = s.String()
+	}
+	return e
+}
+
+// "3 headers, 1 queued" for the log line of a request that ran out of time
+func stageCounts(errs []error) string {
+	counts := make(map[string]int)
+	for _, err := range errs {
+		if s := stageOf(err); s != "" {
+			counts[s]++
+		}
+	}
+	parts := make([]string, 0, len(counts))
+	for s, n := range counts {
+		parts = append(parts, fmt.Sprintf("%d %s", n, s))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
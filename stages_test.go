@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchTimeoutStage(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/body" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"numbers":[1,`))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer func(t *hostTracker) { upstreamStats = t }(upstreamStats)
+	upstreamStats = newHostTracker()
+	o, _ := parseOptions(nil)
+	o.upstreamTimeout = 50 * time.Millisecond
+	tests := []struct {
+		path  string
+		stage string
+	}{
+		{path: "/headers", stage: "headers"},
+		{path: "/body", stage: "body"},
+	}
+	for _, tt := range tests {
+		slot := new(int32)
+		_, err := fetch(withFetchStage(context.Background(), slot), currentTransport(), o, ts.URL+tt.path)
+		if errorCodeOf(err) != codeUpstreamTimeout || stageOf(err) != tt.stage {
+			t.Errorf("%s: expected a timeout in %s; got %v in %q", tt.path, tt.stage, err, stageOf(err))
+		}
+		if d := detailOf(err); d.Stage != tt.stage {
+			t.Errorf("%s: expected stage %s in the detail; got %+v", tt.path, tt.stage, d)
+		}
+	}
+}
+
+func TestUnansweredStages(t *testing.T) {
+	board := make(stageBoard, 3)
+	setStage(board.slot(1), stageDial)
+	setStage(board.slot(2), stageHeaders)
+	ctx, cancel := context.WithCancel(withStageBoard(context.Background(), board))
+	cancel()
+	o, _ := parseOptions(nil)
+	sum := consume(ctx, []string{"http://a", "http://b", "http://c"}, o, make(chan event))
+	if sum.deadlineStage != requestStageFetch {
+		t.Errorf("expected the deadline in %s; got %q", requestStageFetch, sum.deadlineStage)
+	}
+	want := []string{"queued", "dial", "headers"}
+	got := make(map[string]bool)
+	for _, err := range sum.errs {
+		got[stageOf(err)] = true
+	}
+	for _, s := range want {
+		if !got[s] {
+			t.Errorf("expected a source in %s; got %v", s, sum.errs)
+		}
+	}
+	if c := stageCounts(sum.errs); c != "1 dial, 1 headers, 1 queued" {
+		t.Errorf("unexpected counts %q", c)
+	}
+	if e := detailOf(newFetchError(codeDecode, "http://a", "bad").at(stageBody)); e.Stage != "" {
+		t.Errorf("expected no stage for a decode error; got %q", e.Stage)
+	}
+}
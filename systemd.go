@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// First descriptor passed by socket activation, SD_LISTEN_FDS_START in sd-daemon
+const listenFDsStart = 3
+
+// Listener passed by systemd socket activation, nil when the process wasn't socket activated.
+// The environment is cleared so that child processes don't take the socket for theirs.
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("socket activation passed %d sockets, expected a single stream socket", n)
+	}
+	f := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation - %v", err)
+	}
+	return l, nil
+}
+
+// Socket inherited from an upgrade or passed by systemd if there is one, a new TCP listener on
+// addr otherwise. Nil when there is neither and addr is empty.
+func listen(addr string) (net.Listener, error) {
+	if l, err := inheritedListener(); l != nil || err != nil || upgradeReady != nil {
+		return l, err
+	}
+	l, err := activationListener()
+	if l != nil || err != nil {
+		if err == nil {
+			log.Printf("systemd: serving on activated socket %s", l.Addr())
+		}
+		return l, err
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Sends a state such as READY=1 to the service manager. It does nothing outside of a
+// Type=notify unit, where NOTIFY_SOCKET is unset.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Abstract sockets are announced with a leading @, which net maps to the NUL byte
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Half the watchdog timeout of the unit, 0 when WatchdogSec isn't set for this process
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Tells systemd and the process this one replaces that the service is ready, and keeps the
+// watchdog fed until ctx is done
+func notifyReady(ctx context.Context) {
+	signalUpgradeReady()
+	if err := sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+		log.Printf("systemd: readiness notification failed - %v", err)
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					log.Printf("systemd: watchdog notification failed - %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
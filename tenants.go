@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of the requests of a tenant, on top of the server's. Zero leaves a limit to the server.
+type tenantPolicy struct {
+	// Ceiling of the request deadline
+	Deadline duration `json:"deadline,omitempty"`
+	// Most URLs a request may fan out to, groups expanded
+	MaxURLs int `json:"max_urls,omitempty"`
+	// Most fetches the tenant's requests may run at once, its share of the worker pool
+	Workers int `json:"workers,omitempty"`
+	// Most values a response may carry, a page of a paginated one included
+	MaxValues int `json:"max_values,omitempty"`
+	// Objective of the tenant's requests, its zero fields are those of -slo.latency and friends
+	SLO *sloObjective `json:"slo,omitempty"`
+}
+
+type tenantRegistry struct {
+	mu       sync.RWMutex
+	policies map[string]tenantPolicy
+	// Fetch slots of the tenants with a worker share, a slot is taken while a fetch runs
+	slots map[string]chan struct{}
+}
+
+var tenants = &tenantRegistry{policies: map[string]tenantPolicy{}, slots: map[string]chan struct{}{}}
+
+func registerTenantFlags(fs *flag.FlagSet, file *string) {
+	fs.StringVar(file, "tenants.file", "", "JSON file with tenant policies of the form {\"acme\": {\"deadline\": \"300ms\", \"max_urls\": 100, \"workers\": 20, \"max_values\": 10000}}")
+}
+
+func loadTenants(path string) (map[string]tenantPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var all map[string]tenantPolicy
+	if err := json.NewDecoder(f).Decode(&all); err != nil {
+		return nil, fmt.Errorf("%s decoding error - %v", path, err)
+	}
+	return all, validateTenants(all)
+}
+
+func validateTenants(all map[string]tenantPolicy) error {
+	for name, p := range all {
+		if name == "" {
+			return fmt.Errorf("tenant policy without a tenant")
+		}
+		if p.Deadline < 0 || p.MaxURLs < 0 || p.Workers < 0 || p.MaxValues < 0 {
+			return fmt.Errorf("tenant %q has a negative limit", name)
+		}
+		if p.SLO != nil {
+			if err := p.SLO.validate(); err != nil {
+				return fmt.Errorf("tenant %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces the policies. Fetches holding a slot of the old ones release it there.
+func (t *tenantRegistry) set(all map[string]tenantPolicy) {
+	policies := make(map[string]tenantPolicy, len(all))
+	slots := make(map[string]chan struct{})
+	for name, p := range all {
+		policies[name] = p
+		if p.Workers > 0 {
+			slots[name] = make(chan struct{}, p.Workers)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.policies, t.slots = policies, slots
+}
+
+func (t *tenantRegistry) all() map[string]tenantPolicy {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[string]tenantPolicy, len(t.policies))
+	for name, p := range t.policies {
+		out[name] = p
+	}
+	return out
+}
+
+// Policy of tenant, the zero policy when it has none
+func (t *tenantRegistry) policy(tenant string) tenantPolicy {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.policies[tenant]
+}
+
+// Takes a fetch slot of tenant, waiting for one while its share of the workers is busy. The
+// release func gives it back; ok is false when ctx was done first.
+func (t *tenantRegistry) acquire(ctx context.Context, tenant string) (release func(), ok bool) {
+	t.mu.RLock()
+	slot := t.slots[tenant]
+	t.mu.RUnlock()
+	if slot == nil {
+		return func() {}, true
+	}
+	select {
+	case slot <- struct{}{}:
+	default:
+		httpMetrics.Add("tenant_worker_waits "+tenant, 1)
+		select {
+		case slot <- struct{}{}:
+		case <-ctx.Done():
+			return func() {}, false
+		}
+	}
+	return func() { <-slot }, true
+}
+
+// Fetch slots taken per tenant with a worker share
+func (t *tenantRegistry) busy() map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[string]int, len(t.slots))
+	for name, slot := range t.slots {
+		out[name] = len(slot)
+	}
+	return out
+}
+
+// Deadline of the requests of the tenant of ctx, which may be shorter than the server's
+func tenantDeadline(ctx context.Context, server time.Duration) (time.Duration, bool) {
+	p := tenants.policy(tenantFrom(ctx))
+	if p.Deadline > 0 && time.Duration(p.Deadline) < server {
+		return time.Duration(p.Deadline), true
+	}
+	return server, false
+}
+
+// A request breaking the policy of its tenant
+type policyError struct {
+	status int
+	msg    string
+}
+
+func (e *policyError) Error() string {
+	return e.msg
+}
+
+func (e *policyError) write(w http.ResponseWriter) {
+	httpMetrics.Add(fmt.Sprintf("tenant_rejected %d", e.status), 1)
+	w.WriteHeader(e.status)
+	w.Write([]byte(strconv.Itoa(e.status) + " - " + e.msg))
+}
+
+// Checks a request of the tenant of ctx for urls against its policy before anything is fetched
+func checkTenantRequest(ctx context.Context, q url.Values, urls []string, o options) *policyError {
+	tenant := tenantFrom(ctx)
+	p := tenants.policy(tenant)
+	if p.MaxURLs > 0 && len(urls) > p.MaxURLs {
+		return &policyError{http.StatusForbidden, fmt.Sprintf("tenant %s may request at most %d urls, got %d", tenant, p.MaxURLs, len(urls))}
+	}
+	if p.Deadline > 0 && q.Get("upstream_timeout_ms") != "" && o.upstreamTimeout > time.Duration(p.Deadline) {
+		return &policyError{http.StatusForbidden, fmt.Sprintf("upstream_timeout_ms %d exceeds the %v deadline of tenant %s", o.upstreamTimeout.Milliseconds(), time.Duration(p.Deadline), tenant)}
+	}
+	if p.Deadline > 0 && o.deadline > time.Duration(p.Deadline) {
+		return &policyError{http.StatusForbidden, fmt.Sprintf("timeout %v exceeds the %v deadline of tenant %s", o.deadline, time.Duration(p.Deadline), tenant)}
+	}
+	if p.MaxValues > 0 && o.pageSize > p.MaxValues {
+		return &policyError{http.StatusForbidden, fmt.Sprintf("page_size %d exceeds the %d values tenant %s may receive", o.pageSize, p.MaxValues, tenant)}
+	}
+	return nil
+}
+
+// Checks the size of a response for the tenant of ctx. Histograms don't carry the values.
+func checkTenantResult(ctx context.Context, o options, values int) *policyError {
+	tenant := tenantFrom(ctx)
+	p := tenants.policy(tenant)
+	if p.MaxValues == 0 || values <= p.MaxValues || o.histogram != "" {
+		return nil
+	}
+	return &policyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%d values exceed the %d tenant %s may receive, request pages with page_size", values, p.MaxValues, tenant)}
+}
+
+// Lists the tenant policies and the fetch slots each tenant with a worker share holds
+func tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"policies": tenants.all(), "busy_workers": tenants.busy()})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateTenants(t *testing.T) {
+	tests := []struct {
+		name string
+		all  map[string]tenantPolicy
+		err  bool
+	}{
+		{name: "empty", all: map[string]tenantPolicy{}},
+		{name: "valid", all: map[string]tenantPolicy{"acme": {Deadline: duration(300 * time.Millisecond), MaxURLs: 10, Workers: 2, MaxValues: 100}}},
+		{name: "no tenant", all: map[string]tenantPolicy{"": {MaxURLs: 1}}, err: true},
+		{name: "negative", all: map[string]tenantPolicy{"acme": {Workers: -1}}, err: true},
+	}
+	for _, tt := range tests {
+		if err := validateTenants(tt.all); (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v; got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestTenantPolicies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"numbers": [1, 2, 3]}`))
+	}))
+	defer ts.Close()
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"acme": {Deadline: duration(200 * time.Millisecond), MaxURLs: 2, MaxValues: 2}})
+	tests := []struct {
+		name   string
+		tenant string
+		query  string
+		status int
+		body   string
+	}{
+		{name: "other tenant", tenant: "other", query: "u=" + ts.URL + "&u=" + ts.URL + "&u=" + ts.URL, status: http.StatusOK},
+		{name: "too many urls", tenant: "acme", query: "u=" + ts.URL + "&u=" + ts.URL + "&u=" + ts.URL, status: http.StatusForbidden, body: "403 - tenant acme may request at most 2 urls, got 3"},
+		{name: "upstream timeout", tenant: "acme", query: "u=" + ts.URL + "&upstream_timeout_ms=500", status: http.StatusForbidden, body: "403 - upstream_timeout_ms 500 exceeds the 200ms deadline of tenant acme"},
+		{name: "page size", tenant: "acme", query: "u=" + ts.URL + "&page_size=5", status: http.StatusForbidden, body: "403 - page_size 5 exceeds the 2 values tenant acme may receive"},
+		{name: "too many values", tenant: "acme", query: "u=" + ts.URL, status: http.StatusRequestEntityTooLarge, body: "413 - 3 values exceed the 2 tenant acme may receive, request pages with page_size"},
+		{name: "paged", tenant: "acme", query: "u=" + ts.URL + "&page_size=2", status: http.StatusOK},
+		{name: "histogram", tenant: "acme", query: "u=" + ts.URL + "&histogram=auto", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, endpoint+"?"+tt.query, nil)
+		req = req.WithContext(withTenant(req.Context(), tt.tenant))
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, req)
+		if rec.Code != tt.status || tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s: expected %d %q; got %d %q", tt.name, tt.status, tt.body, rec.Code, rec.Body.String())
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, endpoint, nil)
+	ctx, cancel := requestContext(req.WithContext(withTenant(req.Context(), "acme")), 0)
+	defer cancel()
+	if d, _ := ctx.Deadline(); time.Until(d) > 200*time.Millisecond || deadlineSourceFrom(ctx) != deadlineTenant {
+		t.Errorf("expected the tenant's deadline; got %v from %s", time.Until(d), deadlineSourceFrom(ctx))
+	}
+}
+
+func TestTenantWorkers(t *testing.T) {
+	var running, peak int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"numbers": [1]}`))
+	}))
+	defer ts.Close()
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"acme": {Workers: 2}})
+	urls := make([]string, 8)
+	for i := range urls {
+		urls[i] = ts.URL + "/" + strings.Repeat("x", i)
+	}
+	o, _ := parseOptions(nil)
+	ctx, cancel := context.WithTimeout(withTenant(context.Background(), "acme"), 5*time.Second)
+	defer cancel()
+	if sum := run(ctx, urls, o); sum.ok != len(urls) {
+		t.Fatalf("expected every source to answer; got %d", sum.ok)
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 concurrent fetches of the tenant; got %d", peak)
+	}
+	// The last worker releases its slot right after handing over its event
+	for i := 0; i < 100 && tenants.busy()["acme"] != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if busy := tenants.busy()["acme"]; busy != 0 {
+		t.Errorf("expected every slot to be released; got %d busy", busy)
+	}
+	// A tenant waiting for a slot gives up with its deadline
+	release, ok := tenants.acquire(ctx, "acme")
+	release2, _ := tenants.acquire(ctx, "acme")
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	if _, ok3 := tenants.acquire(short, "acme"); !ok || ok3 {
+		t.Errorf("expected the third slot to time out; got %v and %v", ok, ok3)
+	}
+	release()
+	release2()
+}
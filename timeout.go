@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bounds of the timeout query parameter, set by -timeout.min and -timeout.max
+var (
+	timeoutMu  sync.RWMutex
+	timeoutMin = 10 * time.Millisecond
+	timeoutMax = timeout * time.Millisecond
+)
+
+func registerTimeoutFlags(fs *flag.FlagSet, min, max *time.Duration) {
+	fs.DurationVar(min, "timeout.min", 10*time.Millisecond, "shortest deadline a request may ask for with the timeout query parameter")
+	fs.DurationVar(max, "timeout.max", timeout*time.Millisecond, "longest deadline a request may ask for with the timeout query parameter, may exceed the server's for batch callers")
+}
+
+func setTimeoutBounds(min, max time.Duration) error {
+	if min <= 0 || max < min {
+		return fmt.Errorf("-timeout.min must be positive and at most -timeout.max")
+	}
+	timeoutMu.Lock()
+	defer timeoutMu.Unlock()
+	timeoutMin, timeoutMax = min, max
+	return nil
+}
+
+func currentTimeoutBounds() (min, max time.Duration) {
+	timeoutMu.RLock()
+	defer timeoutMu.RUnlock()
+	return timeoutMin, timeoutMax
+}
+
+// Parses the timeout query parameter, a duration like 300ms within the server's bounds
+func parseTimeout(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", v)
+	}
+	min, max := currentTimeoutBounds()
+	if d < min || d > max {
+		return 0, fmt.Errorf("timeout %v is outside of [%v, %v]", d, min, max)
+	}
+	return d, nil
+}
+
+// Longest time a fetch may wait for response headers, which the transport enforces for every
+// request. Shorter timeouts are applied through the fetch's context.
+func headerTimeout() time.Duration {
+	_, max := currentTimeoutBounds()
+	if d := maxUpstreamTimeout * time.Millisecond; d > max {
+		return d
+	}
+	return max
+}
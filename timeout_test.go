@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTimeoutOption(t *testing.T) {
+	defer setTimeoutBounds(currentTimeoutBounds())
+	if err := setTimeoutBounds(50*time.Millisecond, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query    string
+		deadline time.Duration
+		upstream time.Duration
+		err      bool
+	}{
+		{query: "", upstream: individualTimeout * time.Millisecond},
+		{query: "timeout=300ms", deadline: 300 * time.Millisecond, upstream: 300 * time.Millisecond},
+		{query: "timeout=2m", deadline: 2 * time.Minute, upstream: 2 * time.Minute},
+		{query: "timeout=300ms&upstream_timeout_ms=100", deadline: 300 * time.Millisecond, upstream: 100 * time.Millisecond},
+		{query: "timeout=300ms&upstream_timeout_ms=1000", deadline: 300 * time.Millisecond, upstream: 300 * time.Millisecond},
+		{query: "timeout=10ms", err: true},
+		{query: "timeout=3m", err: true},
+		{query: "timeout=300", err: true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		o, err := parseOptions(q)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v; got %v", tt.query, tt.err, err)
+			continue
+		}
+		if err == nil && (o.deadline != tt.deadline || o.upstreamTimeout != tt.upstream) {
+			t.Errorf("%s: expected deadline %v and upstream timeout %v; got %v and %v", tt.query, tt.deadline, tt.upstream, o.deadline, o.upstreamTimeout)
+		}
+	}
+	if err := setTimeoutBounds(time.Second, time.Millisecond); err == nil {
+		t.Error("expected an error for a minimum above the maximum")
+	}
+	if d := headerTimeout(); d != 2*time.Minute {
+		t.Errorf("expected the transport to allow the longest timeout; got %v", d)
+	}
+}
+
+func TestTimeoutDeadline(t *testing.T) {
+	defer tenants.set(tenants.all())
+	tenants.set(map[string]tenantPolicy{"acme": {Deadline: duration(200 * time.Millisecond)}})
+	tests := []struct {
+		tenant string
+		client time.Duration
+		want   time.Duration
+		source string
+	}{
+		{want: timeout * time.Millisecond, source: deadlineServer},
+		{client: 300 * time.Millisecond, want: 300 * time.Millisecond, source: deadlineClient},
+		{client: 2 * time.Minute, want: 2 * time.Minute, source: deadlineClient},
+		{tenant: "acme", client: 100 * time.Millisecond, want: 100 * time.Millisecond, source: deadlineClient},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, endpoint, nil)
+		ctx, cancel := requestContext(req.WithContext(withTenant(req.Context(), tt.tenant)), tt.client)
+		d, _ := ctx.Deadline()
+		cancel()
+		if left := time.Until(d); left > tt.want || left < tt.want-time.Second || deadlineSourceFrom(ctx) != tt.source {
+			t.Errorf("%v: expected %v from %s; got %v from %s", tt.client, tt.want, tt.source, left, deadlineSourceFrom(ctx))
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(timeOutHandler([]int{1})))
+	defer ts.Close()
+	// The slow source is cut off at the client's deadline rather than the server's
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+"&timeout=100ms", nil))
+	if rec.Code != http.StatusOK || time.Since(start) > 400*time.Millisecond {
+		t.Errorf("expected an answer within the timeout; got %d after %v", rec.Code, time.Since(start))
+	}
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+"&timeout=1s", nil)
+	rec = httptest.NewRecorder()
+	numbersHandler(rec, req.WithContext(withTenant(req.Context(), "acme")))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected a timeout beyond the tenant's deadline to be refused; got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?u="+ts.URL+"&timeout=1h", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a timeout beyond -timeout.max to be refused; got %d", rec.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Values of -transport.min-tls
+var tlsVersions = map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// Flag taking a TLS version like 1.2
+type tlsVersionFlag struct{ v *uint16 }
+
+func (f tlsVersionFlag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	return tlsVersionString(*f.v)
+}
+
+func (f tlsVersionFlag) Set(s string) error {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("invalid TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	*f.v = v
+	return nil
+}
+
+func tlsVersionString(v uint16) string {
+	for s, version := range tlsVersions {
+		if version == v {
+			return s
+		}
+	}
+	return ""
+}
+
+// Handshakes with an upstream host since the start
+type hostTLS struct {
+	handshakes, resumed, failed int64
+	versions                    map[string]int64
+	latency                     *latencyHistogram
+}
+
+type tlsTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostTLS
+}
+
+var tlsStats = &tlsTracker{hosts: make(map[string]*hostTLS)}
+
+func (t *tlsTracker) record(host string, took time.Duration, state tls.ConnectionState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &hostTLS{versions: make(map[string]int64), latency: newLatencyHistogram()}
+		t.hosts[host] = h
+	}
+	h.handshakes++
+	if err != nil {
+		h.failed++
+		upstreamMetrics.Add("tls_failed", 1)
+		return
+	}
+	h.latency.observe(took)
+	version := tls.VersionName(state.Version)
+	h.versions[version]++
+	upstreamMetrics.Add("tls_handshakes "+version, 1)
+	if state.DidResume {
+		h.resumed++
+		upstreamMetrics.Add("tls_resumed", 1)
+	}
+}
+
+// JSON form of a host's handshakes
+type tlsSnapshot struct {
+	Host       string           `json:"host"`
+	Handshakes int64            `json:"handshakes"`
+	Resumed    int64            `json:"resumed"`
+	ResumeRate float64          `json:"resume_rate"`
+	Failed     int64            `json:"failed"`
+	Versions   map[string]int64 `json:"versions"`
+	Handshake  histogramView    `json:"handshake"`
+}
+
+func (t *tlsTracker) snapshot() []tlsSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]tlsSnapshot, 0, len(t.hosts))
+	for host, h := range t.hosts {
+		s := tlsSnapshot{Host: host, Handshakes: h.handshakes, Resumed: h.resumed, Failed: h.failed, Versions: make(map[string]int64, len(h.versions)), Handshake: h.latency.view()}
+		for v, n := range h.versions {
+			s.Versions[v] = n
+		}
+		if ok := h.handshakes - h.failed; ok > 0 {
+			s.ResumeRate = float64(h.resumed) / float64(ok)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// Records the TLS handshakes the fetch of ctx makes with host
+func traceTLS(ctx context.Context, host string) context.Context {
+	var start time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { start = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			tlsStats.record(host, time.Since(start), state, err)
+		},
+	})
+}
+
+func init() {
+	upstreamMetrics.Set("tls", expvar.Func(func() interface{} { return tlsStats.snapshot() }))
+}
+
+// Handshakes per upstream host: how many, how many resumed a session, their latency and the
+// negotiated protocol versions
+func upstreamTLSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"hosts": tlsStats.snapshot()})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSStats(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(simpleHandler([]int{1})))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	host := ts.Listener.Addr().String()
+	o, _ := parseOptions(nil)
+	tests := []struct {
+		name                string
+		minVersion          uint16
+		sessions            int
+		handshakes, resumed int64
+		failed              int64
+	}{
+		{name: "resumed", minVersion: tls.VersionTLS12, sessions: 16, handshakes: 2, resumed: 1},
+		{name: "no session cache", minVersion: tls.VersionTLS12, handshakes: 2},
+		{name: "too old", minVersion: tls.VersionTLS13, handshakes: 2, failed: 2},
+	}
+	for _, tt := range tests {
+		tlsStats = &tlsTracker{hosts: make(map[string]*hostTLS)}
+		c := transportCfg
+		c.minTLSVersion, c.tlsSessionCache = tt.minVersion, tt.sessions
+		tr := newTransport(c)
+		tr.TLSClientConfig.RootCAs = roots
+		for i := 0; i < 2; i++ {
+			_, err := fetch(context.Background(), tr, o, ts.URL)
+			if (err != nil) != (tt.failed > 0) {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			// The next fetch needs a new connection
+			tr.CloseIdleConnections()
+		}
+		hosts := tlsStats.snapshot()
+		if len(hosts) != 1 {
+			t.Fatalf("%s: expected stats for one host; got %+v", tt.name, hosts)
+		}
+		h := hosts[0]
+		if h.Host != host || h.Handshakes != tt.handshakes || h.Resumed != tt.resumed || h.Failed != tt.failed {
+			t.Errorf("%s: expected %d handshakes, %d resumed and %d failed; got %+v", tt.name, tt.handshakes, tt.resumed, tt.failed, h)
+		}
+		if tt.failed == 0 && h.Versions["TLS 1.2"] != tt.handshakes {
+			t.Errorf("%s: expected TLS 1.2; got %v", tt.name, h.Versions)
+		}
+	}
+	tlsStats = &tlsTracker{hosts: make(map[string]*hostTLS)}
+}
+
+func TestTLSVersionFlag(t *testing.T) {
+	var v uint16
+	f := tlsVersionFlag{&v}
+	if err := f.Set("1.3"); err != nil || v != tls.VersionTLS13 || f.String() != "1.3" {
+		t.Errorf("expected TLS 1.3; got %x, %v", v, err)
+	}
+	if err := f.Set("1.4"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timeline of the internal events of one request, returned under _trace with ?trace=true.
+// A nil *tracer records nothing, so call sites don't need to check whether tracing is on.
+type tracer struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []traceEvent
+}
+
+type traceEvent struct {
+	AtMS  float64 `json:"at_ms"`
+	Event string  `json:"event"`
+	URL   string  `json:"url,omitempty"`
+	// Remote address of the connection, for connected events
+	Addr string `json:"addr,omitempty"`
+}
+
+func newTracer(start time.Time) *tracer {
+	return &tracer{start: start}
+}
+
+func (t *tracer) mark(event, url string) {
+	if t == nil {
+		return
+	}
+	at := float64(time.Since(t.start)) / float64(time.Millisecond)
+	t.mu.Lock()
+	t.events = append(t.events, traceEvent{AtMS: at, Event: event, URL: redact(url)})
+	t.mu.Unlock()
+}
+
+func (t *tracer) markAddr(event, url, addr string) {
+	if t == nil {
+		return
+	}
+	at := float64(time.Since(t.start)) / float64(time.Millisecond)
+	t.mu.Lock()
+	t.events = append(t.events, traceEvent{AtMS: at, Event: event, URL: redact(url), Addr: addr})
+	t.mu.Unlock()
+}
+
+func (t *tracer) timeline() []traceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]traceEvent(nil), t.events...)
+}
+
+type traceKeyType struct{}
+
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	return context.WithValue(ctx, traceKeyType{}, t)
+}
+
+func tracerFrom(ctx context.Context) *tracer {
+	t, _ := ctx.Value(traceKeyType{}).(*tracer)
+	return t
+}
+
+// Adds a first byte hook for url when the request is traced
+func traceFetch(ctx context.Context, url string) context.Context {
+	t := tracerFrom(ctx)
+	if t == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { t.mark("first_byte", url) },
+	})
+}
+
+// Encodes v, then appends the timeline, including the encode itself, as a _trace field
+func writeTraced(w io.Writer, v interface{}, t *tracer) error {
+	if t == nil {
+		return json.NewEncoder(w).Encode(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.mark("encode_done", "")
+	tl, err := json.Marshal(t.timeline())
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimSuffix(b, []byte("}"))
+	if len(b) > 1 {
+		b = append(b, ',')
+	}
+	b = append(b, `"_trace":`...)
+	b = append(b, tl...)
+	b = append(b, "}\n"...)
+	_, err = w.Write(b)
+	return err
+}
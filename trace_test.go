@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceTimeline(t *testing.T) {
+	ts := newNumbersServer([]int{2, 1})
+	defer ts.Close()
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?trace=true&u="+ts.URL, nil))
+	var body struct {
+		Numbers []int        `json:"numbers"`
+		Trace   []traceEvent `json:"_trace"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(body.Numbers) != 2 {
+		t.Errorf("unexpected numbers %v", body.Numbers)
+	}
+	expected := []string{"dispatch", "first_byte", "decode_done", "merge_done", "sort_done", "encode_done"}
+	if len(body.Trace) != len(expected) {
+		t.Fatalf("expected %v; got %+v", expected, body.Trace)
+	}
+	for i, e := range expected {
+		if body.Trace[i].Event != e {
+			t.Errorf("event %d: expected %s; got %s", i, e, body.Trace[i].Event)
+		}
+		if i > 0 && body.Trace[i].AtMS < body.Trace[i-1].AtMS {
+			t.Errorf("timeline goes backwards at %s", e)
+		}
+	}
+	if body.Trace[0].URL != ts.URL {
+		t.Errorf("expected the dispatch to name the URL; got %q", body.Trace[0].URL)
+	}
+}
+
+func TestWriteTracedEmptyObject(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeTraced(&buf, struct{}{}, newTracer(time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Errorf("invalid JSON %s: %v", buf.String(), err)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *tracer
+	tr.mark("dispatch", "")
+	var buf bytes.Buffer
+	writeTraced(&buf, map[string]int{"a": 1}, tr)
+	if buf.String() != "{\"a\":1}\n" {
+		t.Errorf("unexpected output %s", buf.String())
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Longest transform a group may configure
+const maxTransformLength = 1000
+
+// Per-value normalization of a source's numbers before they are merged, configured as stages
+// separated by "|". Every stage is an expression over the value x: an integer expression
+// replaces the value, a condition keeps only the values it holds for. For example
+// "x * 100 | x >= 0" scales every value and then drops the negative ones.
+//
+// Expressions have integer literals, + - * / %, comparisons, && || !, parentheses and the
+// functions abs(a), min(a, b) and max(a, b). Arithmetic wraps around like Go's int, a value
+// for which a stage divides by zero is dropped.
+type transform struct {
+	stages []stage
+}
+
+// One compiled stage. Exactly one of value and cond is set.
+type stage struct {
+	value func(x int) (int, bool)
+	cond  func(x int) (bool, bool)
+}
+
+func parseTransform(src string) (*transform, error) {
+	if len(src) > maxTransformLength {
+		return nil, fmt.Errorf("transform is longer than %d characters", maxTransformLength)
+	}
+	t := &transform{}
+	for _, part := range splitStages(src) {
+		p := &exprParser{src: part}
+		if err := p.tokenize(); err != nil {
+			return nil, err
+		}
+		e, err := p.parse(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.tokens) {
+			return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.pos], strings.TrimSpace(part))
+		}
+		t.stages = append(t.stages, stage{value: e.value, cond: e.cond})
+	}
+	return t, nil
+}
+
+// Splits at every "|" that isn't part of "||"
+func splitStages(src string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(src); i++ {
+		if src[i] != '|' {
+			continue
+		}
+		if i+1 < len(src) && src[i+1] == '|' {
+			i++
+			continue
+		}
+		parts = append(parts, src[start:i])
+		start = i + 1
+	}
+	return append(parts, src[start:])
+}
+
+// Transforms values in place and returns the values that weren't dropped
+func (t *transform) apply(values []int) []int {
+	if t == nil {
+		return values
+	}
+	out := values[:0]
+next:
+	for _, x := range values {
+		for _, s := range t.stages {
+			if s.value != nil {
+				v, ok := s.value(x)
+				if !ok {
+					continue next
+				}
+				x = v
+				continue
+			}
+			if keep, ok := s.cond(x); !ok || !keep {
+				continue next
+			}
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// A typed expression: value is set for integer expressions, cond for conditions. The bool
+// they return is false when the value has to be dropped, e.g. after a division by zero.
+type expr struct {
+	value func(x int) (int, bool)
+	cond  func(x int) (bool, bool)
+}
+
+type exprParser struct {
+	src    string
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || unicode.IsLetter(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		default:
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					p.tokens = append(p.tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!(),", c) {
+				return fmt.Errorf("unexpected %q in transform", c)
+			}
+			p.tokens = append(p.tokens, string(c))
+			i++
+		}
+	}
+	if len(p.tokens) == 0 {
+		return errors.New("empty transform stage")
+	}
+	return nil
+}
+
+// Binding power of the binary operators
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		if got == "" {
+			return fmt.Errorf("expected %q at the end of %q", tok, strings.TrimSpace(p.src))
+		}
+		return fmt.Errorf("expected %q, got %q in %q", tok, got, strings.TrimSpace(p.src))
+	}
+	return nil
+}
+
+// Precedence climbing parser, binds operators stronger than min
+func (p *exprParser) parse(min int) (expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return expr{}, err
+	}
+	for {
+		op := p.peek()
+		prec, ok := exprPrecedence[op]
+		if !ok || prec <= min {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parse(prec)
+		if err != nil {
+			return expr{}, err
+		}
+		if left, err = binaryExpr(op, left, right); err != nil {
+			return expr{}, fmt.Errorf("%v in %q", err, strings.TrimSpace(p.src))
+		}
+	}
+}
+
+func (p *exprParser) unary() (expr, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return expr{}, fmt.Errorf("incomplete expression %q", strings.TrimSpace(p.src))
+	case tok == "-":
+		e, err := p.unary()
+		if err != nil || e.value == nil {
+			return expr{}, orTypeError(err, "- needs an integer")
+		}
+		return expr{value: func(x int) (int, bool) { v, ok := e.value(x); return -v, ok }}, nil
+	case tok == "!":
+		e, err := p.unary()
+		if err != nil || e.cond == nil {
+			return expr{}, orTypeError(err, "! needs a condition")
+		}
+		return expr{cond: func(x int) (bool, bool) { v, ok := e.cond(x); return !v, ok }}, nil
+	case tok == "(":
+		e, err := p.parse(0)
+		if err != nil {
+			return expr{}, err
+		}
+		return e, p.expect(")")
+	case tok == "x":
+		return expr{value: func(x int) (int, bool) { return x, true }}, nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		n, err := strconv.Atoi(tok)
+		if err != nil {
+			return expr{}, fmt.Errorf("invalid number %q", tok)
+		}
+		return expr{value: func(int) (int, bool) { return n, true }}, nil
+	case tok == "abs" || tok == "min" || tok == "max":
+		return p.call(tok)
+	}
+	return expr{}, fmt.Errorf("unknown name %q in %q, expected x, a number or abs, min, max", tok, strings.TrimSpace(p.src))
+}
+
+func (p *exprParser) call(name string) (expr, error) {
+	if err := p.expect("("); err != nil {
+		return expr{}, err
+	}
+	var args []func(int) (int, bool)
+	for {
+		e, err := p.parse(0)
+		if err != nil {
+			return expr{}, err
+		}
+		if e.value == nil {
+			return expr{}, fmt.Errorf("%s needs integer arguments", name)
+		}
+		args = append(args, e.value)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return expr{}, err
+	}
+	if want := map[string]int{"abs": 1, "min": 2, "max": 2}[name]; len(args) != want {
+		return expr{}, fmt.Errorf("%s takes %d arguments, got %d", name, want, len(args))
+	}
+	if name == "abs" {
+		a := args[0]
+		return expr{value: func(x int) (int, bool) {
+			v, ok := a(x)
+			if v < 0 {
+				v = -v
+			}
+			return v, ok
+		}}, nil
+	}
+	a, b := args[0], args[1]
+	return expr{value: func(x int) (int, bool) {
+		va, oka := a(x)
+		vb, okb := b(x)
+		if (name == "min") == (vb < va) {
+			va = vb
+		}
+		return va, oka && okb
+	}}, nil
+}
+
+func orTypeError(err error, msg string) error {
+	if err != nil {
+		return err
+	}
+	return errors.New(msg)
+}
+
+func binaryExpr(op string, l, r expr) (expr, error) {
+	switch op {
+	case "&&", "||":
+		if l.cond == nil || r.cond == nil {
+			return expr{}, fmt.Errorf("%s needs conditions", op)
+		}
+		and := op == "&&"
+		return expr{cond: func(x int) (bool, bool) {
+			a, ok := l.cond(x)
+			if !ok || a != and {
+				return a, ok
+			}
+			return r.cond(x)
+		}}, nil
+	}
+	if l.value == nil || r.value == nil {
+		return expr{}, fmt.Errorf("%s needs integers", op)
+	}
+	a, b := l.value, r.value
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		cmp := comparisons[op]
+		return expr{cond: func(x int) (bool, bool) {
+			va, oka := a(x)
+			vb, okb := b(x)
+			return cmp(va, vb), oka && okb
+		}}, nil
+	}
+	arith := arithmetic[op]
+	return expr{value: func(x int) (int, bool) {
+		va, oka := a(x)
+		vb, okb := b(x)
+		if !oka || !okb {
+			return 0, false
+		}
+		return arith(va, vb)
+	}}, nil
+}
+
+var comparisons = map[string]func(a, b int) bool{
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+	"<":  func(a, b int) bool { return a < b },
+	"<=": func(a, b int) bool { return a <= b },
+	">":  func(a, b int) bool { return a > b },
+	">=": func(a, b int) bool { return a >= b },
+}
+
+var arithmetic = map[string]func(a, b int) (int, bool){
+	"+": func(a, b int) (int, bool) { return a + b, true },
+	"-": func(a, b int) (int, bool) { return a - b, true },
+	"*": func(a, b int) (int, bool) { return a * b, true },
+	"/": func(a, b int) (int, bool) {
+		if b == 0 {
+			return 0, false
+		}
+		return a / b, true
+	},
+	"%": func(a, b int) (int, bool) {
+		if b == 0 {
+			return 0, false
+		}
+		return a % b, true
+	},
+}
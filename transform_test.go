@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	in := []int{-3, 0, 2, 5, 10}
+	tests := []struct {
+		src  string
+		want []int
+	}{
+		{src: "x * 100 | x >= 0", want: []int{0, 200, 500, 1000}},
+		{src: "x", want: []int{-3, 0, 2, 5, 10}},
+		{src: "x % 2 == 0", want: []int{0, 2, 10}},
+		{src: "!(x < 0) && x != 5 || x == -3", want: []int{-3, 0, 2, 10}},
+		{src: "(x + 1) * -2", want: []int{4, -2, -6, -12, -22}},
+		{src: "abs(x) | min(x, 4)", want: []int{3, 0, 2, 4, 4}},
+		{src: "max(x, 1) - 1", want: []int{0, 0, 1, 4, 9}},
+		// Division by zero drops the value
+		{src: "100 / x", want: []int{-33, 50, 20, 10}},
+		{src: "10 % x == 0", want: []int{2, 5, 10}},
+	}
+	for _, tt := range tests {
+		tr, err := parseTransform(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got := tr.apply(append([]int(nil), in...)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v; got %v", tt.src, tt.want, got)
+		}
+	}
+}
+
+func TestParseTransformErrors(t *testing.T) {
+	for _, src := range []string{"", "x |", "y * 2", "x * (2", "x && 1", "!x", "-(x > 1)", "x > 1 + (x < 2)", "abs(x, 1)", "max(x)", "min(x > 1, 2)", "x $ 2", "x 2", "99999999999999999999"} {
+		if _, err := parseTransform(src); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestGroupTransform(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{-1, 2, 3})))
+	defer ts.Close()
+	defer groups.set(groups.all())
+	all := map[string]group{"cents": {URLs: []string{ts.URL}, Transform: "x * 100 | x > 0"}}
+	if err := validateGroups(all); err != nil {
+		t.Fatal(err)
+	}
+	groups.set(all)
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?g=cents", nil))
+	var res result
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.equals(result{Numbers: []int{200, 300}}) {
+		t.Errorf("expected transformed numbers; got %v", res.Numbers)
+	}
+	conflict := map[string]group{"a": {URLs: []string{ts.URL}, Transform: "x * 2"}, "b": {URLs: []string{ts.URL}}}
+	if err := validateGroups(conflict); err == nil {
+		t.Error("expected an error for a source transformed differently by two groups")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timeouts for the outbound transport. Each phase of the connection gets its own budget so that
+// a dead host can't eat the whole request deadline during TCP or TLS setup.
+type transportConfig struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	expectContinueTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConnsPerHost   int
+	// Oldest TLS version upstreams may negotiate and TLS sessions kept for resumption, 0 disables it
+	minTLSVersion   uint16
+	tlsSessionCache int
+	// Address families dials may use and how long the preferred one gets before the other is tried
+	ipFamily      string
+	fallbackDelay time.Duration
+}
+
+var transportCfg = transportConfig{
+	dialTimeout:           5 * time.Second,
+	tlsHandshakeTimeout:   5 * time.Second,
+	expectContinueTimeout: time.Second,
+	idleConnTimeout:       90 * time.Second,
+	maxIdleConnsPerHost:   maxConnections,
+	minTLSVersion:         tls.VersionTLS12,
+	tlsSessionCache:       1024,
+	ipFamily:              familyAny,
+	fallbackDelay:         300 * time.Millisecond,
+}
+
+// Transport shared by all requests so that keep-alive connections to upstreams are reused.
+// main rebuilds it once the flags are parsed, a snapshot restore may replace it at runtime.
+var (
+	transportMu       sync.RWMutex
+	upstreamTransport = newTransport(transportCfg)
+	activeTransport   = transportCfg
+)
+
+func currentTransport() *http.Transport {
+	transportMu.RLock()
+	defer transportMu.RUnlock()
+	return upstreamTransport
+}
+
+func currentTransportConfig() transportConfig {
+	transportMu.RLock()
+	defer transportMu.RUnlock()
+	return activeTransport
+}
+
+// Swaps in a transport built from c. Requests in flight keep using the old one, whose idle
+// connections are closed.
+func setTransportConfig(c transportConfig) {
+	t := newTransport(c)
+	transportMu.Lock()
+	old := upstreamTransport
+	upstreamTransport, activeTransport = t, c
+	transportMu.Unlock()
+	old.CloseIdleConnections()
+}
+
+func (c *transportConfig) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.dialTimeout, "transport.dial-timeout", c.dialTimeout, "timeout for establishing TCP connections to upstreams")
+	fs.DurationVar(&c.tlsHandshakeTimeout, "transport.tls-handshake-timeout", c.tlsHandshakeTimeout, "timeout for the TLS handshake with upstreams")
+	fs.DurationVar(&c.expectContinueTimeout, "transport.expect-continue-timeout", c.expectContinueTimeout, "time to wait for a 100-continue from upstreams")
+	fs.DurationVar(&c.idleConnTimeout, "transport.idle-conn-timeout", c.idleConnTimeout, "how long idle upstream connections are kept open")
+	fs.IntVar(&c.maxIdleConnsPerHost, "transport.max-idle-conns-per-host", c.maxIdleConnsPerHost, "idle connections kept per upstream host")
+	fs.Var(tlsVersionFlag{&c.minTLSVersion}, "transport.min-tls", "oldest TLS version upstreams may negotiate: 1.0, 1.1, 1.2 or 1.3")
+	fs.IntVar(&c.tlsSessionCache, "transport.tls-session-cache", c.tlsSessionCache, "TLS sessions kept to resume handshakes with upstreams, 0 disables resumption")
+	fs.Var(ipFamilyFlag{&c.ipFamily}, "transport.ip-family", "address families upstream dials use: any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+	fs.DurationVar(&c.fallbackDelay, "transport.fallback-delay", c.fallbackDelay, "head start of the preferred address family before the other one is dialed too, negative only falls back once the preferred family failed")
+}
+
+// Create the http transport used to talk to upstreams. The header timeout is the server policy
+// bound, tighter per-request limits are applied through the request context.
+func newTransport(c transportConfig) *http.Transport {
+	d := &net.Dialer{
+		Timeout:   c.dialTimeout,
+		KeepAlive: 30 * time.Second,
+		// Only used by Happy Eyeballs in the any family, where negative disables it too
+		FallbackDelay: c.fallbackDelay,
+	}
+	tc := &tls.Config{MinVersion: c.minTLSVersion}
+	if c.tlsSessionCache > 0 {
+		tc.ClientSessionCache = tls.NewLRUClientSessionCache(c.tlsSessionCache)
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       tc,
+		DialContext:           sockets.dialer(pinnedDialer(familyDialer(d.DialContext, c.ipFamily, c.fallbackDelay), c.ipFamily)),
+		MaxIdleConnsPerHost:   c.maxIdleConnsPerHost,
+		TLSHandshakeTimeout:   c.tlsHandshakeTimeout,
+		ExpectContinueTimeout: c.expectContinueTimeout,
+		IdleConnTimeout:       c.idleConnTimeout,
+		// Timeout for individual requests
+		ResponseHeaderTimeout: headerTimeout(),
+	}
+}
+
+// Trace hook counting whether upstream requests got a fresh or a pooled connection
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		if info.Reused {
+			upstreamMetrics.Add("conns_reused", 1)
+		} else {
+			upstreamMetrics.Add("conns_new", 1)
+		}
+	},
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSharedTransportReusesConnections(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 2, 3})))
+	defer ts.Close()
+	before := counter(upstreamMetrics.Get("conns_reused"))
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, localhost+"?u="+ts.URL, nil)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		numbersHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status OK; got %v", rec.Code)
+		}
+	}
+	if after := counter(upstreamMetrics.Get("conns_reused")); after <= before {
+		t.Errorf("expected the second request to reuse a connection; reused count stayed at %d", after)
+	}
+}
+
+func counter(v expvar.Var) int64 {
+	if i, ok := v.(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"net/http"
+)
+
+// Single page that runs an aggregation with verbose=all&trace=true and draws the result
+//
+//go:embed ui/index.html
+var uiPage []byte
+
+// Serve the page on /ui. Set by -ui.
+var uiEnabled bool
+
+func registerUIFlags(fs *flag.FlagSet, enabled *bool) {
+	fs.BoolVar(enabled, "ui", false, "serve a small dashboard on /ui to run aggregations from a browser")
+}
+
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(uiPage)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUIHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ui", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected /ui to be off by default; got %v", rec.Code)
+	}
+	uiEnabled = true
+	defer func() { uiEnabled = false }()
+	rec = httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ui", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected the page; got %v %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `fetch("numbers?"`) {
+		t.Errorf("expected the page to query /numbers relative to /ui")
+	}
+}
+
+// The page draws the per-source timeline from these fields
+func TestUIResponseFields(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{3, 1})))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer bad.Close()
+	q := url.Values{"u": {good.URL, bad.URL}, "verbose": {"all"}, "trace": {"true"}}
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil))
+	var body struct {
+		DurationMS *float64 `json:"duration_ms"`
+		Errors     []struct {
+			URL  string `json:"url"`
+			Code string `json:"code"`
+		} `json:"errors"`
+		Trace []traceEvent `json:"_trace"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if body.DurationMS == nil || len(body.Errors) != 1 || body.Errors[0].URL != bad.URL {
+		t.Errorf("expected duration_ms and the error of %s; got %s", bad.URL, rec.Body.String())
+	}
+	events := make(map[string]bool)
+	for _, ev := range body.Trace {
+		if ev.URL == good.URL {
+			events[ev.Event] = true
+		}
+	}
+	for _, ev := range []string{"dispatch", "first_byte", "decode_done"} {
+		if !events[ev] {
+			t.Errorf("expected a %s event for %s; got %+v", ev, good.URL, body.Trace)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Set in a process started by an upgrade: 1 when fd 4 is the listener of the process it replaces,
+// 0 when that process didn't serve HTTP. fd 3 is a pipe to report readiness on.
+const upgradeEnv = "TA_GO_UPGRADE"
+
+// Time the new process has to start up and report readiness
+const upgradeTimeout = 30 * time.Second
+
+// Pipe to the process this one replaces, nil unless started by an upgrade
+var upgradeReady *os.File
+
+func registerUpgradeFlags(fs *flag.FlagSet, drain *time.Duration) {
+	fs.DurationVar(drain, "upgrade.drain-timeout", time.Minute, "time in-flight requests get to finish after SIGHUP handed the listener to a new process")
+}
+
+// Listener handed over by the process this one replaces, nil when there was none
+func inheritedListener() (net.Listener, error) {
+	mode, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+	upgradeReady = os.NewFile(3, "upgrade-ready")
+	if mode != "1" {
+		return nil, nil
+	}
+	f := os.NewFile(4, "upgrade-listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener - %v", err)
+	}
+	log.Printf("upgrade: serving on inherited socket %s", l.Addr())
+	return l, nil
+}
+
+// Tells the process this one replaces to stop accepting and drain
+func signalUpgradeReady() {
+	if upgradeReady == nil {
+		return
+	}
+	upgradeReady.Write([]byte{1})
+	upgradeReady.Close()
+	upgradeReady = nil
+}
+
+// Blocks until SIGHUP started a new process of the same binary which took over l and is ready
+// to serve. Failed upgrades are logged and this process keeps serving.
+func awaitUpgrade(l net.Listener) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for range hup {
+		if err := upgrade(l); err != nil {
+			log.Printf("upgrade: failed, still serving - %v", err)
+			continue
+		}
+		return
+	}
+}
+
+var upgrading sync.Mutex
+
+func upgrade(l net.Listener) error {
+	upgrading.Lock()
+	defer upgrading.Unlock()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files := []*os.File{w}
+	mode := "0"
+	if l != nil {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			w.Close()
+			return fmt.Errorf("can't hand over a %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			w.Close()
+			return err
+		}
+		defer f.Close()
+		files, mode = append(files, f), "1"
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+mode)
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	// Only the child may hold the write end, so that its exit closes the pipe
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("upgrade: started %s as pid %d, waiting for it to be ready", exe, cmd.Process.Pid)
+	if err := waitReady(r, upgradeTimeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	log.Printf("upgrade: pid %d took over, draining", cmd.Process.Pid)
+	return nil
+}
+
+// Waits for the readiness byte of a new process. The pipe is closed without one when the
+// process exits during startup.
+func waitReady(r *os.File, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := r.Read(b); n == 1 {
+			done <- nil
+			return
+		}
+		done <- errors.New("new process exited before it was ready")
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("new process wasn't ready within %v", timeout)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		child   func(w *os.File)
+		wantErr bool
+	}{
+		{name: "Ready", child: func(w *os.File) { w.Write([]byte{1}); w.Close() }},
+		{name: "Exited", child: func(w *os.File) { w.Close() }, wantErr: true},
+		{name: "Timeout", child: func(w *os.File) {}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			defer w.Close()
+			go tt.child(w)
+			if err := waitReady(r, 100*time.Millisecond); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestListenWithoutAddress(t *testing.T) {
+	l, err := listen("")
+	if l != nil || err != nil {
+		t.Errorf("expected no listener; got %v, %v", l, err)
+	}
+}
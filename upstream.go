@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// How outbound requests are shaped and which responses are accepted
+type upstreamPolicy struct {
+	// Identifies this aggregator to source owners
+	userAgent string
+	contact   string
+	// Send the client address in X-Forwarded-For. Off by default as it leaks client addresses.
+	forwardClient bool
+	accept        string
+	// Extra request headers, e.g. content hints like Prefer
+	headers http.Header
+	// Media types a response may declare. Patterns like application/*+json or text/* are allowed.
+	// A response without Content-Type is always accepted.
+	contentTypes []string
+	// URL schemes sources may use, e.g. only https in production
+	schemes []string
+	// Share one fetch of a URL between the requests needing it at the same time
+	coalesce bool
+	// Dispatch the hosts adding the most values first when a fan-out exceeds the free workers
+	prioritize bool
+}
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var upstream = upstreamPolicy{
+	userAgent:    "ta-go",
+	contact:      "https://github.com/karthikraobr/ta-go",
+	accept:       "application/json",
+	headers:      http.Header{},
+	contentTypes: []string{"application/json", "application/*+json", "text/json", "text/plain", "application/cbor", "application/msgpack", "application/x-msgpack", "application/vnd.msgpack", "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+	schemes:      []string{"http", "https"},
+}
+
+// Collects repeated "Name: value" flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlag) Set(v string) error {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("invalid header %q, expected Name: value", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// Comma separated list flag
+type listFlag struct {
+	values *[]string
+}
+
+func (l listFlag) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l listFlag) Set(v string) error {
+	*l.values = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l.values = append(*l.values, s)
+		}
+	}
+	return nil
+}
+
+func (p *upstreamPolicy) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.userAgent, "upstream.user-agent", p.userAgent, "product name in the User-Agent sent to upstreams, the version is appended")
+	fs.StringVar(&p.contact, "upstream.contact", p.contact, "contact URL included in the User-Agent")
+	fs.BoolVar(&p.forwardClient, "upstream.forward-client", p.forwardClient, "send the client address to upstreams in X-Forwarded-For")
+	fs.StringVar(&p.accept, "upstream.accept", p.accept, "Accept header sent to upstreams")
+	fs.Var(headerFlag(p.headers), "upstream.header", "extra \"Name: value\" header sent to upstreams, repeatable")
+	fs.Var(listFlag{&p.contentTypes}, "upstream.content-types", "comma separated media types accepted from upstreams")
+	fs.Var(listFlag{&p.schemes}, "upstream.allowed-schemes", "comma separated URL schemes sources may use, https forbids plaintext sources")
+	fs.BoolVar(&p.coalesce, "upstream.coalesce", p.coalesce, "share one fetch of a URL between concurrent requests needing it instead of fetching it for each")
+	fs.BoolVar(&p.prioritize, "upstream.prioritize", p.prioritize, "when a fan-out has more URLs than free workers, dispatch the hosts that historically add the most values first")
+}
+
+// Rejects sources whose scheme the deployment doesn't allow, before anything is sent
+func (p *upstreamPolicy) checkScheme(u *url.URL) error {
+	for _, s := range p.schemes {
+		if strings.EqualFold(s, u.Scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("scheme %q is not allowed, expected one of %s", u.Scheme, strings.Join(p.schemes, ","))
+}
+
+// e.g. "ta-go/1.2.0 (+https://github.com/karthikraobr/ta-go)"
+func (p *upstreamPolicy) userAgentHeader() string {
+	ua := p.userAgent + "/" + version
+	if p.contact != "" {
+		ua += " (+" + p.contact + ")"
+	}
+	return ua
+}
+
+// Applies the outbound headers to req
+func (p *upstreamPolicy) prepare(req *http.Request) {
+	req.Header.Set("User-Agent", p.userAgentHeader())
+	req.Header.Set("Via", "1.1 "+p.userAgent)
+	if ip := clientIPFrom(req.Context()); p.forwardClient && ip != "" {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	if p.accept != "" {
+		req.Header.Set("Accept", p.accept)
+	}
+	for name, values := range p.headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+}
+
+// Rejects responses declaring a media type we can't decode, such as HTML error pages
+func (p *upstreamPolicy) checkContentType(res *http.Response) error {
+	ct := res.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q", ct)
+	}
+	for _, pattern := range p.contentTypes {
+		if matchMediaType(pattern, mt) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected content type %q", mt)
+}
+
+// Matches type/subtype against a pattern with an optional * in the subtype, e.g. text/* or application/*+json
+func matchMediaType(pattern, mt string) bool {
+	pattern = strings.ToLower(pattern)
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return pattern == mt
+	}
+	return len(mt) >= len(pattern)-1 && strings.HasPrefix(mt, pattern[:i]) && strings.HasSuffix(mt, pattern[i+1:])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchMediaType(t *testing.T) {
+	tt := []struct {
+		pattern, mt string
+		match       bool
+	}{
+		{"application/json", "application/json", true},
+		{"application/*+json", "application/problem+json", true},
+		{"application/*+json", "application/json", false},
+		{"text/*", "text/html", true},
+		{"text/plain", "text/html", false},
+	}
+	for _, tc := range tt {
+		if got := matchMediaType(tc.pattern, tc.mt); got != tc.match {
+			t.Errorf("%s against %s: expected %v", tc.mt, tc.pattern, tc.match)
+		}
+	}
+}
+
+func TestContentTypeRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html>503</html>`))
+	}))
+	defer ts.Close()
+	errs := verboseErrors(t, endpoint+"?verbose=errors&u="+ts.URL)
+	if len(errs) != 1 || errs[0].Code != codeContentType {
+		t.Errorf("expected a content_type error; got %+v", errs)
+	}
+}
+
+func TestSchemePolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1})))
+	defer ts.Close()
+	defer func(schemes []string) { upstream.schemes = schemes }(upstream.schemes)
+	upstream.schemes = []string{"https"}
+	errs := verboseErrors(t, endpoint+"?verbose=errors&u="+ts.URL)
+	if len(errs) != 1 || errs[0].Code != codePolicy || errs[0].URL != ts.URL {
+		t.Errorf("expected a policy error; got %+v", errs)
+	}
+	upstream.schemes = []string{"HTTP"}
+	if errs := verboseErrors(t, endpoint+"?verbose=errors&u="+ts.URL); len(errs) != 0 {
+		t.Errorf("expected schemes to match regardless of case; got %+v", errs)
+	}
+}
+
+func TestOutboundHeaders(t *testing.T) {
+	p := upstreamPolicy{headers: http.Header{}}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	p.registerFlags(fs)
+	if err := fs.Parse([]string{"-upstream.accept=application/x-numbers", "-upstream.header=Prefer: compact", "-upstream.content-types=application/x-numbers"}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://upstream", nil)
+	p.prepare(req)
+	if req.Header.Get("Accept") != "application/x-numbers" || req.Header.Get("Prefer") != "compact" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+	if len(p.contentTypes) != 1 || p.contentTypes[0] != "application/x-numbers" {
+		t.Errorf("unexpected content types %v", p.contentTypes)
+	}
+	if err := fs.Parse([]string{"-upstream.header=nonsense"}); err == nil {
+		t.Error("expected an error for a malformed header")
+	}
+}
+
+func TestIdentificationHeaders(t *testing.T) {
+	p := upstreamPolicy{userAgent: "ta-go", contact: "https://example.com/contact", forwardClient: true, headers: http.Header{}}
+	req := httptest.NewRequest(http.MethodGet, "http://upstream", nil)
+	req = req.WithContext(withClientIP(req.Context(), "192.0.2.7"))
+	p.prepare(req)
+	if ua := req.Header.Get("User-Agent"); ua != "ta-go/"+version+" (+https://example.com/contact)" {
+		t.Errorf("unexpected User-Agent %q", ua)
+	}
+	if req.Header.Get("Via") != "1.1 ta-go" || req.Header.Get("X-Forwarded-For") != "192.0.2.7" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+	p.forwardClient = false
+	req = httptest.NewRequest(http.MethodGet, "http://upstream", nil)
+	req = req.WithContext(withClientIP(req.Context(), "192.0.2.7"))
+	p.prepare(req)
+	if req.Header.Get("X-Forwarded-For") != "" {
+		t.Error("client address forwarded although disabled")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Payloads of a group's webhook
+const (
+	webhookPayloadDelta  = "delta"
+	webhookPayloadCounts = "counts"
+)
+
+// Time a webhook receiver has to answer
+const webhookTimeout = 5 * time.Second
+
+// Called by a scheduled group whenever its result changed
+type webhookConfig struct {
+	URL string `json:"url"`
+	// delta, the default, sends the added and removed values, counts only how many there are
+	Payload string `json:"payload,omitempty"`
+}
+
+func (c *webhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, expected an http or https URL", c.URL)
+	}
+	if c.Payload != "" && c.Payload != webhookPayloadDelta && c.Payload != webhookPayloadCounts {
+		return fmt.Errorf("invalid payload %q, expected delta or counts", c.Payload)
+	}
+	return nil
+}
+
+// Body of a webhook in counts mode
+type deltaCounts struct {
+	Group   string     `json:"group"`
+	Since   *time.Time `json:"since"`
+	At      time.Time  `json:"at"`
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+	Total   int        `json:"total"`
+}
+
+// Body of a webhook in delta mode
+type webhookDelta struct {
+	delta
+	At time.Time `json:"at"`
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// POSTs what changed in the result of group name since prev to its webhook, if it has one and
+// anything changed. Failures are logged and counted, the change isn't sent again.
+func notifyWebhook(name string, c *webhookConfig, prev *snapshot, cur snapshot) {
+	if c == nil {
+		return
+	}
+	var previous []int
+	var since *time.Time
+	if prev != nil {
+		since, previous = &prev.At, prev.Numbers
+	}
+	added, removed := diff(previous, cur.Numbers)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	var v interface{} = webhookDelta{delta: delta{Group: name, Since: since, Added: added, Removed: removed}, At: cur.At}
+	if c.Payload == webhookPayloadCounts {
+		v = deltaCounts{Group: name, Since: since, At: cur.At, Added: len(added), Removed: len(removed), Total: len(cur.Numbers)}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("webhook: group %s could not be encoded - %v", name, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("webhook: group %s - %v", name, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", upstream.userAgentHeader())
+	res, err := webhookClient.Do(req)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			err = fmt.Errorf("receiver answered %s", res.Status)
+		}
+	}
+	if err != nil {
+		webhookMetrics.Add("failed", 1)
+		log.Printf("webhook: change of group %s not delivered to %s - %v", name, redact(c.URL), err)
+		return
+	}
+	webhookMetrics.Add("sent", 1)
+}
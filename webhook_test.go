@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	defer func(h *historyStore) { history = h }(history)
+	var mu sync.Mutex
+	var got []map[string]interface{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&v)
+		mu.Lock()
+		got = append(got, v)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	var values []int
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(result{Numbers: values})
+	}))
+	defer source.Close()
+	down := httptest.NewServer(http.HandlerFunc(errHandler()))
+	defer down.Close()
+	for _, payload := range []string{webhookPayloadDelta, webhookPayloadCounts} {
+		history = newHistoryStore()
+		got = nil
+		gr := group{URLs: []string{source.URL}, Refresh: duration(time.Minute), Webhook: &webhookConfig{URL: receiver.URL, Payload: payload}}
+		// The first result, an unchanged one and a changed one
+		for _, v := range [][]int{{1, 2}, {2, 1}, {2, 3}} {
+			mu.Lock()
+			values = v
+			mu.Unlock()
+			refreshGroup(context.Background(), "g", gr)
+		}
+		// A failing source doesn't remove its values
+		partial := gr
+		partial.URLs = []string{down.URL}
+		refreshGroup(context.Background(), "g", partial)
+		if len(got) != 2 {
+			t.Fatalf("%s: expected a webhook for the first and the changed result; got %v", payload, got)
+		}
+		last := got[1]
+		switch payload {
+		case webhookPayloadDelta:
+			if added, removed := last["added"].([]interface{}), last["removed"].([]interface{}); len(added) != 1 || added[0] != 3.0 || len(removed) != 1 || removed[0] != 1.0 {
+				t.Errorf("expected 3 added and 1 removed; got %v", last)
+			}
+		case webhookPayloadCounts:
+			if last["added"] != 1.0 || last["removed"] != 1.0 || last["total"] != 2.0 || last["group"] != "g" {
+				t.Errorf("expected counts; got %v", last)
+			}
+		}
+		if got[0]["since"] != nil || got[1]["since"] == nil {
+			t.Errorf("expected since on changes only; got %v", got)
+		}
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		gr      group
+		invalid bool
+	}{
+		{name: "ok", gr: group{URLs: []string{"http://a"}, Refresh: duration(time.Minute), Webhook: &webhookConfig{URL: "https://hooks.example.com/x"}}},
+		{name: "not scheduled", gr: group{URLs: []string{"http://a"}, Webhook: &webhookConfig{URL: "https://hooks.example.com/x"}}, invalid: true},
+		{name: "bad url", gr: group{URLs: []string{"http://a"}, Refresh: duration(time.Minute), Webhook: &webhookConfig{URL: "hooks"}}, invalid: true},
+		{name: "bad payload", gr: group{URLs: []string{"http://a"}, Refresh: duration(time.Minute), Webhook: &webhookConfig{URL: "https://hooks.example.com/x", Payload: "all"}}, invalid: true},
+	}
+	for _, tt := range tests {
+		if err := validateGroups(map[string]group{"g": tt.gr}); (err != nil) != tt.invalid {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Media types accepted from XML sources, whatever -upstream.content-types says
+var xmlContentTypes = []string{"application/xml", "text/xml", "application/*+xml"}
+
+// Numbers of a source answering XML, e.g. a SOAP endpoint, configured as "xml" of the source
+type xmlConfig struct {
+	// Elements whose text is a value, see parseDocPath
+	Path string `json:"path"`
+	// Sent as the SOAPAction header SOAP 1.1 endpoints route requests by
+	SOAPAction string `json:"soap_action,omitempty"`
+}
+
+// Decodes the values an XML body has at path. Like JSON numbers, integral values like 3.0 are
+// coerced and empty elements, fractions and overflowing values skipped. Other text fails the
+// source unless lenient, which skips it. A SOAP fault fails the source with its reason. A body
+// that was transcoded is UTF-8 whatever its declaration says, otherwise the declared encoding is read.
+func decodeXML(r io.Reader, path *docPath, lenient, transcoded bool) (result, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(label string, in io.Reader) (io.Reader, error) {
+		if transcoded {
+			return in, nil
+		}
+		next, _, err := charsetDecoder(label)
+		if err != nil || next == nil {
+			return in, err
+		}
+		return &transcoder{src: bufio.NewReader(in), next: next}, nil
+	}
+	res := result{Numbers: []int{}}
+	add := func(s string) error {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			res.skip("null")
+			return nil
+		}
+		n, coerced, reason := numberInt(s)
+		switch {
+		case reason == "invalid" && !lenient:
+			return fmt.Errorf("xml: %q is not a number", s)
+		case reason == "invalid":
+			res.skip("string")
+			return nil
+		case reason != "":
+			res.skip(reason)
+			return nil
+		case coerced:
+			res.coerce()
+		}
+		res.Numbers = append(res.Numbers, n)
+		return nil
+	}
+	var stack []string
+	// Depth of the element whose text is collected and of a SOAP fault, 0 when there is none
+	capture, fault := 0, 0
+	var text, reason strings.Builder
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if fault == 0 && t.Name.Local == "Fault" && len(stack) > 1 && stack[len(stack)-2] == "Body" {
+				fault = len(stack)
+			}
+			if capture > 0 || !path.matches(stack) {
+				continue
+			}
+			if path.attr == "" {
+				capture = len(stack)
+				text.Reset()
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Name.Local == path.attr {
+					if err := add(a.Value); err != nil {
+						return result{}, err
+					}
+				}
+			}
+		case xml.CharData:
+			if capture > 0 {
+				text.Write(t)
+			}
+			// faultstring in SOAP 1.1, Reason/Text in 1.2
+			if fault > 0 && (stack[len(stack)-1] == "faultstring" || stack[len(stack)-1] == "Text") {
+				reason.Write(t)
+			}
+		case xml.EndElement:
+			if capture == len(stack) {
+				capture = 0
+				if err := add(text.String()); err != nil {
+					return result{}, err
+				}
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if fault > 0 {
+		return result{}, fmt.Errorf("soap fault - %s", strings.TrimSpace(reason.String()))
+	}
+	return res, nil
+}
+
+// Checks the media type of an XML source's response
+func checkXMLContentType(res *http.Response) error {
+	p := upstreamPolicy{contentTypes: xmlContentTypes}
+	return p.checkContentType(res)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const soapNumbers = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <m:GetNumbersResponse xmlns:m="urn:numbers">
+      <m:GetNumbersResult>
+        <m:int>3</m:int>
+        <m:int> 1 </m:int>
+        <m:int>2.0</m:int>
+        <m:int/>
+        <m:int>1.5</m:int>
+      </m:GetNumbersResult>
+      <m:count>5</m:count>
+    </m:GetNumbersResponse>
+  </soap:Body>
+</soap:Envelope>`
+
+func TestDecodeXML(t *testing.T) {
+	tests := []struct {
+		name, body, path string
+		lenient          bool
+		want             []int
+		skipped, coerced int
+		err              string
+	}{
+		{name: "soap", body: soapNumbers, path: "/Envelope/Body/GetNumbersResponse/GetNumbersResult/int", want: []int{3, 1, 2}, skipped: 2, coerced: 1},
+		{name: "anywhere", body: soapNumbers, path: "//GetNumbersResponse/*/int", want: []int{3, 1, 2}, skipped: 2, coerced: 1},
+		{name: "suffix only", body: soapNumbers, path: "//count", want: []int{5}},
+		{name: "absolute mismatch", body: soapNumbers, path: "/Body/GetNumbersResponse/count", want: []int{}},
+		{name: "attribute", body: `<r><v n="4"/><v n="-2"/><v/></r>`, path: "//v/@n", want: []int{4, -2}},
+		{name: "strict text", body: `<r><v>1</v><v>x</v></r>`, path: "/r/v", err: `xml: "x" is not a number`},
+		{name: "lenient text", body: `<r><v>1</v><v>x</v></r>`, path: "/r/v", lenient: true, want: []int{1}, skipped: 1},
+		{name: "malformed", body: `<r><v>1</r>`, path: "/r/v", err: "syntax error"},
+		{name: "fault", body: `<s:Envelope xmlns:s="urn:s"><s:Body><s:Fault><faultcode>s:Server</faultcode><faultstring>quota exceeded</faultstring></s:Fault></s:Body></s:Envelope>`, path: "//int", err: "soap fault - quota exceeded"},
+	}
+	for _, tt := range tests {
+		p, err := parseDocPath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := decodeXML(strings.NewReader(tt.body), p, tt.lenient, false)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q; got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(res.Numbers, tt.want) || res.skipped != tt.skipped || res.coerced != tt.coerced {
+			t.Errorf("%s: expected %v, %d skipped, %d coerced; got %v, %d, %d, %v", tt.name, tt.want, tt.skipped, tt.coerced, res.Numbers, res.skipped, res.coerced, err)
+		}
+	}
+}
+
+func TestSOAPSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("SOAPAction") != `"urn:numbers#GetNumbers"` || r.Header.Get("Content-Type") != "text/xml; charset=utf-8" || !strings.Contains(r.Header.Get("Accept"), "text/xml") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(soapNumbers))
+	}))
+	defer ts.Close()
+	plain := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{4})))
+	defer plain.Close()
+	defer groups.set(groups.all())
+	all := map[string]group{"soap": {URLs: []string{ts.URL}, Sources: map[string]sourceConfig{
+		ts.URL: {Body: `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><GetNumbers/></soap:Body></soap:Envelope>`, XML: &xmlConfig{Path: "//GetNumbersResult/int", SOAPAction: "urn:numbers#GetNumbers"}},
+	}}}
+	if err := validateGroups(all); err != nil {
+		t.Fatal(err)
+	}
+	groups.set(all)
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, httptest.NewRequest(http.MethodGet, endpoint+"?verbose=errors&g=soap&u="+plain.URL, nil))
+	var res struct {
+		Numbers []int         `json:"numbers"`
+		Errors  []errorDetail `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Numbers, []int{1, 2, 3, 4}) || len(res.Errors) != 0 {
+		t.Errorf("expected the values of both sources; got %+v", res)
+	}
+	if err := validateGroups(map[string]group{"bad": {URLs: []string{ts.URL}, Sources: map[string]sourceConfig{ts.URL: {XML: &xmlConfig{Path: "int"}}}}}); err == nil {
+		t.Error("expected a relative xml path to be rejected")
+	}
+}
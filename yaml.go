@@ -0,0 +1,508 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// YAML for sources such as config services answering documents with lists of numbers. Only the
+// first document is read, in the YAML 1.2 core schema: block and flow collections, plain and
+// quoted scalars, comments, block scalars and tags. Anchors, aliases and complex keys are
+// rejected. Responses can't be sent as YAML.
+func init() {
+	registerCodec(&codec{
+		name:       "yaml",
+		mediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+		parse:      parseYAML,
+	})
+}
+
+type yamlLine struct {
+	indent int
+	// Without indentation and comment
+	text string
+	num  int
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYAML(data []byte) (interface{}, error) {
+	if !utf8.Valid(data) {
+		return nil, errors.New("yaml: invalid UTF-8")
+	}
+	p := &yamlParser{}
+	if err := p.split(string(data)); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.node(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected %q", p.lines[p.pos].text)
+	}
+	return v, nil
+}
+
+// Splits the first document into lines, dropping comments and blank lines
+func (p *yamlParser) split(doc string) error {
+	started := false
+	for i, raw := range strings.Split(doc, "\n") {
+		raw = strings.TrimSuffix(raw, "\r")
+		if !started && strings.HasPrefix(raw, "%") {
+			// A directive like %YAML 1.2
+			continue
+		}
+		if raw == "---" || strings.HasPrefix(raw, "--- ") {
+			if started {
+				break
+			}
+			started = true
+			raw = raw[3:]
+		}
+		if raw == "..." {
+			break
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		text := strings.TrimRight(stripYAMLComment(raw[indent:]), " \t")
+		if text == "" {
+			continue
+		}
+		if text[0] == '\t' {
+			return fmt.Errorf("yaml: line %d: tabs can't indent", i+1)
+		}
+		started = true
+		p.lines = append(p.lines, yamlLine{indent: indent, text: text, num: i + 1})
+	}
+	return nil
+}
+
+// Cuts a comment off a line: a # at its start or after whitespace, outside of quotes
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,:", s[i-1]) >= 0):
+			// Only a quote starting a scalar opens one, not the one in it's
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	num := 0
+	if p.pos < len(p.lines) {
+		num = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("yaml: line %d: "+format, append([]interface{}{num}, args...)...)
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// Parses the node starting at the current line, which is indented by indent
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+	if isSeqItem(l.text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(l.text); ok {
+		return p.mapping(indent)
+	}
+	p.pos++
+	return p.inline(l.text)
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	out := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].text) {
+		l := p.lines[p.pos]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var v interface{}
+		var err error
+		if rest == "" {
+			p.pos++
+			v, err = p.child(indent)
+		} else {
+			// The item continues on the following lines at the indentation of its content
+			in := indent + len(l.text) - len(rest)
+			p.lines[p.pos] = yamlLine{indent: in, text: rest, num: l.num}
+			v, err = p.node(in)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && !isSeqItem(p.lines[p.pos].text) {
+		key, rest, ok := splitYAMLKey(p.lines[p.pos].text)
+		if !ok {
+			return nil, p.errorf("expected a key in %q", p.lines[p.pos].text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.pos++
+		var v interface{}
+		var err error
+		switch {
+		case rest == "" && p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].text):
+			// A sequence may be indented like its key
+			v, err = p.sequence(indent)
+		case rest == "":
+			v, err = p.child(indent)
+		case rest[0] == '|' || rest[0] == '>':
+			v = p.blockScalar(indent)
+		default:
+			v, err = p.inline(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// Node on the lines indented deeper than indent, nil when there are none
+func (p *yamlParser) child(indent int) (interface{}, error) {
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return p.node(p.lines[p.pos].indent)
+	}
+	return nil, nil
+}
+
+// Text of a literal or folded block scalar, which can't be a number
+func (p *yamlParser) blockScalar(indent int) string {
+	var lines []string
+	for p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		lines = append(lines, p.lines[p.pos].text)
+		p.pos++
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Splits "key: value" or "key:" into the key and the rest
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+	if text[0] == '[' || text[0] == '{' || text[0] == '?' {
+		return "", "", false
+	}
+	end := 0
+	if text[0] == '"' || text[0] == '\'' {
+		k, n, err := yamlQuoted(text, 0)
+		if err != nil {
+			return "", "", false
+		}
+		key, end = k, n
+		if end >= len(text) || text[end] != ':' {
+			return "", "", false
+		}
+	} else {
+		end = strings.Index(text, ": ")
+		if end < 0 {
+			if !strings.HasSuffix(text, ":") {
+				return "", "", false
+			}
+			end = len(text) - 1
+		}
+		key = strings.TrimSpace(text[:end])
+	}
+	if end+1 < len(text) && text[end+1] != ' ' {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(text[end+1:]), true
+}
+
+// Parses a scalar or flow collection, which may continue on the following lines
+func (p *yamlParser) inline(text string) (interface{}, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		// Whitespace other than spaces, such as a vertical tab, leaves nothing: a null
+		return nil, nil
+	}
+	switch text[0] {
+	case '&', '*':
+		return nil, p.errorf("anchors and aliases are not supported")
+	case '!':
+		// Tags don't change the value, except that !!str keeps it a string
+		i := strings.IndexByte(text, ' ')
+		if i < 0 {
+			return nil, nil
+		}
+		v, err := p.inline(text[i+1:])
+		if _, isString := v.(string); err == nil && text[:i] == "!!str" && !isString && v != nil {
+			return strings.TrimSpace(text[i+1:]), nil
+		}
+		return v, err
+	case '[', '{':
+		for !yamlBalanced(text) {
+			if p.pos >= len(p.lines) {
+				return nil, p.errorf("unterminated flow collection")
+			}
+			text += " " + p.lines[p.pos].text
+			p.pos++
+		}
+		f := &yamlFlow{s: text}
+		v, err := f.value()
+		if err == nil && f.space() < len(text) {
+			err = fmt.Errorf("unexpected %q", text[f.i:])
+		}
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return v, nil
+	case '"', '\'':
+		s, n, err := yamlQuoted(text, 0)
+		if err == nil && n != len(text) {
+			err = fmt.Errorf("unexpected %q after the string", text[n:])
+		}
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return s, nil
+	}
+	return yamlScalar(text), nil
+}
+
+// Whether the brackets of a flow collection are closed
+func yamlBalanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// Parses the quoted string starting at s[i] and returns the index after it
+func yamlQuoted(s string, i int) (string, int, error) {
+	q := s[i]
+	var b strings.Builder
+	for i++; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == q:
+			return b.String(), i + 1, nil
+		case c == '\\' && q == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '0':
+				b.WriteByte(0)
+			default:
+				// \" \\ \/ and escapes that can't make a number
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// Resolves a plain scalar: null, a boolean, an integer, a float or else a string
+func yamlScalar(s string) interface{} {
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF":
+		return math.Inf(1)
+	case "-.inf", "-.Inf", "-.INF":
+		return math.Inf(-1)
+	case ".nan", ".NaN", ".NAN":
+		return math.NaN()
+	}
+	digits := strings.TrimLeft(s, "+-")
+	if len(s)-len(digits) > 1 || digits == "" {
+		return s
+	}
+	neg := s[0] == '-'
+	base := 10
+	switch {
+	case strings.HasPrefix(digits, "0x"):
+		base, digits = 16, digits[2:]
+	case strings.HasPrefix(digits, "0o"):
+		base, digits = 8, digits[2:]
+	}
+	if u, err := strconv.ParseUint(digits, base, 64); err == nil {
+		switch {
+		case !neg && u > math.MaxInt64:
+			return u
+		case !neg:
+			return int64(u)
+		case u <= math.MaxInt64:
+			return -int64(u)
+		case u == -math.MinInt64:
+			return int64(math.MinInt64)
+		}
+		return oversized{}
+	} else if errors.Is(err, strconv.ErrRange) {
+		return oversized{}
+	}
+	if base != 10 || strings.Trim(digits, "0123456789.eE+-") != "" || strings.Trim(digits, ".eE+-") == "" {
+		return s
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	} else if errors.Is(err, strconv.ErrRange) {
+		return oversized{}
+	}
+	return s
+}
+
+// Parser of a flow collection like [1, 2, {a: 3}]
+type yamlFlow struct {
+	s string
+	i int
+}
+
+func (f *yamlFlow) space() int {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+	return f.i
+}
+
+func (f *yamlFlow) value() (interface{}, error) {
+	if f.space() >= len(f.s) {
+		return nil, errors.New("unexpected end of flow collection")
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		out := []interface{}{}
+		for {
+			if f.space() < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return out, nil
+			}
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			if err := f.next(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		m := make(map[string]interface{})
+		for {
+			if f.space() < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return m, nil
+			}
+			k, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = strings.TrimSpace(f.s[f.i-len(fmt.Sprint(k)) : f.i])
+			}
+			var v interface{}
+			if f.space() < len(f.s) && f.s[f.i] == ':' {
+				f.i++
+				if f.space() < len(f.s) && f.s[f.i] != ',' && f.s[f.i] != '}' {
+					if v, err = f.value(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			m[key] = v
+			if err := f.next('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f.scalar(false)
+}
+
+// Consumes the comma between elements, or leaves the closing bracket for the caller
+func (f *yamlFlow) next(end byte) error {
+	if f.space() >= len(f.s) {
+		return errors.New("unterminated flow collection")
+	}
+	switch f.s[f.i] {
+	case ',':
+		f.i++
+		return nil
+	case end:
+		return nil
+	}
+	return fmt.Errorf("unexpected %q in flow collection", f.s[f.i:])
+}
+
+// A quoted or plain scalar, which ends at a comma or bracket and for keys at ": "
+func (f *yamlFlow) scalar(key bool) (interface{}, error) {
+	if c := f.s[f.i]; c == '"' || c == '\'' {
+		s, n, err := yamlQuoted(f.s, f.i)
+		f.i = n
+		return s, err
+	}
+	start := f.i
+	for ; f.i < len(f.s); f.i++ {
+		c := f.s[f.i]
+		if c == ',' || c == ']' || c == '}' || key && c == ':' && (f.i+1 == len(f.s) || f.s[f.i+1] == ' ' || f.s[f.i+1] == ',' || f.s[f.i+1] == '}') {
+			break
+		}
+	}
+	text := strings.TrimSpace(f.s[start:f.i])
+	if key {
+		return text, nil
+	}
+	return yamlScalar(text), nil
+}
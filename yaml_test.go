@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+		err  bool
+	}{
+		{name: "block", in: "numbers:\n  - 1\n  - -2\n  - 0x10\n", want: map[string]interface{}{"numbers": []interface{}{int64(1), int64(-2), int64(16)}}},
+		{name: "sequence at key indent", in: "numbers:\n- 1\n- 2 # two\n", want: map[string]interface{}{"numbers": []interface{}{int64(1), int64(2)}}},
+		{name: "flow", in: "numbers: [1, 2.5, null, \"3\", '4', ~, .inf]", want: map[string]interface{}{"numbers": []interface{}{int64(1), 2.5, nil, "3", "4", nil, math.Inf(1)}}},
+		{name: "multiline flow", in: "numbers: [1,\n  2,\n  3]\n", want: map[string]interface{}{"numbers": []interface{}{int64(1), int64(2), int64(3)}}},
+		{name: "nested", in: "%YAML 1.2\n---\n# service limits\ndata:\n  pages:\n    - ids: [1]\n      name: \"a # b\"\n    - ids: {x: 2}\n  note: |\n    not: [a number\n", want: map[string]interface{}{"data": map[string]interface{}{
+			"pages": []interface{}{map[string]interface{}{"ids": []interface{}{int64(1)}, "name": "a # b"}, map[string]interface{}{"ids": map[string]interface{}{"x": int64(2)}}},
+			"note":  "not: [a number",
+		}}},
+		{name: "first document", in: "numbers: [1]\n---\nnumbers: [2]\n", want: map[string]interface{}{"numbers": []interface{}{int64(1)}}},
+		{name: "tags", in: "a: !!int 7\nb: !!str 8\n", want: map[string]interface{}{"a": int64(7), "b": "8"}},
+		{name: "scalars", in: "- 18446744073709551615\n- 99999999999999999999\n- 1e3\n- it's\n- true\n- 1.2.3\n", want: []interface{}{uint64(math.MaxUint64), oversized{}, 1000.0, "it's", true, "1.2.3"}},
+		{name: "empty", in: "# nothing\n", want: nil},
+		{name: "whitespace", in: "\v", want: nil},
+		{name: "whitespace value", in: "a: \v\n", want: map[string]interface{}{"a": nil}},
+		{name: "alias", in: "a: &x 1\nb: *x\n", err: true},
+		{name: "duplicate key", in: "a: 1\na: 2\n", err: true},
+		{name: "bad indentation", in: "a: 1\n  b: 2\n", err: true},
+		{name: "unterminated flow", in: "a: [1, 2\n", err: true},
+		{name: "unterminated string", in: "a: \"1\n", err: true},
+		{name: "tab", in: "a:\n\t- 1\n", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML([]byte(tt.in))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error; got %#v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %#v; got %#v, %v", tt.name, tt.want, got, err)
+		}
+	}
+}
+
+// Bodies come from upstreams, no input may panic the decoder
+func FuzzParseYAML(f *testing.F) {
+	for _, seed := range []string{"numbers: [1, 2]\n", "- 1\n- 2\n", "a:\n  b: {x: [1]}\n", "!!str 1", "\v", "a: |\n  text\n", "---\n"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseYAML(data)
+	})
+}
+
+func TestYAMLSources(t *testing.T) {
+	typed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write([]byte("numbers:\n  - 3\n  - 2.0\n"))
+	}))
+	defer typed.Close()
+	hinted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/yaml") {
+			t.Errorf("expected YAML to be asked for; got %q", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("limits:\n  - ids: [5, 1]\n  - ids: [4]\n"))
+	}))
+	defer hinted.Close()
+	jsonPath := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"ids": [6, 7]}}`))
+	}))
+	defer jsonPath.Close()
+	all := map[string]group{"config": {URLs: []string{typed.URL, hinted.URL, jsonPath.URL}, Sources: map[string]sourceConfig{
+		hinted.URL:   {Format: "yaml", Path: "/limits/ids"},
+		jsonPath.URL: {Path: "//ids"},
+	}}}
+	if err := validateGroups(all); err != nil {
+		t.Fatal(err)
+	}
+	defer groups.set(groups.all())
+	groups.set(all)
+	req := httptest.NewRequest(http.MethodGet, endpoint+"?g=config", nil)
+	rec := httptest.NewRecorder()
+	numbersHandler(rec, req)
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"numbers":[1,2,3,4,5,6,7]}` {
+		t.Errorf("expected the values of all sources; got %s", got)
+	}
+	for _, c := range []sourceConfig{{Format: "toml"}, {Path: "/a/@b"}, {Path: "a"}, {Format: "yaml", XML: &xmlConfig{Path: "/a"}}} {
+		if _, err := compileSource(c); err == nil {
+			t.Errorf("expected %+v to be rejected", c)
+		}
+	}
+	if responseCodec("application/yaml") != nil {
+		t.Error("expected YAML not to be offered for responses")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"expvar"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+const (
+	// Weight of the latest fetch in a host's yield and how many hosts are tracked
+	yieldWeight   = 0.2
+	yieldMaxHosts = 4096
+)
+
+// Values every host historically adds to the responses it is part of, as an average per
+// successful fetch. Fan-outs larger than the free workers dispatch high-yield hosts first.
+type yieldTracker struct {
+	mu    sync.Mutex
+	hosts map[string]float64
+}
+
+var yields = &yieldTracker{hosts: make(map[string]float64)}
+
+func (y *yieldTracker) observe(host string, values int) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	v, ok := y.hosts[host]
+	if !ok {
+		if len(y.hosts) >= yieldMaxHosts {
+			// Forget some host, it gets measured again when it comes back
+			for h := range y.hosts {
+				delete(y.hosts, h)
+				break
+			}
+		}
+		y.hosts[host] = float64(values)
+		return
+	}
+	y.hosts[host] = v + yieldWeight*(float64(values)-v)
+}
+
+func (y *yieldTracker) snapshot() map[string]float64 {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	out := make(map[string]float64, len(y.hosts))
+	for h, v := range y.hosts {
+		out[h] = v
+	}
+	return out
+}
+
+// Indexes of urls in the order to dispatch them: hosts without history first so they get
+// measured, then by yield, best first. Ties keep the order of the request.
+func (y *yieldTracker) order(urls []string) []int {
+	order := make([]int, len(urls))
+	ranks := make([]float64, len(urls))
+	known := make([]bool, len(urls))
+	y.mu.Lock()
+	for i, u := range urls {
+		order[i] = i
+		ranks[i], known[i] = y.hosts[yieldHost(u)]
+	}
+	y.mu.Unlock()
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if known[i] != known[j] {
+			return !known[i]
+		}
+		return ranks[i] > ranks[j]
+	})
+	return order
+}
+
+// Host the yield of u is tracked under
+func yieldHost(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return p.Host
+}
+
+func init() {
+	upstreamMetrics.Set("yield", expvar.Func(func() interface{} { return yields.snapshot() }))
+}
+
+// Dispatch order of a fan-out over urls, nil keeps the request order
+func dispatchOrder(urls []string) []int {
+	if !upstream.prioritize || len(urls) <= pool.idle() {
+		return nil
+	}
+	upstreamMetrics.Add("prioritized_fanouts", 1)
+	return yields.order(urls)
+}
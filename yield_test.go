@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestYieldOrder(t *testing.T) {
+	y := &yieldTracker{hosts: make(map[string]float64)}
+	y.observe("low:1", 10)
+	y.observe("high:1", 100)
+	y.observe("mid:1", 50)
+	// Moves towards the latest fetch
+	y.observe("mid:1", 0)
+	if v := y.snapshot()["mid:1"]; v != 40 {
+		t.Errorf("expected a yield of 40; got %v", v)
+	}
+	urls := []string{"http://low:1/a", "http://mid:1", "http://new:1", "http://high:1", "http://low:1/b"}
+	want := []int{2, 3, 1, 0, 4}
+	got := y.order(urls)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	defer func(p upstreamPolicy, y *yieldTracker) { upstream, yields = p, y }(upstream, yields)
+	yields = &yieldTracker{hosts: make(map[string]float64)}
+	many := make([]string, pool.size()+1)
+	for i := range many {
+		many[i] = "http://h/" + string(rune('a'+i%26))
+	}
+	tests := []struct {
+		name       string
+		prioritize bool
+		urls       []string
+		ordered    bool
+	}{
+		{name: "off", urls: many},
+		{name: "fits the workers", prioritize: true, urls: many[:1]},
+		{name: "exceeds the workers", prioritize: true, urls: many, ordered: true},
+	}
+	for _, tt := range tests {
+		upstream.prioritize = tt.prioritize
+		if got := dispatchOrder(tt.urls); (got != nil) != tt.ordered {
+			t.Errorf("%s: expected ordered %v; got %v", tt.name, tt.ordered, got)
+		}
+	}
+}
+
+func TestYieldObserved(t *testing.T) {
+	defer func(y *yieldTracker, shards int) { yields, mergeShards = y, shards }(yields, mergeShards)
+	a := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{1, 2, 3})))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(simpleHandler([]int{3, 4})))
+	defer b.Close()
+	o, _ := parseOptions(nil)
+	for _, shards := range []int{1, 4} {
+		yields = &yieldTracker{hosts: make(map[string]float64)}
+		mergeShards = shards
+		run(context.Background(), []string{a.URL, b.URL}, o)
+		got := yields.snapshot()
+		// Whichever source merged second only added what the other didn't have
+		ya, yb := got[yieldHost(a.URL)], got[yieldHost(b.URL)]
+		if ya+yb != 4 || ya < 2 || yb < 1 {
+			t.Errorf("%d shards: expected the yields to add up to the 4 distinct values; got %v", shards, got)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Zstandard (RFC 8878) frames for responses compressed with a dictionary. The standard library
+// has no zstd, so this is a small encoder of its own: literals are stored raw and the matches,
+// which can reach back into the dictionary, are coded with the predefined FSE tables, so there
+// are no tables to send. It compresses worse than the reference implementation, but any zstd
+// decoder reads it.
+const (
+	zstdMagic    = 0xfd2fb528
+	zstdBlockMax = 128 << 10
+	// 8MB, the window every decoder of HTTP zstd accepts
+	zstdWindowLogMax = 23
+	zstdMinMatch     = 4
+	zstdHashLog      = 15
+	// Earlier positions with the same hash tried for a match
+	zstdChainDepth = 16
+)
+
+// Block types
+const (
+	zstdRawBlock        = 0
+	zstdCompressedBlock = 2
+)
+
+// Baselines and extra bits of the literal length, match length and offset codes
+var (
+	zstdLiteralLengthBase = [...]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLiteralLengthBits = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMatchLengthBase = [...]uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	zstdMatchLengthBits = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// Predefined distributions of the codes, -1 for a probability below 1
+var (
+	zstdLiteralLengthNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMatchLengthNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOffsetNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+)
+
+var (
+	zstdLiteralLengths = newFSEEncoder(zstdLiteralLengthNorm, 6)
+	zstdMatchLengths   = newFSEEncoder(zstdMatchLengthNorm, 6)
+	zstdOffsets        = newFSEEncoder(zstdOffsetNorm, 5)
+)
+
+// FSE encoding table of a distribution. States are kept offset by the table size, as in the
+// reference implementation.
+type fseEncoder struct {
+	tableLog   uint
+	stateTable []uint32
+	symbols    []fseTransform
+}
+
+type fseTransform struct {
+	deltaBits  uint32
+	deltaState int
+}
+
+func newFSEEncoder(norm []int16, tableLog uint) *fseEncoder {
+	size := 1 << tableLog
+	// Symbols of the decoding states, spread as every decoder does
+	spread := make([]int, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, p := range norm {
+		if p == -1 {
+			spread[high] = s
+			high--
+			cumul[s+1] = cumul[s] + 1
+		} else {
+			cumul[s+1] = cumul[s] + int(p)
+		}
+	}
+	pos, step := 0, size>>1+size>>3+3
+	for s, p := range norm {
+		for i := 0; i < int(p); i++ {
+			spread[pos] = s
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+	e := &fseEncoder{tableLog: tableLog, stateTable: make([]uint32, size), symbols: make([]fseTransform, len(norm))}
+	next := append([]int(nil), cumul...)
+	for u, s := range spread {
+		e.stateTable[next[s]] = uint32(size + u)
+		next[s]++
+	}
+	total := 0
+	for s, p := range norm {
+		switch {
+		case p == -1 || p == 1:
+			e.symbols[s] = fseTransform{deltaBits: uint32(tableLog<<16) - uint32(size), deltaState: total - 1}
+			total++
+		case p > 1:
+			maxBits := tableLog - uint(bits.Len32(uint32(p-1))-1)
+			e.symbols[s] = fseTransform{deltaBits: uint32(maxBits<<16) - uint32(int(p)<<maxBits), deltaState: total - int(p)}
+			total += int(p)
+		}
+	}
+	return e
+}
+
+// State of the symbol coded last, which needs no bits of its own
+func (e *fseEncoder) init(symbol uint8) uint32 {
+	t := e.symbols[symbol]
+	n := (t.deltaBits + 1<<15) >> 16
+	return e.stateTable[int((n<<16-t.deltaBits)>>n)+t.deltaState]
+}
+
+func (e *fseEncoder) encode(w *bitWriter, state *uint32, symbol uint8) {
+	t := e.symbols[symbol]
+	n := uint((*state + t.deltaBits) >> 16)
+	w.add(*state, n)
+	*state = e.stateTable[int(*state>>n)+t.deltaState]
+}
+
+// Writes the state the decoder starts in
+func (e *fseEncoder) flush(w *bitWriter, state uint32) {
+	w.add(state, e.tableLog)
+}
+
+// Bits in the order a zstd decoder reads them backwards
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) add(v uint32, n uint) {
+	w.acc |= uint64(v&(1<<n-1)) << w.n
+	for w.n += n; w.n >= 8; w.n -= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+	}
+}
+
+// Ends the stream with a 1 bit, the decoder starts after the last one
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+type zstdSequence struct {
+	literals, offset, match uint32
+}
+
+func zstdCode(v uint32, base []uint32) uint8 {
+	c := len(base) - 1
+	for base[c] > v {
+		c--
+	}
+	return uint8(c)
+}
+
+// Finds matches in the dictionary followed by the content
+type zstdMatcher struct {
+	hist   []byte
+	window int
+	// Last position with a hash and the previous position with the same hash as each position,
+	// plus one
+	head  []int32
+	chain []int32
+}
+
+func (m *zstdMatcher) hash(i int) uint32 {
+	return binary.LittleEndian.Uint32(m.hist[i:]) * 2654435761 >> (32 - zstdHashLog)
+}
+
+func (m *zstdMatcher) insert(i int) {
+	if i+4 > len(m.hist) {
+		return
+	}
+	h := m.hash(i)
+	m.chain[i] = m.head[h]
+	m.head[h] = int32(i + 1)
+}
+
+// Longest match of the bytes at i ending by end
+func (m *zstdMatcher) find(i, end int) (offset, length int) {
+	for c, depth := m.head[m.hash(i)], 0; c > 0 && depth < zstdChainDepth; c, depth = m.chain[c-1], depth+1 {
+		j := int(c - 1)
+		if i-j > m.window {
+			break
+		}
+		n := 0
+		for i+n < end && m.hist[j+n] == m.hist[i+n] {
+			n++
+		}
+		if n > length {
+			offset, length = i-j, n
+		}
+	}
+	return offset, length
+}
+
+// Compresses src into a zstd frame whose decoder is given dict as raw content dictionary, as
+// with dcz. The frame has no dictionary id, content size or checksum.
+func zstdCompress(src, dict []byte) []byte {
+	hist := make([]byte, 0, len(dict)+len(src))
+	hist = append(append(hist, dict...), src...)
+	windowLog := uint(10)
+	for windowLog < zstdWindowLogMax && 1<<windowLog < len(hist) {
+		windowLog++
+	}
+	out := make([]byte, 4, 6+len(src)/2)
+	binary.LittleEndian.PutUint32(out, zstdMagic)
+	out = append(out, 0, byte(windowLog-10)<<3)
+	m := &zstdMatcher{hist: hist, window: 1 << windowLog, head: make([]int32, 1<<zstdHashLog), chain: make([]int32, len(hist))}
+	for i := range dict {
+		m.insert(i)
+	}
+	for start := len(dict); ; {
+		end := start + zstdBlockMax
+		if end > len(hist) {
+			end = len(hist)
+		}
+		out = m.block(out, start, end, end == len(hist))
+		if end == len(hist) {
+			return out
+		}
+		start = end
+	}
+}
+
+// Appends the block of hist[start:end], compressed unless that doesn't make it smaller
+func (m *zstdMatcher) block(out []byte, start, end int, last bool) []byte {
+	var seqs []zstdSequence
+	var literals []byte
+	lit, i := start, start
+	for i+zstdMinMatch <= end {
+		offset, n := m.find(i, end)
+		if n < zstdMinMatch {
+			m.insert(i)
+			i++
+			continue
+		}
+		literals = append(literals, m.hist[lit:i]...)
+		seqs = append(seqs, zstdSequence{literals: uint32(i - lit), offset: uint32(offset), match: uint32(n)})
+		for j := i; j < i+n; j++ {
+			m.insert(j)
+		}
+		i += n
+		lit = i
+	}
+	for ; i < end; i++ {
+		m.insert(i)
+	}
+	literals = append(literals, m.hist[lit:end]...)
+	if len(seqs) > 0 {
+		body := zstdLiterals(literals)
+		body = append(body, zstdSequences(seqs)...)
+		if len(body) < end-start {
+			return append(zstdBlockHeader(out, zstdCompressedBlock, len(body), last), body...)
+		}
+	}
+	return append(zstdBlockHeader(out, zstdRawBlock, end-start, last), m.hist[start:end]...)
+}
+
+func zstdBlockHeader(out []byte, typ, size int, last bool) []byte {
+	h := uint32(typ<<1 | size<<3)
+	if last {
+		h |= 1
+	}
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// Raw literals section
+func zstdLiterals(literals []byte) []byte {
+	n := len(literals)
+	var out []byte
+	switch {
+	case n < 1<<5:
+		out = []byte{byte(n << 3)}
+	case n < 1<<12:
+		out = []byte{byte(1<<2 | n<<4), byte(n >> 4)}
+	default:
+		out = []byte{byte(3<<2 | n<<4), byte(n >> 4), byte(n >> 12)}
+	}
+	return append(out, literals...)
+}
+
+// Sequences section in predefined mode. The decoder reads the bit stream from its end, so the
+// sequences are written last first.
+func zstdSequences(seqs []zstdSequence) []byte {
+	var out []byte
+	switch n := len(seqs); {
+	case n < 128:
+		out = []byte{byte(n)}
+	case n < 0x7f00:
+		out = []byte{byte(n>>8 + 128), byte(n)}
+	default:
+		out = []byte{255, byte(n - 0x7f00), byte((n - 0x7f00) >> 8)}
+	}
+	// Predefined mode for all three codes
+	out = append(out, 0)
+
+	w := &bitWriter{}
+	var ll, ml, of uint32
+	for i := len(seqs) - 1; i >= 0; i-- {
+		s := seqs[i]
+		llCode := zstdCode(s.literals, zstdLiteralLengthBase[:])
+		mlCode := zstdCode(s.match, zstdMatchLengthBase[:])
+		// Offsets above 3 are new ones, not repeats of earlier offsets
+		offset := s.offset + 3
+		ofCode := uint8(bits.Len32(offset) - 1)
+		if i == len(seqs)-1 {
+			ml = zstdMatchLengths.init(mlCode)
+			of = zstdOffsets.init(ofCode)
+			ll = zstdLiteralLengths.init(llCode)
+		} else {
+			zstdOffsets.encode(w, &of, ofCode)
+			zstdMatchLengths.encode(w, &ml, mlCode)
+			zstdLiteralLengths.encode(w, &ll, llCode)
+		}
+		w.add(s.literals-zstdLiteralLengthBase[llCode], uint(zstdLiteralLengthBits[llCode]))
+		w.add(s.match-zstdMatchLengthBase[mlCode], uint(zstdMatchLengthBits[mlCode]))
+		w.add(offset-1<<ofCode, uint(ofCode))
+	}
+	zstdMatchLengths.flush(w, ml)
+	zstdOffsets.flush(w, of)
+	zstdLiteralLengths.flush(w, ll)
+	return append(out, w.close()...)
+}
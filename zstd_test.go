@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func TestZstdCompress(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 200<<10)
+	r.Read(random)
+	var numbers []byte
+	for len(numbers) < 300<<10 {
+		numbers = append(numbers, fmt.Sprintf("%d,", r.Intn(1000))...)
+	}
+	dict := []byte(`{"numbers":[1000001,1000002,1000003,1000004,1000005]}`)
+	tests := []struct {
+		name string
+		src  []byte
+		dict []byte
+	}{
+		{name: "empty"},
+		{name: "empty with dictionary", dict: dict},
+		{name: "short", src: []byte("abc")},
+		{name: "from dictionary", src: []byte(`{"numbers":[1000001,1000002,1000003,1000004,9]}`), dict: dict},
+		{name: "repeated", src: bytes.Repeat([]byte("0,"), 150<<10), dict: dict},
+		{name: "numbers", src: numbers},
+		{name: "random", src: random, dict: dict},
+	}
+	for _, tt := range tests {
+		frame := zstdCompress(tt.src, tt.dict)
+		got, err := zstdDecompress(frame, tt.dict)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.src) {
+			t.Errorf("%s: expected the content back; got %d bytes of %d", tt.name, len(got), len(tt.src))
+		}
+	}
+	if n := len(zstdCompress(bytes.Repeat([]byte("0,"), 150<<10), nil)); n > 100 {
+		t.Errorf("expected repeated content to be compressed; got %d bytes", n)
+	}
+	if n := len(zstdCompress(random, nil)); n > len(random)+16 {
+		t.Errorf("expected random content to be stored; got %d bytes of %d", n, len(random))
+	}
+}
+
+func FuzzZstdCompress(f *testing.F) {
+	f.Add([]byte(`{"numbers":[1,2,3]}`), []byte(`{"numbers":[1,2]}`))
+	f.Add([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), []byte(nil))
+	f.Fuzz(func(t *testing.T, src, dict []byte) {
+		got, err := zstdDecompress(zstdCompress(src, dict), dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("expected %q; got %q", src, got)
+		}
+	})
+}
+
+// Decodes the frames zstdCompress writes: raw and compressed blocks of raw literals and of
+// sequences in predefined mode, after RFC 8878 rather than the encoder
+func zstdDecompress(frame, dict []byte) ([]byte, error) {
+	if len(frame) < 6 || binary.LittleEndian.Uint32(frame) != zstdMagic || frame[4] != 0 || frame[5]&7 != 0 {
+		return nil, errors.New("zstd: unsupported frame header")
+	}
+	window := 1 << (10 + frame[5]>>3)
+	out := append([]byte(nil), dict...)
+	for p := frame[6:]; ; {
+		if len(p) < 3 {
+			return nil, errors.New("zstd: truncated block header")
+		}
+		h := int(p[0]) | int(p[1])<<8 | int(p[2])<<16
+		size := h >> 3
+		if len(p) < 3+size {
+			return nil, errors.New("zstd: truncated block")
+		}
+		block := p[3 : 3+size]
+		p = p[3+size:]
+		switch h >> 1 & 3 {
+		case zstdRawBlock:
+			out = append(out, block...)
+		case zstdCompressedBlock:
+			var err error
+			if out, err = zstdDecodeBlock(out, block, window); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("zstd: unsupported block type %d", h>>1&3)
+		}
+		if h&1 == 1 {
+			if len(p) > 0 {
+				return nil, errors.New("zstd: data after the last block")
+			}
+			return out[len(dict):], nil
+		}
+	}
+}
+
+func zstdDecodeBlock(out, block []byte, window int) ([]byte, error) {
+	if len(block) < 3 || block[0]&3 != 0 {
+		return nil, errors.New("zstd: unsupported literals")
+	}
+	var n, header int
+	switch block[0] >> 2 & 3 {
+	case 0, 2:
+		n, header = int(block[0]>>3), 1
+	case 1:
+		n, header = int(block[0]>>4)|int(block[1])<<4, 2
+	case 3:
+		n, header = int(block[0]>>4)|int(block[1])<<4|int(block[2])<<12, 3
+	}
+	if len(block) < header+n+1 {
+		return nil, errors.New("zstd: truncated literals")
+	}
+	literals := block[header : header+n]
+	p := block[header+n:]
+	count := int(p[0])
+	switch {
+	case count == 0:
+		return append(out, literals...), nil
+	case count < 128:
+		p = p[1:]
+	case count < 255 && len(p) > 1:
+		count, p = (count-128)<<8+int(p[1]), p[2:]
+	case count == 255 && len(p) > 2:
+		count, p = int(p[1])+int(p[2])<<8+0x7f00, p[3:]
+	default:
+		return nil, errors.New("zstd: truncated sequences header")
+	}
+	if len(p) < 2 || p[0] != 0 {
+		return nil, errors.New("zstd: unsupported sequences")
+	}
+	br, err := newBackwardReader(p[1:])
+	if err != nil {
+		return nil, err
+	}
+	llTable := newFSEDecoder(zstdLiteralLengthNorm, 6)
+	ofTable := newFSEDecoder(zstdOffsetNorm, 5)
+	mlTable := newFSEDecoder(zstdMatchLengthNorm, 6)
+	ll, of, ml := br.read(6), br.read(5), br.read(6)
+	for i := 0; i < count; i++ {
+		ofCode, mlCode, llCode := ofTable.symbol[of], mlTable.symbol[ml], llTable.symbol[ll]
+		offset := 1<<ofCode + br.read(uint(ofCode))
+		match := int(zstdMatchLengthBase[mlCode]) + br.read(uint(zstdMatchLengthBits[mlCode]))
+		lits := int(zstdLiteralLengthBase[llCode]) + br.read(uint(zstdLiteralLengthBits[llCode]))
+		if offset <= 3 {
+			return nil, errors.New("zstd: unsupported repeat offset")
+		}
+		offset -= 3
+		if lits > len(literals) {
+			return nil, errors.New("zstd: literals exhausted")
+		}
+		out = append(out, literals[:lits]...)
+		literals = literals[lits:]
+		if offset > len(out) || offset > window {
+			return nil, fmt.Errorf("zstd: offset %d out of range", offset)
+		}
+		for j := 0; j < match; j++ {
+			out = append(out, out[len(out)-offset])
+		}
+		if i < count-1 {
+			ll = llTable.next(ll, br)
+			ml = mlTable.next(ml, br)
+			of = ofTable.next(of, br)
+		}
+	}
+	if br.err != nil || br.pos != 0 {
+		return nil, errors.New("zstd: corrupt sequences bit stream")
+	}
+	return append(out, literals...), nil
+}
+
+type fseDecoder struct {
+	symbol []int
+	bits   []uint
+	base   []int
+}
+
+func newFSEDecoder(norm []int16, tableLog uint) *fseDecoder {
+	size := 1 << tableLog
+	d := &fseDecoder{symbol: make([]int, size), bits: make([]uint, size), base: make([]int, size)}
+	next := make([]int, len(norm))
+	high := size - 1
+	for s, p := range norm {
+		next[s] = int(p)
+		if p == -1 {
+			d.symbol[high] = s
+			high--
+			next[s] = 1
+		}
+	}
+	pos := 0
+	for s, p := range norm {
+		for i := int16(0); i < p; i++ {
+			d.symbol[pos] = s
+			pos = (pos + size>>1 + size>>3 + 3) & (size - 1)
+			for pos > high {
+				pos = (pos + size>>1 + size>>3 + 3) & (size - 1)
+			}
+		}
+	}
+	for u := range d.symbol {
+		x := next[d.symbol[u]]
+		next[d.symbol[u]]++
+		d.bits[u] = tableLog - uint(bits.Len(uint(x))-1)
+		d.base[u] = x<<d.bits[u] - size
+	}
+	return d
+}
+
+func (d *fseDecoder) next(state int, br *backwardReader) int {
+	return d.base[state] + br.read(d.bits[state])
+}
+
+// Reads bits from the end of the stream to its start
+type backwardReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBackwardReader(data []byte) (*backwardReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errors.New("zstd: bit stream without end mark")
+	}
+	return &backwardReader{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+func (r *backwardReader) read(n uint) int {
+	v := 0
+	for ; n > 0; n-- {
+		if r.pos--; r.pos < 0 {
+			r.err = errors.New("zstd: bit stream overrun")
+			return 0
+		}
+		v = v<<1 | int(r.data[r.pos/8]>>(r.pos%8)&1)
+	}
+	return v
+}